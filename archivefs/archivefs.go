@@ -0,0 +1,314 @@
+// Package archivefs serves the contents of tar and zip archives as
+// read-only rofuse filesystems.
+//
+// The archive is indexed once when the filesystem is created: only the
+// metadata and the location of each entry's data are kept in memory, file
+// contents are read from the underlying io.ReaderAt on demand.
+package archivefs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/KarpelesLab/rofuse"
+	"github.com/KarpelesLab/rofuse/internal/tree"
+)
+
+// location says where the data of a file is in the archive: dataOff is
+// the offset of the uncompressed data, or -1 when the data has to be
+// decompressed from zf.
+type location struct {
+	dataOff int64
+	zf      zipEntry
+}
+
+// node is an indexed archive entry.
+type node = tree.Node[location]
+
+// builder accumulates archive entries into a tree.
+type builder struct {
+	tree *tree.Tree[location]
+}
+
+func newBuilder() *builder {
+	b := &builder{tree: tree.New[location]()}
+	b.root().Data.dataOff = -1
+	return b
+}
+
+func (b *builder) root() *node {
+	return b.tree.Root()
+}
+
+func (b *builder) newNode(parent *node, mode os.FileMode) *node {
+	n := b.tree.NewNode(parent, mode)
+	n.Data.dataOff = -1
+	return n
+}
+
+// dir returns the directory at p, creating it and any missing parents.
+func (b *builder) dir(p string) *node {
+	cur := b.root()
+	if p == "" {
+		return cur
+	}
+	for _, part := range strings.Split(p, "/") {
+		next, ok := cur.Children[part]
+		if !ok || !next.IsDir() {
+			next = b.newNode(cur, os.ModeDir|0755)
+			next.Mtime = cur.Mtime
+			cur.Children[part] = next
+		}
+		cur = next
+	}
+	return cur
+}
+
+// add places n at p, replacing any earlier non-directory entry with the
+// same name (later archive members win, as with extraction).
+func (b *builder) add(p string, mode os.FileMode) *node {
+	if p == "" {
+		return nil
+	}
+	parent := b.root()
+	if d := path.Dir(p); d != "." {
+		parent = b.dir(d)
+	}
+	name := path.Base(p)
+
+	if mode.IsDir() {
+		if existing, ok := parent.Children[name]; ok && existing.IsDir() {
+			existing.Mode = mode
+			return existing
+		}
+	}
+
+	n := b.newNode(parent, mode)
+	parent.Children[name] = n
+	return n
+}
+
+// link adds a hard link at p to the entry at target.
+func (b *builder) link(p, target string) {
+	t := b.find(target)
+	if t == nil || t.IsDir() || p == "" {
+		return
+	}
+	if b.find(p) == t {
+		return
+	}
+	parent := b.root()
+	if d := path.Dir(p); d != "." {
+		parent = b.dir(d)
+	}
+	parent.Children[path.Base(p)] = t
+	t.Nlink++
+}
+
+func (b *builder) find(p string) *node {
+	p, ok := tree.CleanPath(p)
+	if !ok {
+		return nil
+	}
+	cur := b.root()
+	if p == "" {
+		return cur
+	}
+	for _, part := range strings.Split(p, "/") {
+		if cur.Children == nil {
+			return nil
+		}
+		next, ok := cur.Children[part]
+		if !ok {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+// finish sorts directory listings and returns the filesystem.
+func (b *builder) finish(r io.ReaderAt) *archiveFS {
+	b.tree.Sort()
+	return &archiveFS{
+		r:       r,
+		tree:    b.tree,
+		handles: make(map[rofuse.FileHandle]*stream),
+	}
+}
+
+// archiveFS implements rofuse.Filesystem over an indexed archive.
+type archiveFS struct {
+	rofuse.FilesystemBase
+
+	r    io.ReaderAt
+	tree *tree.Tree[location]
+
+	handlesMu sync.Mutex
+	handles   map[rofuse.FileHandle]*stream
+	nextFh    rofuse.FileHandle
+}
+
+// stream is the per-handle state for compressed entries, which can only be
+// read sequentially. Reads at lower offsets restart decompression.
+type stream struct {
+	mu  sync.Mutex
+	zf  zipEntry
+	rc  io.ReadCloser
+	pos int64
+}
+
+// Lookup finds a child by name.
+func (fs *archiveFS) Lookup(ctx rofuse.Context, parent rofuse.Inode, name string) (*rofuse.Entry, error) {
+	return fs.tree.Lookup(parent, name)
+}
+
+// GetAttr returns the attributes of an entry, cached as long as lookups.
+func (fs *archiveFS) GetAttr(ctx rofuse.Context, ino rofuse.Inode, fh *rofuse.FileHandle) (*rofuse.AttrResponse, error) {
+	return fs.tree.GetAttr(ino)
+}
+
+// ReadLink returns a symlink target.
+func (fs *archiveFS) ReadLink(ctx rofuse.Context, ino rofuse.Inode) (string, error) {
+	return fs.tree.ReadLink(ino)
+}
+
+// Open opens a file. Compressed entries get a handle holding their
+// decompression state, the others can be read at any offset directly.
+func (fs *archiveFS) Open(ctx rofuse.Context, ino rofuse.Inode, flags uint32) (*rofuse.OpenResponse, error) {
+	n, err := fs.tree.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, syscall.EISDIR
+	}
+	if n.Data.dataOff >= 0 || n.Data.zf == nil {
+		return &rofuse.OpenResponse{Flags: rofuse.OpenKeepCache}, nil
+	}
+
+	fs.handlesMu.Lock()
+	fs.nextFh++
+	fh := fs.nextFh
+	fs.handles[fh] = &stream{zf: n.Data.zf}
+	fs.handlesMu.Unlock()
+
+	return &rofuse.OpenResponse{Handle: fh, Flags: rofuse.OpenKeepCache}, nil
+}
+
+// Read reads file data.
+func (fs *archiveFS) Read(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]byte, error) {
+	n, err := fs.tree.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= n.Size {
+		return nil, nil
+	}
+	if remain := n.Size - offset; int64(size) > remain {
+		size = uint32(remain)
+	}
+	buf := make([]byte, size)
+
+	if n.Data.dataOff >= 0 {
+		rn, err := fs.r.ReadAt(buf, n.Data.dataOff+offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return buf[:rn], nil
+	}
+
+	fs.handlesMu.Lock()
+	st := fs.handles[fh]
+	fs.handlesMu.Unlock()
+	if st == nil {
+		return nil, syscall.EBADF
+	}
+	rn, err := st.readAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:rn], nil
+}
+
+func (st *stream) readAt(p []byte, off int64) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.rc == nil || off < st.pos {
+		if st.rc != nil {
+			st.rc.Close()
+		}
+		rc, err := st.zf.Open()
+		if err != nil {
+			return 0, err
+		}
+		st.rc = rc
+		st.pos = 0
+	}
+
+	if off > st.pos {
+		skipped, err := io.CopyN(io.Discard, st.rc, off-st.pos)
+		st.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(st.rc, p)
+	st.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Release drops the decompression state of a handle.
+func (fs *archiveFS) Release(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle) error {
+	fs.handlesMu.Lock()
+	st := fs.handles[fh]
+	delete(fs.handles, fh)
+	fs.handlesMu.Unlock()
+
+	if st != nil && st.rc != nil {
+		st.rc.Close()
+	}
+	return nil
+}
+
+// ReadDir lists a directory.
+func (fs *archiveFS) ReadDir(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]rofuse.DirEntry, error) {
+	l, err := fs.tree.Listing(ino)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadDir(offset), nil
+}
+
+// ReadDirPlus lists a directory with attributes.
+func (fs *archiveFS) ReadDirPlus(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]rofuse.DirEntryPlus, error) {
+	l, err := fs.tree.Listing(ino)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadDirPlus(offset), nil
+}
+
+// StatFS reports the archive size in 512-byte blocks and its entry count.
+func (fs *archiveFS) StatFS(ctx rofuse.Context, ino rofuse.Inode) (*rofuse.StatFS, error) {
+	var blocks uint64
+	for _, n := range fs.tree.Nodes {
+		blocks += (uint64(n.Size) + 511) / 512
+	}
+	return &rofuse.StatFS{
+		Blocks:  blocks,
+		Files:   uint64(len(fs.tree.Nodes)),
+		Bsize:   512,
+		Namelen: 255,
+		Frsize:  512,
+	}, nil
+}
@@ -0,0 +1,283 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse"
+)
+
+// member is an entry of a test archive.
+type member struct {
+	name   string
+	mode   os.FileMode
+	data   string
+	target string // Symlink target
+	link   string // Hard link target (tar only)
+}
+
+// fixture has an explicit directory, a file whose parents are implied,
+// symlinks, a hard link and names that try to climb out of the root.
+var fixture = []member{
+	{name: "./dir/", mode: os.ModeDir | 0750},
+	{name: "./dir/file.txt", mode: 0644, data: "hello"},
+	{name: "a/b/c.txt", mode: 0600, data: "implicit parents"},
+	{name: "link", mode: os.ModeSymlink | 0777, target: "a/b/c.txt"},
+	{name: "../../etc/passwd", mode: 0644, data: "escaped"},
+	{name: "a/../../up", mode: 0644, data: "escaped"},
+	{name: "hard", link: "dir/file.txt"},
+}
+
+func makeTar(t *testing.T, members []member) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	mtime := time.Unix(1700000000, 0)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: int64(m.mode.Perm()), ModTime: mtime}
+		switch {
+		case m.link != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = m.link
+		case m.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+		case m.mode&os.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = m.target
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(m.data))
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeZip writes members, deflating regular files unless store is set.
+// Hard links have no zip form and are left out.
+func makeZip(t *testing.T, members []member, store bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, m := range members {
+		if m.link != "" {
+			continue
+		}
+		hdr := &zip.FileHeader{Name: m.name, Method: zip.Deflate, Modified: time.Unix(1700000000, 0)}
+		hdr.SetMode(m.mode)
+		data := m.data
+		switch {
+		case m.mode.IsDir():
+			hdr.Method = zip.Store
+		case m.mode&os.ModeSymlink != 0:
+			data = m.target
+		case store:
+			hdr.Method = zip.Store
+		}
+		fw, err := w.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// walk looks up the path made of names from the root.
+func walk(t *testing.T, fs rofuse.Filesystem, names ...string) (*rofuse.Entry, error) {
+	t.Helper()
+	ino := rofuse.RootInode
+	var e *rofuse.Entry
+	for _, name := range names {
+		var err error
+		if e, err = fs.Lookup(nil, ino, name); err != nil {
+			return nil, err
+		}
+		ino = e.Ino
+	}
+	return e, nil
+}
+
+func mustWalk(t *testing.T, fs rofuse.Filesystem, names ...string) *rofuse.Entry {
+	t.Helper()
+	e, err := walk(t, fs, names...)
+	if err != nil {
+		t.Fatalf("lookup %q: %v", names, err)
+	}
+	return e
+}
+
+func readAll(t *testing.T, fs rofuse.Filesystem, ino rofuse.Inode) string {
+	t.Helper()
+	open, err := fs.Open(nil, ino, 0)
+	if err != nil {
+		t.Fatalf("Open %d: %v", ino, err)
+	}
+	defer fs.Release(nil, ino, open.Handle)
+	data, err := fs.Read(nil, ino, open.Handle, 0, 4096)
+	if err != nil {
+		t.Fatalf("Read %d: %v", ino, err)
+	}
+	return string(data)
+}
+
+// checkTree runs the checks both archive formats share.
+func checkTree(t *testing.T, fs rofuse.Filesystem) {
+	if got := readAll(t, fs, mustWalk(t, fs, "dir", "file.txt").Ino); got != "hello" {
+		t.Errorf("dir/file.txt = %q, want %q", got, "hello")
+	}
+	if mode := mustWalk(t, fs, "dir").Attr.Mode; mode != os.ModeDir|0750 {
+		t.Errorf("dir mode %v, want %v", mode, os.ModeDir|0750)
+	}
+
+	// Parents missing from the archive are made up
+	for _, p := range [][]string{{"a"}, {"a", "b"}} {
+		if e := mustWalk(t, fs, p...); !e.Attr.Mode.IsDir() {
+			t.Errorf("%q mode %v, want a directory", p, e.Attr.Mode)
+		}
+	}
+	c := mustWalk(t, fs, "a", "b", "c.txt")
+	if got := readAll(t, fs, c.Ino); got != "implicit parents" {
+		t.Errorf("a/b/c.txt = %q", got)
+	}
+
+	link := mustWalk(t, fs, "link")
+	if link.Attr.Mode&os.ModeSymlink == 0 || link.Attr.Size != uint64(len("a/b/c.txt")) {
+		t.Errorf("link: mode %v size %d", link.Attr.Mode, link.Attr.Size)
+	}
+	if target, err := fs.ReadLink(nil, link.Ino); err != nil || target != "a/b/c.txt" {
+		t.Errorf("ReadLink = %q, %v", target, err)
+	}
+	if _, err := fs.ReadLink(nil, c.Ino); err != syscall.EINVAL {
+		t.Errorf("ReadLink of a file: %v, want EINVAL", err)
+	}
+
+	// Names climbing out of the root are dropped, not moved inside it
+	for _, p := range [][]string{{"etc"}, {"passwd"}, {"up"}} {
+		if _, err := walk(t, fs, p...); err != syscall.ENOENT {
+			t.Errorf("lookup %q: %v, want ENOENT", p, err)
+		}
+	}
+}
+
+func TestTar(t *testing.T) {
+	data := makeTar(t, fixture)
+	fs, err := FromTar(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, fs)
+
+	hard := mustWalk(t, fs, "hard")
+	if file := mustWalk(t, fs, "dir", "file.txt"); hard.Ino != file.Ino || hard.Attr.Nlink != 2 {
+		t.Errorf("hard link: ino %d nlink %d, want ino %d nlink 2", hard.Ino, hard.Attr.Nlink, file.Ino)
+	}
+}
+
+func TestZip(t *testing.T) {
+	for _, store := range []bool{false, true} {
+		data := makeZip(t, fixture, store)
+		fs, err := FromZip(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, fs)
+	}
+}
+
+// Deflated entries are read through a stream that restarts when a read
+// goes backwards.
+func TestZipSeek(t *testing.T) {
+	data := makeZip(t, []member{{name: "f", mode: 0644, data: "0123456789"}}, false)
+	fs, err := FromZip(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := mustWalk(t, fs, "f").Ino
+	open, err := fs.Open(nil, ino, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		off  int64
+		want string
+	}{{6, "678"}, {2, "234"}, {8, "89"}, {10, ""}} {
+		got, err := fs.Read(nil, ino, open.Handle, r.off, 3)
+		if err != nil || string(got) != r.want {
+			t.Errorf("Read at %d = %q, %v, want %q", r.off, got, err, r.want)
+		}
+	}
+}
+
+// ReadDirPlus lists ".", ".." and the sorted names, each carrying the
+// offset to resume after it, and agrees with ReadDir.
+func TestReadDirPlusOffsets(t *testing.T) {
+	data := makeTar(t, fixture)
+	fs, err := FromTar(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{".", "..", "a", "dir", "hard", "link"}
+	plus, err := fs.ReadDirPlus(nil, rofuse.RootInode, 0, 0, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plus) != len(want) {
+		t.Fatalf("%d entries, want %d", len(plus), len(want))
+	}
+	plain, err := fs.ReadDir(nil, rofuse.RootInode, 0, 0, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range plus {
+		if e.Name != want[i] || e.Offset != uint64(i+1) {
+			t.Errorf("entry %d: %q at offset %d, want %q at %d", i, e.Name, e.Offset, want[i], i+1)
+		}
+		if d := plain[i]; d.Name != e.Name || d.Offset != e.Offset || d.Ino != e.Entry.Ino {
+			t.Errorf("ReadDir entry %d %+v, ReadDirPlus has %q ino %d", i, d, e.Name, e.Entry.Ino)
+		}
+	}
+	if plus[0].Entry.Ino != rofuse.RootInode || plus[1].Entry.Ino != rofuse.RootInode {
+		t.Errorf("root dot entries point to %d and %d", plus[0].Entry.Ino, plus[1].Entry.Ino)
+	}
+
+	// Resuming from an entry's offset continues after it
+	rest, err := fs.ReadDirPlus(nil, rofuse.RootInode, 0, int64(plus[3].Offset), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 2 || rest[0].Name != "hard" || rest[0].Offset != 5 {
+		t.Errorf("from offset %d: %+v", plus[3].Offset, rest)
+	}
+	if end, err := fs.ReadDirPlus(nil, rofuse.RootInode, 0, int64(len(want)), 4096); err != nil || len(end) != 0 {
+		t.Errorf("at the end: %d entries, %v", len(end), err)
+	}
+
+	// The ".." of a subdirectory is its parent
+	sub, err := fs.ReadDirPlus(nil, mustWalk(t, fs, "a", "b").Ino, 0, 0, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := mustWalk(t, fs, "a"); sub[1].Entry.Ino != a.Ino {
+		t.Errorf("a/b/.. is %d, want %d", sub[1].Entry.Ino, a.Ino)
+	}
+}
@@ -0,0 +1,90 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	"github.com/KarpelesLab/rofuse"
+	"github.com/KarpelesLab/rofuse/internal/tree"
+)
+
+// FromTar indexes an uncompressed tar archive of the given size and serves
+// it as a read-only filesystem.
+//
+// The archive is scanned once, seeking over file contents, and the offset
+// of each member's data is recorded so reads go straight to r at any
+// offset. Directories missing from the archive but implied by member
+// paths are created, and symlinks and hard links are preserved. GNU
+// sparse members are not supported and are left out.
+func FromTar(r io.ReaderAt, size int64) (rofuse.Filesystem, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+	b := newBuilder()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archivefs: tar: %w", err)
+		}
+
+		p, ok := tree.CleanPath(hdr.Name)
+		if !ok {
+			continue
+		}
+
+		// The reader does not buffer ahead, so the current position of
+		// the section reader is where this member's data begins.
+		dataOff, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("archivefs: tar: %w", err)
+		}
+
+		var n *node
+		mode := hdr.FileInfo().Mode()
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if p == "" {
+				continue
+			}
+			n = b.add(p, mode)
+			if hdr.Typeflag == tar.TypeReg {
+				n.Size = hdr.Size
+				n.Data.dataOff = dataOff
+			} else {
+				n.Rdev = rofuse.Makedev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+			}
+		case tar.TypeDir:
+			if p == "" {
+				n = b.root()
+				n.Mode = mode
+			} else {
+				n = b.add(p, mode)
+			}
+		case tar.TypeSymlink:
+			if p == "" {
+				continue
+			}
+			n = b.add(p, mode)
+			n.Target = hdr.Linkname
+			n.Size = int64(len(hdr.Linkname))
+		case tar.TypeLink:
+			if target, ok := tree.CleanPath(hdr.Linkname); ok {
+				b.link(p, target)
+			}
+			continue
+		default:
+			continue
+		}
+
+		n.Mtime = hdr.ModTime
+		n.Uid = uint32(hdr.Uid)
+		n.Gid = uint32(hdr.Gid)
+	}
+
+	return b.finish(r), nil
+}
@@ -0,0 +1,98 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/KarpelesLab/rofuse"
+	"github.com/KarpelesLab/rofuse/internal/tree"
+)
+
+// zipEntry is the part of *zip.File needed to decompress an entry.
+type zipEntry interface {
+	Open() (io.ReadCloser, error)
+}
+
+// maxSymlinkTarget bounds how much of a zip symlink entry is read.
+const maxSymlinkTarget = 4096
+
+// FromZip indexes a zip archive of the given size and serves it as a
+// read-only filesystem.
+//
+// Stored (uncompressed) entries are read from r at any offset directly.
+// Compressed entries are decompressed per open handle; sequential reads
+// are cheap, while seeking backwards restarts decompression from the
+// start of the entry. Directories implied by entry paths are created.
+func FromZip(r io.ReaderAt, size int64) (rofuse.Filesystem, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("archivefs: zip: %w", err)
+	}
+
+	b := newBuilder()
+	for _, f := range zr.File {
+		p, ok := tree.CleanPath(f.Name)
+		if !ok {
+			continue
+		}
+
+		mode := f.Mode()
+		var n *node
+
+		switch {
+		case mode.IsDir():
+			if p == "" {
+				n = b.root()
+				n.Mode = mode
+			} else {
+				n = b.add(p, mode)
+			}
+		case mode&os.ModeSymlink != 0:
+			if p == "" {
+				continue
+			}
+			target, err := readZipSymlink(f)
+			if err != nil {
+				return nil, fmt.Errorf("archivefs: zip: %s: %w", f.Name, err)
+			}
+			n = b.add(p, mode)
+			n.Target = target
+			n.Size = int64(len(target))
+		default:
+			if p == "" {
+				continue
+			}
+			n = b.add(p, mode)
+			n.Size = int64(f.UncompressedSize64)
+			if f.Method == zip.Store {
+				off, err := f.DataOffset()
+				if err != nil {
+					return nil, fmt.Errorf("archivefs: zip: %s: %w", f.Name, err)
+				}
+				n.Data.dataOff = off
+			} else {
+				n.Data.zf = f
+			}
+		}
+
+		n.Mtime = f.Modified
+	}
+
+	return b.finish(r), nil
+}
+
+func readZipSymlink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, maxSymlinkTarget))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
@@ -0,0 +1,108 @@
+package rofuse
+
+import (
+	"context"
+	"sync"
+	"syscall"
+)
+
+// Replier completes a request after its handler has returned. Obtain one
+// with AsyncReplier, return ErrReplyAsync from the handler, and call
+// SendData or SendError exactly once when the result is available.
+//
+// The request stays in flight until then: its buffer is kept, Unmount and
+// Wait wait for it, and if the request's context is cancelled first the
+// kernel is answered with EINTR and the Replier becomes a no-op.
+type Replier struct {
+	s    *Server
+	req  *request
+	once sync.Once
+
+	mu   sync.Mutex // Guards stop against the EINTR callback
+	stop func() bool
+}
+
+// AsyncReplier returns the Replier for the request ctx belongs to, or nil
+// if ctx does not come from a server request. Calling it more than once
+// for the same request returns the same Replier.
+//
+// If the handler ends up replying normally (returning anything other than
+// ErrReplyAsync) the Replier is discarded and its methods return
+// ErrAlreadyReplied.
+func AsyncReplier(ctx Context) *Replier {
+	c, ok := ctx.(*fuseContext)
+	if !ok || c.req == nil {
+		return nil
+	}
+	if c.req.replier != nil {
+		return c.req.replier
+	}
+
+	r := &Replier{s: c.srv, req: c.req}
+	c.req.refs.Add(1)
+	c.req.replier = r
+	return r
+}
+
+// arm answers EINTR for the request once ctx is cancelled, or right away
+// if it is already. It runs when the handler has returned ErrReplyAsync,
+// so that a handler replying itself never races the EINTR reply.
+func (r *Replier) arm(ctx context.Context) {
+	if ctx.Err() != nil {
+		r.SendError(syscall.EINTR)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The callback may start before AfterFunc returns; it waits for mu in
+	// complete until stop is set
+	r.stop = context.AfterFunc(ctx, func() {
+		r.SendError(syscall.EINTR)
+	})
+}
+
+// SendData replies with p as the payload, as a Read handler returning p
+// would.
+func (r *Replier) SendData(p []byte) error {
+	return r.complete(func() {
+		r.s.sendData(r.req, p)
+		r.req.endTrace(nil)
+	})
+}
+
+// SendError replies with err, mapped to an errno as handler errors are.
+func (r *Replier) SendError(err error) error {
+	return r.complete(func() {
+		err := r.s.checkCancel(r.req, err)
+		r.s.sendError(r.req, err)
+		r.req.endTrace(err)
+	})
+}
+
+// complete runs send the first time it is called, then drops the
+// Replier's hold on the request.
+func (r *Replier) complete(send func()) error {
+	done := false
+	r.once.Do(func() {
+		done = true
+		r.mu.Lock()
+		if r.stop != nil {
+			r.stop()
+		}
+		r.mu.Unlock()
+		if send != nil {
+			send()
+		}
+		r.s.finish(r.req)
+	})
+	if !done {
+		return ErrAlreadyReplied
+	}
+	return nil
+}
+
+// discard drops the Replier without replying, for a handler that replied
+// itself after all.
+func (r *Replier) discard() {
+	r.complete(nil)
+}
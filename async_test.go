@@ -0,0 +1,72 @@
+package rofuse
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// asyncFS answers reads from another goroutine through a Replier. With
+// wait set, a read first waits until its request is interrupted.
+type asyncFS struct {
+	*testFS
+	wait bool
+	sent chan error // What SendData returned
+}
+
+func (f asyncFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	if f.wait {
+		<-ctx.Done()
+	}
+	r := AsyncReplier(ctx)
+	if r == nil {
+		return nil, syscall.EIO
+	}
+	go func() {
+		f.sent <- r.SendData([]byte("async"))
+	}()
+	return nil, ErrReplyAsync
+}
+
+func TestAsyncReply(t *testing.T) {
+	fs := asyncFS{testFS: newTestFS(), sent: make(chan error, 1)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, nil)
+
+	if got := string(k.readFile(ino, k.open(ino), 0, 4096)); got != "async" {
+		t.Errorf("READ = %q, want %q", got, "async")
+	}
+	if err := <-fs.sent; err != nil {
+		t.Errorf("SendData: %v", err)
+	}
+}
+
+// A request interrupted before its handler hands it to a Replier is
+// answered EINTR once, and the Replier's own reply is dropped.
+func TestAsyncReplyInterrupted(t *testing.T) {
+	fs := asyncFS{testFS: newTestFS(), wait: true, sent: make(chan error, 1)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, nil)
+	fh := k.open(ino)
+
+	unique := k.send(proto.OpRead, uint64(ino), wireBytes(&proto.ReadIn{Fh: fh, Size: 4096}))
+	k.sendInterrupt(unique)
+	if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EINTR {
+		t.Errorf("READ: errno %v, want EINTR", syscall.Errno(-errno))
+	}
+	select {
+	case err := <-fs.sent:
+		if !errors.Is(err, ErrAlreadyReplied) {
+			t.Errorf("SendData after EINTR = %v, want ErrAlreadyReplied", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendData did not return")
+	}
+	k.noReply(unique, 50*time.Millisecond)
+
+	// The server is still serving
+	k.getattr(RootInode)
+}
@@ -0,0 +1,141 @@
+package rofuse
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// BatchAttrFilesystem is implemented by filesystems whose backend can
+// return the attributes of many inodes in one call. With
+// MountOptions.AttrBatchWindow set, GETATTR requests arriving close
+// together are answered by a single BatchGetAttr instead of one GetAttr
+// each.
+type BatchAttrFilesystem interface {
+	// BatchGetAttr returns the attributes of each of inos, in order. A
+	// nil element answers that inode with ENOENT; an error fails the
+	// whole batch. ctx is not tied to any one of the requests, whose
+	// callers may differ: its ids are 0. It is cancelled when the
+	// server shuts down, and with MountOptions.OperationTimeout once the
+	// last of the requests' deadlines has passed.
+	//
+	// Only GETATTR is batched. LOOKUP resolves a name rather than an
+	// inode, which BatchGetAttr cannot express, and GETATTRs on an open
+	// file go to GetAttr with their handle.
+	BatchGetAttr(ctx Context, inos []Inode) ([]*Attr, error)
+}
+
+// maxAttrBatch is the most inodes passed to one BatchGetAttr; a batch that
+// fills up is sent without waiting for the window to end.
+const maxAttrBatch = 256
+
+// attrBatcher coalesces GETATTR requests into BatchGetAttr calls.
+type attrBatcher struct {
+	s      *Server
+	fs     BatchAttrFilesystem
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[uint64]*attrBatch // By snapshot token
+}
+
+// attrBatch is one BatchGetAttr call being collected or running.
+type attrBatch struct {
+	snap     uint64
+	inos     []Inode
+	deadline time.Time // Latest of the requests', zero if one has none
+	sent     bool
+	done     chan struct{}
+	attrs    []*Attr
+	err      error
+}
+
+func newAttrBatcher(s *Server, fs BatchAttrFilesystem, window time.Duration) *attrBatcher {
+	return &attrBatcher{
+		s:       s,
+		fs:      fs,
+		window:  window,
+		pending: make(map[uint64]*attrBatch),
+	}
+}
+
+// get returns the attributes of ino, fetched along with those of other
+// requests arriving within the window. Requests only share a batch if
+// they were issued under the same snapshot.
+func (b *attrBatcher) get(ctx Context, ino Inode) (*AttrResponse, error) {
+	snap := ctx.Snapshot()
+
+	deadline, ok := ctx.Deadline()
+
+	b.mu.Lock()
+	batch := b.pending[snap]
+	if batch == nil {
+		batch = &attrBatch{snap: snap, deadline: deadline, done: make(chan struct{})}
+		b.pending[snap] = batch
+		// The batch outlives the request that started it; Unmount waits
+		// for it like for a request
+		b.s.wg.Add(1)
+		time.AfterFunc(b.window, func() { b.send(batch) })
+	} else if !ok || (!batch.deadline.IsZero() && deadline.After(batch.deadline)) {
+		batch.deadline = deadline
+	}
+	i := len(batch.inos)
+	batch.inos = append(batch.inos, ino)
+	full := len(batch.inos) >= maxAttrBatch
+	b.mu.Unlock()
+
+	if full {
+		b.send(batch)
+	}
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	if i >= len(batch.attrs) || batch.attrs[i] == nil {
+		return nil, syscall.ENOENT
+	}
+	return &AttrResponse{Attr: *batch.attrs[i]}, nil
+}
+
+// send calls BatchGetAttr for batch, unless it was already sent.
+func (b *attrBatcher) send(batch *attrBatch) {
+	b.mu.Lock()
+	if batch.sent {
+		b.mu.Unlock()
+		return
+	}
+	batch.sent = true
+	if b.pending[batch.snap] == batch {
+		delete(b.pending, batch.snap)
+	}
+	b.mu.Unlock()
+
+	defer b.s.wg.Done()
+
+	parent := b.s.ctx
+	if !batch.deadline.IsZero() {
+		var cancel context.CancelFunc
+		parent, cancel = context.WithDeadline(parent, batch.deadline)
+		defer cancel()
+	}
+
+	b.call(newContext(parent, 0, 0, 0, 0, batch.snap), batch)
+	b.s.count("getattr.batch", 1)
+	b.s.count("getattr.batched", int64(len(batch.inos)))
+	close(batch.done)
+}
+
+// call runs BatchGetAttr for batch, turning a panic into EIO.
+func (b *attrBatcher) call(ctx Context, batch *attrBatch) {
+	defer b.s.recoverPanic(proto.OpGetattr, 0, &batch.err)
+	batch.attrs, batch.err = b.fs.BatchGetAttr(ctx, batch.inos)
+}
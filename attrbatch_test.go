@@ -0,0 +1,132 @@
+package rofuse
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// batchFS answers BatchGetAttr from a testFS and counts the calls.
+type batchFS struct {
+	*testFS
+	calls   atomic.Int32
+	getattr atomic.Int32
+	panics  bool
+}
+
+func (f *batchFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	f.getattr.Add(1)
+	return f.testFS.GetAttr(ctx, ino, fh)
+}
+
+func (f *batchFS) BatchGetAttr(ctx Context, inos []Inode) ([]*Attr, error) {
+	f.calls.Add(1)
+	if f.panics {
+		panic("backend exploded")
+	}
+	attrs := make([]*Attr, len(inos))
+	for i, ino := range inos {
+		if n, err := f.node(ino); err == nil {
+			attrs[i] = &n.attr
+		}
+	}
+	return attrs, nil
+}
+
+func TestAttrBatch(t *testing.T) {
+	fs := &batchFS{testFS: newTestFS()}
+	var inos []Inode
+	for _, name := range []string{"a", "b", "c", "d"} {
+		inos = append(inos, fs.create(RootInode, name, []byte(name)))
+	}
+	k := newTestServer(t, fs, &MountOptions{AttrBatchWindow: 100 * time.Millisecond})
+
+	uniques := make([]uint64, len(inos))
+	for i, ino := range inos {
+		uniques[i] = k.send(proto.OpGetattr, uint64(ino), wireBytes(&proto.GetAttrIn{}))
+	}
+	missing := k.send(proto.OpGetattr, 99, wireBytes(&proto.GetAttrIn{}))
+	for i, u := range uniques {
+		errno, data := k.recv(u)
+		if errno != 0 {
+			t.Fatalf("GETATTR %d: %v", inos[i], syscall.Errno(-errno))
+		}
+		if out := wireStruct[proto.AttrOut](t, data); out.Attr.Ino != uint64(inos[i]) {
+			t.Errorf("GETATTR %d answered with inode %d", inos[i], out.Attr.Ino)
+		}
+	}
+	if errno, _ := k.recv(missing); errno != -int32(syscall.ENOENT) {
+		t.Errorf("missing inode: got errno %d, want ENOENT", -errno)
+	}
+	if n := fs.calls.Load(); n != 1 {
+		t.Errorf("%d BatchGetAttr calls, want 1", n)
+	}
+	if n := fs.getattr.Load(); n != 0 {
+		t.Errorf("%d GetAttr calls, want 0", n)
+	}
+}
+
+// GETATTR on an open file goes to GetAttr, which gets the handle.
+func TestAttrBatchHandle(t *testing.T) {
+	fs := &batchFS{testFS: newTestFS()}
+	ino := fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, &MountOptions{AttrBatchWindow: time.Millisecond})
+
+	k.mustCall(proto.OpGetattr, uint64(ino), wireBytes(&proto.GetAttrIn{Flags: proto.GetattrFh, Fh: 1}))
+	if calls, getattr := fs.calls.Load(), fs.getattr.Load(); calls != 0 || getattr != 1 {
+		t.Errorf("%d BatchGetAttr and %d GetAttr calls, want 0 and 1", calls, getattr)
+	}
+}
+
+func TestAttrBatchPanic(t *testing.T) {
+	fs := &batchFS{testFS: newTestFS(), panics: true}
+	ino := fs.create(RootInode, "file", nil)
+	var panics atomic.Int32
+	k := newTestServer(t, fs, &MountOptions{
+		AttrBatchWindow: time.Millisecond,
+		PanicHandler: func(op uint32, unique uint64, v any, stack []byte) {
+			panics.Add(1)
+		},
+	})
+
+	if errno, _ := k.call(proto.OpGetattr, uint64(ino), wireBytes(&proto.GetAttrIn{})); errno != -int32(syscall.EIO) {
+		t.Errorf("got errno %d, want EIO", -errno)
+	}
+	if n := panics.Load(); n != 1 {
+		t.Errorf("PanicHandler called %d times, want 1", n)
+	}
+}
+
+// deadlineFS blocks BatchGetAttr until its context ends.
+type deadlineFS struct {
+	*testFS
+	ended chan struct{}
+}
+
+func (f deadlineFS) BatchGetAttr(ctx Context, inos []Inode) ([]*Attr, error) {
+	<-ctx.Done()
+	close(f.ended)
+	return nil, ctx.Err()
+}
+
+// With OperationTimeout the batch gets the requests' deadline.
+func TestAttrBatchTimeout(t *testing.T) {
+	fs := deadlineFS{newTestFS(), make(chan struct{})}
+	ino := fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, &MountOptions{
+		AttrBatchWindow:  time.Millisecond,
+		OperationTimeout: 50 * time.Millisecond,
+	})
+
+	if errno, _ := k.call(proto.OpGetattr, uint64(ino), wireBytes(&proto.GetAttrIn{})); errno == 0 {
+		t.Error("GETATTR succeeded")
+	}
+	select {
+	case <-fs.ended:
+	case <-time.After(5 * time.Second):
+		t.Error("BatchGetAttr still running")
+	}
+}
@@ -0,0 +1,186 @@
+package rofuse
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// backingTable reference-counts passthrough backing ids.
+//
+// Every id starts with one reference owned by the caller of OpenBackingFD,
+// which CloseBackingFD drops. Each OPEN reply carrying the id adds one
+// more, dropped by the matching RELEASE. The id is closed in the kernel
+// exactly once, when its count reaches zero.
+type backingTable struct {
+	mu      sync.Mutex
+	refs    map[int32]int
+	handles map[backingHandle][]int32
+}
+
+// backingHandle identifies an open file handle. Filesystems may reuse the
+// same FileHandle value for several opens, so ids are stacked per handle.
+type backingHandle struct {
+	ino Inode
+	fh  FileHandle
+}
+
+func newBackingTable() *backingTable {
+	return &backingTable{
+		refs:    make(map[int32]int),
+		handles: make(map[backingHandle][]int32),
+	}
+}
+
+// add registers a newly opened id with the caller's reference.
+func (t *backingTable) add(id int32) {
+	t.mu.Lock()
+	t.refs[id]++
+	t.mu.Unlock()
+}
+
+// retain takes a reference on id for an open handle.
+func (t *backingTable) retain(ino Inode, fh FileHandle, id int32) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs[id] == 0 {
+		return ErrUnknownBackingID
+	}
+	t.refs[id]++
+	key := backingHandle{ino, fh}
+	t.handles[key] = append(t.handles[key], id)
+	return nil
+}
+
+// release drops the reference held by an open handle, if any, and
+// returns the id to close when it was the last one.
+func (t *backingTable) release(ino Inode, fh FileHandle) (int32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := backingHandle{ino, fh}
+	ids := t.handles[key]
+	if len(ids) == 0 {
+		return 0, false
+	}
+	id := ids[len(ids)-1]
+	if len(ids) == 1 {
+		delete(t.handles, key)
+	} else {
+		t.handles[key] = ids[:len(ids)-1]
+	}
+	return id, t.unrefLocked(id)
+}
+
+// unref drops one reference on id and reports whether it was the last.
+func (t *backingTable) unref(id int32) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs[id] == 0 {
+		return false, ErrUnknownBackingID
+	}
+	return t.unrefLocked(id), nil
+}
+
+func (t *backingTable) unrefLocked(id int32) bool {
+	t.refs[id]--
+	if t.refs[id] > 0 {
+		return false
+	}
+	delete(t.refs, id)
+	return true
+}
+
+// OpenBackingFD registers fd as a passthrough backing file with the kernel
+// and returns its backing id, to be returned in OpenResponse.BackingID.
+// Requires CAP_SYS_ADMIN and a kernel that negotiated CapPassthrough.
+//
+// The caller owns one reference on the id and must drop it with
+// CloseBackingFD once no new opens will use it. Open handles keep their
+// own reference until released, so the kernel mapping is closed only
+// after the last of them is gone. fd itself may be closed right away.
+func (s *Server) OpenBackingFD(fd int) (int32, error) {
+	m := proto.BackingMap{Fd: int32(fd)}
+	r, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(s.conn.Fd()),
+		uintptr(proto.DevIocBackingOpen),
+		uintptr(unsafe.Pointer(&m)),
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	id := int32(r)
+	s.backing.add(id)
+	return id, nil
+}
+
+// CloseBackingFD drops the caller's reference on a backing id obtained
+// from OpenBackingFD. The id is closed in the kernel once no open handle
+// references it anymore.
+func (s *Server) CloseBackingFD(id int32) error {
+	last, err := s.backing.unref(id)
+	if err != nil || !last {
+		return err
+	}
+	return s.closeBacking(id)
+}
+
+// openBacking registers fd as the backing file of an open handle, owned
+// by the handle alone. It reports false, and the handle is served by Read,
+// if passthrough was not negotiated or the kernel refused fd.
+func (s *Server) openBacking(ino Inode, fh FileHandle, fd int) (int32, bool) {
+	if s.NegotiatedFlags()&proto.CapPassthrough == 0 {
+		return 0, false
+	}
+	id, err := s.OpenBackingFD(fd)
+	if err != nil {
+		s.opts.logf("inode %d: passthrough for fd %d: %v", ino, fd, err)
+		s.count("passthrough.error", 1)
+		return 0, false
+	}
+	// Hand the caller's reference over to the handle. Neither step fails
+	// unless a CloseBackingFD of an id it does not own dropped ours.
+	if err := s.backing.retain(ino, fh, id); err != nil {
+		s.opts.logf("inode %d: backing id %d closed before its open: %v", ino, id, err)
+		s.count("passthrough.error", 1)
+		return 0, false
+	}
+	if _, err := s.backing.unref(id); err != nil {
+		s.opts.logf("inode %d: backing id %d: %v", ino, id, err)
+		s.count("passthrough.error", 1)
+	}
+	return id, true
+}
+
+// releaseBacking drops the backing reference held by an open handle.
+func (s *Server) releaseBacking(ino Inode, fh FileHandle) {
+	id, last := s.backing.release(ino, fh)
+	if !last {
+		return
+	}
+	if err := s.closeBacking(id); err != nil {
+		s.opts.logf("inode %d: closing backing id %d: %v", ino, id, err)
+		s.count("passthrough.error", 1)
+	}
+}
+
+// closeBacking closes a backing id in the kernel.
+func (s *Server) closeBacking(id int32) error {
+	v := uint32(id)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(s.conn.Fd()),
+		uintptr(proto.DevIocBackingClose),
+		uintptr(unsafe.Pointer(&v)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package rofuse
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Opens of one id, from several handles and twice from the same one, mixed
+// with the caller's CloseBackingFD: the id is closed once, by whichever
+// drops the last reference.
+func TestBackingTable(t *testing.T) {
+	tb := newBackingTable()
+	tb.add(7)
+	tb.add(8)
+	for _, r := range []struct {
+		ino Inode
+		fh  FileHandle
+		id  int32
+	}{{1, 10, 7}, {2, 20, 7}, {1, 10, 7}, {1, 10, 8}} {
+		if err := tb.retain(r.ino, r.fh, r.id); err != nil {
+			t.Fatalf("retain %d for %d/%d: %v", r.id, r.ino, r.fh, err)
+		}
+	}
+
+	closed := make(map[int32]int)
+	release := func(ino Inode, fh FileHandle, want int32) {
+		t.Helper()
+		id, last := tb.release(ino, fh)
+		if id != want {
+			t.Errorf("release %d/%d dropped id %d, want %d", ino, fh, id, want)
+		}
+		if last {
+			closed[id]++
+		}
+	}
+	unref := func(id int32) {
+		t.Helper()
+		last, err := tb.unref(id)
+		if err != nil {
+			t.Errorf("unref %d: %v", id, err)
+		}
+		if last {
+			closed[id]++
+		}
+	}
+
+	release(1, 10, 8) // Handles stack their ids, the last one first
+	release(2, 20, 7)
+	unref(7)
+	if len(closed) != 0 {
+		t.Fatalf("closed %v while handles still hold references", closed)
+	}
+	release(1, 10, 7)
+	release(1, 10, 7)
+	if closed[7] != 1 {
+		t.Errorf("id 7 closed %d times after its last release, want 1", closed[7])
+	}
+	unref(8)
+	if closed[8] != 1 {
+		t.Errorf("id 8 closed %d times after CloseBackingFD, want 1", closed[8])
+	}
+
+	// Nothing is left to drop
+	if id, last := tb.release(1, 10); id != 0 || last {
+		t.Errorf("release of a released handle: %d, %v", id, last)
+	}
+	for _, id := range []int32{7, 8} {
+		if _, err := tb.unref(id); err != ErrUnknownBackingID {
+			t.Errorf("unref of closed id %d: %v, want ErrUnknownBackingID", id, err)
+		}
+		if err := tb.retain(3, 30, id); err != ErrUnknownBackingID {
+			t.Errorf("retain of closed id %d: %v, want ErrUnknownBackingID", id, err)
+		}
+	}
+}
+
+// Concurrent opens and releases racing the caller's CloseBackingFD still
+// close the id exactly once.
+func TestBackingTableConcurrent(t *testing.T) {
+	for range 100 {
+		tb := newBackingTable()
+		tb.add(1)
+		var closes atomic.Int32
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fh := FileHandle(i)
+				// Opens after the id is closed are refused
+				if tb.retain(1, fh, 1) != nil {
+					return
+				}
+				if _, last := tb.release(1, fh); last {
+					closes.Add(1)
+				}
+			}()
+		}
+		if last, err := tb.unref(1); err != nil {
+			t.Fatalf("unref: %v", err)
+		} else if last {
+			closes.Add(1)
+		}
+		wg.Wait()
+		if n := closes.Load(); n != 1 {
+			t.Fatalf("id closed %d times, want 1", n)
+		}
+	}
+}
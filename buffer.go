@@ -41,3 +41,55 @@ func (p *bufferPool) put(buf []byte) {
 		p.pool.Put(&buf)
 	}
 }
+
+// Read replies filled by the synthesized files come from pools by size
+// class, from minReadBuffer up to minReadBuffer<<(readBufferClasses-1)
+// (1MiB, the largest READ the kernel sends).
+const (
+	minReadBuffer     = 4096
+	readBufferClasses = 9
+)
+
+var readBuffers [readBufferClasses]sync.Pool
+
+// readBuffer returns a buffer of size bytes for the reply to the request
+// of ctx. It comes from a pool and goes back once the request is
+// released; outside of a request, or for larger sizes, it is allocated.
+func readBuffer(ctx Context, size int) []byte {
+	c, ok := ctx.(*fuseContext)
+	if !ok || c.req == nil {
+		return make([]byte, size)
+	}
+	class := 0
+	for minReadBuffer<<class < size {
+		class++
+	}
+	if class >= readBufferClasses {
+		return make([]byte, size)
+	}
+
+	bp, _ := readBuffers[class].Get().(*[]byte)
+	if bp == nil {
+		buf := make([]byte, minReadBuffer<<class)
+		bp = &buf
+	}
+	c.req.addBuffer(class, bp)
+	return (*bp)[:size]
+}
+
+// requestBufferSize returns the smallest buffer the kernel accepts for
+// reading requests. Reads into anything smaller than a maximal FUSE_WRITE
+// fail with EINVAL, even on a read-only mount.
+//
+// This only concerns incoming requests. READ replies are allocated per
+// reply and bounded by MaxRead instead (see maxPages).
+func requestBufferSize(maxWrite uint32) int {
+	return max(proto.MinBufferSize, proto.InHeaderSize+proto.WriteInSize+int(maxWrite))
+}
+
+// maxPages returns the max_pages to negotiate at INIT. The kernel bounds
+// both READ and WRITE sizes by it, so it must cover MaxRead and MaxWrite.
+func maxPages(opts *MountOptions) uint16 {
+	n := (max(opts.MaxRead, opts.MaxWrite) + proto.PageSize - 1) / proto.PageSize
+	return uint16(min(max(n, 1), proto.MaxPagesLimit))
+}
@@ -0,0 +1,127 @@
+package rofuse
+
+import "time"
+
+// Caching
+//
+// The kernel caches three things for a FUSE filesystem, each controlled
+// separately:
+//
+//   - dentries (name -> inode), for Entry.EntryTimeout
+//   - attributes, for Entry.AttrTimeout, and after GETATTR for
+//     AttrResponse.Timeout or, if that is zero,
+//     MountOptions.DefaultAttrTimeout
+//   - file data, in the page cache, for as long as the file is open and
+//     beyond, unless the open was made with OpenDirectIO
+//
+// Zero timeouts make the kernel ask again for names and attributes, but do
+// not by themselves keep read data fresh: cached pages are only dropped
+// when a fresh GETATTR shows a changed size or mtime, or on open without
+// OpenKeepCache. Content that changes without its size or mtime changing
+// (a counter, a random stream) therefore also needs direct I/O, which is
+// what the Volatile helpers below combine. With direct I/O the reported
+// size is not used to limit reads either, so such files may report size 0
+// and still return data, as /proc files do.
+
+// CachePolicy describes how the kernel may cache one file. Apply it with
+// ApplyEntry wherever the file's Entry is built (Lookup, ReadDirPlus),
+// with ApplyAttr in GetAttr and with ApplyOpen in Open, so timeouts and
+// open flags always agree.
+type CachePolicy int
+
+const (
+	// CacheDefault caches names and attributes for DefaultCacheTimeout
+	// and data in the page cache until the file changes.
+	CacheDefault CachePolicy = iota
+
+	// CacheImmutable is for content that never changes: names and
+	// attributes are cached for ImmutableCacheTimeout and cached pages
+	// are kept across opens.
+	CacheImmutable
+
+	// CacheVolatile is for content that may change on every access:
+	// nothing is cached and reads bypass the page cache.
+	CacheVolatile
+
+	// CacheDirectIO caches names and attributes like CacheDefault but
+	// bypasses the page cache, for huge files read once.
+	CacheDirectIO
+)
+
+// Timeouts used by CachePolicy.
+const (
+	DefaultCacheTimeout   = time.Second
+	ImmutableCacheTimeout = 24 * time.Hour
+)
+
+// ApplyEntry sets the entry and attribute timeouts of e for the policy.
+func (p CachePolicy) ApplyEntry(e *Entry) {
+	var timeout time.Duration
+	switch p {
+	case CacheImmutable:
+		timeout = ImmutableCacheTimeout
+	case CacheVolatile:
+		timeout = 0
+	default:
+		timeout = DefaultCacheTimeout
+	}
+	e.EntryTimeout = timeout
+	e.AttrTimeout = timeout
+}
+
+// ApplyAttr sets the attribute timeout of r for the policy. A volatile
+// file's attributes are not cached at all, rather than for
+// MountOptions.DefaultAttrTimeout as a zero timeout would be.
+func (p CachePolicy) ApplyAttr(r *AttrResponse) {
+	switch p {
+	case CacheImmutable:
+		r.Timeout = ImmutableCacheTimeout
+	case CacheVolatile:
+		r.Timeout = -1
+	default:
+		r.Timeout = DefaultCacheTimeout
+	}
+}
+
+// ApplyOpen sets the caching flags of r for the policy, replacing any
+// OpenDirectIO or OpenKeepCache already set.
+func (p CachePolicy) ApplyOpen(r *OpenResponse) {
+	r.Flags &^= OpenDirectIO | OpenKeepCache
+	switch p {
+	case CacheImmutable:
+		r.Flags |= OpenKeepCache
+	case CacheVolatile, CacheDirectIO:
+		r.Flags |= OpenDirectIO
+	}
+}
+
+// VolatileEntry returns an Entry for ino that the kernel will not cache:
+// the name is looked up again on every access, and the attributes it
+// carries are not kept. Those GetAttr returns are cached as usual unless
+// it answers with VolatileAttr; pair it with that, and with VolatileOpen
+// when opening the inode.
+func VolatileEntry(ino Inode, attr Attr) *Entry {
+	attr.Ino = ino
+	e := &Entry{
+		Ino:  ino,
+		Attr: attr,
+	}
+	CacheVolatile.ApplyEntry(e)
+	return e
+}
+
+// VolatileAttr returns an AttrResponse the kernel will not cache, so
+// every stat reaches Filesystem.GetAttr.
+func VolatileAttr(attr Attr) *AttrResponse {
+	r := &AttrResponse{Attr: attr}
+	CacheVolatile.ApplyAttr(r)
+	return r
+}
+
+// VolatileOpen returns an OpenResponse for fh that bypasses the page
+// cache, so every read reaches Filesystem.Read.
+func VolatileOpen(fh FileHandle) *OpenResponse {
+	r := &OpenResponse{Handle: fh}
+	CacheVolatile.ApplyOpen(r)
+	return r
+}
@@ -0,0 +1,83 @@
+package rofuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// policyFS applies a CachePolicy to each inode it has one for.
+type policyFS struct {
+	*testFS
+	policies map[Inode]CachePolicy
+}
+
+func (f policyFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	e, err := f.testFS.Lookup(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	f.policies[e.Ino].ApplyEntry(e)
+	return e, nil
+}
+
+func (f policyFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	r, err := f.testFS.GetAttr(ctx, ino, fh)
+	if err != nil {
+		return nil, err
+	}
+	f.policies[ino].ApplyAttr(r)
+	return r, nil
+}
+
+func (f policyFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	r, err := f.testFS.Open(ctx, ino, flags)
+	if err != nil {
+		return nil, err
+	}
+	f.policies[ino].ApplyOpen(r)
+	return r, nil
+}
+
+// Each policy reaches the kernel as the timeouts and FOPEN flags it
+// documents.
+func TestCachePolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  CachePolicy
+		timeout time.Duration
+		flags   uint32
+	}{
+		{"default", CacheDefault, DefaultCacheTimeout, 0},
+		{"immutable", CacheImmutable, ImmutableCacheTimeout, proto.FopenKeepCache},
+		{"volatile", CacheVolatile, 0, proto.FopenDirectIO},
+		{"directio", CacheDirectIO, DefaultCacheTimeout, proto.FopenDirectIO},
+	}
+	fs := policyFS{newTestFS(), make(map[Inode]CachePolicy)}
+	inodes := make([]Inode, len(cases))
+	for i, tc := range cases {
+		inodes[i] = fs.create(RootInode, tc.name, []byte("data"))
+		fs.policies[inodes[i]] = tc.policy
+	}
+	// A long default shows that volatile attributes are not left to it
+	k := newTestServer(t, fs, &MountOptions{DefaultAttrTimeout: time.Hour})
+
+	for i, tc := range cases {
+		ino := inodes[i]
+		sec, nsec := durationToTimespec(tc.timeout)
+
+		e := k.lookup(RootInode, tc.name)
+		if e.EntryValid != sec || e.EntryValidNsec != nsec || e.AttrValid != sec || e.AttrValidNsec != nsec {
+			t.Errorf("%s: LOOKUP entry %d.%09ds attr %d.%09ds, want %v", tc.name,
+				e.EntryValid, e.EntryValidNsec, e.AttrValid, e.AttrValidNsec, tc.timeout)
+		}
+		if a := k.getattr(ino); a.AttrValid != sec || a.AttrValidNsec != nsec {
+			t.Errorf("%s: GETATTR %d.%09ds, want %v", tc.name, a.AttrValid, a.AttrValidNsec, tc.timeout)
+		}
+		data := k.mustCall(proto.OpOpen, uint64(ino), wireBytes(&proto.OpenIn{}))
+		if flags := wireStruct[proto.OpenOut](t, data).OpenFlags; flags&(proto.FopenDirectIO|proto.FopenKeepCache) != tc.flags {
+			t.Errorf("%s: OPEN flags %#x, want %#x", tc.name, flags, tc.flags)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package rofuse
+
+import "github.com/KarpelesLab/rofuse/proto"
+
+// ServerCapabilities reports what a mount supports: the optional
+// operations the Filesystem implements and the features the kernel agreed
+// to at INIT. The negotiated fields are all false until INIT completes.
+type ServerCapabilities struct {
+	// Initialized is true once INIT has been answered.
+	Initialized bool
+
+	// Negotiated with the kernel
+	AsyncRead       bool // Reads may be issued concurrently
+	Readdirplus     bool // READDIRPLUS is used for directory listings
+	ReaddirplusAuto bool // The kernel picks READDIR or READDIRPLUS adaptively
+	ParallelDirops  bool // Lookups and readdirs in a directory run in parallel
+	CacheSymlinks   bool // Symlink targets are cached
+	ExportSupport   bool // The mount can be exported (NFS)
+	Passthrough     bool // Opens may use passthrough backing files
+
+	// Implemented by the Filesystem
+	Statx        bool // StatxFilesystem
+	Poll         bool // PollFilesystem
+	Ioctl        bool // IoctlFilesystem
+	ReleaseFlags bool // ReleaseFlagsFilesystem
+	BatchGetAttr bool // BatchAttrFilesystem, used with MountOptions.AttrBatchWindow
+}
+
+// NegotiatedFlags returns the capability flags (proto.Cap*) agreed with the
+// kernel at INIT, or 0 before INIT. proto.CapabilityNames decodes them.
+func (s *Server) NegotiatedFlags() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.flags
+}
+
+// Capabilities returns the capabilities of the server and its filesystem.
+func (s *Server) Capabilities() ServerCapabilities {
+	s.mu.RLock()
+	initialized := s.initialized
+	flags := s.flags
+	s.mu.RUnlock()
+
+	_, statx := s.fs.(StatxFilesystem)
+	_, poll := s.fs.(PollFilesystem)
+	_, ioctl := s.fs.(IoctlFilesystem)
+	_, release := s.fs.(ReleaseFlagsFilesystem)
+	_, batch := s.fs.(BatchAttrFilesystem)
+
+	return ServerCapabilities{
+		Initialized:     initialized,
+		AsyncRead:       flags&proto.CapAsyncRead != 0,
+		Readdirplus:     flags&proto.CapReaddirplus != 0,
+		ReaddirplusAuto: flags&proto.CapReaddirplusAuto != 0,
+		ParallelDirops:  flags&proto.CapParallelDirops != 0,
+		CacheSymlinks:   flags&proto.CapCacheSymlinks != 0,
+		ExportSupport:   flags&proto.CapExportSupport != 0,
+		Passthrough:     flags&proto.CapPassthrough != 0,
+		Statx:           statx,
+		Poll:            poll,
+		Ioctl:           ioctl,
+		ReleaseFlags:    release,
+		BatchGetAttr:    batch,
+	}
+}
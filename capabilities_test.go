@@ -0,0 +1,164 @@
+package rofuse
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// Requested capabilities above bit 31 are sent in Flags2, along with
+// CapInitExt, when the kernel offers them.
+func TestInitFlags2(t *testing.T) {
+	const high = proto.CapExpireOnly | proto.CapNoExportSupport
+	k := newTestKernel(t, newTestFS(), &MountOptions{Capabilities: high})
+
+	out := k.handshake(high | proto.CapSecurityCtx)
+	if uint64(out.Flags)&proto.CapInitExt == 0 {
+		t.Errorf("Flags %#x without CapInitExt", out.Flags)
+	}
+	if got := uint64(out.Flags2) << 32; got != high {
+		t.Errorf("Flags2 %v, want %v", proto.CapabilityNames(got), proto.CapabilityNames(high))
+	}
+	if got := k.s.NegotiatedFlags(); got&high != high {
+		t.Errorf("negotiated %v, want %v", proto.CapabilityNames(got), proto.CapabilityNames(high))
+	}
+}
+
+// Without CapInitExt from the kernel, Flags2 is neither read nor sent.
+func TestInitFlags2NotOffered(t *testing.T) {
+	k := newTestKernel(t, newTestFS(), &MountOptions{Capabilities: proto.CapExpireOnly})
+
+	in := proto.InitIn{
+		Major:  proto.FuseKernelVersion,
+		Minor:  proto.FuseKernelMinorVersion,
+		Flags:  uint32(proto.CapAsyncRead),
+		Flags2: uint32(proto.CapExpireOnly >> 32),
+	}
+	out := wireStruct[proto.InitOut](t, k.mustCall(proto.OpInit, 0, wireBytes(&in)))
+	if uint64(out.Flags)&proto.CapInitExt != 0 || out.Flags2 != 0 {
+		t.Errorf("Flags %#x, Flags2 %#x, want no extended flags", out.Flags, out.Flags2)
+	}
+}
+
+// Capabilities the server cannot work with are never requested, even
+// when the kernel offers them.
+func TestCapabilitiesMasked(t *testing.T) {
+	var logged bytes.Buffer
+	const unsupported = proto.CapWritebackCache | proto.CapPosixLocks | proto.CapSecurityCtx | proto.CapHasInode
+	k := newTestKernel(t, newTestFS(), &MountOptions{
+		Capabilities: unsupported | proto.CapIoctlDir,
+		Logger:       slog.New(slog.NewTextHandler(&logged, nil)),
+	})
+
+	out := k.handshake(unsupported | proto.CapIoctlDir)
+	flags := uint64(out.Flags) | uint64(out.Flags2)<<32
+	if flags&unsupported != 0 {
+		t.Errorf("requested %v", proto.CapabilityNames(flags&unsupported))
+	}
+	if flags&proto.CapIoctlDir == 0 {
+		t.Errorf("CapIoctlDir not requested: %v", proto.CapabilityNames(flags))
+	}
+	if !strings.Contains(logged.String(), "level=WARN") {
+		t.Errorf("no warning in %q", logged.String())
+	}
+}
+
+// ioctlFS answers every ioctl with no data.
+type ioctlFS struct{ *testFS }
+
+func (f ioctlFS) Ioctl(ctx Context, ino Inode, fh FileHandle, cmd uint32, arg uint64, in []byte, outSize uint32) ([]byte, error) {
+	return nil, nil
+}
+
+// Each optional interface the filesystem implements is reported, and
+// only that one.
+func TestCapabilitiesImplemented(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fs   Filesystem
+		want ServerCapabilities
+	}{
+		{"none", newTestFS(), ServerCapabilities{}},
+		{"statx", &sxFS{testFS: newTestFS()}, ServerCapabilities{Statx: true}},
+		{"poll", &pollFS{testFS: newTestFS()}, ServerCapabilities{Poll: true}},
+		{"ioctl", ioctlFS{newTestFS()}, ServerCapabilities{Ioctl: true}},
+		{"release flags", &locksFS{testFS: newTestFS()}, ServerCapabilities{ReleaseFlags: true}},
+		{"batch getattr", &batchFS{testFS: newTestFS()}, ServerCapabilities{BatchGetAttr: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := newTestConn(t, tc.fs, nil)
+			if got := k.s.Capabilities(); got != tc.want {
+				t.Errorf("before INIT: %+v, want %+v", got, tc.want)
+			}
+
+			go k.s.Serve()
+			k.handshake(0)
+			want := tc.want
+			want.Initialized = true
+			want.AsyncRead, want.Readdirplus, want.ParallelDirops = true, true, true
+			if got := k.s.Capabilities(); got != want {
+				t.Errorf("after INIT: %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// A kernel with a newer major is answered with ours and nothing else, and
+// its second INIT, speaking ours, is negotiated as usual.
+func TestInitNewerMajor(t *testing.T) {
+	k := newTestKernel(t, newTestFS(), nil)
+
+	in := proto.InitIn{
+		Major: proto.FuseKernelVersion + 1,
+		Flags: uint32(proto.CapAsyncRead),
+	}
+	out := wireStruct[proto.InitOut](t, k.mustCall(proto.OpInit, 0, wireBytes(&in)))
+	if out.Major != proto.FuseKernelVersion || out.Minor != proto.FuseKernelMinorVersion {
+		t.Errorf("answered %d.%d, want %d.%d", out.Major, out.Minor, proto.FuseKernelVersion, proto.FuseKernelMinorVersion)
+	}
+	if out.Flags != 0 || out.MaxWrite != 0 {
+		t.Errorf("flags %#x, max_write %d, want nothing negotiated", out.Flags, out.MaxWrite)
+	}
+	if k.s.Capabilities().Initialized {
+		t.Error("initialized by an INIT with a newer major")
+	}
+
+	if out := k.handshake(0); out.Flags&uint32(proto.CapAsyncRead) == 0 {
+		t.Errorf("second INIT: flags %#x without CapAsyncRead", out.Flags)
+	}
+	if !k.s.Capabilities().Initialized {
+		t.Error("not initialized by the second INIT")
+	}
+}
+
+// A kernel with an older major is refused.
+func TestInitOlderMajor(t *testing.T) {
+	k := newTestKernel(t, newTestFS(), nil)
+
+	in := proto.InitIn{Major: proto.FuseKernelVersion - 1, Minor: proto.FuseKernelMinorVersion}
+	if errno, _ := k.call(proto.OpInit, 0, wireBytes(&in)); syscall.Errno(-errno) != syscall.EPROTO {
+		t.Errorf("INIT %d.%d: errno %v, want EPROTO", in.Major, in.Minor, syscall.Errno(-errno))
+	}
+	if k.s.Capabilities().Initialized {
+		t.Error("initialized by an INIT with an older major")
+	}
+}
+
+// A second INIT on a set-up connection is refused and changes nothing.
+func TestInitRepeated(t *testing.T) {
+	k := newTestServer(t, newTestFS(), nil)
+	flags := k.s.NegotiatedFlags()
+
+	in := proto.InitIn{Major: proto.FuseKernelVersion, Minor: proto.FuseKernelMinorVersion}
+	if errno, _ := k.call(proto.OpInit, 0, wireBytes(&in)); syscall.Errno(-errno) != syscall.EPROTO {
+		t.Errorf("repeated INIT: errno %v, want EPROTO", syscall.Errno(-errno))
+	}
+	if got := k.s.NegotiatedFlags(); got != flags {
+		t.Errorf("negotiated %v after the repeated INIT, was %v", proto.CapabilityNames(got), proto.CapabilityNames(flags))
+	}
+	k.getattr(RootInode)
+}
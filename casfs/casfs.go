@@ -0,0 +1,291 @@
+// Package casfs serves a directory tree whose file contents live in a
+// content-addressed store, as a read-only rofuse filesystem.
+//
+// The tree is described by a manifest mapping each path to its mode,
+// size and the hashes of the blobs holding its data, in the manner of git
+// trees or OCI layers. The manifest provides the inodes and attributes;
+// file data is fetched from a BlobStore on demand. Large files can be
+// split into several chunks, each stored as its own blob, and identical
+// content is stored once however many files share it.
+package casfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/rofuse"
+	"github.com/KarpelesLab/rofuse/internal/tree"
+)
+
+// BlobStore fetches blob data by content hash.
+type BlobStore interface {
+	// GetAt reads len(p) bytes of the blob hash starting at off, with
+	// the semantics of io.ReaderAt. It is called concurrently.
+	GetAt(hash string, p []byte, off int64) (int, error)
+}
+
+// MapStore is a BlobStore holding blobs in memory, keyed by hash.
+type MapStore map[string][]byte
+
+// GetAt reads from the blob hash, or fails with ENOENT if there is none.
+func (m MapStore) GetAt(hash string, p []byte, off int64) (int, error) {
+	blob, ok := m[hash]
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+	if off >= int64(len(blob)) {
+		return 0, io.EOF
+	}
+	n := copy(p, blob[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Chunk is a piece of a file's content stored as one blob.
+type Chunk struct {
+	Hash string
+	Size int64
+}
+
+// Entry describes one path of the tree in the manifest.
+type Entry struct {
+	Path   string      // Slash-separated, relative to the root
+	Mode   os.FileMode // Type and permission bits
+	Size   int64       // File size; ignored for directories and symlinks
+	Hash   string      // Blob holding the whole content of a file
+	Chunks []Chunk     // Blobs holding the content in order; overrides Hash
+	Target string      // Symlink target
+	Mtime  time.Time
+	Uid    uint32
+	Gid    uint32
+}
+
+// content locates the data of a file in the store.
+type content struct {
+	chunks []Chunk
+	starts []int64 // File offset of each chunk
+}
+
+// node is a manifest entry placed in the tree.
+type node = tree.Node[content]
+
+// casFS implements rofuse.Filesystem over a manifest and a blob store.
+type casFS struct {
+	rofuse.FilesystemBase
+
+	store BlobStore
+	tree  *tree.Tree[content]
+}
+
+// New builds the tree described by manifest and serves it, reading file
+// data from store. Directories implied by the paths but missing from the
+// manifest are created with mode 0755. The manifest is checked up front:
+// paths must stay inside the root and appear once, and the chunks of a
+// file must add up to its size.
+func New(store BlobStore, manifest []Entry) (rofuse.Filesystem, error) {
+	fs := &casFS{store: store, tree: tree.New[content]()}
+	for i := range manifest {
+		if err := fs.add(&manifest[i]); err != nil {
+			return nil, fmt.Errorf("casfs: %s: %w", manifest[i].Path, err)
+		}
+	}
+	fs.tree.Sort()
+	return fs, nil
+}
+
+// dir returns the directory at p, making the ones the manifest leaves out.
+// It fails with ENOTDIR if a file is in the way.
+func (fs *casFS) dir(p string) (*node, error) {
+	cur := fs.tree.Root()
+	if p == "" {
+		return cur, nil
+	}
+	for _, part := range strings.Split(p, "/") {
+		next, ok := cur.Children[part]
+		if !ok {
+			next = fs.tree.NewNode(cur, os.ModeDir|0755)
+			cur.Children[part] = next
+		} else if !next.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// add places the manifest entry e in the tree.
+func (fs *casFS) add(e *Entry) error {
+	p, ok := tree.CleanPath(e.Path)
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	if e.Mode.IsDir() {
+		d, err := fs.dir(p)
+		if err != nil {
+			return err
+		}
+		d.Mode, d.Mtime, d.Uid, d.Gid = e.Mode, e.Mtime, e.Uid, e.Gid
+		return nil
+	}
+	if p == "" {
+		return syscall.EEXIST
+	}
+
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	parent, err := fs.dir(dir)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+	if _, ok := parent.Children[name]; ok {
+		return syscall.EEXIST
+	}
+
+	n := fs.tree.NewNode(parent, e.Mode)
+	n.Mtime, n.Uid, n.Gid = e.Mtime, e.Uid, e.Gid
+	parent.Children[name] = n
+
+	switch {
+	case e.Mode&os.ModeSymlink != 0:
+		n.Target = e.Target
+		n.Size = int64(len(e.Target))
+	case e.Mode.IsRegular():
+		n.Size = e.Size
+		c := &n.Data
+		c.chunks = e.Chunks
+		if len(c.chunks) == 0 && e.Hash != "" {
+			c.chunks = []Chunk{{Hash: e.Hash, Size: e.Size}}
+		}
+		var off int64
+		c.starts = make([]int64, len(c.chunks))
+		for i, chunk := range c.chunks {
+			c.starts[i] = off
+			off += chunk.Size
+		}
+		if off != e.Size {
+			return fmt.Errorf("chunks hold %d bytes, size is %d", off, e.Size)
+		}
+	}
+	return nil
+}
+
+// Lookup finds a child by name.
+func (fs *casFS) Lookup(ctx rofuse.Context, parent rofuse.Inode, name string) (*rofuse.Entry, error) {
+	return fs.tree.Lookup(parent, name)
+}
+
+// GetAttr returns the attributes the manifest gives an inode, with the
+// same timeout as Lookup.
+func (fs *casFS) GetAttr(ctx rofuse.Context, ino rofuse.Inode, fh *rofuse.FileHandle) (*rofuse.AttrResponse, error) {
+	return fs.tree.GetAttr(ino)
+}
+
+// ReadLink returns a symlink target.
+func (fs *casFS) ReadLink(ctx rofuse.Context, ino rofuse.Inode) (string, error) {
+	return fs.tree.ReadLink(ino)
+}
+
+// Open opens a file. Content never changes, so the page cache is kept.
+func (fs *casFS) Open(ctx rofuse.Context, ino rofuse.Inode, flags uint32) (*rofuse.OpenResponse, error) {
+	n, err := fs.tree.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, syscall.EISDIR
+	}
+	return &rofuse.OpenResponse{Flags: rofuse.OpenKeepCache}, nil
+}
+
+// Read reads file data, fetching it from each chunk the range covers.
+func (fs *casFS) Read(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]byte, error) {
+	n, err := fs.tree.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		return nil, syscall.EISDIR
+	}
+	if offset < 0 || offset >= n.Size {
+		return nil, nil
+	}
+	if remain := n.Size - offset; int64(size) > remain {
+		size = uint32(remain)
+	}
+	buf := make([]byte, size)
+
+	// The last chunk starting at or before offset holds it; empty chunks
+	// before it share its start and are skipped that way.
+	c := &n.Data
+	i := sort.Search(len(c.starts), func(i int) bool { return c.starts[i] > offset }) - 1
+	for done := 0; done < len(buf); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk := c.chunks[i]
+		off := offset + int64(done) - c.starts[i]
+		want := int(min(int64(len(buf)-done), chunk.Size-off))
+		got, err := fs.store.GetAt(chunk.Hash, buf[done:done+want], off)
+		if got < want {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("casfs: blob %s is shorter than %d bytes: %w", chunk.Hash, chunk.Size, io.ErrUnexpectedEOF)
+			}
+			return nil, err
+		}
+		done += want
+	}
+	return buf, nil
+}
+
+// ReadDir lists a directory of the manifest.
+func (fs *casFS) ReadDir(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]rofuse.DirEntry, error) {
+	l, err := fs.tree.Listing(ino)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadDir(offset), nil
+}
+
+// ReadDirPlus lists a directory of the manifest with the attributes of
+// each entry.
+func (fs *casFS) ReadDirPlus(ctx rofuse.Context, ino rofuse.Inode, fh rofuse.FileHandle, offset int64, size uint32) ([]rofuse.DirEntryPlus, error) {
+	l, err := fs.tree.Listing(ino)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadDirPlus(offset), nil
+}
+
+// StatFS reports the stored data in 512-byte blocks, counting each blob
+// once however many files share it, and the entry count.
+func (fs *casFS) StatFS(ctx rofuse.Context, ino rofuse.Inode) (*rofuse.StatFS, error) {
+	seen := make(map[string]bool)
+	var blocks uint64
+	for _, n := range fs.tree.Nodes {
+		for _, c := range n.Data.chunks {
+			if !seen[c.Hash] {
+				seen[c.Hash] = true
+				blocks += (uint64(c.Size) + 511) / 512
+			}
+		}
+	}
+	return &rofuse.StatFS{
+		Blocks:  blocks,
+		Files:   uint64(len(fs.tree.Nodes)),
+		Bsize:   512,
+		Namelen: 255,
+		Frsize:  512,
+	}, nil
+}
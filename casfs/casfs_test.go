@@ -0,0 +1,191 @@
+package casfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse"
+)
+
+// testContext is the context of a request from this process.
+type testContext struct {
+	context.Context
+}
+
+func (testContext) Uid() uint32      { return uint32(os.Getuid()) }
+func (testContext) Gid() uint32      { return uint32(os.Getgid()) }
+func (testContext) Pid() uint32      { return uint32(os.Getpid()) }
+func (testContext) Unique() uint64   { return 1 }
+func (testContext) Snapshot() uint64 { return 0 }
+
+var ctx rofuse.Context = testContext{context.Background()}
+
+var store = MapStore{
+	"h-hello": []byte("hello"),
+	"h-world": []byte(" world"),
+	"h-short": []byte("abc"),
+}
+
+var manifest = []Entry{
+	{Path: "docs", Mode: os.ModeDir | 0700, Uid: 1000},
+	{Path: "docs/hello.txt", Mode: 0644, Size: 5, Hash: "h-hello"},
+	{Path: "a/b/chunked", Mode: 0644, Size: 11, Chunks: []Chunk{
+		{Hash: "h-hello", Size: 5},
+		{Hash: "h-empty", Size: 0},
+		{Hash: "h-world", Size: 6},
+	}},
+	{Path: "missing", Mode: 0644, Size: 4, Hash: "h-none"},
+	{Path: "short", Mode: 0644, Size: 8, Hash: "h-short"},
+	{Path: "link", Mode: os.ModeSymlink | 0777, Target: "docs/hello.txt"},
+	{Path: "empty", Mode: 0644},
+}
+
+func newFS(t *testing.T) rofuse.Filesystem {
+	t.Helper()
+	fs, err := New(store, manifest)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return fs
+}
+
+// lookup looks up the path made of names from the root.
+func lookup(t *testing.T, fs rofuse.Filesystem, names ...string) *rofuse.Entry {
+	t.Helper()
+	e := &rofuse.Entry{Ino: rofuse.RootInode}
+	for _, name := range names {
+		var err error
+		if e, err = fs.Lookup(ctx, e.Ino, name); err != nil {
+			t.Fatalf("lookup %q: %v", names, err)
+		}
+	}
+	return e
+}
+
+func TestManifest(t *testing.T) {
+	fs := newFS(t)
+
+	docs := lookup(t, fs, "docs")
+	if docs.Attr.Mode != os.ModeDir|0700 || docs.Attr.Uid != 1000 {
+		t.Errorf("docs: mode %v uid %d", docs.Attr.Mode, docs.Attr.Uid)
+	}
+	// Directories the manifest leaves out are made up
+	for _, p := range [][]string{{"a"}, {"a", "b"}} {
+		if e := lookup(t, fs, p...); e.Attr.Mode != os.ModeDir|0755 {
+			t.Errorf("%q mode %v, want %v", p, e.Attr.Mode, os.ModeDir|0755)
+		}
+	}
+	if size := lookup(t, fs, "a", "b", "chunked").Attr.Size; size != 11 {
+		t.Errorf("chunked size %d, want 11", size)
+	}
+	link := lookup(t, fs, "link")
+	if target, err := fs.ReadLink(ctx, link.Ino); err != nil || target != "docs/hello.txt" {
+		t.Errorf("ReadLink = %q, %v", target, err)
+	}
+	if _, err := fs.Lookup(ctx, rofuse.RootInode, "nothing"); err != syscall.ENOENT {
+		t.Errorf("lookup of a missing name: %v, want ENOENT", err)
+	}
+
+	entries, err := fs.ReadDir(ctx, rofuse.RootInode, 0, 0, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".", "..", "a", "docs", "empty", "link", "missing", "short"}
+	if len(entries) != len(want) {
+		t.Fatalf("%d root entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Name != want[i] || e.Offset != uint64(i+1) {
+			t.Errorf("entry %d: %q at %d, want %q at %d", i, e.Name, e.Offset, want[i], i+1)
+		}
+	}
+}
+
+// Manifests that do not describe a tree are refused.
+func TestManifestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		manifest []Entry
+		want     error
+	}{
+		{"escape", []Entry{{Path: "../x", Mode: 0644}}, syscall.EINVAL},
+		{"inner escape", []Entry{{Path: "a/../../x", Mode: 0644}}, syscall.EINVAL},
+		{"duplicate", []Entry{{Path: "x", Mode: 0644}, {Path: "x", Mode: 0644}}, syscall.EEXIST},
+		{"file root", []Entry{{Path: "", Mode: 0644}}, syscall.EEXIST},
+		{"file parent", []Entry{{Path: "x", Mode: 0644}, {Path: "x/y", Mode: 0644}}, syscall.ENOTDIR},
+		{"chunk sizes", []Entry{{Path: "x", Mode: 0644, Size: 10, Chunks: []Chunk{{Hash: "h", Size: 4}}}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(store, tc.manifest)
+			if err == nil {
+				t.Fatal("New succeeded")
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("New: %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	fs := newFS(t)
+	chunked := lookup(t, fs, "a", "b", "chunked").Ino
+
+	for _, tc := range []struct {
+		off  int64
+		size uint32
+		want string
+	}{
+		{0, 100, "hello world"},
+		{3, 4, "lo w"}, // Across the empty chunk
+		{5, 3, " wo"},  // Starting at a chunk boundary
+		{10, 10, "d"},
+		{11, 10, ""},
+		{50, 10, ""},
+	} {
+		got, err := fs.Read(ctx, chunked, 0, tc.off, tc.size)
+		if err != nil || string(got) != tc.want {
+			t.Errorf("Read(%d, %d) = %q, %v, want %q", tc.off, tc.size, got, err, tc.want)
+		}
+	}
+
+	if got, err := fs.Read(ctx, lookup(t, fs, "empty").Ino, 0, 0, 10); err != nil || len(got) != 0 {
+		t.Errorf("Read of an empty file = %q, %v", got, err)
+	}
+	if _, err := fs.Read(ctx, lookup(t, fs, "docs").Ino, 0, 0, 10); err != syscall.EISDIR {
+		t.Errorf("Read of a directory: %v, want EISDIR", err)
+	}
+}
+
+// A blob the store does not have, or that is shorter than the manifest
+// says, fails the read instead of returning short data.
+func TestReadBlobErrors(t *testing.T) {
+	fs := newFS(t)
+
+	if _, err := fs.Read(ctx, lookup(t, fs, "missing").Ino, 0, 0, 4); err != syscall.ENOENT {
+		t.Errorf("Read of a missing blob: %v, want ENOENT", err)
+	}
+	short := lookup(t, fs, "short").Ino
+	if got, err := fs.Read(ctx, short, 0, 0, 2); err != nil || string(got) != "ab" {
+		t.Errorf("Read within the blob = %q, %v", got, err)
+	}
+	if _, err := fs.Read(ctx, short, 0, 0, 8); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Read past the blob: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestStatFS(t *testing.T) {
+	st, err := newFS(t).StatFS(ctx, rofuse.RootInode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// h-hello is shared by two files and counted once; the other blobs
+	// take a block each, but for the empty one
+	if st.Blocks != 4 {
+		t.Errorf("%d blocks, want 4", st.Blocks)
+	}
+}
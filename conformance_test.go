@@ -0,0 +1,344 @@
+//go:build integration
+
+package rofuse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// refNode is a file, directory or symlink of the reference tree.
+type refNode struct {
+	attr     Attr
+	data     []byte
+	target   string
+	children []string // Sorted names, for directories
+	denied   bool     // Access refuses every mask
+}
+
+// refFS serves a fixed tree from memory.
+type refFS struct {
+	FilesystemBase
+	nodes map[Inode]*refNode
+	names map[Inode]map[string]Inode
+}
+
+func newRefFS() *refFS {
+	fs := &refFS{
+		nodes: make(map[Inode]*refNode),
+		names: make(map[Inode]map[string]Inode),
+	}
+	fs.add(0, "", RootInode, &refNode{attr: Attr{Mode: os.ModeDir | 0755, Nlink: 2}})
+	fs.add(RootInode, "hello.txt", 2, &refNode{attr: Attr{Mode: 0644, Nlink: 1}, data: []byte("Hello, World!\n")})
+	fs.add(RootInode, "big.bin", 3, &refNode{attr: Attr{Mode: 0444, Nlink: 1}, data: pattern(3*65536 + 123)})
+	fs.add(RootInode, "link", 4, &refNode{attr: Attr{Mode: os.ModeSymlink | 0777, Nlink: 1}, target: "hello.txt"})
+	fs.add(RootInode, "sub", 5, &refNode{attr: Attr{Mode: os.ModeDir | 0755, Nlink: 2}})
+	fs.add(RootInode, "secret", 6, &refNode{attr: Attr{Mode: 0600, Nlink: 1}, data: []byte("no\n"), denied: true})
+	fs.add(5, "empty", 7, &refNode{attr: Attr{Mode: 0644, Nlink: 1}})
+	for i := 0; i < 200; i++ {
+		fs.add(5, fmt.Sprintf("f%03d", i), Inode(100+i), &refNode{attr: Attr{Mode: 0644, Nlink: 1}, data: []byte{byte(i)}})
+	}
+	return fs
+}
+
+func (fs *refFS) add(parent Inode, name string, ino Inode, n *refNode) {
+	n.attr.Ino = ino
+	n.attr.Size = uint64(len(n.data))
+	if n.target != "" {
+		n.attr.Size = uint64(len(n.target))
+	}
+	n.attr.Blocks = (n.attr.Size + 511) / 512
+	n.attr.Mtime = time.Unix(1700000000, 0)
+	n.attr.Atime = n.attr.Mtime
+	n.attr.Ctime = n.attr.Mtime
+	fs.nodes[ino] = n
+	if parent == 0 {
+		return
+	}
+	if fs.names[parent] == nil {
+		fs.names[parent] = make(map[string]Inode)
+	}
+	fs.names[parent][name] = ino
+	p := fs.nodes[parent]
+	p.children = append(p.children, name)
+	sort.Strings(p.children)
+}
+
+// pattern returns n bytes whose value depends on their offset.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
+
+func (fs *refFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	ino, ok := fs.names[parent][name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return &Entry{
+		Ino:          ino,
+		Attr:         fs.nodes[ino].attr,
+		AttrTimeout:  time.Second,
+		EntryTimeout: time.Second,
+	}, nil
+}
+
+func (fs *refFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	n, ok := fs.nodes[ino]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return &AttrResponse{Attr: n.attr, Timeout: time.Second}, nil
+}
+
+func (fs *refFS) ReadLink(ctx Context, ino Inode) (string, error) {
+	n, ok := fs.nodes[ino]
+	if !ok || n.target == "" {
+		return "", syscall.EINVAL
+	}
+	return n.target, nil
+}
+
+func (fs *refFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	n, ok := fs.nodes[ino]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if offset >= int64(len(n.data)) {
+		return nil, nil
+	}
+	end := min(offset+int64(size), int64(len(n.data)))
+	return n.data[offset:end], nil
+}
+
+func (fs *refFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	n, ok := fs.nodes[ino]
+	if !ok || !n.attr.Mode.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	var out []DirEntry
+	for i, name := range n.children {
+		if int64(i) < offset {
+			continue
+		}
+		child := fs.names[ino][name]
+		out = append(out, DirEntry{
+			Ino:    child,
+			Offset: uint64(i + 1),
+			Type:   refModeType(fs.nodes[child].attr.Mode),
+			Name:   name,
+		})
+	}
+	return out, nil
+}
+
+func (fs *refFS) Access(ctx Context, ino Inode, mask uint32) error {
+	if n, ok := fs.nodes[ino]; ok && n.denied {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+func refModeType(m os.FileMode) uint32 {
+	switch {
+	case m.IsDir():
+		return proto.DtDir
+	case m&os.ModeSymlink != 0:
+		return proto.DtLnk
+	default:
+		return proto.DtReg
+	}
+}
+
+// TestConformance mounts a reference tree and checks what the kernel serves
+// from it against POSIX read-only semantics: stat results, complete and
+// ordered listings, reads at offsets and past EOF, ENOENT, EACCES, symlinks
+// and EROFS.
+func TestConformance(t *testing.T) {
+	fs := newRefFS()
+	_, dir := mountTest(t, fs, &MountOptions{FSName: "rofuse-conformance"})
+	check := func(name string, err error) {
+		t.Run(name, func(t *testing.T) {
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	check("stat root", checkStat(filepath.Join(dir), fs.nodes[RootInode]))
+	check("stat file", checkStat(filepath.Join(dir, "hello.txt"), fs.nodes[2]))
+	check("stat large file", checkStat(filepath.Join(dir, "big.bin"), fs.nodes[3]))
+	check("stat directory", checkStat(filepath.Join(dir, "sub"), fs.nodes[5]))
+	check("lstat symlink", checkLstat(filepath.Join(dir, "link"), fs.nodes[4]))
+	check("stat through symlink", checkStat(filepath.Join(dir, "link"), fs.nodes[2]))
+
+	check("readdir root", checkReadDir(dir, fs.nodes[RootInode].children))
+	check("readdir large directory", checkReadDir(filepath.Join(dir, "sub"), fs.nodes[5].children))
+
+	check("read whole file", checkReadAll(filepath.Join(dir, "hello.txt"), fs.nodes[2].data))
+	check("read large file", checkReadAll(filepath.Join(dir, "big.bin"), fs.nodes[3].data))
+	check("read at offsets", checkReadAt(filepath.Join(dir, "big.bin"), fs.nodes[3].data))
+	check("read empty file", checkReadAll(filepath.Join(dir, "sub", "empty"), nil))
+	check("read at EOF", checkEOF(filepath.Join(dir, "hello.txt"), int64(len(fs.nodes[2].data))))
+	check("read through symlink", checkReadAll(filepath.Join(dir, "link"), fs.nodes[2].data))
+	check("readlink", checkReadlink(filepath.Join(dir, "link"), "hello.txt"))
+
+	check("missing file is ENOENT", wantErrno(os.Lstat(filepath.Join(dir, "missing"))))
+	check("missing nested file is ENOENT", wantErrno(os.Lstat(filepath.Join(dir, "sub", "missing"))))
+	check("denied access is EACCES", wantErrnoIs(syscall.Access(filepath.Join(dir, "secret"), 4), syscall.EACCES))
+	check("write is EROFS", wantErrnoIs(os.WriteFile(filepath.Join(dir, "new"), nil, 0644), syscall.EROFS))
+}
+
+func checkStat(path string, n *refNode) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return compareAttr(fi, n)
+}
+
+func checkLstat(path string, n *refNode) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return compareAttr(fi, n)
+}
+
+func compareAttr(fi os.FileInfo, n *refNode) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Ino != uint64(n.attr.Ino) {
+		return fmt.Errorf("ino %d, want %d", st.Ino, n.attr.Ino)
+	}
+	if fi.Mode() != n.attr.Mode {
+		return fmt.Errorf("mode %v, want %v", fi.Mode(), n.attr.Mode)
+	}
+	if uint64(fi.Size()) != n.attr.Size {
+		return fmt.Errorf("size %d, want %d", fi.Size(), n.attr.Size)
+	}
+	if uint64(st.Blocks) != n.attr.Blocks {
+		return fmt.Errorf("blocks %d, want %d", st.Blocks, n.attr.Blocks)
+	}
+	if uint32(st.Nlink) != n.attr.Nlink {
+		return fmt.Errorf("nlink %d, want %d", st.Nlink, n.attr.Nlink)
+	}
+	if !fi.ModTime().Equal(n.attr.Mtime) {
+		return fmt.Errorf("mtime %v, want %v", fi.ModTime(), n.attr.Mtime)
+	}
+	return nil
+}
+
+// checkReadDir lists path in small batches, so that the listing has to be
+// resumed from offsets, and compares it with want in order.
+func checkReadDir(path string, want []string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var got []string
+	for {
+		names, err := f.Readdirnames(7)
+		got = append(got, names...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(got) != len(want) {
+		return fmt.Errorf("%d entries, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return fmt.Errorf("entry %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+	return nil
+}
+
+func checkReadAll(path string, want []byte) error {
+	got, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read %d bytes not matching the %d expected", len(got), len(want))
+	}
+	return nil
+}
+
+func checkReadAt(path string, want []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, off := range []int64{0, 1, 4095, 4096, 65535, 65536, 131072 + 17, int64(len(want)) - 10} {
+		buf := make([]byte, 5000)
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("at %d: %w", off, err)
+		}
+		end := min(off+int64(len(buf)), int64(len(want)))
+		if !bytes.Equal(buf[:n], want[off:end]) {
+			return fmt.Errorf("at %d: got %d bytes not matching the %d expected", off, n, end-off)
+		}
+	}
+	return nil
+}
+
+func checkEOF(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, off := range []int64{size, size + 1, size + 100000} {
+		n, err := f.ReadAt(make([]byte, 16), off)
+		if n != 0 || err != io.EOF {
+			return fmt.Errorf("at %d: read %d bytes, err %v, want 0 and EOF", off, n, err)
+		}
+	}
+	return nil
+}
+
+func checkReadlink(path, want string) error {
+	got, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("target %q, want %q", got, want)
+	}
+	return nil
+}
+
+func wantErrno(_ os.FileInfo, err error) error {
+	return wantErrnoIs(err, syscall.ENOENT)
+}
+
+func wantErrnoIs(err error, want syscall.Errno) error {
+	if !errors.Is(err, want) {
+		return fmt.Errorf("got %v, want %v", err, want)
+	}
+	return nil
+}
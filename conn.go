@@ -1,13 +1,19 @@
 package rofuse
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
 )
 
 // connection manages /dev/fuse I/O.
@@ -15,8 +21,15 @@ type connection struct {
 	fd      int
 	mounted bool
 
-	// Serialized writes
-	writeMu sync.Mutex
+	// Held shared by writes and exclusively by close. Writes must not
+	// exclude each other: each is a whole message the kernel takes
+	// atomically, and a notification can block in the kernel until a
+	// reply written after it has been received.
+	writeMu sync.RWMutex
+
+	// Eventfd that ends reads once signalled (see newStoppableConnection),
+	// -1 if only unmounting does
+	wake int
 
 	// Protocol version negotiated during INIT
 	protoMajor uint32
@@ -28,14 +41,35 @@ func newConnection(fd int) *connection {
 	return &connection{
 		fd:      fd,
 		mounted: true,
+		wake:    -1,
 	}
 }
 
+// newStoppableConnection creates a connection whose reads also end, with
+// ErrNotMounted, once the eventfd wake is signalled. fd is made
+// non-blocking so that a read never waits for a request that another
+// descriptor of the mount has taken first; the connection waits in
+// poll(2) instead.
+func newStoppableConnection(fd, wake int) (*connection, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, fmt.Errorf("set non-blocking: %w", err)
+	}
+	c := newConnection(fd)
+	c.wake = wake
+	return c, nil
+}
+
 // readRequest reads the next FUSE request from the kernel.
+//
+// The kernel never truncates a request to fit: it refuses reads into
+// buffers smaller than requestBufferSize with EINVAL (ErrBufferTooSmall),
+// fails requests larger than the buffer with EIO itself, and sizes
+// BATCH_FORGETs to the buffer. checkRequest still rejects a header whose
+// length disagrees with what was read before anything parses the body.
 func (c *connection) readRequest(pool *bufferPool) (*request, error) {
 	buf := pool.get()
 
-	n, err := syscall.Read(c.fd, buf)
+	n, err := c.read(buf)
 	if err != nil {
 		pool.put(buf)
 		if err == syscall.ENODEV {
@@ -45,6 +79,11 @@ func (c *connection) readRequest(pool *bufferPool) (*request, error) {
 			// Interrupted, try again
 			return nil, err
 		}
+		if err == syscall.EINVAL {
+			// The kernel checks the buffer size before dequeuing
+			// anything, so no request was lost.
+			return nil, fmt.Errorf("read /dev/fuse: %w (buffer is %d bytes)", ErrBufferTooSmall, len(buf))
+		}
 		return nil, err
 	}
 
@@ -53,23 +92,141 @@ func (c *connection) readRequest(pool *bufferPool) (*request, error) {
 		return nil, io.ErrUnexpectedEOF
 	}
 
-	return newRequest(buf[:n], pool), nil
+	return newRequest(c, buf[:n], pool), nil
+}
+
+// read reads one message into buf. Without a wake eventfd the descriptor
+// is blocking and this is a plain read(2). Once the connection is closed
+// it fails with ENODEV, as reads do once the mount is gone.
+func (c *connection) read(buf []byte) (int, error) {
+	if c.wake < 0 {
+		fd := c.readFd()
+		if fd < 0 {
+			return 0, syscall.ENODEV
+		}
+		return syscall.Read(fd, buf)
+	}
+
+	// Held across the wait, so that close cannot free the descriptors
+	// for reuse while they are polled. It only comes once wake is
+	// signalled, which ends the wait.
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+	for {
+		if c.fd < 0 {
+			return 0, syscall.ENODEV
+		}
+		n, err := syscall.Read(c.fd, buf)
+		if err != syscall.EAGAIN {
+			return n, err
+		}
+		if err := c.waitReadable(c.fd); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readFd returns the descriptor to read from, or -1 once closed. close
+// may run while a blocking read is still going, e.g. when Unmount gives
+// up waiting for it.
+func (c *connection) readFd() int {
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+	return c.fd
+}
+
+// waitReadable waits until fd has a request or the wake eventfd is
+// signalled, in which case it returns ErrNotMounted.
+func (c *connection) waitReadable(fd int) error {
+	fds := []unix.PollFd{
+		{Fd: int32(fd), Events: unix.POLLIN},
+		{Fd: int32(c.wake), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fds[1].Revents != 0 {
+			return ErrNotMounted
+		}
+		// Readable, or an error that the read will report
+		return nil
+	}
 }
 
-// writeResponse writes a FUSE response to the kernel.
+// The system calls replies are written with, replaced by tests to make
+// them fail
+var (
+	sysWrite  = syscall.Write
+	sysWritev = unix.Writev
+)
+
+// writeResponse writes a FUSE response to the kernel, retrying if a
+// signal interrupts the write.
 func (c *connection) writeResponse(data []byte) error {
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+
+	// Late replies after close are dropped
+	if c.fd < 0 {
+		return nil
+	}
 
-	_, err := syscall.Write(c.fd, data)
-	if err == syscall.ENODEV {
+	for {
+		n, err := sysWrite(c.fd, data)
+		if err == syscall.EINTR {
+			continue
+		}
+		return writeResult(n, len(data), err)
+	}
+}
+
+// writeResult maps the outcome of writing a message of size bytes. The
+// kernel parses every write as one whole message, so the rest of a short
+// write cannot be sent on its own: it is reported as io.ErrShortWrite.
+func writeResult(n, size int, err error) error {
+	switch {
+	case err == syscall.ENODEV:
 		return ErrNotMounted
+	case err != nil:
+		return err
+	case n < size:
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// writeResponseVec writes a FUSE response made of a header and a payload
+// with a single writev(2), so the payload is not copied into a buffer of
+// its own first. The kernel takes both parts as one message, as with
+// writeResponse.
+func (c *connection) writeResponseVec(header, payload []byte) error {
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+
+	// Late replies after close are dropped
+	if c.fd < 0 {
+		return nil
+	}
+
+	for {
+		n, err := sysWritev(c.fd, [][]byte{header, payload})
+		if err == unix.EINTR {
+			continue
+		}
+		return writeResult(n, len(header)+len(payload), err)
 	}
-	return err
 }
 
 // close closes the connection.
 func (c *connection) close() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
 	if c.fd >= 0 {
 		err := syscall.Close(c.fd)
 		c.fd = -1
@@ -88,23 +245,59 @@ type request struct {
 	header *proto.InHeader
 	data   []byte // Full request data including header
 	pool   *bufferPool
+
+	// Connection the request was read from; the kernel only takes its
+	// reply there (see Server.ServeParallel)
+	conn *connection
+
+	// Snapshot token when the request was read (see Server.SetSnapshot)
+	snap uint64
+
+	// Context handed to the filesystem, created on first use
+	ctx *fuseContext
+
+	// Parent of ctx, cancelled by FUSE_INTERRUPT (see Server.track)
+	parent context.Context
+	cancel context.CancelFunc
+
+	// Ends the request's trace span (MountOptions.TraceStart)
+	traceEnd func(err error)
+
+	// Holders of the request: the handler, plus a pending Replier
+	refs    atomic.Int32
+	replier *Replier
+
+	// When the request arrived, if it is logged (MountOptions.Logger)
+	start time.Time
+
+	// Pooled reply buffers, returned on release (see readBuffer)
+	bufMu   sync.Mutex
+	buffers []pooledBuffer
 }
 
-// newRequest parses a FUSE request from raw data.
-func newRequest(data []byte, pool *bufferPool) *request {
+// pooledBuffer is a buffer from readBuffers[class].
+type pooledBuffer struct {
+	class int
+	buf   *[]byte
+}
+
+// newRequest parses a FUSE request read from conn.
+func newRequest(conn *connection, data []byte, pool *bufferPool) *request {
 	return &request{
 		header: (*proto.InHeader)(unsafe.Pointer(&data[0])),
 		data:   data,
 		pool:   pool,
+		conn:   conn,
 	}
 }
 
-// body returns the request body (data after the header).
-func (r *request) body() unsafe.Pointer {
-	if len(r.data) <= proto.InHeaderSize {
-		return nil
+// bodyAs returns the request body for a cast to a struct of size bytes,
+// or false when the kernel sent less than that.
+func (r *request) bodyAs(size int) (unsafe.Pointer, bool) {
+	if size <= 0 || len(r.data)-proto.InHeaderSize < size {
+		return nil, false
 	}
-	return unsafe.Pointer(&r.data[proto.InHeaderSize])
+	return unsafe.Pointer(&r.data[proto.InHeaderSize]), true
 }
 
 // bodyBytes returns the request body as a byte slice.
@@ -130,12 +323,48 @@ func (r *request) filename() string {
 	return string(body)
 }
 
+// endTrace ends the request's trace span, if any, with the outcome of the
+// request. Only the first call has an effect.
+func (r *request) endTrace(err error) {
+	if r.traceEnd != nil {
+		end := r.traceEnd
+		r.traceEnd = nil
+		end(err)
+	}
+}
+
+// compact moves the request out of its pool buffer into one of its own
+// size, so that a request left waiting in a queue does not hold a buffer
+// sized for the largest write.
+func (r *request) compact() {
+	if r.pool == nil || r.data == nil {
+		return
+	}
+	data := slices.Clone(r.data)
+	r.pool.put(r.data[:cap(r.data)])
+	r.data, r.pool = data, nil
+	r.header = (*proto.InHeader)(unsafe.Pointer(&data[0]))
+}
+
 // release returns the request buffer to the pool.
 func (r *request) release() {
 	if r.pool != nil && r.data != nil {
 		r.pool.put(r.data[:cap(r.data)])
 		r.data = nil
 	}
+	r.bufMu.Lock()
+	for _, b := range r.buffers {
+		readBuffers[b.class].Put(b.buf)
+	}
+	r.buffers = nil
+	r.bufMu.Unlock()
+}
+
+// addBuffer records a pooled buffer used for the reply to r.
+func (r *request) addBuffer(class int, buf *[]byte) {
+	r.bufMu.Lock()
+	r.buffers = append(r.buffers, pooledBuffer{class, buf})
+	r.bufMu.Unlock()
 }
 
 // response builds a FUSE response.
@@ -0,0 +1,120 @@
+package rofuse
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeWrites makes the first len(errs) writes fail with errs in order,
+// and later ones go through. The real calls are put back when the test
+// ends.
+func fakeWrites(t *testing.T, errs ...error) *int {
+	t.Helper()
+	calls := new(int)
+	fail := func() (bool, error) {
+		*calls++
+		if *calls > len(errs) {
+			return false, nil
+		}
+		return true, errs[*calls-1]
+	}
+	write, writev := sysWrite, sysWritev
+	sysWrite = func(fd int, p []byte) (int, error) {
+		if ok, err := fail(); ok {
+			return 0, err
+		}
+		return write(fd, p)
+	}
+	sysWritev = func(fd int, iovs [][]byte) (int, error) {
+		if ok, err := fail(); ok {
+			return 0, err
+		}
+		return writev(fd, iovs)
+	}
+	t.Cleanup(func() { sysWrite, sysWritev = write, writev })
+	return calls
+}
+
+// newTestPair returns a connection on one end of a socket pair and the
+// other end.
+func newTestPair(t *testing.T) (*connection, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	c := newConnection(fds[0])
+	t.Cleanup(func() {
+		c.close()
+		unix.Close(fds[1])
+	})
+	return c, fds[1]
+}
+
+// A write interrupted by a signal is made again, as one whole message.
+func TestWriteResponseEINTR(t *testing.T) {
+	for _, vec := range []bool{false, true} {
+		c, peer := newTestPair(t)
+		calls := fakeWrites(t, syscall.EINTR, syscall.EINTR)
+
+		var err error
+		if vec {
+			err = c.writeResponseVec([]byte("head"), []byte("payload"))
+		} else {
+			err = c.writeResponse([]byte("headpayload"))
+		}
+		if err != nil {
+			t.Errorf("vec %v: %v", vec, err)
+		}
+		if *calls != 3 {
+			t.Errorf("vec %v: %d calls, want 3", vec, *calls)
+		}
+		buf := make([]byte, 64)
+		n, err := unix.Read(peer, buf)
+		if err != nil || string(buf[:n]) != "headpayload" {
+			t.Errorf("vec %v: peer read %q, %v", vec, buf[:max(n, 0)], err)
+		}
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		err  error
+		want error
+	}{
+		{10, nil, nil},
+		{4, nil, io.ErrShortWrite},
+		{0, nil, io.ErrShortWrite},
+		{0, syscall.ENODEV, ErrNotMounted},
+		{0, syscall.ENOENT, syscall.ENOENT}, // The request was interrupted
+	} {
+		if err := writeResult(tc.n, 10, tc.err); !errors.Is(err, tc.want) {
+			t.Errorf("writeResult(%d, 10, %v) = %v, want %v", tc.n, tc.err, err, tc.want)
+		}
+	}
+
+	// Both write paths report what writeResult makes of the call
+	c, _ := newTestPair(t)
+	fakeWrites(t, syscall.ENODEV, syscall.ENODEV)
+	if err := c.writeResponse([]byte("x")); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("writeResponse = %v, want ErrNotMounted", err)
+	}
+	if err := c.writeResponseVec([]byte("x"), []byte("y")); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("writeResponseVec = %v, want ErrNotMounted", err)
+	}
+
+	// The rest of a short write is not sent on its own
+	sysWrite = func(fd int, p []byte) (int, error) { return len(p) - 1, nil }
+	sysWritev = func(fd int, iovs [][]byte) (int, error) { return len(iovs[0]), nil }
+	if err := c.writeResponse([]byte("xy")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("short writeResponse = %v, want io.ErrShortWrite", err)
+	}
+	if err := c.writeResponseVec([]byte("x"), []byte("y")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("short writeResponseVec = %v, want io.ErrShortWrite", err)
+	}
+}
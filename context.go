@@ -19,6 +19,10 @@ type Context interface {
 
 	// Unique returns the unique request ID.
 	Unique() uint64
+
+	// Snapshot returns the snapshot token the request was issued under
+	// (see Server.SetSnapshot). It is fixed when the request arrives.
+	Snapshot() uint64
 }
 
 // fuseContext implements Context.
@@ -28,20 +32,27 @@ type fuseContext struct {
 	gid    uint32
 	pid    uint32
 	unique uint64
+	snap   uint64
+
+	// Set for contexts of server requests, for AsyncReplier
+	srv *Server
+	req *request
 }
 
-func (c *fuseContext) Uid() uint32    { return c.uid }
-func (c *fuseContext) Gid() uint32    { return c.gid }
-func (c *fuseContext) Pid() uint32    { return c.pid }
-func (c *fuseContext) Unique() uint64 { return c.unique }
+func (c *fuseContext) Uid() uint32      { return c.uid }
+func (c *fuseContext) Gid() uint32      { return c.gid }
+func (c *fuseContext) Pid() uint32      { return c.pid }
+func (c *fuseContext) Unique() uint64   { return c.unique }
+func (c *fuseContext) Snapshot() uint64 { return c.snap }
 
 // newContext creates a FUSE context from request header.
-func newContext(parent context.Context, uid, gid, pid uint32, unique uint64) Context {
+func newContext(parent context.Context, uid, gid, pid uint32, unique, snap uint64) Context {
 	return &fuseContext{
 		Context: parent,
 		uid:     uid,
 		gid:     gid,
 		pid:     pid,
 		unique:  unique,
+		snap:    snap,
 	}
 }
@@ -0,0 +1,22 @@
+package rofuse
+
+// Device numbers in Attr.Rdev use the kernel's 32-bit encoding
+// (new_encode_dev): the low 8 bits of the minor, then 12 bits of major,
+// then the remaining 12 bits of the minor. This is not the glibc dev_t
+// layout of stat(2) results, which unix.Major and unix.Minor decode.
+
+// Makedev packs a major and minor device number into an Attr.Rdev value.
+// major is limited to 12 bits and minor to 20, as in the kernel.
+func Makedev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major&0xfff)<<8 | (minor&0xfff00)<<12
+}
+
+// Major returns the major device number of an Attr.Rdev value.
+func Major(rdev uint32) uint32 {
+	return (rdev & 0xfff00) >> 8
+}
+
+// Minor returns the minor device number of an Attr.Rdev value.
+func Minor(rdev uint32) uint32 {
+	return (rdev & 0xff) | (rdev>>12)&0xfff00
+}
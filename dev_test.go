@@ -0,0 +1,45 @@
+package rofuse
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMakedev(t *testing.T) {
+	for _, tc := range []struct {
+		major, minor uint32
+		rdev         uint32
+	}{
+		{1, 3, 0x103}, // /dev/null
+		{0, 0, 0},
+		{259, 0x12345, 0x12310345}, // Minor above 8 bits goes to the top
+		{0xfff, 0xfffff, 0xffffffff},
+	} {
+		rdev := Makedev(tc.major, tc.minor)
+		if rdev != tc.rdev {
+			t.Errorf("Makedev(%d, %#x) = %#x, want %#x", tc.major, tc.minor, rdev, tc.rdev)
+		}
+		if major, minor := Major(rdev), Minor(rdev); major != tc.major || minor != tc.minor {
+			t.Errorf("%#x decodes to %d, %#x, want %d, %#x", rdev, major, minor, tc.major, tc.minor)
+		}
+	}
+
+	// Bits beyond the widths the kernel keeps are dropped
+	if rdev := Makedev(0x1001, 0x100003); rdev != 0x103 {
+		t.Errorf("Makedev of oversized numbers = %#x, want 0x103", rdev)
+	}
+}
+
+// The device number of a stat(2) result is re-encoded for the kernel.
+func TestAttrFromFileInfoRdev(t *testing.T) {
+	fi, err := os.Lstat("/dev/null")
+	if err != nil {
+		t.Skip(err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		t.Skipf("/dev/null is %v, not a character device", fi.Mode())
+	}
+	if rdev := AttrFromFileInfo(fi).Rdev; rdev != Makedev(1, 3) {
+		t.Errorf("/dev/null rdev %#x (%d, %d), want 1, 3", rdev, Major(rdev), Minor(rdev))
+	}
+}
@@ -0,0 +1,401 @@
+package rofuse
+
+import (
+	"cmp"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// PrependDotEntries returns entries preceded by "." (ino) and ".."
+// (parentIno), both typed DT_DIR. The dot entries get offsets 1 and 2 and
+// the offsets of entries are shifted up by 2, so a ReadDir that numbers
+// its entries from 1 can build the full listing with this helper and then
+// skip every entry whose Offset is not greater than the offset it was
+// called with.
+//
+// Whether ReadDir returns "." and ".." is up to the filesystem: the
+// kernel passes whatever it gets to getdents(2), and many tools (find,
+// fts-based walkers) expect both to be present. See also
+// MountOptions.SynthesizeDotEntries.
+func PrependDotEntries(ino, parentIno Inode, entries []DirEntry) []DirEntry {
+	result := make([]DirEntry, 0, len(entries)+2)
+	result = append(result,
+		DirEntry{Ino: ino, Offset: 1, Type: proto.DtDir, Name: "."},
+		DirEntry{Ino: parentIno, Offset: 2, Type: proto.DtDir, Name: ".."},
+	)
+	for _, e := range entries {
+		e.Offset += 2
+		result = append(result, e)
+	}
+	return result
+}
+
+// DirListing is the complete listing of a directory, "." and ".."
+// included, for filesystems that keep their directories in memory. Its
+// ReadDir and ReadDirPlus serve it from the offset the kernel asks for:
+// entry i goes out with offset i+1, so the listing must keep its order for
+// as long as the directory can be read.
+type DirListing []DirEntryPlus
+
+// ReadDir returns the entries of l from offset on, typed after their mode
+// (or Type, for modes that have none).
+func (l DirListing) ReadDir(offset int64) []DirEntry {
+	if offset < 0 || offset >= int64(len(l)) {
+		return nil
+	}
+	result := make([]DirEntry, 0, int64(len(l))-offset)
+	for i := offset; i < int64(len(l)); i++ {
+		result = append(result, DirEntry{
+			Ino:    l[i].Entry.Ino,
+			Offset: uint64(i + 1),
+			Type:   direntPlusType(&l[i]),
+			Name:   l[i].Name,
+		})
+	}
+	return result
+}
+
+// ReadDirPlus returns the entries of l from offset on.
+func (l DirListing) ReadDirPlus(offset int64) []DirEntryPlus {
+	if offset < 0 || offset >= int64(len(l)) {
+		return nil
+	}
+	result := slices.Clone(l[offset:])
+	for i := range result {
+		result[i].Offset = uint64(offset) + uint64(i) + 1
+	}
+	return result
+}
+
+// isDotName reports whether name is "." or "..".
+func isDotName(name string) bool {
+	return name == "." || name == ".."
+}
+
+// openDirs gives open directories handles of the server's own while it
+// keeps state for them (MountOptions.SynthesizeDotEntries and
+// StableDirOrder). The filesystem's handles cannot key that state: they
+// need not be unique, and FilesystemBase leaves every one of them 0. The
+// kernel is given the server's handle instead, which maps back to the
+// filesystem's handle and to the state of that one open directory.
+type openDirs struct {
+	mu   sync.Mutex
+	next uint64
+	dirs map[uint64]*openDir
+}
+
+// openDir is one open directory.
+type openDir struct {
+	fh FileHandle // The filesystem's handle
+
+	mu      sync.Mutex
+	dots    bool       // "." and ".." are injected
+	listing []DirEntry // Sorted listing, nil until taken
+}
+
+// open registers a directory the filesystem opened as fh and returns the
+// handle to give the kernel.
+func (t *openDirs) open(fh FileHandle) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dirs == nil {
+		t.dirs = make(map[uint64]*openDir)
+	}
+	t.next++
+	t.dirs[t.next] = &openDir{fh: fh}
+	return t.next
+}
+
+// get returns the open directory the kernel knows as handle. A handle the
+// server did not give out, such as one from the process that passed a
+// descriptor to NewServerFromFd, is taken as the filesystem's own.
+func (t *openDirs) get(handle uint64) *openDir {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d, ok := t.dirs[handle]; ok {
+		return d
+	}
+	return &openDir{fh: FileHandle(handle)}
+}
+
+// release forgets handle and returns its open directory, as get does.
+func (t *openDirs) release(handle uint64) *openDir {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d, ok := t.dirs[handle]; ok {
+		delete(t.dirs, handle)
+		return d
+	}
+	return &openDir{fh: FileHandle(handle)}
+}
+
+// keepsDirState reports whether the server keeps state for open
+// directories.
+func (s *Server) keepsDirState() bool {
+	return s.opts.SynthesizeDotEntries || s.opts.StableDirOrder
+}
+
+// dirHandle returns the filesystem's handle for the directory handle the
+// kernel sent.
+func (s *Server) dirHandle(handle uint64) FileHandle {
+	if !s.keepsDirState() {
+		return FileHandle(handle)
+	}
+	return s.dirs.get(handle).fh
+}
+
+// synthDots reports whether "." and ".." are injected into the listing,
+// as decided when it was read from offset 0.
+func (d *openDir) synthDots() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dots
+}
+
+func (d *openDir) setSynthDots(synth bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dots = synth
+}
+
+// fsDirOffset maps a kernel readdir offset to the filesystem's offset when
+// dot entries are injected: the two synthetic entries take offsets 1 and 2
+// and everything from the filesystem is shifted up by 2.
+func fsDirOffset(offset int64, synth bool) int64 {
+	if !synth {
+		return offset
+	}
+	return max(offset-2, 0)
+}
+
+// readDirDots serves READDIR with "." and ".." injected when the
+// filesystem's listing (as seen at offset 0) lacks them.
+func (s *Server) readDirDots(ctx Context, ino Inode, d *openDir, offset int64, size uint32) ([]DirEntry, error) {
+	synth := offset != 0 && d.synthDots()
+
+	entries, err := s.fs.ReadDir(ctx, ino, d.fh, fsDirOffset(offset, synth), size)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 {
+		synth = true
+		for _, e := range entries {
+			if isDotName(e.Name) {
+				synth = false
+				break
+			}
+		}
+		d.setSynthDots(synth)
+	}
+	if !synth {
+		return entries, nil
+	}
+
+	entries = PrependDotEntries(ino, s.nodes.parent(ino), entries)
+	if offset > 0 {
+		entries = entries[min(offset, 2):]
+	}
+	return entries, nil
+}
+
+// readDirPlusDots is the READDIRPLUS counterpart of readDirDots.
+func (s *Server) readDirPlusDots(ctx Context, ino Inode, d *openDir, offset int64, size uint32) ([]DirEntryPlus, error) {
+	synth := offset != 0 && d.synthDots()
+
+	entries, err := s.fs.ReadDirPlus(ctx, ino, d.fh, fsDirOffset(offset, synth), size)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 {
+		synth = true
+		for i := range entries {
+			if isDotName(entries[i].Name) {
+				synth = false
+				break
+			}
+		}
+		d.setSynthDots(synth)
+	}
+	if !synth {
+		return entries, nil
+	}
+
+	result := make([]DirEntryPlus, 0, len(entries)+2)
+	if offset < 1 {
+		result = append(result, dotEntryPlus(".", ino, 1))
+	}
+	if offset < 2 {
+		result = append(result, dotEntryPlus("..", s.nodes.parent(ino), 2))
+	}
+	for _, e := range entries {
+		e.Offset += 2
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// dotEntryPlus builds a "." or ".." entry for READDIRPLUS. The kernel does
+// not instantiate these, so only the inode and directory type matter.
+func dotEntryPlus(name string, ino Inode, offset uint64) DirEntryPlus {
+	return DirEntryPlus{
+		Name:   name,
+		Offset: offset,
+		Entry: Entry{
+			Ino:  ino,
+			Attr: Attr{Ino: ino, Mode: os.ModeDir | 0755},
+		},
+	}
+}
+
+// maxListingCalls caps the ReadDir calls made to snapshot one directory, in
+// case the filesystem never reports the end of the listing.
+const maxListingCalls = 1 << 16
+
+// stableListing returns the sorted listing of an open directory, reading
+// the whole directory from the filesystem when offset is 0 or no listing
+// was taken yet. Entries are ordered by name, "." and ".." first, and
+// numbered from 1 so the kernel's offsets index the listing.
+func (s *Server) stableListing(ctx Context, ino Inode, d *openDir, offset int64, size uint32) ([]DirEntry, error) {
+	d.mu.Lock()
+	listing := d.listing
+	d.mu.Unlock()
+	if offset != 0 && listing != nil {
+		return listing, nil
+	}
+
+	var all []DirEntry
+	var off int64
+	for range maxListingCalls {
+		entries, err := s.fs.ReadDir(ctx, ino, d.fh, off, size)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		all = append(all, entries...)
+
+		next := int64(entries[len(entries)-1].Offset)
+		if next == off {
+			// No progress, the filesystem ignores offsets
+			break
+		}
+		off = next
+	}
+
+	hasDots := slices.ContainsFunc(all, func(e DirEntry) bool { return isDotName(e.Name) })
+	if s.opts.SynthesizeDotEntries && !hasDots {
+		all = PrependDotEntries(ino, s.nodes.parent(ino), all)
+	}
+
+	slices.SortStableFunc(all, func(a, b DirEntry) int {
+		if da, db := isDotName(a.Name), isDotName(b.Name); da != db {
+			if da {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	for i := range all {
+		all[i].Offset = uint64(i + 1)
+	}
+
+	if all == nil {
+		all = []DirEntry{}
+	}
+	d.mu.Lock()
+	d.listing = all
+	d.mu.Unlock()
+	return all, nil
+}
+
+// readDirStable serves READDIR from the sorted listing.
+func (s *Server) readDirStable(ctx Context, ino Inode, d *openDir, offset int64, size uint32) ([]DirEntry, error) {
+	all, err := s.stableListing(ctx, ino, d, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset >= int64(len(all)) {
+		return nil, nil
+	}
+	return all[offset:], nil
+}
+
+// readDirPlusStable serves READDIRPLUS from the sorted listing.
+func (s *Server) readDirPlusStable(ctx Context, ino Inode, d *openDir, offset int64, size uint32) ([]DirEntryPlus, error) {
+	entries, err := s.readDirStable(ctx, ino, d, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	return direntsAsPlus(entries), nil
+}
+
+// readDir lists a directory for READDIR, in the order and with the dot
+// entries the mount options ask for. handle is the one the kernel sent.
+func (s *Server) readDir(ctx Context, ino Inode, handle uint64, offset int64, size uint32) ([]DirEntry, error) {
+	switch {
+	case s.opts.StableDirOrder:
+		return s.readDirStable(ctx, ino, s.dirs.get(handle), offset, size)
+	case s.opts.SynthesizeDotEntries:
+		return s.readDirDots(ctx, ino, s.dirs.get(handle), offset, size)
+	}
+	return s.fs.ReadDir(ctx, ino, FileHandle(handle), offset, size)
+}
+
+// readDirPlus is the READDIRPLUS counterpart of readDir.
+func (s *Server) readDirPlus(ctx Context, ino Inode, handle uint64, offset int64, size uint32) ([]DirEntryPlus, error) {
+	switch {
+	case s.opts.StableDirOrder:
+		return s.readDirPlusStable(ctx, ino, s.dirs.get(handle), offset, size)
+	case s.opts.SynthesizeDotEntries:
+		return s.readDirPlusDots(ctx, ino, s.dirs.get(handle), offset, size)
+	}
+	return s.fs.ReadDirPlus(ctx, ino, FileHandle(handle), offset, size)
+}
+
+// readDirAsPlus serves READDIRPLUS from readDir, for filesystems without
+// ReadDirPlus.
+func (s *Server) readDirAsPlus(ctx Context, ino Inode, handle uint64, offset int64, size uint32) ([]DirEntryPlus, error) {
+	entries, err := s.readDir(ctx, ino, handle, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	return direntsAsPlus(entries), nil
+}
+
+// direntsAsPlus converts READDIR entries for READDIRPLUS. They only have
+// names and types, so they are sent with node id 0, which the kernel
+// lists without instantiating; it looks each name up when it is used.
+func direntsAsPlus(entries []DirEntry) []DirEntryPlus {
+	plus := make([]DirEntryPlus, len(entries))
+	for i, e := range entries {
+		plus[i] = DirEntryPlus{
+			Name:   e.Name,
+			Offset: e.Offset,
+			Type:   e.Type,
+			Entry:  Entry{Attr: Attr{Ino: e.Ino, Mode: typeToFileMode(e.Type)}},
+		}
+	}
+	return plus
+}
+
+// minDirReadSize is the smallest MaxDirReadSize honoured, room for the
+// largest READDIRPLUS entry (a 255-byte name).
+const minDirReadSize = 1024
+
+// dirReadSize returns the buffer size to list a directory with for a
+// kernel request of size bytes, clamped to MountOptions.MaxDirReadSize.
+func (s *Server) dirReadSize(size uint32) uint32 {
+	limit := s.opts.MaxDirReadSize
+	if limit == 0 {
+		return size
+	}
+	return min(size, max(limit, minDirReadSize))
+}
@@ -0,0 +1,165 @@
+package rofuse
+
+import (
+	"os"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func direntNames(entries []DirEntry) []string {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func TestPrependDotEntries(t *testing.T) {
+	entries := PrependDotEntries(5, 2, []DirEntry{{Ino: 9, Offset: 1, Type: proto.DtReg, Name: "a"}})
+	want := []DirEntry{
+		{Ino: 5, Offset: 1, Type: proto.DtDir, Name: "."},
+		{Ino: 2, Offset: 2, Type: proto.DtDir, Name: ".."},
+		{Ino: 9, Offset: 3, Type: proto.DtReg, Name: "a"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %v, want %v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestSynthesizeDotEntries(t *testing.T) {
+	fs := newTestFS()
+	dir := fs.mkdir(RootInode, "dir")
+	fs.create(dir, "file", nil)
+	k := newTestServer(t, fs, &MountOptions{SynthesizeDotEntries: true})
+
+	k.lookup(RootInode, "dir")
+	fh := k.opendir(dir)
+	entries := k.readdir(dir, fh, 0)
+	if len(entries) != 3 {
+		t.Fatalf("got %v, want ., .. and file", direntNames(entries))
+	}
+	for i, want := range []struct {
+		name string
+		ino  Inode
+	}{{".", dir}, {"..", RootInode}} {
+		e := entries[i]
+		if e.Name != want.name || e.Ino != want.ino || e.Type != proto.DtDir {
+			t.Errorf("entry %d = %+v, want %q ino %d DT_DIR", i, e, want.name, want.ino)
+		}
+	}
+
+	// Resuming past the dot entries gives the rest only
+	rest := k.readdir(dir, fh, 2)
+	if len(rest) != 1 || rest[0].Name != "file" {
+		t.Errorf("from offset 2: got %v, want [file]", direntNames(rest))
+	}
+}
+
+// Filesystems that leave every directory handle 0 still get state per
+// open directory.
+func TestStableDirOrderPerHandle(t *testing.T) {
+	fs := newTestFS()
+	for _, name := range []string{"c", "a", "b"} {
+		fs.create(RootInode, name, nil)
+	}
+	k := newTestServer(t, fs, &MountOptions{StableDirOrder: true})
+
+	h1 := k.opendir(RootInode)
+	if got := direntNames(k.readdir(RootInode, h1, 0)); len(got) != 3 || got[0] != "a" {
+		t.Fatalf("first listing = %v, want [a b c]", got)
+	}
+
+	// A second open after the directory changed sees the change...
+	fs.create(RootInode, "aa", nil)
+	h2 := k.opendir(RootInode)
+	if h1 == h2 {
+		t.Fatalf("both opens got handle %d", h1)
+	}
+	if got := direntNames(k.readdir(RootInode, h2, 0)); len(got) != 4 || got[1] != "aa" {
+		t.Fatalf("second listing = %v, want [a aa b c]", got)
+	}
+
+	// ...while the first one resumes its own listing, also after the
+	// second one is closed
+	if got := direntNames(k.readdir(RootInode, h1, 1)); len(got) != 2 || got[0] != "b" {
+		t.Errorf("first listing from 1 = %v, want [b c]", got)
+	}
+	k.mustCall(proto.OpReleasedir, uint64(RootInode), wireBytes(&proto.ReleaseIn{Fh: h2}))
+	if got := direntNames(k.readdir(RootInode, h1, 2)); len(got) != 1 || got[0] != "c" {
+		t.Errorf("first listing from 2 = %v, want [c]", got)
+	}
+}
+
+// The cookie of each READDIRPLUS entry is its Offset, not anything from
+// its attributes, and Type stands in for a mode without a type.
+func TestSerializeDirentsPlusOffsets(t *testing.T) {
+	opts := &MountOptions{}
+	setDefaults(opts)
+	entries := []DirEntryPlus{
+		{Entry: Entry{Ino: 5, Generation: 77, Attr: Attr{Ino: 5, Mode: os.ModeDir | 0o755}}, Offset: 1, Name: "dir"},
+		{Entry: Entry{Ino: 6, Generation: 88, Attr: Attr{Ino: 6, Mode: os.ModeIrregular}}, Offset: 1 << 40, Type: proto.DtLnk, Name: "link"},
+	}
+	buf, n := serializeDirentsPlus(entries, 4096, opts)
+	if n != 2 {
+		t.Fatalf("serialized %d entries, want 2", n)
+	}
+	got := parseDirentsPlus(t, buf)
+	if len(got) != 2 {
+		t.Fatalf("parsed %d entries, want 2", len(got))
+	}
+	for i, want := range []DirEntry{
+		{Ino: 5, Offset: 1, Type: proto.DtDir, Name: "dir"},
+		{Ino: 6, Offset: 1 << 40, Type: proto.DtLnk, Name: "link"},
+	} {
+		if got[i].DirEntry != want {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i].DirEntry, want)
+		}
+		if gen := got[i].Entry.Generation; gen != entries[i].Entry.Generation {
+			t.Errorf("entry %d generation %d, want %d", i, gen, entries[i].Entry.Generation)
+		}
+	}
+}
+
+// A DirListing hands out offsets by position and types entries after
+// their mode.
+func TestDirListing(t *testing.T) {
+	l := DirListing{
+		{Entry: Entry{Ino: 1, Attr: Attr{Mode: os.ModeDir | 0755}}, Name: "."},
+		{Entry: Entry{Ino: 1, Attr: Attr{Mode: os.ModeDir | 0755}}, Name: ".."},
+		{Entry: Entry{Ino: 2, Attr: Attr{Mode: 0644}}, Name: "file"},
+		{Entry: Entry{Ino: 3, Attr: Attr{Mode: os.ModeIrregular}}, Type: proto.DtSock, Name: "odd"},
+	}
+
+	entries := l.ReadDir(2)
+	want := []DirEntry{
+		{Ino: 2, Offset: 3, Type: proto.DtReg, Name: "file"},
+		{Ino: 3, Offset: 4, Type: proto.DtSock, Name: "odd"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ReadDir(2) = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	plus := l.ReadDirPlus(1)
+	if len(plus) != 3 || plus[0].Name != ".." || plus[0].Offset != 2 || plus[2].Offset != 4 {
+		t.Errorf("ReadDirPlus(1) = %+v", plus)
+	}
+	if l[1].Offset != 0 {
+		t.Error("ReadDirPlus changed the listing")
+	}
+	for _, off := range []int64{-1, 4, 10} {
+		if n := len(l.ReadDir(off)) + len(l.ReadDirPlus(off)); n != 0 {
+			t.Errorf("%d entries from offset %d", n, off)
+		}
+	}
+}
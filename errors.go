@@ -18,6 +18,52 @@ var (
 
 	// ErrServerClosed is returned when the server is closed.
 	ErrServerClosed = errors.New("server closed")
+
+	// ErrAlreadyServing is returned by Serve, ServeParallel and
+	// ServeBackground when the server's loop was already started.
+	ErrAlreadyServing = errors.New("server already serving")
+
+	// ErrFuseDeviceMissing is returned by Mount when /dev/fuse is absent or
+	// the fuse module is not loaded.
+	ErrFuseDeviceMissing = errors.New("fuse device not found")
+
+	// ErrFusermountNotFound is returned by Mount when neither fusermount3
+	// nor fusermount is installed.
+	ErrFusermountNotFound = errors.New("fusermount not found")
+
+	// ErrMountPermission is returned by Mount when the caller is not allowed
+	// to mount (missing CAP_SYS_ADMIN, no write access to the mount point,
+	// allow_other not enabled in /etc/fuse.conf, ...).
+	ErrMountPermission = errors.New("mount not permitted")
+
+	// ErrMountpointBusy is returned by Mount when the mount point is already
+	// in use.
+	ErrMountpointBusy = errors.New("mount point busy")
+
+	// ErrNoMountPoint is returned by ConnectionID and the fusectl setters
+	// of a server from NewServerFromFd, which does not know where its
+	// connection is mounted.
+	ErrNoMountPoint = errors.New("server has no mount point")
+
+	// ErrBufferTooSmall is returned when the kernel rejects a read from
+	// /dev/fuse because the request buffer is smaller than it requires.
+	ErrBufferTooSmall = errors.New("request buffer too small")
+
+	// ErrReplyAsync is returned by a handler that will answer the request
+	// later through its Replier (see AsyncReplier).
+	ErrReplyAsync = errors.New("reply sent asynchronously")
+
+	// ErrAlreadyReplied is returned by a Replier whose request has already
+	// been answered.
+	ErrAlreadyReplied = errors.New("request already replied")
+
+	// ErrLandlockUnsupported is returned by LockdownAfterMount when the
+	// kernel does not provide Landlock (Linux 5.13+, enabled as an LSM).
+	ErrLandlockUnsupported = errors.New("landlock not supported")
+
+	// ErrUnknownBackingID is returned when a passthrough backing id is not
+	// registered with the server.
+	ErrUnknownBackingID = errors.New("unknown backing id")
 )
 
 // toErrno converts a Go error to a FUSE errno value.
@@ -0,0 +1,582 @@
+package rofuse
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// FallbackFS serves one tree from several backends in priority order,
+// e.g. a local cache in front of a remote origin. Each request goes to the
+// first backend, and only if that fails to the next, until one succeeds;
+// the first success wins, so when backends disagree on content the
+// earliest one that answers is served. If every backend fails, the first
+// backend's error is returned.
+//
+// The backends must agree on inode numbers: an inode returned by one of
+// them means the same file in all the others. A cancelled request, EACCES
+// and EPERM end the chain right away rather than being retried, so a
+// later backend cannot override a permission decision.
+//
+// Files are opened on the first backend that accepts them and lazily on
+// the others when a read has to fall back. A directory listing comes
+// entirely from the backend that opened it, since listing offsets mean
+// nothing to another backend.
+type FallbackFS struct {
+	backends []Filesystem
+
+	mu      sync.Mutex
+	handles map[FileHandle]*fallbackHandle
+	nextFh  FileHandle
+	lookups map[Inode][]uint64 // Lookups answered by each backend
+}
+
+// fallbackHandle is an outer handle and the backend handles behind it.
+type fallbackHandle struct {
+	flags uint32
+	dir   bool
+
+	mu     sync.Mutex
+	opened []bool
+	fhs    []FileHandle
+}
+
+// NewFallbackFS returns a FallbackFS trying backends in the given order.
+func NewFallbackFS(backends ...Filesystem) *FallbackFS {
+	return &FallbackFS{
+		backends: backends,
+		handles:  make(map[FileHandle]*fallbackHandle),
+		lookups:  make(map[Inode][]uint64),
+	}
+}
+
+// fallbackFinal reports whether err must be returned as is instead of
+// trying the next backend.
+func fallbackFinal(ctx Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM)
+}
+
+// each calls try for every backend in turn until it succeeds. It returns
+// nil on success, otherwise the first backend's error.
+func (f *FallbackFS) each(ctx Context, try func(i int, fs Filesystem) error) error {
+	var firstErr error
+	for i, fs := range f.backends {
+		err := try(i, fs)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if fallbackFinal(ctx, err) {
+			return err
+		}
+	}
+	if firstErr == nil {
+		return syscall.ENOSYS
+	}
+	return firstErr
+}
+
+// countLookup records that backend i answered a lookup of ino.
+func (f *FallbackFS) countLookup(i int, ino Inode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.lookups[ino]
+	if n == nil {
+		n = make([]uint64, len(f.backends))
+		f.lookups[ino] = n
+	}
+	n[i]++
+}
+
+// addHandle registers h and returns its outer handle.
+func (f *FallbackFS) addHandle(h *fallbackHandle) FileHandle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextFh++
+	f.handles[f.nextFh] = h
+	return f.nextFh
+}
+
+// handle resolves an outer handle, forgetting it if drop is set.
+func (f *FallbackFS) handle(fh FileHandle, drop bool) (*fallbackHandle, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h, ok := f.handles[fh]
+	if drop {
+		delete(f.handles, fh)
+	}
+	return h, ok
+}
+
+// newHandle returns a handle already opened on backend i.
+func (f *FallbackFS) newHandle(i int, fh FileHandle, flags uint32, dir bool) *fallbackHandle {
+	h := &fallbackHandle{
+		flags:  flags,
+		dir:    dir,
+		opened: make([]bool, len(f.backends)),
+		fhs:    make([]FileHandle, len(f.backends)),
+	}
+	h.opened[i] = true
+	h.fhs[i] = fh
+	return h
+}
+
+// backendHandle returns h's handle on backend i, opening ino there first
+// if needed.
+func (h *fallbackHandle) backendHandle(ctx Context, i int, fs Filesystem, ino Inode) (FileHandle, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.opened[i] {
+		return h.fhs[i], nil
+	}
+	resp, err := fs.Open(ctx, ino, h.flags)
+	if err != nil {
+		return 0, err
+	}
+	h.opened[i] = true
+	h.fhs[i] = resp.Handle
+	return resp.Handle, nil
+}
+
+// owner returns the backend a directory handle was opened on.
+func (h *fallbackHandle) owner() (int, FileHandle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, ok := range h.opened {
+		if ok {
+			return i, h.fhs[i]
+		}
+	}
+	return -1, 0
+}
+
+// Init initializes every backend and returns the first error.
+func (f *FallbackFS) Init(ctx Context, config *Config) error {
+	var firstErr error
+	for _, fs := range f.backends {
+		c := *config
+		if err := fs.Init(ctx, &c); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Destroy destroys every backend.
+func (f *FallbackFS) Destroy(ctx Context) {
+	for _, fs := range f.backends {
+		fs.Destroy(ctx)
+	}
+}
+
+// Lookup returns the entry from the first backend that finds name.
+func (f *FallbackFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	var entry, negative *Entry
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		e, err := fs.Lookup(ctx, parent, name)
+		if err != nil {
+			return err
+		}
+		if e.Ino == 0 {
+			// Absent from this backend, the next one may have it
+			if negative == nil {
+				negative = e
+			}
+			return syscall.ENOENT
+		}
+		f.countLookup(i, e.Ino)
+		entry = e
+		return nil
+	})
+	if negative != nil && errors.Is(err, syscall.ENOENT) {
+		return negative, nil
+	}
+	return entry, err
+}
+
+// GetAttr returns the attributes from the first backend that has them.
+func (f *FallbackFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	var h *fallbackHandle
+	if fh != nil {
+		h, _ = f.handle(*fh, false)
+	}
+
+	var resp *AttrResponse
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		var backendFh *FileHandle
+		if h != nil {
+			h.mu.Lock()
+			if h.opened[i] {
+				backendFh = &h.fhs[i]
+			}
+			h.mu.Unlock()
+		}
+		r, err := fs.GetAttr(ctx, ino, backendFh)
+		if err != nil {
+			return err
+		}
+		resp = r
+		return nil
+	})
+	return resp, err
+}
+
+// ReadLink returns the target from the first backend that can read it.
+func (f *FallbackFS) ReadLink(ctx Context, ino Inode) (string, error) {
+	var target string
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		t, err := fs.ReadLink(ctx, ino)
+		if err != nil {
+			return err
+		}
+		target = t
+		return nil
+	})
+	return target, err
+}
+
+// Open opens ino on the first backend that accepts it.
+func (f *FallbackFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	var out OpenResponse
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		resp, err := fs.Open(ctx, ino, flags)
+		if err != nil {
+			return err
+		}
+		out = *resp
+		out.Handle = f.addHandle(f.newHandle(i, resp.Handle, flags, false))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Read returns the data from the first backend that can read it, opening
+// the file on later backends as needed.
+func (f *FallbackFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	var data []byte
+	var eof error
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		backendFh, err := h.backendHandle(ctx, i, fs, ino)
+		if err != nil {
+			return err
+		}
+		d, err := fs.Read(ctx, ino, backendFh, offset, size)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		data, eof = d, err
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, eof
+}
+
+// Lseek seeks on the first backend that can, like Read. ENXIO is an
+// answer, not a failure, and is not retried on later backends.
+func (f *FallbackFS) Lseek(ctx Context, ino Inode, fh FileHandle, offset int64, whence uint32) (int64, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+
+	var off int64
+	var nxio error
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		backendFh, err := h.backendHandle(ctx, i, fs, ino)
+		if err != nil {
+			return err
+		}
+		o, err := fs.Lseek(ctx, ino, backendFh, offset, whence)
+		if errors.Is(err, syscall.ENXIO) || errors.Is(err, io.EOF) {
+			nxio = syscall.ENXIO
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		off = o
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return off, nxio
+}
+
+// release releases every backend handle behind fh. info is passed on for
+// file handles.
+func (f *FallbackFS) release(ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error {
+	h, ok := f.handle(fh, true)
+	if !ok {
+		return syscall.EBADF
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var firstErr error
+	for i, fs := range f.backends {
+		if !h.opened[i] {
+			continue
+		}
+		var err error
+		if h.dir {
+			err = fs.ReleaseDir(ctx, ino, h.fhs[i])
+		} else {
+			err = releaseFile(fs, ctx, ino, h.fhs[i], info)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Release releases fh on every backend it was opened on.
+func (f *FallbackFS) Release(ctx Context, ino Inode, fh FileHandle) error {
+	return f.release(ctx, ino, fh, ReleaseInfo{})
+}
+
+// ReleaseWithFlags releases fh on every backend it was opened on, passing
+// info on to each.
+func (f *FallbackFS) ReleaseWithFlags(ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error {
+	return f.release(ctx, ino, fh, info)
+}
+
+// OpenDir opens ino on the first backend that accepts it, which then
+// serves the whole listing.
+func (f *FallbackFS) OpenDir(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	var out OpenResponse
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		resp, err := fs.OpenDir(ctx, ino, flags)
+		if err != nil {
+			return err
+		}
+		out = *resp
+		out.Handle = f.addHandle(f.newHandle(i, resp.Handle, flags, true))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ReadDir lists the directory on the backend that opened it.
+func (f *FallbackFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	i, backendFh := h.owner()
+	return f.backends[i].ReadDir(ctx, ino, backendFh, offset, size)
+}
+
+// ReadDirPlus lists the directory with attributes on the backend that
+// opened it.
+func (f *FallbackFS) ReadDirPlus(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntryPlus, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	i, backendFh := h.owner()
+	entries, err := f.backends[i].ReadDirPlus(ctx, ino, backendFh, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Entry.Ino != 0 && !isDotName(e.Name) {
+			f.countLookup(i, e.Entry.Ino)
+		}
+	}
+	return entries, nil
+}
+
+// ReleaseDir releases the directory handle on the backend that opened it.
+func (f *FallbackFS) ReleaseDir(ctx Context, ino Inode, fh FileHandle) error {
+	return f.release(ctx, ino, fh, ReleaseInfo{})
+}
+
+// StatFS returns the statistics of the first backend that reports them.
+func (f *FallbackFS) StatFS(ctx Context, ino Inode) (*StatFS, error) {
+	var st *StatFS
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		s, err := fs.StatFS(ctx, ino)
+		if err != nil {
+			return err
+		}
+		st = s
+		return nil
+	})
+	return st, err
+}
+
+// Access asks the backends in turn; a denial is final.
+func (f *FallbackFS) Access(ctx Context, ino Inode, mask uint32) error {
+	return f.each(ctx, func(i int, fs Filesystem) error {
+		return fs.Access(ctx, ino, mask)
+	})
+}
+
+// Forget forwards to each backend the lookups it answered, up to nlookup
+// in total.
+func (f *FallbackFS) Forget(ctx Context, ino Inode, nlookup uint64) {
+	for i, n := range f.forget(ino, nlookup) {
+		if n > 0 {
+			f.backends[i].Forget(ctx, ino, n)
+		}
+	}
+}
+
+// BatchForget forwards to each backend the lookups it answered.
+func (f *FallbackFS) BatchForget(ctx Context, entries []ForgetEntry) {
+	batches := make([][]ForgetEntry, len(f.backends))
+	for _, e := range entries {
+		for i, n := range f.forget(e.Ino, e.Nlookup) {
+			if n > 0 {
+				batches[i] = append(batches[i], ForgetEntry{Ino: e.Ino, Nlookup: n})
+			}
+		}
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			f.backends[i].BatchForget(ctx, batch)
+		}
+	}
+}
+
+// forget takes nlookup lookups of ino off the per-backend counts, earliest
+// backends first, and returns how many each backend gets to forget.
+func (f *FallbackFS) forget(ino Inode, nlookup uint64) []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts, ok := f.lookups[ino]
+	if !ok {
+		return nil
+	}
+	out := make([]uint64, len(counts))
+	total := uint64(0)
+	for i, n := range counts {
+		take := min(n, nlookup)
+		out[i] = take
+		counts[i] -= take
+		nlookup -= take
+		total += counts[i]
+	}
+	if total == 0 {
+		delete(f.lookups, ino)
+	}
+	return out
+}
+
+// Poll polls the first backend that supports it and has the file.
+func (f *FallbackFS) Poll(ctx Context, ino Inode, fh FileHandle, events uint32, kh uint64) (uint32, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+
+	var revents uint32
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		pfs, ok := fs.(PollFilesystem)
+		if !ok {
+			return syscall.ENOSYS
+		}
+		backendFh, err := h.backendHandle(ctx, i, fs, ino)
+		if err != nil {
+			return err
+		}
+		r, err := pfs.Poll(ctx, ino, backendFh, events, kh)
+		if err != nil {
+			return err
+		}
+		revents = r
+		return nil
+	})
+	return revents, err
+}
+
+// Ioctl issues an ioctl on the first backend that supports it and has
+// the file.
+func (f *FallbackFS) Ioctl(ctx Context, ino Inode, fh FileHandle, cmd uint32, arg uint64, in []byte, outSize uint32) ([]byte, error) {
+	h, ok := f.handle(fh, false)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	var data []byte
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		ifs, ok := fs.(IoctlFilesystem)
+		if !ok {
+			return syscall.ENOTTY
+		}
+		backendFh, err := h.backendHandle(ctx, i, fs, ino)
+		if err != nil {
+			return err
+		}
+		d, err := ifs.Ioctl(ctx, ino, backendFh, cmd, arg, in, outSize)
+		if err != nil {
+			return err
+		}
+		data = d
+		return nil
+	})
+	return data, err
+}
+
+// Statx returns extended attributes from the first backend that has
+// them, built from GetAttr for backends that don't support statx.
+func (f *FallbackFS) Statx(ctx Context, ino Inode, fh *FileHandle, mask, flags uint32) (*Statx, error) {
+	var h *fallbackHandle
+	if fh != nil {
+		h, _ = f.handle(*fh, false)
+	}
+
+	var st *Statx
+	err := f.each(ctx, func(i int, fs Filesystem) error {
+		var backendFh *FileHandle
+		if h != nil {
+			h.mu.Lock()
+			if h.opened[i] {
+				backendFh = &h.fhs[i]
+			}
+			h.mu.Unlock()
+		}
+		sfs, ok := fs.(StatxFilesystem)
+		if !ok {
+			resp, err := fs.GetAttr(ctx, ino, backendFh)
+			if err != nil {
+				return err
+			}
+			s := StatxFromAttr(resp.Attr)
+			st = &s
+			return nil
+		}
+		s, err := sfs.Statx(ctx, ino, backendFh, mask, flags)
+		if err != nil {
+			return err
+		}
+		st = s
+		return nil
+	})
+	return st, err
+}
@@ -0,0 +1,42 @@
+package rofuse
+
+import (
+	"syscall"
+	"testing"
+)
+
+// failingFS fails every read with EIO.
+type failingFS struct {
+	*testFS
+}
+
+func (failingFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	return nil, syscall.EIO
+}
+
+func TestFallbackRead(t *testing.T) {
+	primary, secondary := newTestFS(), newTestFS()
+	primary.create(RootInode, "file", []byte("cached"))
+	secondary.create(RootInode, "file", []byte("origin"))
+	k := newTestServer(t, NewFallbackFS(failingFS{primary}, secondary), nil)
+
+	ino := Inode(k.lookup(RootInode, "file").NodeID)
+	fh := k.open(ino)
+	if got := string(k.readFile(ino, fh, 0, 4096)); got != "origin" {
+		t.Errorf("read %q, want the secondary's %q", got, "origin")
+	}
+}
+
+// When the backends disagree, the primary wins.
+func TestFallbackPrimaryWins(t *testing.T) {
+	primary, secondary := newTestFS(), newTestFS()
+	primary.create(RootInode, "file", []byte("cached"))
+	secondary.create(RootInode, "file", []byte("origin"))
+	k := newTestServer(t, NewFallbackFS(primary, secondary), nil)
+
+	ino := Inode(k.lookup(RootInode, "file").NodeID)
+	fh := k.open(ino)
+	if got := string(k.readFile(ino, fh, 0, 4096)); got != "cached" {
+		t.Errorf("read %q, want the primary's %q", got, "cached")
+	}
+}
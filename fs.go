@@ -1,10 +1,21 @@
 package rofuse
 
-import "syscall"
+import (
+	"syscall"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
 
 // Filesystem is the interface that read-only filesystems must implement.
 // All methods operate on inode numbers, not paths.
 // Methods should be goroutine-safe as they may be called concurrently.
+//
+// Errors are sent to the kernel as errnos (see the syscall.Errno values);
+// context.Canceled becomes EINTR, but only if ctx was actually cancelled.
+// A context.Canceled coming from anywhere else is answered with EIO.
+// ctx is cancelled when the calling process is interrupted by a signal
+// (FUSE_INTERRUPT, e.g. Ctrl-C) and when the server is unmounted, so
+// methods blocking on a slow backend should watch ctx.Done().
 type Filesystem interface {
 	// Init is called during FUSE_INIT to allow filesystem initialization.
 	// The Config contains negotiated protocol parameters.
@@ -18,11 +29,14 @@ type Filesystem interface {
 	// Should return syscall.ENOENT if not found.
 	Lookup(ctx Context, parent Inode, name string) (*Entry, error)
 
-	// GetAttr retrieves attributes for an inode.
-	// If fh is non-nil, it's a file handle from a previous Open.
-	GetAttr(ctx Context, ino Inode, fh *FileHandle) (*Attr, error)
+	// GetAttr retrieves attributes for an inode, and how long the kernel
+	// may cache them. If fh is non-nil, it's a file handle from a
+	// previous Open.
+	GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error)
 
 	// ReadLink reads the target of a symbolic link.
+	// The target must be non-empty and must not contain NUL bytes;
+	// otherwise the kernel gets EINVAL.
 	ReadLink(ctx Context, ino Inode) (string, error)
 
 	// Open opens a file and returns a file handle.
@@ -33,6 +47,15 @@ type Filesystem interface {
 	// Returns data read. May return less than size bytes.
 	Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error)
 
+	// Lseek finds the next data (whence proto.SeekData) or hole
+	// (proto.SeekHole) at or after offset, for lseek(2) on sparse files;
+	// the kernel handles the other whence values itself. The end of the
+	// file counts as a hole. It returns syscall.ENXIO (io.EOF is taken
+	// as such) when offset is at or past the end of the file, or when no
+	// data follows it. ENOSYS, the FilesystemBase default, makes the
+	// kernel treat the whole file as data from then on.
+	Lseek(ctx Context, ino Inode, fh FileHandle, offset int64, whence uint32) (int64, error)
+
 	// Release closes a file handle opened by Open.
 	Release(ctx Context, ino Inode, fh FileHandle) error
 
@@ -42,10 +65,15 @@ type Filesystem interface {
 	// ReadDir reads directory entries.
 	// offset is the position in the directory stream (from previous DirEntry.Offset).
 	// Returns entries that fit within size bytes when serialized.
+	// Entries whose type is expensive to determine may use DtUnknown.
+	// If ctx is cancelled meanwhile the result is discarded and the
+	// kernel gets EINTR, so returning early with partial entries is fine.
 	ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error)
 
 	// ReadDirPlus reads directory entries with attributes (READDIRPLUS).
-	// This combines ReadDir + Lookup for better performance.
+	// This combines ReadDir + Lookup for better performance, but needs
+	// full attributes for every entry; backends for which that means a
+	// stat per child should return ENOSYS and serve ReadDir instead.
 	ReadDirPlus(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntryPlus, error)
 
 	// ReleaseDir closes a directory handle.
@@ -91,6 +119,11 @@ func (FilesystemBase) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse,
 	return &OpenResponse{Handle: 0}, nil
 }
 
+// Lseek returns ENOSYS by default: files have no holes.
+func (FilesystemBase) Lseek(ctx Context, ino Inode, fh FileHandle, offset int64, whence uint32) (int64, error) {
+	return 0, syscall.ENOSYS
+}
+
 // Release is a no-op by default.
 func (FilesystemBase) Release(ctx Context, ino Inode, fh FileHandle) error {
 	return nil
@@ -139,3 +172,42 @@ func (fs FilesystemBase) BatchForget(ctx Context, entries []ForgetEntry) {
 		fs.Forget(ctx, e.Ino, e.Nlookup)
 	}
 }
+
+// ReleaseInfo describes a RELEASE beyond the handle being closed.
+type ReleaseInfo struct {
+	Flags     uint32 // Flags the handle was opened with
+	Flush     bool   // The release stands in for a FLUSH (proto.ReleaseFlush)
+	Flock     bool   // flock(2) locks held by LockOwner must be dropped
+	LockOwner uint64 // Owner id of the closing file, as in lock requests
+}
+
+// ReleaseFlagsFilesystem is implemented by filesystems that need to know
+// more about a RELEASE than Release tells them, typically to drop the
+// locks a closing file held. The kernel only sets Flock when flock(2)
+// locks are handled by the filesystem (proto.CapFlockLocks), which rofuse
+// does not negotiate yet; until then locks stay local to the kernel and
+// Flock is always false. When a filesystem implements it, ReleaseWithFlags
+// is called instead of Release for file handles; directory handles still
+// go to ReleaseDir.
+type ReleaseFlagsFilesystem interface {
+	ReleaseWithFlags(ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error
+}
+
+// releaseInfo decodes the body of a FUSE_RELEASE.
+func releaseInfo(in *proto.ReleaseIn) ReleaseInfo {
+	return ReleaseInfo{
+		Flags:     in.Flags,
+		Flush:     in.ReleaseFlags&proto.ReleaseFlush != 0,
+		Flock:     in.ReleaseFlags&proto.ReleaseFlock != 0,
+		LockOwner: in.LockOwner,
+	}
+}
+
+// releaseFile closes a file handle, passing info on to filesystems that
+// want it.
+func releaseFile(fs Filesystem, ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error {
+	if rfs, ok := fs.(ReleaseFlagsFilesystem); ok {
+		return rfs.ReleaseWithFlags(ctx, ino, fh, info)
+	}
+	return fs.Release(ctx, ino, fh)
+}
@@ -0,0 +1,59 @@
+package rofuse
+
+import (
+	"os"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// locksFS holds flock(2) locks by owner and drops them on release.
+type locksFS struct {
+	*testFS
+	released chan ReleaseInfo
+	locks    map[uint64]bool
+}
+
+func (f *locksFS) ReleaseWithFlags(ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error {
+	if info.Flock {
+		delete(f.locks, info.LockOwner)
+	}
+	f.released <- info
+	return nil
+}
+
+func TestReleaseWithFlags(t *testing.T) {
+	fs := &locksFS{
+		testFS:   newTestFS(),
+		released: make(chan ReleaseInfo, 1),
+		locks:    map[uint64]bool{0xabc: true, 0xdef: true},
+	}
+	ino := fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, nil)
+
+	fh := k.open(ino)
+	k.mustCall(proto.OpRelease, uint64(ino), wireBytes(&proto.ReleaseIn{
+		Fh:           fh,
+		Flags:        uint32(os.O_RDONLY),
+		ReleaseFlags: proto.ReleaseFlock | proto.ReleaseFlush,
+		LockOwner:    0xabc,
+	}))
+
+	want := ReleaseInfo{Flags: uint32(os.O_RDONLY), Flush: true, Flock: true, LockOwner: 0xabc}
+	if info := <-fs.released; info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+	if fs.locks[0xabc] || !fs.locks[0xdef] {
+		t.Errorf("locks left: %v, want only 0xdef", fs.locks)
+	}
+
+	// Without FLOCK the owner's locks are kept
+	fh = k.open(ino)
+	k.mustCall(proto.OpRelease, uint64(ino), wireBytes(&proto.ReleaseIn{Fh: fh, LockOwner: 0xdef}))
+	if info := <-fs.released; info.Flock || info.Flush {
+		t.Errorf("got %+v, want neither Flock nor Flush", info)
+	}
+	if !fs.locks[0xdef] {
+		t.Error("lock of 0xdef dropped without FLOCK")
+	}
+}
@@ -0,0 +1,71 @@
+package rofuse
+
+import (
+	"os"
+	"time"
+)
+
+// GeneratorFile is a synthesized read-only file whose content is computed
+// from the offset instead of being stored, so a file of any size, such as
+// a 10GB test fixture of a repeating pattern, costs no storage. Size is
+// the virtual size reported to the kernel; Generate fills p with the
+// content starting at off and returns how many bytes it wrote. It is only
+// asked for ranges inside the file, and must be safe for concurrent use
+// and give the same bytes for the same range every time, as the kernel
+// caches them.
+//
+// A filesystem serving one routes to it the way it would a StatsFile:
+// Lookup of its name returns Entry(), and GetAttr, Open and Read on Ino
+// are answered by Attr, Open and Read.
+type GeneratorFile struct {
+	Ino      Inode
+	Size     int64
+	Mode     os.FileMode // Permission bits; 0444 if zero
+	Mtime    time.Time
+	Generate func(off int64, p []byte) int
+}
+
+// RepeatPattern returns a Generate function for content made of pattern
+// repeated over and over, the first copy starting at offset 0.
+func RepeatPattern(pattern []byte) func(off int64, p []byte) int {
+	return func(off int64, p []byte) int {
+		if len(pattern) == 0 {
+			return 0
+		}
+		n := copy(p, pattern[off%int64(len(pattern)):])
+		for n < len(p) {
+			n += copy(p[n:], pattern)
+		}
+		return n
+	}
+}
+
+// Attr returns the attributes of the generated file.
+func (f *GeneratorFile) Attr() Attr {
+	return synthAttr(f.Ino, f.Size, f.Mode, f.Mtime)
+}
+
+// Entry returns the lookup result for the generated file. The content
+// never changes, so the entry and attributes are cached for an hour.
+func (f *GeneratorFile) Entry() *Entry {
+	return synthEntry(f.Attr(), time.Hour)
+}
+
+// Open returns the open response for the generated file, keeping the page
+// cache across opens.
+func (f *GeneratorFile) Open() *OpenResponse {
+	return &OpenResponse{Flags: OpenKeepCache}
+}
+
+// Read returns up to size bytes of the content from offset, and nothing
+// at or past Size. Like ReaderAtFile.Read, it fills a pooled buffer when
+// ctx is a request's, which must not be kept past the Filesystem's Read.
+func (f *GeneratorFile) Read(ctx Context, offset int64, size uint32) ([]byte, error) {
+	n := synthRange(offset, size, f.Size)
+	if n == 0 {
+		return nil, nil
+	}
+	buf := readBuffer(ctx, n)
+	n = f.Generate(offset, buf)
+	return buf[:max(0, min(n, len(buf)))], nil
+}
@@ -0,0 +1,44 @@
+package rofuse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGeneratorFile(t *testing.T) {
+	pattern := []byte("0123456789abcdef")
+	const size = 10 << 30
+	gen := &GeneratorFile{Ino: 2, Size: size, Generate: RepeatPattern(pattern)}
+	k := newTestServer(t, synthFS{f: gen}, nil)
+
+	if got := k.lookup(RootInode, "file").Attr.Size; got != size {
+		t.Fatalf("size %d, want %d", got, uint64(size))
+	}
+	fh := k.open(2)
+
+	want := func(off int64, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = pattern[(off+int64(i))%int64(len(pattern))]
+		}
+		return b
+	}
+	for _, tt := range []struct {
+		name string
+		off  int64
+		n    int // Bytes expected of a 4096-byte read
+	}{
+		{"start", 0, 4096},
+		{"across 2GB", 2<<30 - 100, 4096},
+		{"across 4GB", 4<<30 - 7, 4096},
+		{"past 4GB", 4<<30 + 3, 4096},
+		{"across EOF", size - 1000, 1000},
+		{"at EOF", size, 0},
+		{"past EOF", size + 4096, 0},
+	} {
+		got := k.readFile(2, fh, uint64(tt.off), 4096)
+		if !bytes.Equal(got, want(tt.off, tt.n)) {
+			t.Errorf("%s: read %d bytes not matching the %d expected", tt.name, len(got), tt.n)
+		}
+	}
+}
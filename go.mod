@@ -2,4 +2,4 @@ module github.com/KarpelesLab/rofuse
 
 go 1.25.4
 
-require golang.org/x/sys v0.39.0 // indirect
+require golang.org/x/sys v0.39.0
@@ -2,7 +2,12 @@ package rofuse
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/KarpelesLab/rofuse/proto"
@@ -11,44 +16,79 @@ import (
 // handler is a function that handles a FUSE request.
 type handler func(s *Server, req *request) error
 
+// opHandler is the handler of an opcode and the smallest request body it
+// can parse, which checkRequest enforces before calling it.
+type opHandler struct {
+	handle  handler
+	minBody int
+}
+
 // handlers maps opcodes to their handlers.
-var handlers = map[uint32]handler{
-	proto.OpInit:        handleInit,
-	proto.OpDestroy:     handleDestroy,
-	proto.OpLookup:      handleLookup,
-	proto.OpForget:      handleForget,
-	proto.OpBatchForget: handleBatchForget,
-	proto.OpGetattr:     handleGetattr,
-	proto.OpReadlink:    handleReadlink,
-	proto.OpOpen:        handleOpen,
-	proto.OpRead:        handleRead,
-	proto.OpRelease:     handleRelease,
-	proto.OpOpendir:     handleOpendir,
-	proto.OpReaddir:     handleReaddir,
-	proto.OpReaddirplus: handleReaddirplus,
-	proto.OpReleasedir:  handleReleasedir,
-	proto.OpStatfs:      handleStatfs,
-	proto.OpAccess:      handleAccess,
-	proto.OpFlush:       handleFlush,
-	proto.OpInterrupt:   handleInterrupt,
+var handlers = map[uint32]opHandler{
+	proto.OpInit:        {handleInit, initInCompatSize},
+	proto.OpDestroy:     {handleDestroy, 0},
+	proto.OpLookup:      {handleLookup, 0},
+	proto.OpForget:      {handleForget, proto.ForgetInSize},
+	proto.OpBatchForget: {handleBatchForget, proto.BatchForgetInSize},
+	proto.OpGetattr:     {handleGetattr, proto.GetAttrInSize},
+	proto.OpReadlink:    {handleReadlink, 0},
+	proto.OpOpen:        {handleOpen, proto.OpenInSize},
+	proto.OpRead:        {handleRead, proto.ReadInSize},
+	proto.OpRelease:     {handleRelease, proto.ReleaseInSize},
+	proto.OpOpendir:     {handleOpendir, proto.OpenInSize},
+	proto.OpReaddir:     {handleReaddir, proto.ReadInSize},
+	proto.OpReaddirplus: {handleReaddirplus, proto.ReadInSize},
+	proto.OpReleasedir:  {handleReleasedir, proto.ReleaseInSize},
+	proto.OpStatfs:      {handleStatfs, 0},
+	proto.OpAccess:      {handleAccess, proto.AccessInSize},
+	proto.OpFlush:       {handleFlush, 0},
+	proto.OpInterrupt:   {handleInterrupt, proto.InterruptInSize},
+	proto.OpStatx:       {handleStatx, proto.StatxInSize},
+	proto.OpLseek:       {handleLseek, proto.LseekInSize},
+	proto.OpPoll:        {handlePoll, proto.PollInSize},
+	proto.OpIoctl:       {handleIoctl, proto.IoctlInSize},
 }
 
+// initInCompatSize is the size of the INIT body before protocol 7.36
+// extended it with Flags2.
+const initInCompatSize = 16
+
 // handleInit processes FUSE_INIT.
 func handleInit(s *Server, req *request) error {
-	in := (*proto.InitIn)(req.body())
+	p, ok := req.bodyAs(initInCompatSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.InitIn)(p)
+
+	s.mu.RLock()
+	initialized := s.initialized
+	s.mu.RUnlock()
+	if initialized {
+		s.opts.logf("INIT received on an initialized connection")
+		return syscall.EPROTO
+	}
 
 	// Validate protocol version
-	if in.Major != proto.FuseKernelVersion {
-		// Major version mismatch - negotiate
+	switch {
+	case in.Major > proto.FuseKernelVersion:
+		// Newer kernel: reply with only our major, and the kernel
+		// sends a second INIT speaking it
 		out := &proto.InitOut{
 			Major: proto.FuseKernelVersion,
 			Minor: proto.FuseKernelMinorVersion,
 		}
 		s.sendResponse(req, initOutBytes(out))
 		return nil
+	case in.Major < proto.FuseKernelVersion:
+		s.opts.logf("kernel speaks FUSE %d.%d, at least %d.%d is required",
+			in.Major, in.Minor, proto.FuseKernelVersion, proto.MinSupportedMinor)
+		return syscall.EPROTO
 	}
 
 	if in.Minor < proto.MinSupportedMinor {
+		s.opts.logf("kernel speaks FUSE %d.%d, at least %d.%d is required",
+			in.Major, in.Minor, proto.FuseKernelVersion, proto.MinSupportedMinor)
 		return syscall.EPROTO
 	}
 
@@ -62,67 +102,126 @@ func handleInit(s *Server, req *request) error {
 	s.conn.protoMajor = in.Major
 	s.conn.protoMinor = minor
 
+	// Capabilities we support, intersected with the kernel's
+	flags := initFlags(s.opts) & kernelFlags(in, len(req.bodyBytes()))
+
 	// Create config
-	s.config = &Config{
+	pages := maxPages(s.opts)
+	config := &Config{
 		ProtoMajor:   in.Major,
 		ProtoMinor:   minor,
 		MaxReadahead: min(in.MaxReadahead, s.opts.MaxReadahead),
 		MaxWrite:     s.opts.MaxWrite,
-		MaxPages:     proto.DefaultMaxPages,
+		MaxRead:      min(s.opts.MaxRead, uint32(pages)*proto.PageSize),
+		MaxPages:     pages,
+		Flags:        flags,
 	}
 
 	// Call filesystem Init
 	ctx := s.newContext(req)
-	if err := s.fs.Init(ctx, s.config); err != nil {
+	if err := s.fs.Init(ctx, config); err != nil {
 		return err
 	}
 
-	// Build response with capabilities we support
-	var flags uint32 = 0
-
-	// Read-only filesystem capabilities
-	flags |= uint32(proto.CapAsyncRead)
-	flags |= uint32(proto.CapParallelDirops)
-	flags |= uint32(proto.CapAutoInvalData)
-	flags |= uint32(proto.CapReaddirplus)
-	flags |= uint32(proto.CapReaddirplusAuto)
-	flags |= uint32(proto.CapCacheSymlinks)
-	flags |= uint32(proto.CapExportSupport)
-	flags |= uint32(proto.CapMaxPages)
-
-	// Intersect with kernel capabilities
-	flags &= in.Flags
-
 	out := &proto.InitOut{
 		Major:               proto.FuseKernelVersion,
 		Minor:               minor,
-		MaxReadahead:        s.config.MaxReadahead,
-		Flags:               flags,
+		MaxReadahead:        config.MaxReadahead,
+		Flags:               uint32(flags),
 		MaxBackground:       s.opts.MaxBackground,
 		CongestionThreshold: s.opts.MaxBackground * 3 / 4,
 		MaxWrite:            s.opts.MaxWrite,
 		TimeGran:            proto.DefaultTimeGran,
-		MaxPages:            proto.DefaultMaxPages,
+		MaxPages:            pages,
+	}
+	if flags>>32 != 0 {
+		out.Flags |= uint32(proto.CapInitExt)
+		out.Flags2 = uint32(flags >> 32)
+	}
+	if flags&proto.CapPassthrough != 0 {
+		// The kernel only enables passthrough with a stack depth; backing
+		// files may not be on another FUSE or overlay mount
+		out.MaxStackDepth = 1
 	}
 
 	s.mu.Lock()
 	s.initialized = true
+	s.flags = flags
+	s.config = config
 	s.mu.Unlock()
 
+	if s.opts.debugging() {
+		s.opts.logf("negotiated FUSE %d.%d: %s", out.Major, out.Minor, strings.Join(proto.CapabilityNames(flags), " "))
+	}
+
 	s.sendResponse(req, initOutBytes(out))
+	s.readyOnce.Do(func() { close(s.ready) })
 	return nil
 }
 
+// optionalCaps are the capabilities MountOptions.Capabilities may ask
+// for: those that change nothing the server relies on. The ones for
+// writing, locking or request formats it does not parse are left out, as
+// are those it manages itself (CapInitExt, CapPassthrough).
+const optionalCaps = proto.CapAsyncDIO |
+	proto.CapNoOpenSupport |
+	proto.CapNoOpendirSupport |
+	proto.CapIoctlDir |
+	proto.CapAbortError |
+	proto.CapExpireOnly |
+	proto.CapNoExportSupport
+
+// initFlags returns the capabilities the server asks for at INIT.
+func initFlags(opts *MountOptions) uint64 {
+	// Read-only filesystem capabilities
+	flags := proto.CapAsyncRead |
+		proto.CapParallelDirops |
+		proto.CapReaddirplus |
+		proto.CapReaddirplusAuto |
+		proto.CapCacheSymlinks |
+		proto.CapExportSupport |
+		proto.CapMaxPages |
+		opts.Capabilities&optionalCaps
+	if opts.Passthrough {
+		flags |= proto.CapPassthrough
+	}
+
+	// The kernel ignores EXPLICIT_INVAL_DATA if AUTO_INVAL_DATA is set
+	if opts.ExplicitInvalidation {
+		flags |= proto.CapExplicitInvalData
+	} else {
+		flags |= proto.CapAutoInvalData
+	}
+	return flags
+}
+
+// kernelFlags returns the capabilities offered in INIT, including the
+// extended ones (Flags2) when the kernel sends them. size is the length
+// of the INIT body; Flags2 is only read when the body holds all of it.
+func kernelFlags(in *proto.InitIn, size int) uint64 {
+	flags := uint64(in.Flags)
+	if flags&proto.CapInitExt != 0 && size >= proto.InitInSize {
+		flags |= uint64(in.Flags2) << 32
+	}
+	return flags
+}
+
 // handleDestroy processes FUSE_DESTROY.
 func handleDestroy(s *Server, req *request) error {
 	ctx := s.newContext(req)
 	s.fs.Destroy(ctx)
 
+	s.sendResponse(req, nil)
+
+	action := DestroyContinue
+	if s.opts.OnDestroy != nil {
+		action = s.opts.OnDestroy()
+	}
+
 	s.mu.Lock()
 	s.destroyed = true
+	s.destroyAction = action
 	s.mu.Unlock()
-
-	s.sendResponse(req, nil)
 	return nil
 }
 
@@ -131,21 +230,34 @@ func handleLookup(s *Server, req *request) error {
 	name := req.filename()
 
 	ctx := s.newContext(req)
-	entry, err := s.fs.Lookup(ctx, Inode(req.header.NodeID), name)
+	parent := Inode(req.header.NodeID)
+	entry, err := s.fs.Lookup(ctx, parent, name)
 	if err != nil {
 		return err
 	}
+	if entry.Ino == 0 {
+		// Negative entry: node id 0, only the entry timeout counts
+		sec, nsec := durationToTimespec(max(entry.EntryTimeout, 0))
+		s.sendResponse(req, entryOutBytes(&proto.EntryOut{EntryValid: sec, EntryValidNsec: nsec}))
+		return nil
+	}
+	s.nodes.add(parent, name, entry)
 
-	out := entryToProto(entry)
+	out := entryToProto(entry, s.opts)
 	s.sendResponse(req, entryOutBytes(out))
 	return nil
 }
 
 // handleForget processes FUSE_FORGET (no reply).
 func handleForget(s *Server, req *request) error {
-	in := (*proto.ForgetIn)(req.body())
+	p, ok := req.bodyAs(proto.ForgetInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ForgetIn)(p)
 
 	ctx := s.newContext(req)
+	s.nodes.forget(Inode(req.header.NodeID), in.Nlookup)
 	s.fs.Forget(ctx, Inode(req.header.NodeID), in.Nlookup)
 
 	// No reply for FORGET
@@ -154,26 +266,32 @@ func handleForget(s *Server, req *request) error {
 
 // handleBatchForget processes FUSE_BATCH_FORGET (no reply).
 func handleBatchForget(s *Server, req *request) error {
-	in := (*proto.BatchForgetIn)(req.body())
+	p, ok := req.bodyAs(proto.BatchForgetInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.BatchForgetIn)(p)
 	body := req.bodyBytes()
 
-	if len(body) < proto.BatchForgetInSize {
-		return syscall.EINVAL
+	// Forget the entries that are there even if the count is off:
+	// dropping references is safer than leaking them
+	count := int(in.Count)
+	if have := (len(body) - proto.BatchForgetInSize) / proto.ForgetOneSize; count > have {
+		s.protocolError(req, fmt.Errorf("count %d, body holds %d entries: %w", count, have, syscall.EINVAL))
+		count = have
 	}
 
 	// Parse forget entries
-	entries := make([]ForgetEntry, in.Count)
+	entries := make([]ForgetEntry, count)
 	offset := proto.BatchForgetInSize
-	for i := uint32(0); i < in.Count; i++ {
-		if offset+proto.ForgetOneSize > len(body) {
-			break
-		}
+	for i := range count {
 		one := (*proto.ForgetOne)(unsafe.Pointer(&body[offset]))
 		entries[i] = ForgetEntry{
 			Ino:     Inode(one.NodeID),
 			Nlookup: one.Nlookup,
 		}
 		offset += proto.ForgetOneSize
+		s.nodes.forget(Inode(one.NodeID), one.Nlookup)
 	}
 
 	ctx := s.newContext(req)
@@ -185,7 +303,11 @@ func handleBatchForget(s *Server, req *request) error {
 
 // handleGetattr processes FUSE_GETATTR.
 func handleGetattr(s *Server, req *request) error {
-	in := (*proto.GetAttrIn)(req.body())
+	p, ok := req.bodyAs(proto.GetAttrInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.GetAttrIn)(p)
 
 	var fh *FileHandle
 	if in.Flags&proto.GetattrFh != 0 {
@@ -194,28 +316,55 @@ func handleGetattr(s *Server, req *request) error {
 	}
 
 	ctx := s.newContext(req)
-	attr, err := s.fs.GetAttr(ctx, Inode(req.header.NodeID), fh)
+	resp, err := s.getAttr(ctx, Inode(req.header.NodeID), fh)
 	if err != nil {
 		return err
 	}
+	s.nodes.setAttr(Inode(req.header.NodeID), &resp.Attr)
 
+	valid, validNsec := s.opts.attrTimeout(resp.Timeout)
 	out := &proto.AttrOut{
-		AttrValid:     1, // 1 second default
-		AttrValidNsec: 0,
-		Attr:          attrToProto(attr),
+		AttrValid:     valid,
+		AttrValidNsec: validNsec,
+		Attr:          attrToProto(&resp.Attr, s.opts),
 	}
 
 	s.sendResponse(req, attrOutBytes(out))
 	return nil
 }
 
+// getAttr asks the filesystem for the attributes of ino, through the
+// batcher when BatchGetAttr is in use. BatchGetAttr has no file handles,
+// so requests naming one are not batched.
+func (s *Server) getAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	if s.attrs != nil && fh == nil {
+		return s.attrs.get(ctx, ino)
+	}
+	return s.fs.GetAttr(ctx, ino, fh)
+}
+
 // handleReadlink processes FUSE_READLINK.
 func handleReadlink(s *Server, req *request) error {
 	ctx := s.newContext(req)
-	target, err := s.fs.ReadLink(ctx, Inode(req.header.NodeID))
+	ino := Inode(req.header.NodeID)
+	target, err := s.fs.ReadLink(ctx, ino)
+	if errors.Is(err, syscall.ENOSYS) {
+		// Reported a symlink but cannot read it (FilesystemBase)
+		s.opts.logf("symlink %d: ReadLink not implemented", ino)
+		return syscall.EIO
+	}
 	if err != nil {
 		return err
 	}
+	if target == "" || strings.IndexByte(target, 0) >= 0 {
+		// Not something a symlink can hold
+		s.opts.logf("symlink %d: invalid target %q", ino, target)
+		return syscall.EINVAL
+	}
+	if size, ok := s.nodes.size(ino); ok && size != uint64(len(target)) {
+		// Callers sizing their buffer by st_size would truncate it
+		s.opts.logf("symlink %d reported size %d for a %d-byte target (see SymlinkAttr)", ino, size, len(target))
+	}
 
 	s.sendResponse(req, []byte(target))
 	return nil
@@ -223,10 +372,15 @@ func handleReadlink(s *Server, req *request) error {
 
 // handleOpen processes FUSE_OPEN.
 func handleOpen(s *Server, req *request) error {
-	in := (*proto.OpenIn)(req.body())
+	p, ok := req.bodyAs(proto.OpenInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.OpenIn)(p)
 
 	ctx := s.newContext(req)
-	resp, err := s.fs.Open(ctx, Inode(req.header.NodeID), in.Flags)
+	ino := Inode(req.header.NodeID)
+	resp, err := s.fs.Open(ctx, ino, in.Flags)
 	if err != nil {
 		return err
 	}
@@ -236,36 +390,225 @@ func handleOpen(s *Server, req *request) error {
 		OpenFlags: uint32(resp.Flags),
 	}
 
+	if resp.BackingID != 0 {
+		if err := s.backing.retain(ino, resp.Handle, resp.BackingID); err != nil {
+			releaseFile(s.fs, ctx, ino, resp.Handle, ReleaseInfo{Flags: in.Flags})
+			return err
+		}
+		out.BackingID = resp.BackingID
+		out.OpenFlags |= proto.FopenPassthrough
+	} else if resp.BackingFd > 0 {
+		if id, ok := s.openBacking(ino, resp.Handle, resp.BackingFd); ok {
+			out.BackingID = id
+			out.OpenFlags |= proto.FopenPassthrough
+		}
+	}
+
 	s.sendResponse(req, openOutBytes(out))
 	return nil
 }
 
 // handleRead processes FUSE_READ.
 func handleRead(s *Server, req *request) error {
-	in := (*proto.ReadIn)(req.body())
+	p, ok := req.bodyAs(proto.ReadInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ReadIn)(p)
+	if err := s.checkReadIn(req, in); err != nil {
+		return err
+	}
+
+	ino := Inode(req.header.NodeID)
+
+	if s.opts.TrackFileTypes {
+		if dir, _ := s.nodes.isDir(ino); dir {
+			return syscall.EISDIR
+		}
+	}
+
+	var limit uint64
+	clamp := false
+	if s.opts.ClampReads {
+		limit, clamp = s.nodes.size(ino)
+		if clamp && in.Offset >= limit {
+			s.sendResponse(req, nil)
+			return nil
+		}
+	}
 
 	ctx := s.newContext(req)
-	data, err := s.fs.Read(
+	read := s.fs.Read
+	if s.opts.FillReads {
+		read = s.fillRead
+	}
+	data, err := read(
 		ctx,
-		Inode(req.header.NodeID),
+		ino,
 		FileHandle(in.Fh),
 		int64(in.Offset),
 		in.Size,
 	)
+	// Data returned along with io.EOF is still a valid short read
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if uint32(len(data)) > in.Size {
+		// The kernel rejects replies longer than the read
+		data = data[:in.Size]
+	}
+	if clamp && in.Offset+uint64(len(data)) > limit {
+		data = data[:limit-in.Offset]
+	}
+
+	s.sendData(req, data)
+	return nil
+}
+
+// maxFillCalls caps the Read calls fillRead makes for one request, in case
+// the filesystem keeps returning tiny chunks.
+const maxFillCalls = 256
+
+// fillRead calls Read until size bytes have been read, the file ends (a
+// short result of 0 bytes or io.EOF), an error occurs or ctx is done
+// (MountOptions.FillReads). An error after some data was read is dropped
+// and the data returned; the kernel will hit the error again when it asks
+// for the rest.
+func (s *Server) fillRead(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	var buf []byte
+	for range maxFillCalls {
+		data, err := s.fs.Read(ctx, ino, fh, offset+int64(len(buf)), size-uint32(len(buf)))
+		if buf == nil {
+			if err != nil || len(data) >= int(size) {
+				return data, err
+			}
+			buf = make([]byte, 0, size)
+		}
+		buf = append(buf, data[:min(len(data), int(size)-len(buf))]...)
+
+		if err != nil || len(data) == 0 || len(buf) == int(size) || ctx.Err() != nil {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// handleLseek processes FUSE_LSEEK.
+func handleLseek(s *Server, req *request) error {
+	p, ok := req.bodyAs(proto.LseekInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.LseekIn)(p)
+
+	ctx := s.newContext(req)
+	off, err := s.fs.Lseek(ctx, Inode(req.header.NodeID), FileHandle(in.Fh), int64(in.Offset), in.Whence)
+	if errors.Is(err, io.EOF) {
+		// Would otherwise be answered as success with no offset
+		err = syscall.ENXIO
+	}
 	if err != nil {
 		return err
 	}
 
-	s.sendResponse(req, data)
+	out := make([]byte, proto.LseekOutSize)
+	binary.LittleEndian.PutUint64(out, uint64(off))
+	s.sendResponse(req, out)
+	return nil
+}
+
+// handlePoll processes FUSE_POLL. Filesystems that don't implement
+// PollFilesystem are answered ENOSYS, after which the kernel stops sending
+// POLL and reports their files as always ready.
+func handlePoll(s *Server, req *request) error {
+	p, ok := req.bodyAs(proto.PollInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.PollIn)(p)
+
+	pfs, ok := s.fs.(PollFilesystem)
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	var kh uint64
+	if in.Flags&proto.PollScheduleNotify != 0 {
+		kh = in.Kh
+	}
+
+	ctx := s.newContext(req)
+	revents, err := pfs.Poll(ctx, Inode(req.header.NodeID), FileHandle(in.Fh), in.Events, kh)
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, proto.PollOutSize)
+	binary.LittleEndian.PutUint32(out, revents)
+	s.sendResponse(req, out)
+	return nil
+}
+
+// handleIoctl processes FUSE_IOCTL. Only restricted ioctls are served,
+// whose buffers the kernel sizes from cmd and copies in one go; the server
+// never asks the kernel to retry with other buffers.
+func handleIoctl(s *Server, req *request) error {
+	p, ok := req.bodyAs(proto.IoctlInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.IoctlIn)(p)
+
+	ifs, ok := s.fs.(IoctlFilesystem)
+	if !ok {
+		return syscall.ENOTTY
+	}
+	if in.Flags&proto.IoctlUnrestricted != 0 {
+		return syscall.EINVAL
+	}
+
+	body := req.bodyBytes()[proto.IoctlInSize:]
+	if uint32(len(body)) < in.InSize {
+		return syscall.EINVAL
+	}
+
+	ctx := s.newContext(req)
+	fh := FileHandle(in.Fh)
+	if in.Flags&proto.IoctlDir != 0 {
+		fh = s.dirHandle(in.Fh)
+	}
+	data, err := ifs.Ioctl(ctx, Inode(req.header.NodeID), fh, in.Cmd, in.Arg, body[:in.InSize], in.OutSize)
+	if err != nil {
+		return err
+	}
+	if uint32(len(data)) > in.OutSize {
+		s.opts.logf("ioctl %#x returned %d bytes, caller takes %d", in.Cmd, len(data), in.OutSize)
+		return syscall.EIO
+	}
+
+	// Result, flags and iovec counts are all 0
+	out := make([]byte, proto.IoctlOutSize+len(data))
+	copy(out[proto.IoctlOutSize:], data)
+	s.sendResponse(req, out)
 	return nil
 }
 
 // handleRelease processes FUSE_RELEASE.
 func handleRelease(s *Server, req *request) error {
-	in := (*proto.ReleaseIn)(req.body())
+	p, ok := req.bodyAs(proto.ReleaseInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ReleaseIn)(p)
 
 	ctx := s.newContext(req)
-	err := s.fs.Release(ctx, Inode(req.header.NodeID), FileHandle(in.Fh))
+	ino := Inode(req.header.NodeID)
+	err := releaseFile(s.fs, ctx, ino, FileHandle(in.Fh), releaseInfo(in))
+
+	// The kernel is done with the handle even if Release failed
+	s.releaseBacking(ino, FileHandle(in.Fh))
+
 	if err != nil {
 		return err
 	}
@@ -276,7 +619,11 @@ func handleRelease(s *Server, req *request) error {
 
 // handleOpendir processes FUSE_OPENDIR.
 func handleOpendir(s *Server, req *request) error {
-	in := (*proto.OpenIn)(req.body())
+	p, ok := req.bodyAs(proto.OpenInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.OpenIn)(p)
 
 	ctx := s.newContext(req)
 	resp, err := s.fs.OpenDir(ctx, Inode(req.header.NodeID), in.Flags)
@@ -288,6 +635,9 @@ func handleOpendir(s *Server, req *request) error {
 		Fh:        uint64(resp.Handle),
 		OpenFlags: uint32(resp.Flags),
 	}
+	if s.keepsDirState() {
+		out.Fh = s.dirs.open(resp.Handle)
+	}
 
 	s.sendResponse(req, openOutBytes(out))
 	return nil
@@ -295,54 +645,89 @@ func handleOpendir(s *Server, req *request) error {
 
 // handleReaddir processes FUSE_READDIR.
 func handleReaddir(s *Server, req *request) error {
-	in := (*proto.ReadIn)(req.body())
+	p, ok := req.bodyAs(proto.ReadInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ReadIn)(p)
+	if err := s.checkReadIn(req, in); err != nil {
+		return err
+	}
 
 	ctx := s.newContext(req)
-	entries, err := s.fs.ReadDir(
+	size := s.dirReadSize(in.Size)
+	entries, err := s.readDir(
 		ctx,
 		Inode(req.header.NodeID),
-		FileHandle(in.Fh),
+		in.Fh,
 		int64(in.Offset),
-		in.Size,
+		size,
 	)
 	if err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		// Cancelled while listing: the entries may be partial, and a
+		// short listing would read as the end of the directory
+		return err
+	}
 
 	// Serialize directory entries
-	data := serializeDirents(entries, in.Size)
+	data := serializeDirents(entries, size)
 	s.sendResponse(req, data)
 	return nil
 }
 
 // handleReaddirplus processes FUSE_READDIRPLUS.
 func handleReaddirplus(s *Server, req *request) error {
-	in := (*proto.ReadIn)(req.body())
+	p, ok := req.bodyAs(proto.ReadInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ReadIn)(p)
+	if err := s.checkReadIn(req, in); err != nil {
+		return err
+	}
 
 	ctx := s.newContext(req)
-	entries, err := s.fs.ReadDirPlus(
-		ctx,
-		Inode(req.header.NodeID),
-		FileHandle(in.Fh),
-		int64(in.Offset),
-		in.Size,
-	)
+	ino := Inode(req.header.NodeID)
+	size := s.dirReadSize(in.Size)
+
+	entries, err := s.readDirPlus(ctx, ino, in.Fh, int64(in.Offset), size)
+	if errors.Is(err, syscall.ENOSYS) {
+		// The kernel asks for READDIRPLUS whatever the filesystem
+		// implements; list with ReadDir instead
+		entries, err = s.readDirAsPlus(ctx, ino, in.Fh, int64(in.Offset), size)
+	}
 	if err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Serialize directory entries with attributes
-	data := serializeDirentsPlus(entries, in.Size)
+	data, n := serializeDirentsPlus(entries, size, s.opts)
+	s.nodes.addPlus(ino, entries[:n])
 	s.sendResponse(req, data)
 	return nil
 }
 
 // handleReleasedir processes FUSE_RELEASEDIR.
 func handleReleasedir(s *Server, req *request) error {
-	in := (*proto.ReleaseIn)(req.body())
+	p, ok := req.bodyAs(proto.ReleaseInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.ReleaseIn)(p)
 
 	ctx := s.newContext(req)
-	err := s.fs.ReleaseDir(ctx, Inode(req.header.NodeID), FileHandle(in.Fh))
+	ino := Inode(req.header.NodeID)
+	fh := FileHandle(in.Fh)
+	if s.keepsDirState() {
+		fh = s.dirs.release(in.Fh).fh
+	}
+	err := s.fs.ReleaseDir(ctx, ino, fh)
 	if err != nil {
 		return err
 	}
@@ -359,13 +744,20 @@ func handleStatfs(s *Server, req *request) error {
 		return err
 	}
 
+	files, ffree := st.Files, st.Ffree
+	if files == 0 {
+		files, ffree = s.opts.StatFSFiles, s.opts.StatFSFfree
+	}
+	// More free than total would show as negative usage in df -i
+	ffree = min(ffree, files)
+
 	out := &proto.StatfsOut{
 		St: proto.Kstatfs{
 			Blocks:  st.Blocks,
 			Bfree:   st.Bfree,
 			Bavail:  st.Bavail,
-			Files:   st.Files,
-			Ffree:   st.Ffree,
+			Files:   files,
+			Ffree:   ffree,
 			Bsize:   st.Bsize,
 			Namelen: st.Namelen,
 			Frsize:  st.Frsize,
@@ -378,7 +770,11 @@ func handleStatfs(s *Server, req *request) error {
 
 // handleAccess processes FUSE_ACCESS.
 func handleAccess(s *Server, req *request) error {
-	in := (*proto.AccessIn)(req.body())
+	p, ok := req.bodyAs(proto.AccessInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.AccessIn)(p)
 
 	ctx := s.newContext(req)
 	err := s.fs.Access(ctx, Inode(req.header.NodeID), in.Mask)
@@ -399,8 +795,67 @@ func handleFlush(s *Server, req *request) error {
 
 // handleInterrupt processes FUSE_INTERRUPT.
 func handleInterrupt(s *Server, req *request) error {
-	// We don't track interruptible operations currently
-	// Just acknowledge the interrupt
+	p, ok := req.bodyAs(proto.InterruptInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.InterruptIn)(p)
+
+	// An interrupt that found its request gets no reply. Otherwise the
+	// request may not have been registered yet, e.g. when another loop
+	// read it: EAGAIN makes the kernel queue the interrupt again, unless
+	// the request has finished, in which case it drops it.
+	if !s.interrupt(in.Unique) {
+		return syscall.EAGAIN
+	}
+	s.count("interrupt", 1)
+	return nil
+}
+
+// handleStatx processes FUSE_STATX. Filesystems that don't implement
+// StatxFilesystem are answered from GetAttr, with the birth time taken
+// from Attr.Btime when they set it.
+func handleStatx(s *Server, req *request) error {
+	p, ok := req.bodyAs(proto.StatxInSize)
+	if !ok {
+		return syscall.EINVAL
+	}
+	in := (*proto.StatxIn)(p)
+
+	var fh *FileHandle
+	if in.GetattrFlags&proto.GetattrFh != 0 {
+		h := FileHandle(in.Fh)
+		fh = &h
+	}
+
+	ctx := s.newContext(req)
+	ino := Inode(req.header.NodeID)
+	var st *Statx
+	var timeout time.Duration
+	if sfs, ok := s.fs.(StatxFilesystem); ok {
+		var err error
+		st, err = sfs.Statx(ctx, ino, fh, in.SxMask, in.SxFlags)
+		if err != nil {
+			return err
+		}
+	} else {
+		resp, err := s.getAttr(ctx, ino, fh)
+		if err != nil {
+			return err
+		}
+		sx := StatxFromAttr(resp.Attr)
+		st, timeout = &sx, resp.Timeout
+	}
+	s.nodes.setAttr(ino, &st.Attr)
+
+	valid, validNsec := s.opts.attrTimeout(timeout)
+	out := &proto.StatxOut{
+		AttrValid:     valid,
+		AttrValidNsec: validNsec,
+		Stat:          statxToProto(st, in.SxMask, s.opts),
+	}
+
+	s.sendResponse(req, statxOutBytes(out))
 	return nil
 }
 
@@ -448,7 +903,7 @@ func openOutBytes(out *proto.OpenOut) []byte {
 	data := make([]byte, proto.OpenOutSize)
 	binary.LittleEndian.PutUint64(data[0:], out.Fh)
 	binary.LittleEndian.PutUint32(data[8:], out.OpenFlags)
-	binary.LittleEndian.PutUint32(data[12:], out.Padding)
+	binary.LittleEndian.PutUint32(data[12:], uint32(out.BackingID))
 	return data
 }
 
@@ -465,6 +920,41 @@ func statfsOutBytes(out *proto.StatfsOut) []byte {
 	return data
 }
 
+func statxOutBytes(out *proto.StatxOut) []byte {
+	data := make([]byte, proto.StatxOutSize)
+	binary.LittleEndian.PutUint64(data[0:], out.AttrValid)
+	binary.LittleEndian.PutUint32(data[8:], out.AttrValidNsec)
+	binary.LittleEndian.PutUint32(data[12:], out.Flags)
+
+	st := &out.Stat
+	b := data[32:]
+	binary.LittleEndian.PutUint32(b[0:], st.Mask)
+	binary.LittleEndian.PutUint32(b[4:], st.Blksize)
+	binary.LittleEndian.PutUint64(b[8:], st.Attributes)
+	binary.LittleEndian.PutUint32(b[16:], st.Nlink)
+	binary.LittleEndian.PutUint32(b[20:], st.Uid)
+	binary.LittleEndian.PutUint32(b[24:], st.Gid)
+	binary.LittleEndian.PutUint16(b[28:], st.Mode)
+	binary.LittleEndian.PutUint64(b[32:], st.Ino)
+	binary.LittleEndian.PutUint64(b[40:], st.Size)
+	binary.LittleEndian.PutUint64(b[48:], st.Blocks)
+	binary.LittleEndian.PutUint64(b[56:], st.AttributesMask)
+	writeSxTime(b[64:], &st.Atime)
+	writeSxTime(b[80:], &st.Btime)
+	writeSxTime(b[96:], &st.Ctime)
+	writeSxTime(b[112:], &st.Mtime)
+	binary.LittleEndian.PutUint32(b[128:], st.RdevMajor)
+	binary.LittleEndian.PutUint32(b[132:], st.RdevMinor)
+	binary.LittleEndian.PutUint32(b[136:], st.DevMajor)
+	binary.LittleEndian.PutUint32(b[140:], st.DevMinor)
+	return data
+}
+
+func writeSxTime(data []byte, t *proto.SxTime) {
+	binary.LittleEndian.PutUint64(data[0:], uint64(t.Sec))
+	binary.LittleEndian.PutUint32(data[8:], t.Nsec)
+}
+
 func writeAttr(data []byte, attr *proto.Attr) {
 	binary.LittleEndian.PutUint64(data[0:], attr.Ino)
 	binary.LittleEndian.PutUint64(data[8:], attr.Size)
@@ -484,7 +974,7 @@ func writeAttr(data []byte, attr *proto.Attr) {
 	binary.LittleEndian.PutUint32(data[84:], attr.Flags)
 }
 
-func entryToProto(entry *Entry) *proto.EntryOut {
+func entryToProto(entry *Entry, opts *MountOptions) *proto.EntryOut {
 	entrySec, entryNsec := durationToTimespec(entry.EntryTimeout)
 	attrSec, attrNsec := durationToTimespec(entry.AttrTimeout)
 
@@ -495,7 +985,7 @@ func entryToProto(entry *Entry) *proto.EntryOut {
 		EntryValidNsec: entryNsec,
 		AttrValid:      attrSec,
 		AttrValidNsec:  attrNsec,
-		Attr:           attrToProto(&entry.Attr),
+		Attr:           attrToProto(&entry.Attr, opts),
 	}
 }
 
@@ -526,9 +1016,32 @@ func serializeDirents(entries []DirEntry, maxSize uint32) []byte {
 	return buf
 }
 
-func serializeDirentsPlus(entries []DirEntryPlus, maxSize uint32) []byte {
+// direntPlusType returns the type written for a READDIRPLUS entry: the
+// one of its mode, or Type if the mode has none.
+func direntPlusType(entry *DirEntryPlus) uint32 {
+	typ := FileModeType(entry.Entry.Attr.Mode)
+	if typ == proto.DtUnknown {
+		typ = entry.Type
+	}
+	return typ
+}
+
+// direntPlusIno returns the inode number listed for a READDIRPLUS entry:
+// its node id, or Attr.Ino for entries sent without one (node id 0), which
+// readdir(3) would otherwise skip.
+func direntPlusIno(entry *DirEntryPlus) Inode {
+	if entry.Entry.Ino != 0 {
+		return entry.Entry.Ino
+	}
+	return entry.Entry.Attr.Ino
+}
+
+// serializeDirentsPlus encodes as many entries as fit in maxSize and
+// returns the data and the number of entries encoded.
+func serializeDirentsPlus(entries []DirEntryPlus, maxSize uint32, opts *MountOptions) ([]byte, int) {
 	buf := make([]byte, 0, maxSize)
 
+	n := 0
 	for _, entry := range entries {
 		// Calculate entry size (padded to 8 bytes)
 		nameLen := len(entry.Name)
@@ -540,19 +1053,20 @@ func serializeDirentsPlus(entries []DirEntryPlus, maxSize uint32) []byte {
 		}
 
 		// Write EntryOut + Dirent
-		entryOut := entryToProto(&entry.Entry)
+		entryOut := entryToProto(&entry.Entry, opts)
 		entryOutData := entryOutBytes(entryOut)
 
 		direntData := make([]byte, paddedSize-proto.EntryOutSize)
-		binary.LittleEndian.PutUint64(direntData[0:], uint64(entry.Entry.Ino))
-		binary.LittleEndian.PutUint64(direntData[8:], entry.Entry.Generation) // Use generation as offset
+		binary.LittleEndian.PutUint64(direntData[0:], uint64(direntPlusIno(&entry)))
+		binary.LittleEndian.PutUint64(direntData[8:], entry.Offset)
 		binary.LittleEndian.PutUint32(direntData[16:], uint32(nameLen))
-		binary.LittleEndian.PutUint32(direntData[20:], fileModeToType(entry.Entry.Attr.Mode))
+		binary.LittleEndian.PutUint32(direntData[20:], direntPlusType(&entry))
 		copy(direntData[proto.DirentSize:], entry.Name)
 
 		buf = append(buf, entryOutData...)
 		buf = append(buf, direntData...)
+		n++
 	}
 
-	return buf
+	return buf, n
 }
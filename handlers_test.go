@@ -0,0 +1,346 @@
+package rofuse
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// fillWire sets every field of the struct v points to a distinct non-zero
+// value, leaving the reserved ones (Unused, Padding, Spare*, Reserved)
+// zero as the packers do.
+func fillWire(v any) {
+	n := uint64(0)
+	var fill func(rv reflect.Value)
+	fill = func(rv reflect.Value) {
+		switch rv.Kind() {
+		case reflect.Struct:
+			for i := range rv.NumField() {
+				name := rv.Type().Field(i).Name
+				if name == "Unused" || name == "Padding" || name == "Reserved" || strings.HasPrefix(name, "Spare") {
+					continue
+				}
+				fill(rv.Field(i))
+			}
+		case reflect.Array:
+			for i := range rv.Len() {
+				fill(rv.Index(i))
+			}
+		case reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n++
+			rv.SetUint(n<<(rv.Type().Bits()-8) | n)
+		case reflect.Int32, reflect.Int64:
+			n++
+			rv.SetInt(int64(n<<(rv.Type().Bits()-16) | n))
+		default:
+			panic("fillWire: unexpected " + rv.Kind().String())
+		}
+	}
+	fill(reflect.ValueOf(v).Elem())
+}
+
+// Every reply packer writes exactly its declared size, with each field
+// where the kernel's struct has it.
+func TestReplyPackers(t *testing.T) {
+	check := func(t *testing.T, got []byte, size int, want []byte) {
+		t.Helper()
+		if len(got) != size {
+			t.Fatalf("packed %d bytes, want %d", len(got), size)
+		}
+		if len(want) != size {
+			t.Fatalf("struct is %d bytes, declared size %d", len(want), size)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("packed\n%x\nwant\n%x", got, want)
+		}
+	}
+
+	t.Run("InitOut", func(t *testing.T) {
+		var out proto.InitOut
+		fillWire(&out)
+		check(t, initOutBytes(&out), proto.InitOutSize, wireBytes(&out))
+	})
+	t.Run("EntryOut", func(t *testing.T) {
+		var out proto.EntryOut
+		fillWire(&out)
+		check(t, entryOutBytes(&out), proto.EntryOutSize, wireBytes(&out))
+	})
+	t.Run("AttrOut", func(t *testing.T) {
+		var out proto.AttrOut
+		fillWire(&out)
+		check(t, attrOutBytes(&out), proto.AttrOutSize, wireBytes(&out))
+	})
+	t.Run("OpenOut", func(t *testing.T) {
+		var out proto.OpenOut
+		fillWire(&out)
+		check(t, openOutBytes(&out), proto.OpenOutSize, wireBytes(&out))
+	})
+	t.Run("StatfsOut", func(t *testing.T) {
+		var out proto.StatfsOut
+		fillWire(&out)
+		check(t, statfsOutBytes(&out), proto.StatfsOutSize, wireBytes(&out))
+	})
+	t.Run("StatxOut", func(t *testing.T) {
+		var out proto.StatxOut
+		fillWire(&out)
+		check(t, statxOutBytes(&out), proto.StatxOutSize, wireBytes(&out))
+	})
+}
+
+// The sizes the wire structs are cut to and read from match their layout.
+func TestWireSizes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  uintptr
+		want int
+	}{
+		{"Attr", unsafe.Sizeof(proto.Attr{}), proto.AttrSize},
+		{"Kstatfs", unsafe.Sizeof(proto.Kstatfs{}), proto.KstatfsSize},
+		{"Statx", unsafe.Sizeof(proto.Statx{}), proto.StatxSize},
+		{"LseekOut", unsafe.Sizeof(proto.LseekOut{}), proto.LseekOutSize},
+		{"PollOut", unsafe.Sizeof(proto.PollOut{}), proto.PollOutSize},
+		{"IoctlOut", unsafe.Sizeof(proto.IoctlOut{}), proto.IoctlOutSize},
+		{"NotifyPollWakeupOut", unsafe.Sizeof(proto.NotifyPollWakeupOut{}), proto.NotifyPollWakeupOutSize},
+		{"NotifyInvalInodeOut", unsafe.Sizeof(proto.NotifyInvalInodeOut{}), proto.NotifyInvalInodeOutSize},
+		{"NotifyInvalEntryOut", unsafe.Sizeof(proto.NotifyInvalEntryOut{}), proto.NotifyInvalEntryOutSize},
+		{"NotifyDeleteOut", unsafe.Sizeof(proto.NotifyDeleteOut{}), proto.NotifyDeleteOutSize},
+	} {
+		if int(tc.got) != tc.want {
+			t.Errorf("%s: struct is %d bytes, declared size %d", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+// Kernels before 7.36 send a 16-byte INIT body, without Flags2.
+func TestInitCompatBody(t *testing.T) {
+	in := wireBytes(&proto.InitIn{
+		Major: proto.FuseKernelVersion,
+		Minor: 31,
+		Flags: uint32(proto.CapAsyncRead | proto.CapInitExt),
+	})
+
+	k := newTestKernel(t, newTestFS(), nil)
+	if errno, _ := k.call(proto.OpInit, 0, in[:initInCompatSize-1]); syscall.Errno(-errno) != syscall.EINVAL {
+		t.Fatalf("%d-byte INIT: errno %v, want EINVAL", initInCompatSize-1, syscall.Errno(-errno))
+	}
+	out := wireStruct[proto.InitOut](t, k.mustCall(proto.OpInit, 0, in[:initInCompatSize]))
+	if out.Minor != 31 {
+		t.Errorf("minor %d, want 31", out.Minor)
+	}
+	if out.Flags2 != 0 {
+		t.Errorf("Flags2 %#x from a body without it", out.Flags2)
+	}
+}
+
+// FuzzRequestBody sends every opcode bodies of any length. Those shorter
+// than the handler's minimum are answered EINVAL, and no handler panics
+// or leaves the server unable to answer.
+func FuzzRequestBody(f *testing.F) {
+	var ops []uint32
+	for _, op := range slices.Sorted(maps.Keys(handlers)) {
+		if op != proto.OpInit && op != proto.OpDestroy {
+			ops = append(ops, op)
+		}
+	}
+	for i, op := range ops {
+		if n := handlers[op].minBody; n > 0 {
+			f.Add(uint8(i), make([]byte, n-1))
+			f.Add(uint8(i), make([]byte, n))
+		} else {
+			f.Add(uint8(i), []byte("name\x00"))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, i uint8, body []byte) {
+		op := ops[int(i)%len(ops)]
+		fs := newTestFS()
+		fs.create(RootInode, "name", []byte("data"))
+		k := newTestServer(t, fs, &MountOptions{
+			PanicHandler: func(op uint32, unique uint64, v any, stack []byte) {
+				t.Errorf("%s panicked: %v\n%s", proto.OpcodeName(op), v, stack)
+			},
+		})
+
+		unique := k.send(op, uint64(RootInode), body)
+		if op != proto.OpForget && op != proto.OpBatchForget {
+			errno, _ := k.recv(unique)
+			if len(body) < handlers[op].minBody && syscall.Errno(-errno) != syscall.EINVAL {
+				t.Errorf("%d-byte %s: errno %v, want EINVAL", len(body), proto.OpcodeName(op), syscall.Errno(-errno))
+			}
+		}
+		k.getattr(RootInode)
+	})
+}
+
+// With ClampReads the size the kernel was given bounds reads, however much
+// data the filesystem has behind it.
+func TestClampReads(t *testing.T) {
+	fs := newTestFS()
+	data := []byte("0123456789")
+	short := fs.add(RootInode, "short", &testNode{attr: Attr{Mode: 0644, Size: 4}, data: data})
+	empty := fs.add(RootInode, "empty", &testNode{attr: Attr{Mode: 0644}, data: data})
+	unseen := fs.add(RootInode, "unseen", &testNode{attr: Attr{Mode: 0644, Size: 4}, data: data})
+	k := newTestServer(t, fs, &MountOptions{ClampReads: true})
+	k.lookup(RootInode, "short")
+	k.lookup(RootInode, "empty")
+
+	fh := k.open(short)
+	for _, tc := range []struct {
+		off  uint64
+		size uint32
+		want string
+	}{
+		{0, 2, "01"},
+		{2, 10, "23"}, // Straddles the reported size
+		{4, 10, ""},   // At it
+		{6, 10, ""},   // Past it
+	} {
+		if got := string(k.readFile(short, fh, tc.off, tc.size)); got != tc.want {
+			t.Errorf("read of %d at %d = %q, want %q", tc.size, tc.off, got, tc.want)
+		}
+	}
+
+	if got := k.readFile(empty, k.open(empty), 0, 10); len(got) != 0 {
+		t.Errorf("read of a zero-size file = %q, want nothing", got)
+	}
+	// Without a reported size, the data is taken as is
+	if got := string(k.readFile(unseen, k.open(unseen), 2, 10)); got != "23456789" {
+		t.Errorf("read of a file never looked up = %q, want %q", got, "23456789")
+	}
+}
+
+// chunkFS returns at most chunk bytes per Read, with io.EOF alongside the
+// last of the data, and counts the calls.
+type chunkFS struct {
+	*testFS
+	chunk int
+	calls atomic.Int32
+}
+
+func (f *chunkFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	f.calls.Add(1)
+	data, err := f.testFS.Read(ctx, ino, fh, offset, min(size, uint32(f.chunk)))
+	if err != nil {
+		return nil, err
+	}
+	n, _ := f.node(ino)
+	if offset+int64(len(data)) >= int64(len(n.data)) {
+		return data, io.EOF
+	}
+	return data, nil
+}
+
+// Data returned along with io.EOF is a short read, not an error.
+func TestReadEOFData(t *testing.T) {
+	fs := &chunkFS{testFS: newTestFS(), chunk: 100}
+	ino := fs.create(RootInode, "file", []byte("0123456789"))
+	k := newTestServer(t, fs, nil)
+	fh := k.open(ino)
+
+	if got := string(k.readFile(ino, fh, 4, 100)); got != "456789" {
+		t.Errorf("read up to EOF = %q, want %q", got, "456789")
+	}
+	if got := k.readFile(ino, fh, 10, 100); len(got) != 0 {
+		t.Errorf("read at EOF = %q, want nothing", got)
+	}
+}
+
+// With FillReads short results are followed up until the read is full or
+// the file ends; without it the first one is the reply.
+func TestFillReads(t *testing.T) {
+	for _, fill := range []bool{false, true} {
+		fs := &chunkFS{testFS: newTestFS(), chunk: 3}
+		ino := fs.create(RootInode, "file", []byte("0123456789"))
+		k := newTestServer(t, fs, &MountOptions{FillReads: fill})
+		fh := k.open(ino)
+
+		for _, tc := range []struct {
+			off      uint64
+			size     uint32
+			want     string
+			wantFill string
+			calls    int32 // With FillReads
+		}{
+			{0, 8, "012", "01234567", 3},
+			{2, 100, "234", "23456789", 3}, // Ends with io.EOF
+			{9, 100, "9", "9", 1},
+			{10, 100, "", "", 1},
+		} {
+			fs.calls.Store(0)
+			want, calls := tc.want, int32(1)
+			if fill {
+				want, calls = tc.wantFill, tc.calls
+			}
+			if got := string(k.readFile(ino, fh, tc.off, tc.size)); got != want {
+				t.Errorf("FillReads %v: read of %d at %d = %q, want %q", fill, tc.size, tc.off, got, want)
+			}
+			if n := fs.calls.Load(); n != calls {
+				t.Errorf("FillReads %v: read of %d at %d took %d calls, want %d", fill, tc.size, tc.off, n, calls)
+			}
+		}
+	}
+}
+
+// With TrackFileTypes a READ on an inode last reported as a directory is
+// answered EISDIR, until the kernel forgets the inode.
+func TestTrackFileTypes(t *testing.T) {
+	fs := newTestFS()
+	dir := fs.mkdir(RootInode, "dir")
+	file := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{TrackFileTypes: true})
+	k.lookup(RootInode, "dir")
+	k.lookup(RootInode, "file")
+
+	read := wireBytes(&proto.ReadIn{Size: 4096})
+	for _, ino := range []Inode{dir, RootInode} {
+		if errno, _ := k.call(proto.OpRead, uint64(ino), read); syscall.Errno(-errno) != syscall.EISDIR {
+			t.Errorf("READ of directory %d: errno %v, want EISDIR", ino, syscall.Errno(-errno))
+		}
+	}
+	if got := string(k.readFile(file, k.open(file), 0, 4096)); got != "data" {
+		t.Errorf("READ of a file = %q, want %q", got, "data")
+	}
+
+	k.send(proto.OpForget, uint64(dir), wireBytes(&proto.ForgetIn{Nlookup: 1}))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := k.s.nodes.isDir(dir); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("type still tracked after FORGET")
+		}
+	}
+	// Unknown again, so the filesystem decides
+	if errno, _ := k.call(proto.OpRead, uint64(dir), read); errno != 0 {
+		t.Errorf("READ of a forgotten directory: errno %v, want the filesystem's answer", syscall.Errno(-errno))
+	}
+}
+
+// A request whose header length is not what was read is refused before
+// its body is looked at, whether the header claims more or less.
+func TestHeaderLength(t *testing.T) {
+	fs := newTestFS()
+	fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, nil)
+
+	body := []byte("file\x00")
+	for _, delta := range []int{8, -2} {
+		h := k.header(proto.OpLookup, uint64(RootInode))
+		h.Len = uint32(proto.InHeaderSize + len(body) + delta)
+		k.sendHeader(&h, body)
+		if errno, _ := k.recv(h.Unique); syscall.Errno(-errno) != syscall.EINVAL {
+			t.Errorf("header length off by %d: errno %v, want EINVAL", delta, syscall.Errno(-errno))
+		}
+	}
+	k.lookup(RootInode, "file")
+}
@@ -0,0 +1,84 @@
+package rofuse
+
+import "math"
+
+// IDMapRange maps Count consecutive ids starting at From (as stored by
+// the filesystem) to the ids starting at To (as shown to the system). The
+// part of a range that would go past the largest id on either side is
+// ignored.
+type IDMapRange struct {
+	From  uint32
+	To    uint32
+	Count uint32
+}
+
+// contains reports whether id is in the Count ids starting at start, and
+// at which offset. Offsets that would take From or To past the largest
+// id are out of the range.
+func (r IDMapRange) contains(start, id uint32) (uint32, bool) {
+	off := id - start
+	if id < start || off >= r.Count {
+		return 0, false
+	}
+	return off, uint64(max(r.From, r.To))+uint64(off) <= math.MaxUint32
+}
+
+// IDMap translates uids or gids between the filesystem and the system,
+// like a user namespace id map applied at the FUSE layer
+// (MountOptions.UidMap, MountOptions.GidMap). Ranges should not overlap;
+// the first matching one wins.
+type IDMap []IDMapRange
+
+// Map translates a filesystem id to the id reported to the system. ok is
+// false if no range contains id.
+func (m IDMap) Map(id uint32) (mapped uint32, ok bool) {
+	for _, r := range m {
+		if off, ok := r.contains(r.From, id); ok {
+			return r.To + off, true
+		}
+	}
+	return 0, false
+}
+
+// Reverse translates a system id, such as the id of a caller, back to the
+// filesystem's id space. ok is false if no range maps to id. The server
+// already applies it to the ids of the Context passed to the filesystem.
+func (m IDMap) Reverse(id uint32) (orig uint32, ok bool) {
+	for _, r := range m {
+		if off, ok := r.contains(r.To, id); ok {
+			return r.From + off, true
+		}
+	}
+	return 0, false
+}
+
+// mapID applies m to id for reporting. Unmapped ids are reported as
+// nobody if set, and unchanged otherwise.
+func mapID(m IDMap, id uint32, nobody *uint32) uint32 {
+	if len(m) == 0 {
+		return id
+	}
+	if mapped, ok := m.Map(id); ok {
+		return mapped
+	}
+	if nobody != nil {
+		return *nobody
+	}
+	return id
+}
+
+// reverseID applies m backwards to the id of a caller, so that the
+// filesystem sees it in its own id space. Callers no range maps to are
+// seen as nobody if set, and unchanged otherwise.
+func reverseID(m IDMap, id uint32, nobody *uint32) uint32 {
+	if len(m) == 0 {
+		return id
+	}
+	if orig, ok := m.Reverse(id); ok {
+		return orig
+	}
+	if nobody != nil {
+		return *nobody
+	}
+	return id
+}
@@ -0,0 +1,106 @@
+package rofuse
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func TestIDMap(t *testing.T) {
+	m := IDMap{{From: 1000, To: 500, Count: 10}}
+	for _, tt := range []struct {
+		id, want uint32
+		ok       bool
+	}{
+		{1000, 500, true},
+		{1009, 509, true},
+		{1010, 0, false},
+		{999, 0, false},
+	} {
+		if got, ok := m.Map(tt.id); got != tt.want || ok != tt.ok {
+			t.Errorf("Map(%d) = %d, %v; want %d, %v", tt.id, got, ok, tt.want, tt.ok)
+		}
+		if tt.ok {
+			if back, ok := m.Reverse(tt.want); back != tt.id || !ok {
+				t.Errorf("Reverse(%d) = %d, %v; want %d", tt.want, back, ok, tt.id)
+			}
+		}
+	}
+
+	nobody := uint32(65534)
+	if got := mapID(m, 42, nil); got != 42 {
+		t.Errorf("unmapped id reported as %d, want 42", got)
+	}
+	if got := mapID(m, 42, &nobody); got != nobody {
+		t.Errorf("unmapped id reported as %d, want nobody", got)
+	}
+}
+
+// Ranges reaching past the largest id stop there instead of wrapping.
+func TestIDMapOverflow(t *testing.T) {
+	m := IDMap{{From: 10, To: math.MaxUint32 - 4, Count: 100}}
+	if got, ok := m.Map(14); got != math.MaxUint32 || !ok {
+		t.Errorf("Map(14) = %d, %v; want %d", got, ok, uint32(math.MaxUint32))
+	}
+	if got, ok := m.Map(15); ok {
+		t.Errorf("Map(15) = %d, want out of range", got)
+	}
+	if got, ok := m.Reverse(1); ok {
+		t.Errorf("Reverse(1) = %d, want out of range", got)
+	}
+
+	m = IDMap{{From: math.MaxUint32 - 1, To: 0, Count: 10}}
+	if got, ok := m.Reverse(2); ok {
+		t.Errorf("Reverse(2) = %d, want out of range", got)
+	}
+}
+
+// accessFS sends the ids of the callers of Access to callers.
+type accessFS struct {
+	*testFS
+	callers chan [2]uint32
+}
+
+func newAccessFS() *accessFS {
+	return &accessFS{testFS: newTestFS(), callers: make(chan [2]uint32, 1)}
+}
+
+func (f *accessFS) Access(ctx Context, ino Inode, mask uint32) error {
+	f.callers <- [2]uint32{ctx.Uid(), ctx.Gid()}
+	return nil
+}
+
+func TestIDMapCaller(t *testing.T) {
+	fs := newAccessFS()
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	k := newTestServer(t, fs, &MountOptions{
+		UidMap: IDMap{{From: 1000, To: uid, Count: 1}},
+		GidMap: IDMap{{From: 2000, To: gid, Count: 1}},
+	})
+
+	k.mustCall(proto.OpAccess, uint64(RootInode), wireBytes(&proto.AccessIn{Mask: 4}))
+	if ids := <-fs.callers; ids != [2]uint32{1000, 2000} {
+		t.Errorf("Access saw %d:%d, want 1000:2000", ids[0], ids[1])
+	}
+}
+
+func TestIDMapUnmappedCaller(t *testing.T) {
+	fs := newAccessFS()
+	uid := uint32(os.Getuid())
+	nobody := uint32(65534)
+	k := newTestServer(t, fs, &MountOptions{
+		UidMap:     IDMap{{From: 1000, To: uid + 1, Count: 1}},
+		UnmappedID: &nobody,
+	})
+
+	k.mustCall(proto.OpAccess, uint64(RootInode), wireBytes(&proto.AccessIn{Mask: 4}))
+	ids := <-fs.callers
+	if ids[0] != nobody {
+		t.Errorf("Access saw uid %d, want nobody", ids[0])
+	}
+	if ids[1] != uint32(os.Getgid()) {
+		t.Errorf("Access saw gid %d, want %d without a gid map", ids[1], os.Getgid())
+	}
+}
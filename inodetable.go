@@ -0,0 +1,347 @@
+package rofuse
+
+import (
+	"container/list"
+	"sync"
+)
+
+// InodeTable hands out inode numbers for filesystems that create inodes on
+// demand, and recycles them once the kernel has forgotten them.
+//
+// A recycled number gets a higher generation than any object it was used
+// for before. Return it in Entry.Generation: if the kernel still holds
+// something cached for the old object (a FORGET racing with the LOOKUP
+// that reuses the number), the generation tells the two apart, and NFS
+// exports reject stale handles instead of reaching the new object.
+//
+// The root inode is always allocated and never freed. The number of live
+// inodes only depends on what the kernel keeps cached; SetLimit bounds it.
+// Forget must see every FORGET the filesystem receives, which embedding
+// InodeTableBase takes care of.
+type InodeTable struct {
+	mu   sync.Mutex
+	next Inode
+	refs map[Inode]uint64 // Kernel lookup count of live inodes
+	gens map[Inode]uint64 // Current generation of every number ever used
+	free []Inode          // Forgotten numbers, reused oldest first
+
+	byKey map[any]Inode // Live inodes created by GetOrCreate
+	keys  map[Inode]any
+
+	onForget func(ino Inode, key any) // See SetOnForget
+
+	// High-water eviction, see SetLimit
+	limit    int
+	evict    func(inos []Inode) (kept []Inode)
+	lru      *list.List // Live inodes, most recently used first
+	lruPos   map[Inode]*list.Element
+	evicting map[Inode]bool // Handed to evict, not forgotten yet
+}
+
+// NewInodeTable returns a table with only the root inode allocated.
+func NewInodeTable() *InodeTable {
+	return &InodeTable{
+		next:  RootInode + 1,
+		refs:  map[Inode]uint64{RootInode: 1},
+		gens:  map[Inode]uint64{RootInode: 0},
+		byKey: make(map[any]Inode),
+		keys:  make(map[Inode]any),
+	}
+}
+
+// Allocate returns an inode number for a new object with its generation,
+// counting one kernel reference: call it when the object is first
+// returned from Lookup or ReadDirPlus, and Ref when it is returned again.
+func (t *InodeTable) Allocate() (Inode, uint64) {
+	t.mu.Lock()
+	ino, gen := t.allocate()
+	batch := t.overLimit()
+	t.mu.Unlock()
+
+	if len(batch) > 0 {
+		go t.runEvict(batch)
+	}
+	return ino, gen
+}
+
+// allocate is Allocate with t.mu held.
+func (t *InodeTable) allocate() (Inode, uint64) {
+	var ino Inode
+	if len(t.free) > 0 {
+		ino = t.free[0]
+		t.free[0] = 0
+		t.free = t.free[1:]
+		t.gens[ino]++
+	} else {
+		ino = t.next
+		t.next++
+		t.gens[ino] = 0
+	}
+	t.refs[ino] = 1
+	t.touch(ino)
+	return ino, t.gens[ino]
+}
+
+// GetOrCreate returns the inode of the object identified by key, such as
+// a remote path or object id, allocating one if key has no live inode,
+// and counts one kernel reference on it. created reports whether the
+// inode is new. Concurrent calls with the same key, e.g. from LOOKUPs of
+// the same name running in parallel, all get the same inode, which a
+// filesystem discovering its tree lazily needs to keep the kernel's cache
+// consistent. The key is dropped once Forget frees the inode, and the next
+// GetOrCreate of it allocates a fresh one. key must be comparable.
+func (t *InodeTable) GetOrCreate(key any) (ino Inode, created bool) {
+	t.mu.Lock()
+	if ino, ok := t.byKey[key]; ok {
+		t.refs[ino]++
+		t.touch(ino)
+		t.mu.Unlock()
+		return ino, false
+	}
+	ino, _ = t.allocate()
+	t.byKey[key] = ino
+	t.keys[ino] = key
+	batch := t.overLimit()
+	t.mu.Unlock()
+
+	if len(batch) > 0 {
+		go t.runEvict(batch)
+	}
+	return ino, true
+}
+
+// Key returns the key ino was created for by GetOrCreate, and whether it
+// has one.
+func (t *InodeTable) Key(ino Inode) (any, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.keys[ino]
+	return key, ok
+}
+
+// Ref counts one more kernel reference on a live inode and returns its
+// generation. ok is false if ino is not allocated.
+func (t *InodeTable) Ref(ino Inode) (gen uint64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.refs[ino]; !ok {
+		return 0, false
+	}
+	t.refs[ino]++
+	t.touch(ino)
+	return t.gens[ino], true
+}
+
+// Forget drops nlookup kernel references, as passed to Filesystem.Forget.
+// It returns true if that was the last one and the number was freed for
+// reuse.
+func (t *InodeTable) Forget(ino Inode, nlookup uint64) bool {
+	t.mu.Lock()
+	key, freed := t.forget(ino, nlookup)
+	onForget := t.onForget
+	t.mu.Unlock()
+
+	if freed && onForget != nil {
+		onForget(ino, key)
+	}
+	return freed
+}
+
+// BatchForget is Forget for every entry, as passed to
+// Filesystem.BatchForget, taking the lock once. It returns the inodes
+// that were freed.
+func (t *InodeTable) BatchForget(entries []ForgetEntry) []Inode {
+	var freed []Inode
+	var keys []any
+
+	t.mu.Lock()
+	for _, e := range entries {
+		if key, ok := t.forget(e.Ino, e.Nlookup); ok {
+			freed = append(freed, e.Ino)
+			keys = append(keys, key)
+		}
+	}
+	onForget := t.onForget
+	t.mu.Unlock()
+
+	if onForget != nil {
+		for i, ino := range freed {
+			onForget(ino, keys[i])
+		}
+	}
+	return freed
+}
+
+// forget is Forget with t.mu held. It returns the key the inode was
+// created for, if any, when it is freed.
+func (t *InodeTable) forget(ino Inode, nlookup uint64) (any, bool) {
+	refs, ok := t.refs[ino]
+	if !ok || ino == RootInode {
+		return nil, false
+	}
+	if nlookup < refs {
+		t.refs[ino] = refs - nlookup
+		return nil, false
+	}
+	delete(t.refs, ino)
+	if e, ok := t.lruPos[ino]; ok {
+		t.lru.Remove(e)
+		delete(t.lruPos, ino)
+		delete(t.evicting, ino)
+	}
+	key, hasKey := t.keys[ino]
+	if hasKey {
+		delete(t.keys, ino)
+		delete(t.byKey, key)
+	}
+	t.free = append(t.free, ino)
+	return key, true
+}
+
+// SetOnForget sets a function called with every inode the kernel has
+// fully forgotten, once its number is freed, so that caches holding data
+// for it can drop it. key is what the inode was created for by
+// GetOrCreate, or nil. fn runs on the goroutine calling Forget or
+// BatchForget, after the table is unlocked, so it may use the table; a
+// GetOrCreate of the same key racing with it gets a fresh inode.
+func (t *InodeTable) SetOnForget(fn func(ino Inode, key any)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onForget = fn
+}
+
+// Generation returns the current generation of ino, and whether it is
+// allocated.
+func (t *InodeTable) Generation(ino Inode) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.refs[ino]; !ok {
+		return 0, false
+	}
+	return t.gens[ino], true
+}
+
+// Len returns the number of live inodes, the root included.
+func (t *InodeTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.refs)
+}
+
+// SetLimit bounds the number of live inodes for long-running filesystems
+// facing access patterns, such as stats of millions of unique paths, that
+// would otherwise grow the table as long as the kernel keeps the entries
+// cached. Past max live inodes (root excluded), the least recently
+// returned ones are passed to evict, which should ask the kernel to drop
+// them, typically Server.EvictInodes, and return those it could not ask
+// about; they are retried after the others. The table cannot reclaim an
+// inode the kernel still references: the numbers are only freed once the
+// resulting FORGETs reach Forget, and inodes the kernel keeps (open files,
+// current directories) stay live. Eviction goes down to 90% of max so it
+// happens in batches.
+//
+// evict runs in its own goroutine, never from the call that allocated:
+// invalidating an entry while a LOOKUP is being answered in the same
+// directory would wait on that LOOKUP. A max of 0 disables eviction.
+func (t *InodeTable) SetLimit(max int, evict func(inos []Inode) (kept []Inode)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limit = max
+	t.evict = evict
+	if max <= 0 {
+		t.lru, t.lruPos, t.evicting = nil, nil, nil
+		return
+	}
+	if t.lru == nil {
+		t.lru = list.New()
+		t.lruPos = make(map[Inode]*list.Element)
+		t.evicting = make(map[Inode]bool)
+		for ino := range t.refs {
+			t.touch(ino)
+		}
+	}
+}
+
+// touch marks ino as just used. The root is never evicted, so it is not
+// tracked. Called with t.mu held.
+func (t *InodeTable) touch(ino Inode) {
+	if t.lru == nil || ino == RootInode {
+		return
+	}
+	if e, ok := t.lruPos[ino]; ok {
+		t.lru.MoveToFront(e)
+	} else {
+		t.lruPos[ino] = t.lru.PushFront(ino)
+	}
+	delete(t.evicting, ino)
+}
+
+// overLimit returns the inodes to evict if the table has grown past its
+// limit. Called with t.mu held.
+func (t *InodeTable) overLimit() []Inode {
+	if t.lru == nil || t.evict == nil || t.lru.Len() <= t.limit {
+		return nil
+	}
+
+	n := t.lru.Len() - len(t.evicting) - (t.limit - t.limit/10)
+	var batch []Inode
+	for e := t.lru.Back(); e != nil && len(batch) < n; e = e.Prev() {
+		ino := e.Value.(Inode)
+		if !t.evicting[ino] {
+			t.evicting[ino] = true
+			batch = append(batch, ino)
+		}
+	}
+	return batch
+}
+
+// runEvict passes batch to the evict callback. The inodes it kept are no
+// longer being evicted, and go to the front of the queue, so that the
+// next batch is made of others.
+func (t *InodeTable) runEvict(batch []Inode) {
+	t.mu.Lock()
+	evict := t.evict
+	t.mu.Unlock()
+	if evict == nil {
+		return
+	}
+	kept := evict(batch)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ino := range kept {
+		if t.evicting[ino] {
+			t.touch(ino)
+		}
+	}
+}
+
+// InodeTableBase is FilesystemBase for filesystems that number their
+// inodes with an InodeTable: embed it instead of FilesystemBase and set
+// Inodes, and FORGET and BATCH_FORGET drop the kernel's references in the
+// table without further code. Filesystems embedding both would get two
+// conflicting Forget methods.
+type InodeTableBase struct {
+	FilesystemBase
+	Inodes *InodeTable
+}
+
+// Forget drops nlookup references on ino in Inodes.
+func (b *InodeTableBase) Forget(ctx Context, ino Inode, nlookup uint64) {
+	if b.Inodes != nil {
+		b.Inodes.Forget(ino, nlookup)
+	}
+}
+
+// BatchForget drops the references of every entry in Inodes.
+func (b *InodeTableBase) BatchForget(ctx Context, entries []ForgetEntry) {
+	if b.Inodes != nil {
+		b.Inodes.BatchForget(entries)
+	}
+}
@@ -0,0 +1,294 @@
+package rofuse
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
+)
+
+// Concurrent GetOrCreate calls with one new key all get the same inode,
+// which exactly one of them created.
+func TestInodeTableGetOrCreate(t *testing.T) {
+	table := NewInodeTable()
+	const n = 64
+	inos := make([]Inode, n)
+	var created atomic.Int32
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range inos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			ino, c := table.GetOrCreate("remote/path")
+			if c {
+				created.Add(1)
+			}
+			inos[i] = ino
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, ino := range inos {
+		if ino != inos[0] {
+			t.Fatalf("call %d got inode %d, call 0 got %d", i, ino, inos[0])
+		}
+	}
+	if c := created.Load(); c != 1 {
+		t.Errorf("%d calls created the inode, want 1", c)
+	}
+	if key, ok := table.Key(inos[0]); !ok || key != "remote/path" {
+		t.Errorf("Key = %v, %v", key, ok)
+	}
+
+	// Every call counted a reference; the key lives until all are gone
+	gen, _ := table.Generation(inos[0])
+	if table.Forget(inos[0], n-1) {
+		t.Error("inode freed with a reference left")
+	}
+	if !table.Forget(inos[0], 1) {
+		t.Error("inode not freed after its last reference")
+	}
+	ino, c := table.GetOrCreate("remote/path")
+	if newGen, _ := table.Generation(ino); !c || (ino == inos[0] && newGen == gen) {
+		t.Errorf("after forget: inode %d generation %d, created %v; want a fresh one", ino, newGen, c)
+	}
+}
+
+// Inodes the evict callback could not evict are offered again, after the
+// others.
+func TestInodeTableEvictKept(t *testing.T) {
+	table := NewInodeTable()
+	batches := make(chan []Inode, 10)
+	table.SetLimit(10, func(inos []Inode) []Inode {
+		batches <- inos
+		return inos // None could be evicted
+	})
+
+	var inos []Inode
+	for range 11 {
+		ino, _ := table.Allocate()
+		inos = append(inos, ino)
+	}
+	first := <-batches
+	if len(first) == 0 || first[0] != inos[0] {
+		t.Fatalf("first batch %v, want the oldest inodes first", first)
+	}
+
+	// Wait for the kept inodes to be put back, then go over again
+	for {
+		table.mu.Lock()
+		n := len(table.evicting)
+		table.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	table.Allocate()
+	second := <-batches
+	for _, ino := range second {
+		for _, old := range first {
+			if ino == old {
+				t.Fatalf("second batch %v repeats inode %d of the first %v", second, ino, first)
+			}
+		}
+	}
+}
+
+// tableFS is a filesystem numbering its inodes with an InodeTable: every
+// name in the root exists, and gets the inode of its key.
+type tableFS struct {
+	InodeTableBase
+}
+
+func newTableFS() *tableFS {
+	return &tableFS{InodeTableBase{Inodes: NewInodeTable()}}
+}
+
+func (f *tableFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	if parent != RootInode {
+		return nil, syscall.ENOENT
+	}
+	ino, _ := f.Inodes.GetOrCreate(name)
+	gen, _ := f.Inodes.Generation(ino)
+	return &Entry{Ino: ino, Generation: gen, Attr: Attr{Ino: ino, Mode: 0644}}, nil
+}
+
+func (f *tableFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	if ino == RootInode {
+		return &AttrResponse{Attr: Attr{Ino: ino, Mode: os.ModeDir | 0755}}, nil
+	}
+	return &AttrResponse{Attr: Attr{Ino: ino, Mode: 0644}}, nil
+}
+
+func (f *tableFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *tableFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	return nil, nil
+}
+
+// A flood of lookups of unique names, with the table limited and its
+// evictions sent to the kernel with EvictInodes, keeps the table bounded
+// once the kernel answers them with FORGETs.
+func TestInodeTableLimitServed(t *testing.T) {
+	fs := newTableFS()
+	k := newTestServer(t, fs, nil)
+	const limit, names = 20, 300
+	fs.Inodes.SetLimit(limit, k.s.EvictInodes)
+
+	// Read as the kernel does, dropping each invalidated entry
+	nodeids := make(map[string]uint64)
+	handle := func(unique uint64, r testReply) {
+		if unique != 0 || r.errno != proto.NotifyInvalEntry {
+			return
+		}
+		out := wireStruct[proto.NotifyInvalEntryOut](t, r.data)
+		name := string(r.data[proto.NotifyInvalEntryOutSize:][:out.Namelen])
+		if nodeid, ok := nodeids[name]; ok {
+			delete(nodeids, name)
+			k.send(proto.OpForget, nodeid, wireBytes(&proto.ForgetIn{Nlookup: 1}))
+		}
+	}
+
+	peak := 0
+	for i := range names {
+		name := fmt.Sprintf("f%d", i)
+		unique := k.send(proto.OpLookup, uint64(RootInode), append([]byte(name), 0))
+		for {
+			u, r := k.read()
+			if u == unique {
+				if r.errno != 0 {
+					t.Fatalf("LOOKUP %s: %v", name, syscall.Errno(-r.errno))
+				}
+				nodeids[name] = wireStruct[proto.EntryOut](t, r.data).NodeID
+				break
+			}
+			handle(u, r)
+		}
+		peak = max(peak, fs.Inodes.Len())
+	}
+
+	// The last evictions are answered in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.Inodes.Len() > limit+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d live inodes after the flood, limit %d", fs.Inodes.Len(), limit)
+		}
+		fds := []unix.PollFd{{Fd: int32(k.fd), Events: unix.POLLIN}}
+		if n, _ := unix.Poll(fds, 10); n > 0 {
+			handle(k.read())
+		}
+	}
+	if peak > 2*limit {
+		t.Errorf("%d live inodes at the peak of %d lookups, limit %d", peak, names, limit)
+	}
+}
+
+// forgotten is an inode reported to OnForget.
+type forgotten struct {
+	ino Inode
+	key any
+}
+
+// FORGET and BATCH_FORGET reach the table through InodeTableBase, and
+// OnForget hears of each inode once, when its last reference goes, with
+// the key it was created for.
+func TestInodeTableBaseForget(t *testing.T) {
+	fs := newTableFS()
+	got := make(chan forgotten, 10)
+	fs.Inodes.SetOnForget(func(ino Inode, key any) { got <- forgotten{ino, key} })
+	k := newTestServer(t, fs, nil)
+
+	a := Inode(k.lookup(RootInode, "a").NodeID)
+	k.lookup(RootInode, "a")
+	b := Inode(k.lookup(RootInode, "b").NodeID)
+	c := Inode(k.lookup(RootInode, "c").NodeID)
+
+	expect := func(want ...forgotten) {
+		t.Helper()
+		var seen []forgotten
+		for range want {
+			select {
+			case f := <-got:
+				seen = append(seen, f)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("OnForget calls %v, want %v", seen, want)
+			}
+		}
+		select {
+		case f := <-got:
+			t.Fatalf("OnForget calls %v, then %v, want %v", seen, f, want)
+		case <-time.After(50 * time.Millisecond):
+		}
+		slices.SortFunc(seen, func(x, y forgotten) int { return cmp.Compare(x.ino, y.ino) })
+		if !slices.Equal(seen, want) {
+			t.Errorf("OnForget calls %v, want %v", seen, want)
+		}
+	}
+	forget := func(ino Inode, nlookup uint64) {
+		k.send(proto.OpForget, uint64(ino), wireBytes(&proto.ForgetIn{Nlookup: nlookup}))
+	}
+
+	forget(a, 1) // One of its two lookups
+	expect()
+
+	batch := wireBytes(&proto.BatchForgetIn{Count: 3})
+	for _, e := range []proto.ForgetOne{{NodeID: uint64(a), Nlookup: 1}, {NodeID: uint64(b), Nlookup: 1}, {NodeID: uint64(c), Nlookup: 0}} {
+		batch = append(batch, wireBytes(&e)...)
+	}
+	k.send(proto.OpBatchForget, 0, batch)
+	expect(forgotten{a, "a"}, forgotten{b, "b"})
+
+	forget(c, 1)
+	expect(forgotten{c, "c"})
+	// Already forgotten
+	forget(c, 1)
+	expect()
+	if n := fs.Inodes.Len(); n != 1 {
+		t.Errorf("%d live inodes, want only the root", n)
+	}
+}
+
+// A number freed by Forget comes back from the next Allocate with a higher
+// generation, which reaches the kernel in the LOOKUP reply.
+func TestInodeTableGeneration(t *testing.T) {
+	table := NewInodeTable()
+	ino, gen := table.Allocate()
+	if !table.Forget(ino, 1) {
+		t.Fatal("inode not freed by its only reference")
+	}
+	again, next := table.Allocate()
+	if again != ino || next <= gen {
+		t.Errorf("reallocated inode %d generation %d, want inode %d above generation %d", again, next, ino, gen)
+	}
+
+	fs := newTableFS()
+	k := newTestServer(t, fs, nil)
+	old := k.lookup(RootInode, "old")
+	k.send(proto.OpForget, old.NodeID, wireBytes(&proto.ForgetIn{Nlookup: 1}))
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.Inodes.Len() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("FORGET did not free the inode")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	e := k.lookup(RootInode, "new")
+	if e.NodeID != old.NodeID || e.Generation <= old.Generation {
+		t.Errorf("LOOKUP after FORGET: node %d generation %d, want node %d above generation %d",
+			e.NodeID, e.Generation, old.NodeID, old.Generation)
+	}
+}
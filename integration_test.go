@@ -0,0 +1,301 @@
+//go:build integration
+
+package rofuse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The tests in files tagged integration mount real filesystems:
+//
+//	go test -tags integration ./...
+//
+// As root they mount with mount(2), otherwise through fusermount. They are
+// skipped when /dev/fuse is missing or mounting is not permitted.
+
+// mountTest mounts fs on a temporary directory and serves it until the test
+// ends. It returns the server and the mount point.
+func mountTest(t testing.TB, fs Filesystem, opts *MountOptions) (*Server, string) {
+	t.Helper()
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("no fuse device: %v", err)
+	}
+
+	// Opening a file on the mount registers it with the runtime's poller,
+	// which makes the kernel send FUSE_POLL while the opening goroutine
+	// still holds its P. With a single P the server could never read it.
+	if runtime.GOMAXPROCS(0) < 2 {
+		prev := runtime.GOMAXPROCS(2)
+		t.Cleanup(func() { runtime.GOMAXPROCS(prev) })
+	}
+
+	var o MountOptions
+	if opts != nil {
+		o = *opts
+	}
+	if os.Geteuid() == 0 {
+		o.DirectMount = true
+	}
+	o.DirectMountFallback = true
+
+	dir := t.TempDir()
+	s, err := Mount(dir, fs, &o)
+	if errors.Is(err, ErrFuseDeviceMissing) || errors.Is(err, ErrFusermountNotFound) || errors.Is(err, ErrMountPermission) {
+		t.Skipf("cannot mount: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	if err := s.ServeBackground(); err != nil {
+		s.Unmount()
+		t.Fatalf("serve: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Unmount(); err != nil {
+			t.Errorf("unmount: %v", err)
+		}
+		<-s.Done()
+		s.Wait()
+	})
+	return s, dir
+}
+
+// mountInfo returns the filesystem type, mount options and super options
+// of the mount at dir, from /proc/self/mountinfo.
+func mountInfo(t testing.TB, dir string) (fstype, opts, superOpts string) {
+	t.Helper()
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// id parent dev root mountpoint opts [optional...] - fstype source superopts
+		before, after, ok := strings.Cut(line, " - ")
+		fields, tail := strings.Fields(before), strings.Fields(after)
+		if !ok || len(fields) < 6 || len(tail) < 3 || fields[4] != dir {
+			continue
+		}
+		return tail[0], fields[5], tail[2]
+	}
+	t.Fatalf("%s not in /proc/self/mountinfo", dir)
+	return "", "", ""
+}
+
+// The subtype is part of the mount's type, as stat -f and /proc/mounts
+// report it.
+func TestMountSubtype(t *testing.T) {
+	_, dir := mountTest(t, newTestFS(), &MountOptions{FSName: "rofuse-test", Subtype: "rofusetest"})
+	if fstype, _, _ := mountInfo(t, dir); fstype != "fuse.rofusetest" {
+		t.Errorf("type %q, want fuse.rofusetest", fstype)
+	}
+}
+
+// The mount is read-only to the kernel too, not just answered EROFS.
+func TestMountReadOnly(t *testing.T) {
+	_, dir := mountTest(t, newTestFS(), nil)
+	_, opts, _ := mountInfo(t, dir)
+	if !slices.Contains(strings.Split(opts, ","), "ro") {
+		t.Errorf("mount options %q, want ro", opts)
+	}
+}
+
+// cachingFS is a testFS whose entries and file data the kernel keeps until
+// it is told they changed.
+type cachingFS struct {
+	*testFS
+}
+
+func (f cachingFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	entry, err := f.testFS.Lookup(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	entry.EntryTimeout, entry.AttrTimeout = time.Hour, time.Hour
+	return entry, nil
+}
+
+func (f cachingFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	return &OpenResponse{Flags: OpenKeepCache}, nil
+}
+
+// Content that changes without its size or mtime changing is read from the
+// page cache until NotifyInvalInode drops it.
+func TestNotifyInvalInodeMounted(t *testing.T) {
+	fs := cachingFS{newTestFS()}
+	ino := fs.create(RootInode, "file", []byte("old data"))
+	s, dir := mountTest(t, fs, nil)
+	path := filepath.Join(dir, "file")
+
+	read := func() string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if got := read(); got != "old data" {
+		t.Fatalf("read %q, want old data", got)
+	}
+	fs.setData(ino, []byte("new data"))
+	if got := read(); got != "old data" {
+		t.Fatalf("read %q before invalidating, want the cached old data", got)
+	}
+	if err := s.NotifyInvalInode(ino, 0, 0); err != nil {
+		t.Fatalf("NotifyInvalInode: %v", err)
+	}
+	if got := read(); got != "new data" {
+		t.Errorf("read %q after invalidating, want new data", got)
+	}
+}
+
+// A name looked up stays in the dentry cache after it goes away in the
+// backend, until NotifyInvalEntry drops it.
+func TestNotifyInvalEntryMounted(t *testing.T) {
+	fs := cachingFS{newTestFS()}
+	fs.create(RootInode, "file", []byte("data"))
+	s, dir := mountTest(t, fs, nil)
+	path := filepath.Join(dir, "file")
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	fs.remove(RootInode, "file")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stat before invalidating: %v, want the cached entry", err)
+	}
+	if err := s.NotifyInvalEntry(RootInode, "file"); err != nil {
+		t.Fatalf("NotifyInvalEntry: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat after invalidating: %v, want ENOENT", err)
+	}
+}
+
+// volatileFS is a testFS whose inodes are all volatile.
+type volatileFS struct {
+	*testFS
+}
+
+func (f volatileFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	entry, err := f.testFS.Lookup(ctx, parent, name)
+	if err != nil {
+		return nil, err
+	}
+	return VolatileEntry(entry.Ino, entry.Attr), nil
+}
+
+func (f volatileFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	resp, err := f.testFS.GetAttr(ctx, ino, fh)
+	if err != nil {
+		return nil, err
+	}
+	return VolatileAttr(resp.Attr), nil
+}
+
+func (f volatileFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	return VolatileOpen(0), nil
+}
+
+// Reads and stats of a volatile file always reach the filesystem, even
+// when neither its size nor its mtime change.
+func TestVolatileMounted(t *testing.T) {
+	fs := volatileFS{newTestFS()}
+	ino := fs.create(RootInode, "file", []byte("old data"))
+	_, dir := mountTest(t, fs, &MountOptions{DefaultAttrTimeout: time.Hour})
+	path := filepath.Join(dir, "file")
+
+	// Opened blocking, so that the runtime's poller, and FUSE_POLL, stay
+	// out of it
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	readAt := func() string {
+		t.Helper()
+		buf := make([]byte, 64)
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	if got := readAt(); got != "old data" {
+		t.Fatalf("read %q, want old data", got)
+	}
+	fs.setData(ino, []byte("new data"))
+	if got := readAt(); got != "new data" {
+		t.Errorf("read %q from the open file, want new data", got)
+	}
+
+	// A new file under the same name is seen at once
+	fs.remove(RootInode, "file")
+	fs.create(RootInode, "file", []byte("longer data"))
+	if fi, err := os.Stat(path); err != nil || fi.Size() != int64(len("longer data")) {
+		t.Errorf("stat: %v, %v, want the new file's size", fi, err)
+	}
+}
+
+// readMounted reads the file at path on a mount. It is opened blocking,
+// as os.ReadFile would not: registering it with the runtime's poller
+// sends FUSE_POLL, which the server may be unable to answer in time.
+func readMounted(t *testing.T, path string) string {
+	t.Helper()
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+// A mounted DirFS serves the tree as it is on disk, and its symlinks for
+// the kernel to resolve.
+func TestDirFSMounted(t *testing.T) {
+	tree, _ := newDirTree(t)
+	fsys, err := DirFS(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dir := mountTest(t, fsys, nil)
+
+	for name, want := range map[string]string{
+		"file":     "inside",
+		"sub/file": "deeper",
+		"inner":    "deeper", // Resolved by the kernel, inside the mount
+	} {
+		if got := readMounted(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"absolute", "file", "inner", "sub", "up"}; !slices.Equal(names, want) {
+		t.Errorf("listing %q, want %q", names, want)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "up")); err != nil || target != "../secret" {
+		t.Errorf("readlink up = %q, %v", target, err)
+	}
+}
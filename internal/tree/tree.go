@@ -0,0 +1,214 @@
+// Package tree holds the in-memory directory tree of the read-only
+// filesystems that index all of their content up front (archivefs,
+// casfs): inode numbering, attributes, lookups and listings. Each
+// filesystem keeps the location of its file data in Node.Data.
+package tree
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/rofuse"
+)
+
+// CacheTimeout is the entry and attribute timeout handed to the kernel.
+// The trees never change once built, so this can be long.
+const CacheTimeout = time.Hour
+
+// Node is an entry of a tree, with data of type T for the filesystem
+// serving it.
+type Node[T any] struct {
+	Ino    rofuse.Inode
+	Parent *Node[T] // The root is its own parent
+	Mode   os.FileMode
+	Size   int64
+	Mtime  time.Time
+	Uid    uint32
+	Gid    uint32
+	Rdev   uint32
+	Nlink  uint32 // Names of a non-directory; directories count their own
+	Target string // Symlink target
+
+	Children map[string]*Node[T]
+	Names    []string // Sorted child names, gives stable ReadDir offsets
+
+	Data T
+}
+
+// IsDir reports whether n is a directory.
+func (n *Node[T]) IsDir() bool {
+	return n.Mode.IsDir()
+}
+
+// Attr returns the attributes of n. A directory has two links plus one
+// for each subdirectory it holds, counted where the subdirectory was
+// created so that a name added by a hard link does not count twice.
+func (n *Node[T]) Attr() rofuse.Attr {
+	nlink := n.Nlink
+	if n.IsDir() {
+		nlink = 2
+		for _, c := range n.Children {
+			if c.IsDir() && c.Parent == n {
+				nlink++
+			}
+		}
+	}
+
+	return rofuse.Attr{
+		Ino:     n.Ino,
+		Size:    uint64(n.Size),
+		Blocks:  (uint64(n.Size) + 511) / 512,
+		Atime:   n.Mtime,
+		Mtime:   n.Mtime,
+		Ctime:   n.Mtime,
+		Mode:    n.Mode,
+		Nlink:   nlink,
+		Uid:     n.Uid,
+		Gid:     n.Gid,
+		Rdev:    n.Rdev,
+		Blksize: 4096,
+	}
+}
+
+// Entry returns the lookup result for n.
+func (n *Node[T]) Entry() *rofuse.Entry {
+	return &rofuse.Entry{
+		Ino:          n.Ino,
+		Attr:         n.Attr(),
+		AttrTimeout:  CacheTimeout,
+		EntryTimeout: CacheTimeout,
+	}
+}
+
+// Tree is a tree of nodes numbered from 1 in the order they are created.
+type Tree[T any] struct {
+	Nodes []*Node[T] // Indexed by inode number - 1
+}
+
+// New returns a tree holding only its root, a directory with mode 0755.
+func New[T any]() *Tree[T] {
+	t := &Tree[T]{}
+	root := t.NewNode(nil, os.ModeDir|0755)
+	root.Parent = root
+	return t
+}
+
+// Root returns the root directory.
+func (t *Tree[T]) Root() *Node[T] {
+	return t.Nodes[0]
+}
+
+// NewNode numbers a new node under parent. Placing it in the children of
+// parent is up to the caller.
+func (t *Tree[T]) NewNode(parent *Node[T], mode os.FileMode) *Node[T] {
+	n := &Node[T]{
+		Ino:    rofuse.Inode(len(t.Nodes) + 1),
+		Parent: parent,
+		Mode:   mode,
+		Nlink:  1,
+	}
+	if mode.IsDir() {
+		n.Children = make(map[string]*Node[T])
+	}
+	t.Nodes = append(t.Nodes, n)
+	return n
+}
+
+// Sort fills in the sorted names of every directory, once the tree is
+// complete.
+func (t *Tree[T]) Sort() {
+	for _, n := range t.Nodes {
+		if !n.IsDir() {
+			continue
+		}
+		n.Names = make([]string, 0, len(n.Children))
+		for name := range n.Children {
+			n.Names = append(n.Names, name)
+		}
+		sort.Strings(n.Names)
+	}
+}
+
+// Node returns the node numbered ino, or ENOENT.
+func (t *Tree[T]) Node(ino rofuse.Inode) (*Node[T], error) {
+	if ino == 0 || int(ino) > len(t.Nodes) {
+		return nil, syscall.ENOENT
+	}
+	return t.Nodes[ino-1], nil
+}
+
+// Lookup finds a child by name.
+func (t *Tree[T]) Lookup(parent rofuse.Inode, name string) (*rofuse.Entry, error) {
+	p, err := t.Node(parent)
+	if err != nil {
+		return nil, err
+	}
+	if !p.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	n, ok := p.Children[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n.Entry(), nil
+}
+
+// GetAttr returns the attributes of ino, cached as long as lookups.
+func (t *Tree[T]) GetAttr(ino rofuse.Inode) (*rofuse.AttrResponse, error) {
+	n, err := t.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	return &rofuse.AttrResponse{Attr: n.Attr(), Timeout: CacheTimeout}, nil
+}
+
+// ReadLink returns a symlink target, or EINVAL for other nodes.
+func (t *Tree[T]) ReadLink(ino rofuse.Inode) (string, error) {
+	n, err := t.Node(ino)
+	if err != nil {
+		return "", err
+	}
+	if n.Mode&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+	return n.Target, nil
+}
+
+// Listing returns the listing of directory ino: ".", ".." and the
+// children in name order, which stays the same for the life of the tree.
+func (t *Tree[T]) Listing(ino rofuse.Inode) (rofuse.DirListing, error) {
+	n, err := t.Node(ino)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	l := make(rofuse.DirListing, 0, len(n.Names)+2)
+	l = append(l,
+		rofuse.DirEntryPlus{Entry: *n.Entry(), Name: "."},
+		rofuse.DirEntryPlus{Entry: *n.Parent.Entry(), Name: ".."},
+	)
+	for _, name := range n.Names {
+		l = append(l, rofuse.DirEntryPlus{Entry: *n.Children[name].Entry(), Name: name})
+	}
+	return l, nil
+}
+
+// CleanPath normalizes a slash-separated path relative to the root. It
+// returns false for paths with a ".." component, which would place the
+// entry outside the root; they are checked before cleaning, which would
+// drop the "..".
+func CleanPath(name string) (string, bool) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/"), true
+}
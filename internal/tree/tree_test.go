@@ -0,0 +1,79 @@
+package tree
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"a/b", "a/b", true},
+		{"./a//b/", "a/b", true},
+		{"/abs", "abs", true},
+		{"", "", true},
+		{".", "", true},
+		{"../x", "", false},
+		{"a/../../x", "", false},
+		{"a/../b", "", false}, // Refused even though it stays inside
+	} {
+		got, ok := CleanPath(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("CleanPath(%q) = %q, %v, want %q, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// A directory counts the subdirectories created in it, not a second name
+// of one of them; other nodes count their own names.
+func TestAttrNlink(t *testing.T) {
+	tr := New[int]()
+	root := tr.Root()
+	sub := tr.NewNode(root, os.ModeDir|0755)
+	root.Children["sub"] = sub
+	inner := tr.NewNode(sub, os.ModeDir|0755)
+	sub.Children["inner"] = inner
+	root.Children["alias"] = inner
+	dev := tr.NewNode(root, os.ModeDevice|0600)
+	dev.Rdev, dev.Nlink = 0x0103, 2
+	root.Children["dev"] = dev
+	tr.Sort()
+
+	for _, tc := range []struct {
+		n    *Node[int]
+		want uint32
+	}{{root, 3}, {sub, 3}, {inner, 2}, {dev, 2}} {
+		if got := tc.n.Attr().Nlink; got != tc.want {
+			t.Errorf("inode %d: nlink %d, want %d", tc.n.Ino, got, tc.want)
+		}
+	}
+	if rdev := dev.Entry().Attr.Rdev; rdev != 0x0103 {
+		t.Errorf("rdev %#x, want 0x103", rdev)
+	}
+
+	l, err := tr.Listing(root.Ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".", "..", "alias", "dev", "sub"}
+	if len(l) != len(want) {
+		t.Fatalf("%d entries, want %d", len(l), len(want))
+	}
+	for i, e := range l {
+		if e.Name != want[i] {
+			t.Errorf("entry %d is %q, want %q", i, e.Name, want[i])
+		}
+	}
+	if l[1].Entry.Ino != root.Ino {
+		t.Errorf("root .. is %d, want the root", l[1].Entry.Ino)
+	}
+	if _, err := tr.Listing(dev.Ino); err != syscall.ENOTDIR {
+		t.Errorf("Listing of a device: %v, want ENOTDIR", err)
+	}
+	if _, err := tr.Node(99); err != syscall.ENOENT {
+		t.Errorf("Node(99): %v, want ENOENT", err)
+	}
+}
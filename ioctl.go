@@ -0,0 +1,15 @@
+package rofuse
+
+// IoctlFilesystem is implemented by filesystems that answer ioctl(2) on
+// their files, such as FS_IOC_GETFLAGS for lsattr. Others fail every
+// ioctl with ENOTTY. Directories only get ioctls with proto.CapIoctlDir
+// in MountOptions.Capabilities.
+//
+// Only ioctls whose argument sizes are encoded in cmd are passed on. in
+// holds the data the caller passed (for _IOW ioctls), valid only during
+// the call, and Ioctl returns at most outSize bytes to copy back (for _IOR
+// ioctls). Return ENOTTY for unknown commands and EROFS for those that
+// would modify the file.
+type IoctlFilesystem interface {
+	Ioctl(ctx Context, ino Inode, fh FileHandle, cmd uint32, arg uint64, in []byte, outSize uint32) ([]byte, error)
+}
@@ -0,0 +1,421 @@
+package rofuse
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// FSAdapter serves an io/fs.FS, such as an embed.FS, a *zip.Reader or an
+// os.DirFS, as a read-only filesystem. The tree is discovered lazily:
+// inodes are allocated from an InodeTable on first Lookup, keyed by path,
+// and freed once the kernel forgets them. Symlinks are served when the
+// FS implements fs.ReadLinkFS, and show as their targets otherwise, as
+// fs.Stat follows them.
+//
+// Files are read with ReadAt when the fs.File implements io.ReaderAt,
+// with Seek and Read when it implements io.Seeker, and otherwise by
+// reading sequentially, reopening the file when a read goes backwards.
+// Directories are listed once per open, from fs.ReadDir.
+type FSAdapter struct {
+	InodeTableBase
+
+	// CacheTimeout is how long the kernel caches entries and attributes.
+	// NewFSAdapter sets one second; trees that never change, such as an
+	// embed.FS, can use much longer. Set it before mounting.
+	CacheTimeout time.Duration
+
+	fsys fs.FS
+	root *os.Root // Closed by Destroy, if DirFS opened it
+
+	handlesMu sync.Mutex
+	handles   map[FileHandle]any // *fsFile or []fs.DirEntry
+	nextFh    FileHandle
+}
+
+// NewFSAdapter returns a Filesystem serving fsys.
+func NewFSAdapter(fsys fs.FS) *FSAdapter {
+	return &FSAdapter{
+		InodeTableBase: InodeTableBase{Inodes: NewInodeTable()},
+		CacheTimeout:   time.Second,
+		fsys:           fsys,
+		handles:        make(map[FileHandle]any),
+	}
+}
+
+// MountFS mounts fsys read-only at mountPoint, as Mount does with
+// NewFSAdapter(fsys).
+func MountFS(mountPoint string, fsys fs.FS, opts *MountOptions) (*Server, error) {
+	return Mount(mountPoint, NewFSAdapter(fsys), opts)
+}
+
+// DirFS returns a Filesystem serving the directory tree at root. It is
+// NewFSAdapter over an os.Root rather than os.DirFS: no lookup, read or
+// listing reaches outside root, whether through ".." or through a symlink
+// swapped in while the tree is served. Symlinks are served as such, for
+// the kernel to resolve like any other.
+//
+// Attributes are those lstat(2) reports (see AttrFromFileInfo), under the
+// adapter's own inode numbers. Each open file is an *os.File read with
+// ReadAt and closed on Release. root itself stays open until Destroy.
+func DirFS(root string) (*FSAdapter, error) {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	a := NewFSAdapter(r.FS())
+	a.root = r
+	return a, nil
+}
+
+// Destroy closes the directory DirFS opened.
+func (a *FSAdapter) Destroy(ctx Context) {
+	if a.root != nil {
+		a.root.Close()
+	}
+}
+
+// fsFile is an open file and, for files that cannot be read at an offset,
+// the position it was left at.
+type fsFile struct {
+	mu   sync.Mutex
+	name string
+	f    fs.File
+	pos  int64
+}
+
+// path returns the fs.FS path of ino.
+func (a *FSAdapter) path(ino Inode) (string, error) {
+	if ino == RootInode {
+		return ".", nil
+	}
+	key, ok := a.Inodes.Key(ino)
+	if !ok {
+		return "", syscall.ENOENT
+	}
+	return key.(string), nil
+}
+
+// childPath joins a directory path and an entry name.
+func childPath(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// attr converts the FileInfo of ino.
+func (a *FSAdapter) attr(ino Inode, fi fs.FileInfo) Attr {
+	attr := AttrFromFileInfo(fi)
+	attr.Ino = ino
+	attr.Nlink = 1 // As if unknown, which keeps find from guessing subdirectory counts
+	return attr
+}
+
+// entry returns the entry for the file at p and counts a kernel
+// reference on its inode.
+func (a *FSAdapter) entry(p string, fi fs.FileInfo) *Entry {
+	ino, _ := a.Inodes.GetOrCreate(p)
+	gen, _ := a.Inodes.Generation(ino)
+	return &Entry{
+		Ino:          ino,
+		Generation:   gen,
+		Attr:         a.attr(ino, fi),
+		AttrTimeout:  a.CacheTimeout,
+		EntryTimeout: a.CacheTimeout,
+	}
+}
+
+// Lookup stats name in parent and returns its entry.
+func (a *FSAdapter) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	dir, err := a.path(parent)
+	if err != nil {
+		return nil, err
+	}
+	p := childPath(dir, name)
+	if !fs.ValidPath(p) {
+		return nil, syscall.ENOENT
+	}
+	fi, err := fs.Lstat(a.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	return a.entry(p, fi), nil
+}
+
+// GetAttr stats ino.
+func (a *FSAdapter) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	p, err := a.path(ino)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Lstat(a.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	return &AttrResponse{Attr: a.attr(ino, fi), Timeout: a.CacheTimeout}, nil
+}
+
+// ReadLink returns the target of a symlink, if the FS has any.
+func (a *FSAdapter) ReadLink(ctx Context, ino Inode) (string, error) {
+	p, err := a.path(ino)
+	if err != nil {
+		return "", err
+	}
+	target, err := fs.ReadLink(a.fsys, p)
+	if errors.Is(err, fs.ErrInvalid) {
+		return "", syscall.EINVAL
+	}
+	return target, err
+}
+
+// Open opens a file.
+func (a *FSAdapter) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	p, err := a.path(ino)
+	if err != nil {
+		return nil, err
+	}
+	f, err := a.fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		f.Close()
+		if err == nil {
+			err = syscall.EISDIR
+		}
+		return nil, err
+	}
+	return &OpenResponse{Handle: a.addHandle(&fsFile{name: p, f: f})}, nil
+}
+
+// Read reads file data from an open handle.
+func (a *FSAdapter) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	h, ok := a.handle(fh).(*fsFile)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	buf := make([]byte, size)
+	n, err := h.readAt(a.fsys, buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readAt reads p at off, by whichever means the file offers.
+func (h *fsFile) readAt(fsys fs.FS, p []byte, off int64) (int, error) {
+	if ra, ok := h.f.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if off != h.pos {
+		if s, ok := h.f.(io.Seeker); ok {
+			pos, err := s.Seek(off, io.SeekStart)
+			if err != nil {
+				return 0, err
+			}
+			h.pos = pos
+		} else if off < h.pos {
+			f, err := fsys.Open(h.name)
+			if err != nil {
+				return 0, err
+			}
+			h.f.Close()
+			h.f, h.pos = f, 0
+		}
+	}
+	if off > h.pos {
+		skipped, err := io.CopyN(io.Discard, h.f, off-h.pos)
+		h.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(h.f, p)
+	h.pos += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Release closes an open file.
+func (a *FSAdapter) Release(ctx Context, ino Inode, fh FileHandle) error {
+	if h, ok := a.dropHandle(fh).(*fsFile); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.f.Close()
+	}
+	return nil
+}
+
+// OpenDir reads the listing of a directory, which is served from the
+// handle until it is released.
+func (a *FSAdapter) OpenDir(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	p, err := a.path(ino)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(a.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenResponse{Handle: a.addHandle(entries)}, nil
+}
+
+// listing returns the entries of an open directory.
+func (a *FSAdapter) listing(fh FileHandle) ([]fs.DirEntry, error) {
+	entries, ok := a.handle(fh).([]fs.DirEntry)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return entries, nil
+}
+
+// unknownIno is reported by READDIR for entries that have no inode yet,
+// as the kernel's FUSE_UNKNOWN_INO: readers such as Go's os.ReadDir skip
+// entries whose inode is 0.
+const unknownIno Inode = 0xffffffff
+
+// liveInode returns the inode of p if the kernel holds one, without
+// counting a reference.
+func (a *FSAdapter) liveInode(p string) (Inode, bool) {
+	if p == "." {
+		return RootInode, true
+	}
+	a.Inodes.mu.Lock()
+	defer a.Inodes.mu.Unlock()
+
+	ino, ok := a.Inodes.byKey[p]
+	return ino, ok
+}
+
+// parentInode returns the inode of the parent of the directory at dir.
+func (a *FSAdapter) parentInode(dir string) Inode {
+	if ino, ok := a.liveInode(path.Dir(dir)); ok {
+		return ino
+	}
+	return RootInode
+}
+
+// ReadDir lists a directory: "." and ".." at offsets 1 and 2, then the
+// entries in name order, as fs.ReadDir sorts them.
+func (a *FSAdapter) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	entries, err := a.listing(fh)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := a.path(ino)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset >= int64(len(entries))+2 {
+		return nil, nil
+	}
+
+	result := PrependDotEntries(ino, a.parentInode(dir), nil)[min(offset, 2):]
+	for i := max(offset-2, 0); i < int64(len(entries)); i++ {
+		e := entries[i]
+		child, ok := a.liveInode(childPath(dir, e.Name()))
+		if !ok {
+			child = unknownIno
+		}
+		result = append(result, DirEntry{
+			Ino:    child,
+			Offset: uint64(i + 3),
+			Type:   FileModeType(e.Type()),
+			Name:   e.Name(),
+		})
+	}
+	return result, nil
+}
+
+// ReadDirPlus lists a directory with attributes, in the order of ReadDir.
+// It stops at size bytes: the kernel counts a reference on every entry it
+// receives, so the ones that would not fit are not looked up.
+func (a *FSAdapter) ReadDirPlus(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntryPlus, error) {
+	entries, err := a.listing(fh)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := a.path(ino)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, nil
+	}
+
+	var result []DirEntryPlus
+	used := 0
+	fits := func(name string) bool {
+		n := (proto.DirentPlusSize + len(name) + 7) &^ 7
+		used += n
+		return used <= int(size)
+	}
+
+	if offset < 1 && fits(".") {
+		result = append(result, dotEntryPlus(".", ino, 1))
+	}
+	if offset < 2 && fits("..") {
+		result = append(result, dotEntryPlus("..", a.parentInode(dir), 2))
+	}
+	for i := max(offset-2, 0); i < int64(len(entries)); i++ {
+		e := entries[i]
+		if !fits(e.Name()) {
+			break
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue // Removed since the directory was opened
+		}
+		result = append(result, DirEntryPlus{
+			Entry:  *a.entry(childPath(dir, e.Name()), fi),
+			Offset: uint64(i + 3),
+			Name:   e.Name(),
+		})
+	}
+	return result, nil
+}
+
+// ReleaseDir drops the listing of a directory.
+func (a *FSAdapter) ReleaseDir(ctx Context, ino Inode, fh FileHandle) error {
+	a.dropHandle(fh)
+	return nil
+}
+
+func (a *FSAdapter) addHandle(h any) FileHandle {
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+
+	a.nextFh++
+	a.handles[a.nextFh] = h
+	return a.nextFh
+}
+
+func (a *FSAdapter) handle(fh FileHandle) any {
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+	return a.handles[fh]
+}
+
+func (a *FSAdapter) dropHandle(fh FileHandle) any {
+	a.handlesMu.Lock()
+	defer a.handlesMu.Unlock()
+
+	h := a.handles[fh]
+	delete(a.handles, fh)
+	return h
+}
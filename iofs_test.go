@@ -0,0 +1,283 @@
+package rofuse
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// newDirTree makes a directory holding "tree", to be served, and a file
+// "secret" next to it, which no request may reach.
+func newDirTree(t *testing.T) (tree, outside string) {
+	t.Helper()
+	outside = t.TempDir()
+	tree = filepath.Join(outside, "tree")
+	for _, dir := range []string{tree, filepath.Join(tree, "sub")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(tree, "file"):        "inside",
+		filepath.Join(tree, "sub", "file"): "deeper",
+		filepath.Join(outside, "secret"):   "outside",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"up":       "../secret",
+		"absolute": filepath.Join(outside, "secret"),
+		"inner":    "sub/file",
+	} {
+		if err := os.Symlink(target, filepath.Join(tree, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree, outside
+}
+
+// No request on a DirFS reaches outside its root, through "..", through a
+// symlink or through a directory swapped for a symlink after lookup.
+func TestDirFSEscapes(t *testing.T) {
+	tree, outside := newDirTree(t)
+	fsys, err := DirFS(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newTestServer(t, fsys, nil)
+
+	file := Inode(k.lookup(RootInode, "file").NodeID)
+	if got := string(k.readFile(file, k.open(file), 0, 4096)); got != "inside" {
+		t.Errorf("file = %q, want inside", got)
+	}
+	if errno, _ := k.call(proto.OpLookup, uint64(RootInode), []byte("..\x00")); errno == 0 {
+		t.Error("LOOKUP of .. in the root succeeded")
+	}
+
+	// Symlinks are served as such, but not followed by the server
+	for _, name := range []string{"up", "absolute", "inner"} {
+		e := k.lookup(RootInode, name)
+		if e.Attr.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("%s: mode %o, want a symlink", name, e.Attr.Mode)
+		}
+		if name == "inner" {
+			continue
+		}
+		errno, data := k.call(proto.OpOpen, e.NodeID, wireBytes(&proto.OpenIn{}))
+		if errno == 0 {
+			fh := wireStruct[proto.OpenOut](t, data).Fh
+			_, data = k.call(proto.OpRead, e.NodeID, wireBytes(&proto.ReadIn{Fh: fh, Size: 4096}))
+		}
+		if errno == 0 || bytes.Contains(data, []byte("outside")) {
+			t.Errorf("OPEN of %s: errno %d, read %q, want it refused", name, errno, data)
+		}
+	}
+
+	// A directory the kernel looked up is replaced by a link out
+	sub := k.lookup(RootInode, "sub").NodeID
+	if err := os.Rename(filepath.Join(tree, "sub"), filepath.Join(outside, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tree, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if errno, _ := k.call(proto.OpLookup, sub, []byte("secret\x00")); errno == 0 {
+		t.Error("LOOKUP through a swapped-in symlink succeeded")
+	}
+	errno, data := k.call(proto.OpOpendir, sub, wireBytes(&proto.OpenIn{}))
+	if errno == 0 {
+		fh := wireStruct[proto.OpenOut](t, data).Fh
+		for _, d := range k.readdir(Inode(sub), fh, 0) {
+			if d.Name == "secret" {
+				t.Error("listing through a swapped-in symlink shows secret")
+			}
+		}
+	}
+}
+
+// Destroy closes the directory DirFS opened.
+func TestDirFSDestroy(t *testing.T) {
+	tree, _ := newDirTree(t)
+	fsys, err := DirFS(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Lookup(nil, RootInode, "file"); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	fsys.Destroy(nil)
+	if _, err := fsys.Lookup(nil, RootInode, "file"); err == nil {
+		t.Error("Lookup after Destroy succeeded")
+	}
+}
+
+var mapFS = fstest.MapFS{
+	"a.txt":       {Data: []byte("alpha"), Mode: 0644},
+	"b/c.txt":     {Data: []byte("nested"), Mode: 0600},
+	"b/d":         {Mode: fs.ModeDir | 0750},
+	"link":        {Data: []byte("b/c.txt"), Mode: fs.ModeSymlink | 0777},
+	"z-last.data": {Data: []byte("z"), Mode: 0644},
+}
+
+func TestFSAdapterLookup(t *testing.T) {
+	k := newTestServer(t, NewFSAdapter(mapFS), nil)
+
+	b := k.lookup(RootInode, "b")
+	if b.Attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("b: mode %o, want a directory", b.Attr.Mode)
+	}
+	c := k.lookup(Inode(b.NodeID), "c.txt")
+	if c.Attr.Size != 6 || c.Attr.Mode != syscall.S_IFREG|0600 {
+		t.Errorf("b/c.txt: size %d mode %o", c.Attr.Size, c.Attr.Mode)
+	}
+	if got := string(k.readFile(Inode(c.NodeID), k.open(Inode(c.NodeID)), 2, 4096)); got != "sted" {
+		t.Errorf("b/c.txt at 2 = %q, want sted", got)
+	}
+	if again := k.lookup(Inode(b.NodeID), "c.txt"); again.NodeID != c.NodeID {
+		t.Errorf("second lookup gave %d, want %d", again.NodeID, c.NodeID)
+	}
+	if errno, _ := k.call(proto.OpLookup, uint64(RootInode), []byte("missing\x00")); errno != -int32(syscall.ENOENT) {
+		t.Errorf("LOOKUP of a missing name: errno %d, want ENOENT", errno)
+	}
+
+	// Symlinks come from fs.ReadLinkFS, not followed
+	link := k.lookup(RootInode, "link")
+	if link.Attr.Mode&syscall.S_IFMT != syscall.S_IFLNK || link.Attr.Size != uint64(len("b/c.txt")) {
+		t.Errorf("link: mode %o size %d", link.Attr.Mode, link.Attr.Size)
+	}
+	if got := string(k.mustCall(proto.OpReadlink, link.NodeID, nil)); got != "b/c.txt" {
+		t.Errorf("READLINK = %q, want b/c.txt", got)
+	}
+	if errno, _ := k.call(proto.OpReadlink, c.NodeID, nil); errno != -int32(syscall.EINVAL) {
+		t.Errorf("READLINK of a file: errno %d, want EINVAL", errno)
+	}
+}
+
+// Listings start with "." and "..", continue in name order, and resume
+// after the offset of the last entry returned.
+func TestFSAdapterReadDir(t *testing.T) {
+	k := newTestServer(t, NewFSAdapter(mapFS), nil)
+	a := Inode(k.lookup(RootInode, "a.txt").NodeID)
+	want := []string{".", "..", "a.txt", "b", "link", "z-last.data"}
+
+	fh := k.opendir(RootInode)
+	entries := k.readdir(RootInode, fh, 0)
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Name != want[i] || e.Offset != uint64(i+1) {
+			t.Errorf("entry %d: %q at %d, want %q at %d", i, e.Name, e.Offset, want[i], i+1)
+		}
+	}
+	// Only inodes the kernel holds are reported
+	if entries[2].Ino != a || entries[3].Ino != unknownIno {
+		t.Errorf("inodes %d and %d, want %d and unknown", entries[2].Ino, entries[3].Ino, a)
+	}
+	if rest := k.readdir(RootInode, fh, entries[3].Offset); len(rest) != 2 || rest[0].Name != "link" {
+		t.Errorf("from offset %d: %+v", entries[3].Offset, rest)
+	}
+	if end := k.readdir(RootInode, fh, uint64(len(want))); len(end) != 0 {
+		t.Errorf("at the end: %+v", end)
+	}
+
+	// READDIRPLUS stops at what fits, and resumes from there
+	size := 0
+	for _, name := range want[:3] {
+		size += (proto.DirentPlusSize + len(name) + 7) &^ 7
+	}
+	plusFh := k.opendir(RootInode)
+	var names []string
+	for off := uint64(0); ; {
+		in := proto.ReadIn{Fh: plusFh, Offset: off, Size: uint32(size)}
+		batch := parseDirentsPlus(t, k.mustCall(proto.OpReaddirplus, uint64(RootInode), wireBytes(&in)))
+		if len(batch) == 0 {
+			break
+		}
+		if len(names) == 0 && len(batch) != 3 {
+			t.Errorf("first READDIRPLUS gave %d entries, want the 3 that fit", len(batch))
+		}
+		for _, e := range batch {
+			names = append(names, e.Name)
+			if e.Name != "." && e.Name != ".." && e.Entry.NodeID == 0 {
+				t.Errorf("%s has no inode", e.Name)
+			}
+		}
+		off = batch[len(batch)-1].Offset
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("READDIRPLUS listed %q, want %q", names, want)
+	}
+}
+
+// countFS counts the files opened from an fs.FS.
+type countFS struct {
+	fs.FS
+	opens atomic.Int32
+}
+
+func (c *countFS) Open(name string) (fs.File, error) {
+	c.opens.Add(1)
+	return c.FS.Open(name)
+}
+
+// Deflated zip members can only be read in order: reads that skip ahead
+// read through, and reads that go back reopen the member.
+func TestFSAdapterSequential(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, err := w.Create("deflated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &countFS{FS: zr}
+	k := newTestServer(t, NewFSAdapter(fsys), nil)
+
+	ino := Inode(k.lookup(RootInode, "deflated").NodeID)
+	fh := k.open(ino)
+	opened := fsys.opens.Load()
+	for _, r := range []struct {
+		off     uint64
+		reopens int32 // Files opened since OPEN
+	}{
+		{5000, 0},
+		{5100, 0}, // Right where the last read stopped
+		{7000, 0},
+		{100, 1}, // Backwards
+		{9990, 1},
+	} {
+		got := k.readFile(ino, fh, r.off, 100)
+		if want := data[r.off:min(r.off+100, uint64(len(data)))]; !bytes.Equal(got, want) {
+			t.Errorf("read at %d = %q, want %q", r.off, got, want)
+		}
+		if n := fsys.opens.Load() - opened; n != r.reopens {
+			t.Errorf("after reading at %d: reopened %d times, want %d", r.off, n, r.reopens)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package rofuse
+
+import (
+	"encoding/binary"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
+)
+
+// testKernel plays the kernel's side of a FUSE connection, so that a
+// Server can be driven with raw requests without mounting anything. The
+// two ends are a SOCK_SEQPACKET socket pair, which keeps message
+// boundaries the way /dev/fuse does.
+type testKernel struct {
+	t  testing.TB
+	s  *Server
+	fd int
+
+	unique atomic.Uint64
+
+	mu      sync.Mutex
+	replies map[uint64]testReply // Read while waiting for another one
+}
+
+// testReply is a reply read from the server.
+type testReply struct {
+	errno int32
+	data  []byte
+}
+
+// newTestConn returns a testKernel for a server of fs that is not served
+// yet. The server is unmounted when the test ends.
+func newTestConn(t testing.TB, fs Filesystem, opts *MountOptions) *testKernel {
+	t.Helper()
+	if opts == nil {
+		opts = &MountOptions{}
+	}
+	setDefaults(opts)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	tv := unix.Timeval{Sec: 10}
+	if err := unix.SetsockoptTimeval(fds[1], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatalf("SO_RCVTIMEO: %v", err)
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatalf("eventfd: %v", err)
+	}
+	conn, err := newStoppableConnection(fds[0], wake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer("", conn, fs, opts)
+	s.wake = wake
+
+	k := &testKernel{
+		t:       t,
+		s:       s,
+		fd:      fds[1],
+		replies: make(map[uint64]testReply),
+	}
+	t.Cleanup(func() {
+		s.Unmount()
+		k.close()
+	})
+	return k
+}
+
+// newTestKernel serves fs over a fresh connection until the test ends. The
+// connection is not initialized; see handshake.
+func newTestKernel(t testing.TB, fs Filesystem, opts *MountOptions) *testKernel {
+	t.Helper()
+	k := newTestConn(t, fs, opts)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := k.s.Serve(); err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		k.s.Unmount()
+		<-served
+	})
+	return k
+}
+
+// close closes the kernel's end of the connection, which the server then
+// reads as end of file.
+func (k *testKernel) close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.fd >= 0 {
+		unix.Close(k.fd)
+		k.fd = -1
+	}
+}
+
+// newTestServer returns a testKernel whose connection is initialized.
+func newTestServer(t testing.TB, fs Filesystem, opts *MountOptions) *testKernel {
+	t.Helper()
+	k := newTestKernel(t, fs, opts)
+	k.handshake(0)
+	return k
+}
+
+// handshake sends INIT offering flags, on top of the capabilities a
+// current kernel offers, and returns the reply.
+func (k *testKernel) handshake(flags uint64) *proto.InitOut {
+	k.t.Helper()
+	flags |= proto.CapAsyncRead | proto.CapParallelDirops | proto.CapReaddirplus |
+		proto.CapMaxPages | proto.CapInitExt
+	in := proto.InitIn{
+		Major:        proto.FuseKernelVersion,
+		Minor:        proto.FuseKernelMinorVersion,
+		MaxReadahead: 128 << 10,
+		Flags:        uint32(flags),
+		Flags2:       uint32(flags >> 32),
+	}
+	errno, data := k.call(proto.OpInit, 0, wireBytes(&in))
+	if errno != 0 {
+		k.t.Fatalf("INIT: %v", syscall.Errno(-errno))
+	}
+	return wireStruct[proto.InitOut](k.t, data)
+}
+
+// header returns the header of a request from the test process.
+func (k *testKernel) header(op uint32, nodeid uint64) proto.InHeader {
+	return proto.InHeader{
+		Opcode: op,
+		Unique: k.unique.Add(2), // Odd ones are interrupts in the kernel
+		NodeID: nodeid,
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Pid:    uint32(os.Getpid()),
+	}
+}
+
+// send sends a request and returns its unique id.
+func (k *testKernel) send(op uint32, nodeid uint64, body []byte) uint64 {
+	k.t.Helper()
+	h := k.header(op, nodeid)
+	k.sendHeader(&h, body)
+	return h.Unique
+}
+
+// sendHeader sends a request with header h. Len is filled in if zero.
+func (k *testKernel) sendHeader(h *proto.InHeader, body []byte) {
+	k.t.Helper()
+	if h.Len == 0 {
+		h.Len = uint32(proto.InHeaderSize + len(body))
+	}
+	k.sendRaw(append(wireBytes(h), body...))
+}
+
+// sendRaw sends msg as one request.
+func (k *testKernel) sendRaw(msg []byte) {
+	k.t.Helper()
+	if _, err := unix.Write(k.fd, msg); err != nil {
+		k.t.Fatalf("write request: %v", err)
+	}
+}
+
+// recv waits for the reply to unique and returns its errno (negative, as
+// on the wire) and payload.
+func (k *testKernel) recv(unique uint64) (int32, []byte) {
+	k.t.Helper()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for {
+		if r, ok := k.replies[unique]; ok {
+			delete(k.replies, unique)
+			return r.errno, r.data
+		}
+		u, r := k.read()
+		k.replies[u] = r
+	}
+}
+
+// read reads the next message the server wrote.
+func (k *testKernel) read() (uint64, testReply) {
+	k.t.Helper()
+	buf := make([]byte, 1<<20+4096)
+	n, err := unix.Read(k.fd, buf)
+	if err != nil {
+		k.t.Fatalf("read reply: %v", err)
+	}
+	if n < proto.OutHeaderSize {
+		k.t.Fatalf("%d-byte reply", n)
+	}
+	h := wireStruct[proto.OutHeader](k.t, buf[:n])
+	if int(h.Len) != n {
+		k.t.Fatalf("reply header says %d bytes, got %d", h.Len, n)
+	}
+	return h.Unique, testReply{h.Error, slices.Clone(buf[proto.OutHeaderSize:n])}
+}
+
+// noReply fails the test if a reply to unique arrives within wait.
+func (k *testKernel) noReply(unique uint64, wait time.Duration) {
+	k.t.Helper()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.replies[unique]; ok {
+		k.t.Fatalf("unexpected reply to %d", unique)
+	}
+	fds := []unix.PollFd{{Fd: int32(k.fd), Events: unix.POLLIN}}
+	deadline := time.Now().Add(wait)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return
+		}
+		n, err := unix.Poll(fds, int(left.Milliseconds())+1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			k.t.Fatalf("poll: %v", err)
+		}
+		if n == 0 {
+			return
+		}
+		u, r := k.read()
+		if u == unique {
+			k.t.Fatalf("unexpected reply to %d (errno %d)", unique, r.errno)
+		}
+		k.replies[u] = r
+	}
+}
+
+// call sends a request and waits for its reply.
+func (k *testKernel) call(op uint32, nodeid uint64, body []byte) (int32, []byte) {
+	k.t.Helper()
+	return k.recv(k.send(op, nodeid, body))
+}
+
+// mustCall is call for requests that must succeed.
+func (k *testKernel) mustCall(op uint32, nodeid uint64, body []byte) []byte {
+	k.t.Helper()
+	errno, data := k.call(op, nodeid, body)
+	if errno != 0 {
+		k.t.Fatalf("%s on %d: %v", proto.OpcodeName(op), nodeid, syscall.Errno(-errno))
+	}
+	return data
+}
+
+// lookup looks name up in parent.
+func (k *testKernel) lookup(parent Inode, name string) *proto.EntryOut {
+	k.t.Helper()
+	data := k.mustCall(proto.OpLookup, uint64(parent), append([]byte(name), 0))
+	return wireStruct[proto.EntryOut](k.t, data)
+}
+
+// getattr returns the attributes of ino.
+func (k *testKernel) getattr(ino Inode) *proto.AttrOut {
+	k.t.Helper()
+	data := k.mustCall(proto.OpGetattr, uint64(ino), wireBytes(&proto.GetAttrIn{}))
+	return wireStruct[proto.AttrOut](k.t, data)
+}
+
+// open opens file ino and returns the handle the kernel would use.
+func (k *testKernel) open(ino Inode) uint64 {
+	k.t.Helper()
+	data := k.mustCall(proto.OpOpen, uint64(ino), wireBytes(&proto.OpenIn{}))
+	return wireStruct[proto.OpenOut](k.t, data).Fh
+}
+
+// readFile reads up to size bytes of file ino through handle fh.
+func (k *testKernel) readFile(ino Inode, fh, offset uint64, size uint32) []byte {
+	k.t.Helper()
+	in := proto.ReadIn{Fh: fh, Offset: offset, Size: size}
+	return k.mustCall(proto.OpRead, uint64(ino), wireBytes(&in))
+}
+
+// opendir opens directory ino and returns the handle the kernel would use.
+func (k *testKernel) opendir(ino Inode) uint64 {
+	k.t.Helper()
+	data := k.mustCall(proto.OpOpendir, uint64(ino), wireBytes(&proto.OpenIn{}))
+	return wireStruct[proto.OpenOut](k.t, data).Fh
+}
+
+// readdir reads directory ino through handle fh from offset.
+func (k *testKernel) readdir(ino Inode, fh, offset uint64) []DirEntry {
+	k.t.Helper()
+	in := proto.ReadIn{Fh: fh, Offset: offset, Size: 4096}
+	return parseDirents(k.t, k.mustCall(proto.OpReaddir, uint64(ino), wireBytes(&in)))
+}
+
+// readdirplus reads directory ino with attributes through handle fh from
+// offset.
+func (k *testKernel) readdirplus(ino Inode, fh, offset uint64) []testDirentPlus {
+	k.t.Helper()
+	in := proto.ReadIn{Fh: fh, Offset: offset, Size: 4096}
+	return parseDirentsPlus(k.t, k.mustCall(proto.OpReaddirplus, uint64(ino), wireBytes(&in)))
+}
+
+// wireBytes returns a copy of the memory of a wire struct.
+func wireBytes[T any](v *T) []byte {
+	return slices.Clone(unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v)))
+}
+
+// wireStruct decodes a wire struct from the start of b.
+func wireStruct[T any](t testing.TB, b []byte) *T {
+	t.Helper()
+	v := new(T)
+	size := int(unsafe.Sizeof(*v))
+	if len(b) < size {
+		t.Fatalf("%d bytes, want at least %d", len(b), size)
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(v)), size), b)
+	return v
+}
+
+// parseDirents decodes a READDIR reply.
+func parseDirents(t testing.TB, b []byte) []DirEntry {
+	t.Helper()
+	var entries []DirEntry
+	for len(b) > 0 {
+		if len(b) < proto.DirentSize {
+			t.Fatalf("%d trailing bytes in READDIR reply", len(b))
+		}
+		namelen := int(binary.LittleEndian.Uint32(b[16:]))
+		entries = append(entries, DirEntry{
+			Ino:    Inode(binary.LittleEndian.Uint64(b[0:])),
+			Offset: binary.LittleEndian.Uint64(b[8:]),
+			Type:   binary.LittleEndian.Uint32(b[20:]),
+			Name:   string(b[proto.DirentSize : proto.DirentSize+namelen]),
+		})
+		b = b[min(len(b), (proto.DirentSize+namelen+7)&^7):]
+	}
+	return entries
+}
+
+// testDirentPlus is an entry of a READDIRPLUS reply.
+type testDirentPlus struct {
+	DirEntry
+	Entry proto.EntryOut
+}
+
+// parseDirentsPlus decodes a READDIRPLUS reply.
+func parseDirentsPlus(t testing.TB, b []byte) []testDirentPlus {
+	t.Helper()
+	var entries []testDirentPlus
+	for len(b) > 0 {
+		if len(b) < proto.DirentPlusSize {
+			t.Fatalf("%d trailing bytes in READDIRPLUS reply", len(b))
+		}
+		e := testDirentPlus{Entry: *wireStruct[proto.EntryOut](t, b)}
+		d := b[proto.EntryOutSize:]
+		namelen := int(binary.LittleEndian.Uint32(d[16:]))
+		e.DirEntry = DirEntry{
+			Ino:    Inode(binary.LittleEndian.Uint64(d[0:])),
+			Offset: binary.LittleEndian.Uint64(d[8:]),
+			Type:   binary.LittleEndian.Uint32(d[20:]),
+			Name:   string(d[proto.DirentSize : proto.DirentSize+namelen]),
+		}
+		entries = append(entries, e)
+		b = b[min(len(b), (proto.DirentPlusSize+namelen+7)&^7):]
+	}
+	return entries
+}
+
+// testFS is an in-memory tree for tests. Inode 1 is the root directory;
+// the other nodes are added with mkdir, create and symlink.
+type testFS struct {
+	FilesystemBase
+
+	mu    sync.Mutex
+	nodes map[Inode]*testNode
+}
+
+// testNode is a file, directory or symlink of a testFS.
+type testNode struct {
+	attr   Attr
+	data   []byte
+	target string
+	names  []string // Children in creation order
+	kids   map[string]Inode
+}
+
+func newTestFS() *testFS {
+	return &testFS{nodes: map[Inode]*testNode{
+		RootInode: {
+			attr: Attr{Ino: RootInode, Mode: os.ModeDir | 0755, Nlink: 2},
+			kids: make(map[string]Inode),
+		},
+	}}
+}
+
+// add creates a node named name in parent.
+func (f *testFS) add(parent Inode, name string, n *testNode) Inode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ino := Inode(len(f.nodes) + 1)
+	n.attr.Ino = ino
+	if n.attr.Nlink == 0 {
+		n.attr.Nlink = 1
+	}
+	f.nodes[ino] = n
+	p := f.nodes[parent]
+	p.names = append(p.names, name)
+	p.kids[name] = ino
+	return ino
+}
+
+func (f *testFS) mkdir(parent Inode, name string) Inode {
+	return f.add(parent, name, &testNode{
+		attr: Attr{Mode: os.ModeDir | 0755, Nlink: 2},
+		kids: make(map[string]Inode),
+	})
+}
+
+func (f *testFS) create(parent Inode, name string, data []byte) Inode {
+	return f.add(parent, name, &testNode{
+		attr: Attr{Mode: 0644, Size: uint64(len(data))},
+		data: data,
+	})
+}
+
+func (f *testFS) symlink(parent Inode, name, target string) Inode {
+	return f.add(parent, name, &testNode{attr: SymlinkAttr(target), target: target})
+}
+
+// setData replaces the content of the file ino behind the kernel's back,
+// as a backend would: its size and mtime are left alone.
+func (f *testFS) setData(ino Inode, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[ino].data = data
+}
+
+// remove unlinks name from parent.
+func (f *testFS) remove(parent Inode, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.nodes[parent]
+	p.names = slices.DeleteFunc(p.names, func(n string) bool { return n == name })
+	delete(p.kids, name)
+}
+
+func (f *testFS) node(ino Inode) (*testNode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.nodes[ino]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, nil
+}
+
+func (f *testFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	p, err := f.node(parent)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	ino, ok := p.kids[name]
+	f.mu.Unlock()
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	n, err := f.node(ino)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Ino: ino, Attr: n.attr, AttrTimeout: time.Second, EntryTimeout: time.Second}, nil
+}
+
+func (f *testFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	n, err := f.node(ino)
+	if err != nil {
+		return nil, err
+	}
+	return &AttrResponse{Attr: n.attr}, nil
+}
+
+func (f *testFS) ReadLink(ctx Context, ino Inode) (string, error) {
+	n, err := f.node(ino)
+	if err != nil {
+		return "", err
+	}
+	if n.attr.Mode&os.ModeSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+	return n.target, nil
+}
+
+func (f *testFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	n, err := f.node(ino)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	data := n.data
+	f.mu.Unlock()
+	if offset >= int64(len(data)) {
+		return nil, nil
+	}
+	return data[offset:min(int64(len(data)), offset+int64(size))], nil
+}
+
+func (f *testFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	n, err := f.node(ino)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n.kids == nil {
+		return nil, syscall.ENOTDIR
+	}
+	var entries []DirEntry
+	for i := int(max(offset, 0)); i < len(n.names); i++ {
+		kid := f.nodes[n.kids[n.names[i]]]
+		entries = append(entries, DirEntry{
+			Ino:    kid.attr.Ino,
+			Offset: uint64(i + 1),
+			Type:   FileModeType(kid.attr.Mode),
+			Name:   n.names[i],
+		})
+	}
+	return entries, nil
+}
+
+// plusFS is a testFS that also implements ReadDirPlus.
+type plusFS struct {
+	*testFS
+}
+
+func (f plusFS) ReadDirPlus(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntryPlus, error) {
+	entries, err := f.ReadDir(ctx, ino, fh, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	plus := make([]DirEntryPlus, len(entries))
+	for i, e := range entries {
+		entry, err := f.Lookup(ctx, ino, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		plus[i] = DirEntryPlus{Entry: *entry, Offset: e.Offset, Name: e.Name}
+	}
+	return plus, nil
+}
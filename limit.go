@@ -0,0 +1,134 @@
+package rofuse
+
+import (
+	"sync"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// uidLimiter caps how many requests of each uid are handled at once
+// (MountOptions.PerUidConcurrency). Requests over the limit wait in a
+// per-uid FIFO, so neither the read loop nor other uids are held up.
+type uidLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	users map[uint32]*uidQueue
+}
+
+// uidQueue is the state of one uid with requests in flight. It is removed
+// as soon as the uid has nothing running.
+type uidQueue struct {
+	running int
+	waiting []*request
+}
+
+func newUidLimiter(limit int) *uidLimiter {
+	return &uidLimiter{
+		limit: limit,
+		users: make(map[uint32]*uidQueue),
+	}
+}
+
+// acquire reports whether req may run now. If not, it is queued and will
+// be returned by a later release for the same uid.
+func (l *uidLimiter) acquire(req *request) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	uid := req.header.Uid
+	q, ok := l.users[uid]
+	if !ok {
+		q = &uidQueue{}
+		l.users[uid] = q
+	}
+	if q.running < l.limit {
+		q.running++
+		return true
+	}
+	req.compact()
+	q.waiting = append(q.waiting, req)
+	return false
+}
+
+// release marks one request of uid as done and returns the next queued
+// request of that uid, which now holds the freed slot, or nil.
+func (l *uidLimiter) release(uid uint32) *request {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q, ok := l.users[uid]
+	if !ok {
+		return nil
+	}
+	if len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting[0] = nil
+		q.waiting = q.waiting[1:]
+		return next
+	}
+	q.running--
+	if q.running == 0 {
+		delete(l.users, uid)
+	}
+	return nil
+}
+
+// requestLimiter caps how many requests are handled at once across all
+// uids (MountOptions.MaxConcurrentRequests). Requests over the limit wait
+// in a FIFO without a goroutine, so the read loop goes on reading and
+// FORGET and INTERRUPT are still handled.
+type requestLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	running int
+	waiting []*request
+}
+
+func newRequestLimiter(limit int) *requestLimiter {
+	return &requestLimiter{limit: limit}
+}
+
+// acquire reports whether req may run now. If not, it is queued and will
+// be returned by a later release.
+func (l *requestLimiter) acquire(req *request) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.running < l.limit {
+		l.running++
+		return true
+	}
+	req.compact()
+	l.waiting = append(l.waiting, req)
+	return false
+}
+
+// release marks one request as done and returns the next queued request,
+// which now holds the freed slot, or nil.
+func (l *requestLimiter) release() *request {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.waiting) > 0 {
+		next := l.waiting[0]
+		l.waiting[0] = nil
+		l.waiting = l.waiting[1:]
+		return next
+	}
+	l.running--
+	return nil
+}
+
+// unlimited reports whether opcode skips the per-uid limit and
+// MaxConcurrentRequests. Forgets carry no uid worth accounting and
+// interrupts must not queue behind the requests they interrupt.
+func unlimited(opcode uint32) bool {
+	switch opcode {
+	case proto.OpForget, proto.OpBatchForget, proto.OpInterrupt:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,257 @@
+package rofuse
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// Requests over MaxConcurrentRequests wait without holding up the read
+// loop: an INTERRUPT still gets through and frees a slot for them.
+func TestMaxConcurrentRequests(t *testing.T) {
+	fs := blockingFS{newTestFS(), make(chan struct{}, 3), make(chan error, 3)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{MaxConcurrentRequests: 2})
+	fh := k.open(ino)
+
+	in := wireBytes(&proto.ReadIn{Fh: fh, Size: 4096})
+	var reads [3]uint64
+	for i := range reads {
+		reads[i] = k.send(proto.OpRead, uint64(ino), in)
+	}
+	<-fs.started
+	<-fs.started
+	select {
+	case <-fs.started:
+		t.Fatal("third READ started over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The interrupt is read while both slots are taken, and the queued
+	// READ takes the one it frees
+	k.sendInterrupt(reads[0])
+	if errno, _ := k.recv(reads[0]); syscall.Errno(-errno) != syscall.EINTR {
+		t.Fatalf("interrupted READ: errno %v, want EINTR", syscall.Errno(-errno))
+	}
+	select {
+	case <-fs.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued READ not started")
+	}
+	for _, unique := range reads[1:] {
+		k.sendInterrupt(unique)
+		if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EINTR {
+			t.Errorf("READ %d: errno %v, want EINTR", unique, syscall.Errno(-errno))
+		}
+	}
+}
+
+// holdFS holds reads until they are interrupted or the server stops.
+type holdFS struct {
+	*testFS
+}
+
+func (f holdFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// BenchmarkReadFlood sends b.N READs that the filesystem holds, and
+// reports the goroutines and heap the backlog takes once all of them have
+// been read. Under MaxConcurrentRequests, on by default, the goroutines
+// stay at the limit and each waiting READ keeps a buffer of its size;
+// without it every READ holds a goroutine and a full-size request buffer.
+func BenchmarkReadFlood(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		limit int
+	}{
+		{"default", 0},
+		{"unlimited", -1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fs := holdFS{newTestFS()}
+			ino := fs.create(RootInode, "file", make([]byte, 4096))
+			k := newTestServer(b, fs, &MountOptions{MaxConcurrentRequests: bc.limit})
+			in := wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096})
+
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			goroutines := runtime.NumGoroutine()
+			b.ResetTimer()
+
+			for range b.N {
+				k.send(proto.OpRead, uint64(ino), in)
+			}
+			// Once the interrupt is answered, every READ before it has
+			// been read and dispatched
+			k.recv(k.sendInterrupt(k.unique.Add(2)))
+
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+			b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/float64(b.N), "heap-B/req")
+			// The held READs end when the server is unmounted
+		})
+	}
+}
+
+// gateFS holds lookups, directory reads and file reads until told to go
+// on, and reports each one as it starts.
+type gateFS struct {
+	*testFS
+	started chan uint32              // Opcode of the call
+	proceed map[uint32]chan struct{} // By opcode
+}
+
+func (f gateFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	f.started <- proto.OpLookup
+	<-f.proceed[proto.OpLookup]
+	return f.testFS.Lookup(ctx, parent, name)
+}
+
+func (f gateFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	f.started <- proto.OpReaddir
+	<-f.proceed[proto.OpReaddir]
+	return f.testFS.ReadDir(ctx, ino, fh, offset, size)
+}
+
+func (f gateFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	f.started <- proto.OpRead
+	<-f.proceed[proto.OpRead]
+	return f.testFS.Read(ctx, ino, fh, offset, size)
+}
+
+// Listed opcodes run one at a time, in order, while the others still run
+// side by side.
+func TestSerialOpcodes(t *testing.T) {
+	fs := gateFS{newTestFS(), make(chan uint32, 8), make(map[uint32]chan struct{})}
+	for _, op := range []uint32{proto.OpLookup, proto.OpReaddir, proto.OpRead} {
+		fs.proceed[op] = make(chan struct{}, 2)
+	}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{SerialOpcodes: []uint32{proto.OpLookup, proto.OpReaddir}})
+	fh := k.open(ino)
+	dh := k.opendir(RootInode)
+
+	started := func(want uint32) {
+		t.Helper()
+		select {
+		case op := <-fs.started:
+			if op != want {
+				t.Fatalf("%s started, want %s", proto.OpcodeName(op), proto.OpcodeName(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not started", proto.OpcodeName(want))
+		}
+	}
+	notStarted := func() {
+		t.Helper()
+		select {
+		case op := <-fs.started:
+			t.Fatalf("%s started while a serial request runs", proto.OpcodeName(op))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	lookup := k.send(proto.OpLookup, uint64(RootInode), append([]byte("file"), 0))
+	started(proto.OpLookup)
+	readdir := k.send(proto.OpReaddir, uint64(RootInode), wireBytes(&proto.ReadIn{Fh: dh, Size: 4096}))
+	notStarted()
+
+	// Other opcodes are not held up, and run concurrently
+	read := wireBytes(&proto.ReadIn{Fh: fh, Size: 4096})
+	reads := []uint64{k.send(proto.OpRead, uint64(ino), read), k.send(proto.OpRead, uint64(ino), read)}
+	started(proto.OpRead)
+	started(proto.OpRead)
+	k.getattr(RootInode)
+	notStarted()
+
+	// The queued READDIR runs once the LOOKUP is done
+	fs.proceed[proto.OpLookup] <- struct{}{}
+	if errno, _ := k.recv(lookup); errno != 0 {
+		t.Fatalf("LOOKUP: errno %v", syscall.Errno(-errno))
+	}
+	started(proto.OpReaddir)
+	fs.proceed[proto.OpReaddir] <- struct{}{}
+	fs.proceed[proto.OpRead] <- struct{}{}
+	fs.proceed[proto.OpRead] <- struct{}{}
+	for _, unique := range append(reads, readdir) {
+		if errno, _ := k.recv(unique); errno != 0 {
+			t.Errorf("request %d: errno %v", unique, syscall.Errno(-errno))
+		}
+	}
+}
+
+// uidHoldFS holds the reads of uid 1 like holdFS, and answers the others.
+type uidHoldFS struct {
+	*testFS
+	started chan struct{}
+}
+
+func (f uidHoldFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	if ctx.Uid() != 1 {
+		return f.testFS.Read(ctx, ino, fh, offset, size)
+	}
+	f.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// A uid flooding the mount fills its own slots and queue, and another uid
+// is answered meanwhile. A uid's state goes away once its queue drains.
+func TestPerUidConcurrency(t *testing.T) {
+	fs := uidHoldFS{newTestFS(), make(chan struct{}, 10)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{PerUidConcurrency: 2})
+	in := wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096})
+
+	var flood []uint64
+	for range 10 {
+		flood = append(flood, k.sendAs(1, proto.OpRead, uint64(ino), in))
+	}
+	<-fs.started
+	<-fs.started
+
+	errno, data := k.recv(k.sendAs(2, proto.OpRead, uint64(ino), in))
+	if errno != 0 || string(data) != "data" {
+		t.Fatalf("READ of uid 2 during the flood: errno %d, %q", errno, data)
+	}
+	select {
+	case <-fs.started:
+		t.Fatal("READ of uid 1 started over its limit")
+	default:
+	}
+	k.s.uids.mu.Lock()
+	q := k.s.uids.users[1]
+	if q == nil || q.running != 2 || len(q.waiting) != 8 {
+		t.Errorf("uid 1 state %+v, want 2 running and 8 waiting", q)
+	}
+	k.s.uids.mu.Unlock()
+
+	// Queued READs are interrupted once they start
+	for _, unique := range flood {
+		k.sendInterrupt(unique)
+		if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EINTR {
+			t.Errorf("READ %d: errno %v, want EINTR", unique, syscall.Errno(-errno))
+		}
+	}
+	// Slots are released after the reply is sent
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		k.s.uids.mu.Lock()
+		n := len(k.s.uids.users)
+		k.s.uids.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state of %d uids left once their queues drained", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
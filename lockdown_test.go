@@ -0,0 +1,83 @@
+package rofuse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Each ABI version handles the rights it introduced, so that none of
+// them is left allowed by default.
+func TestLandlockAccessFS(t *testing.T) {
+	const v1 = 1<<13 - 1 // EXECUTE through MAKE_SYM
+	for _, tc := range []struct {
+		abi  int
+		want uint64
+	}{
+		{1, v1},
+		{2, v1 | unix.LANDLOCK_ACCESS_FS_REFER},
+		{3, v1 | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE},
+		{4, v1 | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE}, // Network rights only
+		{5, v1 | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV},
+		{6, v1 | unix.LANDLOCK_ACCESS_FS_REFER | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV},
+	} {
+		if got := landlockAccessFS(tc.abi); got != tc.want {
+			t.Errorf("ABI %d: access %#x, want %#x", tc.abi, got, tc.want)
+		}
+	}
+}
+
+func TestLandlockReadAccess(t *testing.T) {
+	handled := landlockAccessFS(1)
+	read := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE)
+	if got := landlockReadAccess(false, handled); got != read {
+		t.Errorf("file: %#x, want %#x", got, read)
+	}
+	if got := landlockReadAccess(true, handled); got != read|unix.LANDLOCK_ACCESS_FS_READ_DIR {
+		t.Errorf("directory: %#x, want %#x", got, read|unix.LANDLOCK_ACCESS_FS_READ_DIR)
+	}
+	// Never more than the ruleset handles
+	if got := landlockReadAccess(true, unix.LANDLOCK_ACCESS_FS_READ_DIR); got != unix.LANDLOCK_ACCESS_FS_READ_DIR {
+		t.Errorf("with READ_FILE unhandled: %#x", got)
+	}
+}
+
+// Kernels without Landlock, or with it disabled, are reported as such;
+// other failures are passed on.
+func TestLandlockVersionError(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSYS, syscall.EOPNOTSUPP} {
+		if err := landlockVersionError(errno); !errors.Is(err, ErrLandlockUnsupported) {
+			t.Errorf("%v: %v, want ErrLandlockUnsupported", errno, err)
+		}
+	}
+	err := landlockVersionError(syscall.EPERM)
+	if errors.Is(err, ErrLandlockUnsupported) || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("EPERM: %v", err)
+	}
+}
+
+// The ruleset is built by the running kernel, without enforcing it.
+func TestLandlockRuleset(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := landlockRuleset([]string{dir, file})
+	if errors.Is(err, ErrLandlockUnsupported) {
+		t.Skip("no Landlock in this kernel")
+	}
+	if err != nil {
+		t.Fatalf("ruleset: %v", err)
+	}
+	unix.Close(fd)
+
+	if _, err := landlockRuleset([]string{filepath.Join(dir, "missing")}); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("missing path: %v, want ENOENT", err)
+	}
+}
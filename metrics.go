@@ -0,0 +1,98 @@
+package rofuse
+
+import (
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// MetricsSink receives counters from the server. Count may be called
+// concurrently from request goroutines and should not block.
+//
+// Counters currently reported:
+//
+//	lookup.error.<ERRNO>  LOOKUP requests that failed, by errno name
+//	getattr.batch         BatchGetAttr calls (AttrBatchWindow)
+//	getattr.batched       GETATTR requests answered by them
+//	reply.error.<ERRNO>   Replies the kernel rejected
+//	notify.sent           Notifications written to the kernel
+//	notify.error.<ERRNO>  Notifications the kernel rejected
+//	notify.full           Notifications that waited for queue space
+//	notify.dropped        Queued notifications dropped on shutdown
+//	panic                 Handlers that panicked (answered with EIO)
+//	interrupt             Requests cancelled by FUSE_INTERRUPT
+//	passthrough.error     Backing files the kernel refused (BackingFd)
+type MetricsSink interface {
+	Count(name string, delta int64)
+}
+
+// Counters is a MetricsSink that keeps running totals in memory.
+type Counters struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// Count adds delta to the named counter.
+func (c *Counters) Count(name string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[name] += delta
+}
+
+// Snapshot returns a copy of all counters.
+func (c *Counters) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// count reports to the configured sink, if any.
+func (s *Server) count(name string, delta int64) {
+	if s.opts.Metrics != nil {
+		s.opts.Metrics.Count(name, delta)
+	}
+}
+
+// errnoName returns the symbolic name of a negative errno as sent to the
+// kernel, such as "ENOENT".
+func errnoName(errno int32) string {
+	if name := unix.ErrnoName(syscall.Errno(-errno)); name != "" {
+		return name
+	}
+	return "E" + strconv.Itoa(int(-errno))
+}
+
+// replyErrnoName is errnoName, with "0" for a successful reply.
+func replyErrnoName(errno int32) string {
+	if errno == 0 {
+		return "0"
+	}
+	return errnoName(errno)
+}
+
+// lookupFailed accounts a failed LOOKUP. ENOENT is the normal answer for
+// a name that does not exist; anything else usually means the backend is
+// in trouble, so it is also logged in debug mode.
+func (s *Server) lookupFailed(req *request, err error) {
+	errno := toErrno(err)
+	if errno == 0 {
+		return
+	}
+
+	name := errnoName(errno)
+	s.count("lookup.error."+name, 1)
+	if errno != -int32(syscall.ENOENT) {
+		s.opts.logf("lookup %q in %d failed: %s (%v)", req.filename(), req.header.NodeID, name, err)
+	}
+}
@@ -1,19 +1,32 @@
 package rofuse
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 // MountOptions configures the FUSE mount.
 type MountOptions struct {
-	// Debug enables debug logging.
+	// Debug enables debug logging, to stderr unless Logger is set.
 	Debug bool
 
+	// Logger receives debug output at slog.LevelDebug: a line when each
+	// request arrives and one when it is answered, with the opcode,
+	// unique id, node id, caller, errno and latency, plus the messages
+	// Debug enables. If nil, nothing is logged or formatted unless Debug
+	// is set.
+	Logger *slog.Logger
+
 	// MaxReadahead is the maximum readahead size in bytes.
 	// Default is 128KB.
 	MaxReadahead uint32
@@ -22,6 +35,90 @@ type MountOptions struct {
 	// Default is 128KB.
 	MaxWrite uint32
 
+	// MaxRead is the largest READ the kernel will send, in bytes; bigger
+	// reads are split. It is independent of MaxWrite, which sizes the
+	// request buffers: READ requests are tiny, only their replies carry
+	// data. Both are limited to 256 pages (1MiB, proto.MaxPagesLimit) by
+	// the kernel; larger values are lowered to that, with a warning to
+	// Logger.
+	// Default is 128KB.
+	MaxRead uint32
+
+	// ExplicitInvalidation keeps file data cached until the server
+	// invalidates it explicitly (see SetSnapshot), even if a GETATTR
+	// shows a new size or mtime. By default the kernel uses automatic
+	// invalidation instead, dropping cached pages whenever it sees the
+	// mtime or size change. The two modes are exclusive; explicit mode
+	// suits immutable data whose timestamps may be noisy.
+	ExplicitInvalidation bool
+
+	// Capabilities are extra proto.Cap* bits to request at INIT on top of
+	// those the server always asks for, such as proto.CapExpireOnly or
+	// proto.CapNoExportSupport. Bits above 31 are sent in Flags2, which
+	// kernels from FUSE 7.36 accept. As with the others, only the bits the
+	// kernel offers are enabled: Config.Flags, passed to Filesystem.Init,
+	// and Server.Capabilities tell which ones were. Only bits that leave
+	// the protocol as the server parses it may be requested: CapAsyncDIO,
+	// CapNoOpenSupport, CapNoOpendirSupport, CapIoctlDir, CapAbortError,
+	// CapExpireOnly and CapNoExportSupport. Others are dropped with a
+	// warning.
+	Capabilities uint64
+
+	// Passthrough asks the kernel for FUSE passthrough (proto.CapPassthrough,
+	// FUSE 7.40), so that files opened with OpenResponse.BackingFd or
+	// BackingID are read by the kernel straight from a backing file.
+	// Registering backing files requires CAP_SYS_ADMIN. When the kernel
+	// does not agree to it, such opens are served by Read as usual.
+	Passthrough bool
+
+	// UidMap and GidMap translate the owner and group of every inode
+	// from the filesystem's ids to the ids reported to the system, e.g.
+	// archive uid 1000 to local uid 500. Ids outside every range are
+	// reported as UnmappedID if it is set, and unchanged otherwise. The
+	// maps are applied backwards to the caller's ids in the Context, so
+	// that Access and other permission checks compare ids of the
+	// filesystem's own space; callers outside every range are seen as
+	// UnmappedID if it is set.
+	UidMap     IDMap
+	GidMap     IDMap
+	UnmappedID *uint32
+
+	// ForceUid and ForceGid, if set, are reported as the owner and group
+	// of every inode in place of the filesystem's Attr.Uid and Attr.Gid,
+	// e.g. to show an archive's files as owned by the local user. They
+	// take precedence over UidMap and GidMap.
+	ForceUid *uint32
+	ForceGid *uint32
+
+	// DefaultBlksize is reported as the preferred I/O size (st_blksize)
+	// for inodes whose Attr.Blksize is 0. Tools like cat size their reads
+	// by it. Default is MaxWrite.
+	DefaultBlksize uint32
+
+	// ModeMask, if non-zero, limits the permission bits of every reported
+	// mode to the bits it contains, e.g. 0555 so that nothing ever appears
+	// writable. File type and setuid/setgid/sticky bits are kept. The
+	// filesystem still sees its own modes; only what the kernel is told
+	// changes, which also affects DefaultPermissions checks.
+	ModeMask os.FileMode
+
+	// AttrFilter, if set, is called with a copy of every attribute set
+	// about to be sent to the kernel, in GETATTR, LOOKUP, READDIRPLUS and
+	// STATX replies alike, and may change any field of it: clamp times,
+	// hide sizes, adjust ownership by rules the other options cannot
+	// express. It sees the attributes after DefaultBlksize, ModeMask,
+	// UidMap/GidMap and ForceUid/ForceGid were applied, and its changes
+	// are sent as is. It runs on the hot path of every request, possibly
+	// from many goroutines at once, so it must be fast and safe for
+	// concurrent use.
+	AttrFilter func(ino Inode, attr *Attr)
+
+	// DefaultAttrTimeout is how long the kernel caches attributes when
+	// GetAttr leaves AttrResponse.Timeout zero, and those returned by
+	// BatchGetAttr and Statx, which have no timeout of their own. A
+	// negative value disables caching. Default is one second.
+	DefaultAttrTimeout time.Duration
+
 	// MaxBackground is the max number of background requests.
 	// Default is 12.
 	MaxBackground uint16
@@ -30,10 +127,34 @@ type MountOptions struct {
 	// Requires CAP_SYS_ADMIN or root privileges.
 	DirectMount bool
 
+	// DirectMountFallback retries with fusermount when DirectMount fails
+	// for lack of privileges (EPERM/EACCES). Other direct mount errors are
+	// returned as is.
+	DirectMountFallback bool
+
+	// MountRetries is how many more times Mount tries after a transient
+	// failure (EBUSY or EAGAIN, e.g. racing a concurrent unmount), waiting
+	// twice as long before each retry. Permission errors and a missing
+	// fuse device or fusermount are returned at once. Default is 0 (no
+	// retries).
+	MountRetries int
+
 	// AllowOther allows other users to access the mount.
 	// Requires user_allow_other in /etc/fuse.conf.
 	AllowOther bool
 
+	// AllowRoot allows root to access the mount besides the user who
+	// mounted it. The mount is made with allow_other and the server turns
+	// away requests from other users with EACCES, so it needs
+	// user_allow_other too. It cannot be combined with AllowOther.
+	AllowRoot bool
+
+	// AutoUnmount has fusermount unmount the filesystem when the process
+	// exits, even if it crashes without calling Unmount, instead of
+	// leaving a dead mount behind. fusermount stays running alongside the
+	// process for that. Direct mounts (DirectMount) ignore it.
+	AutoUnmount bool
+
 	// DefaultPermissions uses kernel permission checks.
 	DefaultPermissions bool
 
@@ -44,29 +165,264 @@ type MountOptions struct {
 	// FSName is the filesystem name shown in /proc/mounts.
 	FSName string
 
-	// Subtype is the filesystem subtype (e.g., "myfs").
+	// Subtype is the filesystem subtype (e.g., "myfs"). The mount's type
+	// in /proc/mounts, and as shown by df -T or findmnt, becomes
+	// "fuse.<Subtype>" instead of "fuse", which is how tools tell FUSE
+	// filesystems apart. The statfs f_type magic cannot be changed: the
+	// kernel always reports FUSE_SUPER_MAGIC (0x65735546), which stat -f
+	// names "fuseblk", whatever the filesystem's StatFS returns.
 	Subtype string
+
+	// SynthesizeDotEntries makes the server add "." and ".." to directory
+	// listings that lack them. The decision is made per open directory
+	// when it is read from offset 0: if that batch has neither entry, the
+	// server serves "." and ".." at offsets 1 and 2 and shifts the
+	// filesystem's offsets up by 2 (subtracting 2 again when calling
+	// ReadDir). ".." is the directory the inode was last looked up in.
+	SynthesizeDotEntries bool
+
+	// StableDirOrder makes directory listings independent of the order in
+	// which the filesystem enumerates entries (e.g. map iteration). When
+	// a directory is read from offset 0, the server reads the whole
+	// listing through ReadDir, sorts it by name with "." and ".." first,
+	// and serves it, and READDIRPLUS, from that copy with offsets 1..n
+	// until the directory is released. Listings are therefore identical
+	// across reopens as long as the contents do not change. READDIRPLUS
+	// entries carry no attributes in this mode, so ReadDirPlus is not
+	// called. Memory use is proportional to the largest open directory.
+	StableDirOrder bool
+
+	// ClampReads makes the size last reported for an inode (by Lookup,
+	// ReadDirPlus or GetAttr) authoritative for reads: data past it is cut
+	// off, and reads starting at or beyond it return EOF without calling
+	// Read. Useful when Attr.Size describes a truncated view of a larger
+	// backing object. Inodes the server has no size for are not clamped.
+	ClampReads bool
+
+	// FillReads makes the server call Read repeatedly until the size the
+	// kernel asked for is filled or the file ends, and reply once. It
+	// saves round trips for filesystems that return data in small pieces.
+	// The number of calls per request is capped. Not for filesystems that
+	// reply asynchronously.
+	FillReads bool
+
+	// TrackFileTypes makes the file type last reported for an inode (by
+	// Lookup, ReadDirPlus or GetAttr) authoritative for operations that
+	// only make sense on some types: a READ on a directory fails with
+	// EISDIR without calling Read, as read(2) does. The root is always a
+	// directory; inodes the server has no type for are passed through.
+	TrackFileTypes bool
+
+	// AttrBatchWindow, if non-zero and the filesystem implements
+	// BatchAttrFilesystem, is how long a GETATTR waits for others to
+	// arrive so they can be answered by one BatchGetAttr call. Each
+	// GETATTR is delayed by up to this much, so keep it well below the
+	// backend's round trip (a millisecond or two). fstat-style requests,
+	// which name an open file, go to GetAttr with their handle instead.
+	AttrBatchWindow time.Duration
+
+	// StatFSFiles and StatFSFfree are the total and free inode counts
+	// (df -i) reported when StatFS leaves Files at 0, as FilesystemBase
+	// does. A read-only filesystem should report the number of objects
+	// it holds as Files and 0 free (see StatFS.SetInodeCount).
+	StatFSFiles uint64
+	StatFSFfree uint64
+
+	// MaxDirReadSize, if non-zero, caps the size passed to ReadDir and
+	// ReadDirPlus (and the reply sent for them) below what the kernel
+	// asks for, bounding how much a single call enumerates and
+	// serializes. The kernel resumes from the last entry's offset, so a
+	// listing is simply served in more, smaller calls. Values below 1KiB
+	// are raised to it.
+	MaxDirReadSize uint32
+
+	// SerialOpcodes lists opcodes (proto.OpReaddir, proto.OpLookup, ...)
+	// whose handlers must never run concurrently with each other. Requests
+	// with these opcodes are handled one at a time, in arrival order, on a
+	// single goroutine; all other opcodes still get a goroutine each.
+	//
+	// Serialized requests queue behind each other, so a slow handler delays
+	// every other listed opcode, and once the queue is full the read loop
+	// itself waits. Only list opcodes the filesystem cannot handle
+	// concurrently; serializing READ usually costs a lot of throughput.
+	SerialOpcodes []uint32
+
+	// PerUidConcurrency, if positive, caps how many requests of any one
+	// uid are handled at the same time. Further requests from that uid
+	// wait in a queue of their own, so a single user flooding the mount
+	// does not delay the others. Serialized opcodes (SerialOpcodes),
+	// FORGET and INTERRUPT are not counted.
+	PerUidConcurrency int
+
+	// MaxConcurrentRequests caps how many requests are handled at once,
+	// each on a goroutine of its own, so that a flood of requests cannot
+	// exhaust memory. Once it is reached further requests wait in a queue,
+	// with no goroutine and a buffer cut to their size, while the read
+	// loop goes on reading. Serialized opcodes (SerialOpcodes), FORGET
+	// and INTERRUPT are not counted. The limit is on by default, at 16
+	// times MaxBackground; a negative value removes it.
+	MaxConcurrentRequests int
+
+	// NotifyQueueSize, if positive, makes notifications to the kernel
+	// (NotifyInvalInode, SetSnapshot, ...) go through a queue of that
+	// many entries, written by a goroutine of its own, instead of being
+	// written by the caller. A burst of invalidations then interleaves
+	// with replies one at a time instead of holding up the caller, and
+	// once the queue is full callers block until it drains. Write errors
+	// are counted and logged rather than returned.
+	NotifyQueueSize int
+
+	// TraceStart, if set, is called as each request is dispatched to
+	// start a tracing span (OpenTelemetry or similar). op is the opcode
+	// (proto.Op*). The returned context, which must derive from ctx, is
+	// the one the filesystem method runs under, so backend calls made
+	// with it join the span; the server still wraps it to provide the
+	// Context methods. The returned function is called once the request
+	// is answered, with the handler's error (nil on success).
+	TraceStart func(ctx Context, op uint32) (context.Context, func(err error))
+
+	// Metrics, if set, receives the server's counters (see MetricsSink).
+	Metrics MetricsSink
+
+	// OnProtocolError, if set, is called when a request is rejected
+	// because it is malformed (a body too short for its opcode, a name
+	// without its NUL terminator, a BATCH_FORGET count larger than its
+	// body) rather than because the filesystem failed it. op is the
+	// opcode, unique the request id, and err wraps syscall.EINVAL, which
+	// is also what the kernel is answered. Such errors point to a kernel
+	// or protocol version mismatch, or to a misbehaving client of the
+	// device; they are also logged in debug mode.
+	OnProtocolError func(op uint32, unique uint64, err error)
+
+	// PanicHandler, if set, is called when a handler panics, typically
+	// from a bug in the Filesystem, with the opcode, the request id, the
+	// value passed to panic and the goroutine's stack. The request is
+	// answered with EIO and the server keeps running. If nil, the panic
+	// and its stack are logged in debug mode.
+	PanicHandler func(op uint32, unique uint64, v any, stack []byte)
+
+	// OperationTimeout, if non-zero, is a deadline for each request,
+	// counted from when it is read from the kernel. Its context expires
+	// then, and a filesystem method returning ctx.Err() fails the
+	// request with ETIMEDOUT. Methods that ignore their context are not
+	// interrupted.
+	OperationTimeout time.Duration
+
+	// UnmountTimeout bounds how long Unmount waits for in-flight requests
+	// to return after cancelling their contexts.
+	// Default is DefaultUnmountTimeout.
+	UnmountTimeout time.Duration
+
+	// OnDestroy is called once FUSE_DESTROY has been answered and decides
+	// what Serve does next. If nil, Serve keeps running until the kernel
+	// closes the connection (DestroyContinue).
+	OnDestroy func() DestroyAction
+}
+
+// DefaultUnmountTimeout is the default MountOptions.UnmountTimeout.
+const DefaultUnmountTimeout = 5 * time.Second
+
+// DestroyAction selects what Serve does after FUSE_DESTROY.
+type DestroyAction int
+
+const (
+	// DestroyContinue keeps reading from the connection until the kernel
+	// closes it (ENODEV), then Serve returns nil.
+	DestroyContinue DestroyAction = iota
+
+	// DestroyExit makes Serve return nil as soon as DESTROY has been
+	// answered, leaving the fd open (e.g. for a handoff).
+	DestroyExit
+)
+
+// logf logs a debug message to Logger.
+func (o *MountOptions) logf(format string, args ...any) {
+	if o.debugging() {
+		o.Logger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// warnf logs a warning to Logger, if set.
+func (o *MountOptions) warnf(format string, args ...any) {
+	if o.Logger != nil {
+		o.Logger.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+// debugging reports whether debug messages are logged.
+func (o *MountOptions) debugging() bool {
+	return o.Logger != nil && o.Logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// attrTimeout returns the attribute validity sent for a GetAttr timeout
+// of d, DefaultAttrTimeout if d is zero.
+func (o *MountOptions) attrTimeout(d time.Duration) (sec uint64, nsec uint32) {
+	if d == 0 {
+		d = o.DefaultAttrTimeout
+	}
+	if d < 0 {
+		return 0, 0
+	}
+	return durationToTimespec(d)
 }
 
-// mount opens /dev/fuse and mounts the filesystem.
-func mount(mountPoint string, opts *MountOptions) (int, error) {
+// mount opens /dev/fuse and mounts the filesystem. With AutoUnmount it
+// also returns the socket fusermount waits on, closing which unmounts;
+// otherwise that is -1.
+func mount(mountPoint string, opts *MountOptions) (fd, autoUnmount int, err error) {
 	if opts == nil {
 		opts = &MountOptions{}
 	}
+	if opts.AllowOther && opts.AllowRoot {
+		return -1, -1, errors.New("AllowOther and AllowRoot are mutually exclusive")
+	}
 
 	// Validate mount point exists and is a directory
 	fi, err := os.Stat(mountPoint)
 	if err != nil {
-		return -1, fmt.Errorf("mount point: %w", err)
+		return -1, -1, fmt.Errorf("mount point: %w", err)
 	}
 	if !fi.IsDir() {
-		return -1, fmt.Errorf("mount point is not a directory: %s", mountPoint)
+		return -1, -1, fmt.Errorf("mount point is not a directory: %s", mountPoint)
+	}
+
+	delay := mountRetryDelay
+	for attempt := 0; ; attempt++ {
+		fd, autoUnmount, err = mountOnce(mountPoint, opts)
+		if err == nil || attempt >= opts.MountRetries || !transientMountErr(err) {
+			return fd, autoUnmount, err
+		}
+		opts.logf("mount failed (%v), retrying in %v", err, delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
+}
 
+// mountRetryDelay is the wait before the first mount retry; it doubles
+// with each further attempt.
+const mountRetryDelay = 50 * time.Millisecond
+
+// mountOnce makes a single attempt at mounting, directly or through
+// fusermount as configured.
+func mountOnce(mountPoint string, opts *MountOptions) (fd, autoUnmount int, err error) {
 	if opts.DirectMount {
-		return mountDirect(mountPoint, opts)
+		fd, err := mountDirect(mountPoint, opts)
+		if err == nil {
+			opts.logf("mounted %s directly", mountPoint)
+			return fd, -1, nil
+		}
+		if !opts.DirectMountFallback || !errors.Is(err, ErrMountPermission) {
+			return -1, -1, err
+		}
+		opts.logf("direct mount failed (%v), falling back to fusermount", err)
+	}
+
+	fd, autoUnmount, err = mountFusermount(mountPoint, opts)
+	if err != nil {
+		return -1, -1, err
 	}
-	return mountFusermount(mountPoint, opts)
+	opts.logf("mounted %s via fusermount", mountPoint)
+	return fd, autoUnmount, nil
 }
 
 // mountDirect mounts without fusermount helper.
@@ -75,57 +431,80 @@ func mountDirect(mountPoint string, opts *MountOptions) (int, error) {
 	// Open /dev/fuse
 	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
 	if err != nil {
-		return -1, fmt.Errorf("open /dev/fuse: %w", err)
+		return -1, mountErr("open /dev/fuse", classifyErrno(err), err)
 	}
 
-	// Build mount options
-	mountOpts := fmt.Sprintf(
-		"fd=%d,rootmode=%o,user_id=%d,group_id=%d",
-		fd,
-		040755, // Directory with 0755 permissions
-		os.Getuid(),
-		os.Getgid(),
-	)
+	mountOpts := directMountOptions(fd, os.Getuid(), os.Getgid(), opts)
 
-	if opts.AllowOther {
-		mountOpts += ",allow_other"
+	// Mount flags: read-only, so that the mount shows as such in
+	// /proc/mounts and the kernel rejects writes without asking us
+	flags := uintptr(syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+
+	// The kernel registers "fuse" as having subtypes: mounting
+	// "fuse.<subtype>" shows that type in /proc/mounts, like fusermount
+	// does with subtype=.
+	source := "fuse"
+	if opts.FSName != "" {
+		source = opts.FSName
 	}
-	if opts.DefaultPermissions {
-		mountOpts += ",default_permissions"
+	fstype := "fuse"
+	if opts.Subtype != "" {
+		fstype += "." + opts.Subtype
 	}
 
-	// Mount flags
-	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
-
 	// Call mount(2)
 	err = syscall.Mount(
-		"fuse",     // source
+		source,     // source
 		mountPoint, // target
-		"fuse",     // fstype
+		fstype,     // fstype
 		flags,      // flags
 		mountOpts,  // data
 	)
 	if err != nil {
 		syscall.Close(fd)
-		return -1, fmt.Errorf("mount: %w", err)
+		return -1, mountErr("mount", classifyErrno(err), err)
 	}
 
 	return fd, nil
 }
 
-// mountFusermount mounts using the fusermount3/fusermount helper.
-func mountFusermount(mountPoint string, opts *MountOptions) (int, error) {
-	// Create socket pair for receiving the fd
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
-	if err != nil {
-		return -1, fmt.Errorf("socketpair: %w", err)
+// directMountOptions returns the mount(2) data for a mount served on fd
+// and owned by uid and gid.
+func directMountOptions(fd, uid, gid int, opts *MountOptions) string {
+	mountOpts := fmt.Sprintf(
+		"fd=%d,rootmode=%o,user_id=%d,group_id=%d",
+		fd,
+		040755, // Directory with 0755 permissions
+		uid,
+		gid,
+	)
+
+	if opts.MaxRead != 0 {
+		mountOpts += fmt.Sprintf(",max_read=%d", opts.MaxRead)
+	}
+	if opts.AllowOther || opts.AllowRoot {
+		// The kernel has no allow_root; the server checks for it
+		mountOpts += ",allow_other"
+	}
+	if opts.DefaultPermissions {
+		mountOpts += ",default_permissions"
 	}
+	return mountOpts
+}
 
-	// Build fusermount options
-	fusermountOpts := "rw"
-	if opts.AllowOther {
+// fusermountOptions returns the -o argument for fusermount.
+func fusermountOptions(opts *MountOptions) string {
+	fusermountOpts := "ro"
+	if opts.MaxRead != 0 {
+		fusermountOpts += fmt.Sprintf(",max_read=%d", opts.MaxRead)
+	}
+	if opts.AllowOther || opts.AllowRoot {
+		// As libfuse does: allow_root is enforced by the server
 		fusermountOpts += ",allow_other"
 	}
+	if opts.AutoUnmount {
+		fusermountOpts += ",auto_unmount"
+	}
 	if opts.DefaultPermissions {
 		fusermountOpts += ",default_permissions"
 	}
@@ -135,6 +514,18 @@ func mountFusermount(mountPoint string, opts *MountOptions) (int, error) {
 	if opts.Subtype != "" {
 		fusermountOpts += ",subtype=" + opts.Subtype
 	}
+	return fusermountOpts
+}
+
+// mountFusermount mounts using the fusermount3/fusermount helper. With
+// AutoUnmount, fusermount keeps running until the socket it was given is
+// closed, then unmounts; that socket is returned as autoUnmount.
+func mountFusermount(mountPoint string, opts *MountOptions) (fd, autoUnmount int, err error) {
+	// Create socket pair for receiving the fd
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, -1, fmt.Errorf("socketpair: %w", err)
+	}
 
 	// Try fusermount3 first, then fusermount
 	fusermountPath := "fusermount3"
@@ -142,34 +533,69 @@ func mountFusermount(mountPoint string, opts *MountOptions) (int, error) {
 		fusermountPath = "fusermount"
 	}
 
-	// Run fusermount
-	cmd := exec.Command(fusermountPath, "-o", fusermountOpts, "--", mountPoint)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("_FUSE_COMMFD=%d", fds[0]))
+	// Run fusermount, passing it one end of the socket as fd 3
+	comm := os.NewFile(uintptr(fds[0]), "fusermount-comm")
+	var stderr bytes.Buffer
+	cmd := exec.Command(fusermountPath, "-o", fusermountOptions(opts), "--", mountPoint)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{comm}
 
-	// Pass the socket fd to fusermount
-	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(fds[0]), "fusermount-comm")}
+	err = cmd.Start()
+	comm.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		var kind error
+		if errors.Is(err, exec.ErrNotFound) {
+			kind = ErrFusermountNotFound
+		}
+		return -1, -1, mountErr("fusermount", kind, err)
+	}
 
-	// Close our copy of fds[0] after starting
-	defer syscall.Close(fds[0])
+	wait := func() error {
+		err := cmd.Wait()
+		if err == nil {
+			return nil
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return mountErr("fusermount", classifyFusermount(msg), err)
+	}
 
-	if err := cmd.Start(); err != nil {
+	if !opts.AutoUnmount {
+		// Wait for fusermount to complete
+		if err := wait(); err != nil {
+			syscall.Close(fds[1])
+			return -1, -1, err
+		}
+		fd, err := receiveFuseFd(fds[1])
 		syscall.Close(fds[1])
-		return -1, fmt.Errorf("fusermount: %w", err)
+		return fd, -1, err
 	}
 
-	// Wait for fusermount to complete
-	if err := cmd.Wait(); err != nil {
+	// fusermount stays up, so the descriptor arrives while it runs; if
+	// it fails instead, the socket reaches EOF and its error says why
+	fd, err = receiveFuseFd(fds[1])
+	if err != nil {
 		syscall.Close(fds[1])
-		return -1, fmt.Errorf("fusermount: %w", err)
+		if werr := wait(); werr != nil {
+			return -1, -1, werr
+		}
+		return -1, -1, err
 	}
+	go cmd.Wait()
+	return fd, fds[1], nil
+}
 
-	// Receive the fuse fd from fusermount via SCM_RIGHTS
+// receiveFuseFd receives the /dev/fuse descriptor fusermount sends over
+// sock with SCM_RIGHTS.
+func receiveFuseFd(sock int) (int, error) {
 	buf := make([]byte, 1)
 	oob := make([]byte, unix.CmsgSpace(4))
 
-	n, oobn, _, _, err := syscall.Recvmsg(fds[1], buf, oob, 0)
-	syscall.Close(fds[1])
-
+	n, oobn, _, _, err := syscall.Recvmsg(sock, buf, oob, 0)
 	if err != nil {
 		return -1, fmt.Errorf("recvmsg: %w", err)
 	}
@@ -196,6 +622,68 @@ func mountFusermount(mountPoint string, opts *MountOptions) (int, error) {
 	return -1, fmt.Errorf("fusermount: did not receive file descriptor")
 }
 
+// mountErr wraps err for op, also tagging it with kind (one of the typed
+// mount errors) when known so callers can test for it with errors.Is.
+func mountErr(op string, kind, err error) error {
+	if kind == nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return fmt.Errorf("%s: %w: %w", op, kind, err)
+}
+
+// classifyErrno maps an errno from open(/dev/fuse) or mount(2) to a typed
+// mount error, or nil.
+func classifyErrno(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return ErrFuseDeviceMissing
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return ErrMountPermission
+	case errors.Is(err, syscall.EBUSY):
+		return ErrMountpointBusy
+	default:
+		return nil
+	}
+}
+
+// classifyFusermount maps a fusermount error message to a typed mount
+// error, or nil. fusermount only reports failures as text on stderr.
+func classifyFusermount(msg string) error {
+	switch {
+	case strings.Contains(msg, "device not found"),
+		strings.Contains(msg, "/dev/fuse") && strings.Contains(msg, "No such"):
+		return ErrFuseDeviceMissing
+	case strings.Contains(msg, "Permission denied"),
+		strings.Contains(msg, "Operation not permitted"),
+		strings.Contains(msg, "no write access"),
+		strings.Contains(msg, "only allowed if"):
+		return ErrMountPermission
+	case strings.Contains(msg, "Device or resource busy"),
+		strings.Contains(msg, "not empty"),
+		strings.Contains(msg, "already mounted"):
+		return ErrMountpointBusy
+	default:
+		return nil
+	}
+}
+
+// transientMountErr reports whether a failed mount is worth retrying: the
+// mount point was momentarily busy (e.g. racing a concurrent unmount) or a
+// resource was temporarily unavailable. Permission and missing-device
+// errors are permanent.
+func transientMountErr(err error) bool {
+	if errors.Is(err, ErrMountPermission) || errors.Is(err, ErrFuseDeviceMissing) || errors.Is(err, ErrFusermountNotFound) {
+		return false
+	}
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	// fusermount only reports the errno as text
+	msg := err.Error()
+	return strings.Contains(msg, "Device or resource busy") ||
+		strings.Contains(msg, "Resource temporarily unavailable")
+}
+
 // unmount unmounts the filesystem.
 func unmount(mountPoint string) error {
 	// Try lazy unmount first
@@ -0,0 +1,107 @@
+package rofuse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMountOptionStrings(t *testing.T) {
+	for _, tc := range []struct {
+		opts       MountOptions
+		direct     string // After the fd, rootmode and ids
+		fusermount string
+	}{
+		{MountOptions{}, "", "ro"},
+		{MountOptions{AllowOther: true}, ",allow_other", "ro,allow_other"},
+		// The kernel knows no allow_root: the server enforces it
+		{MountOptions{AllowRoot: true}, ",allow_other", "ro,allow_other"},
+		// fusermount does the unmounting; mount(2) has nothing to do with it
+		{MountOptions{AutoUnmount: true}, "", "ro,auto_unmount"},
+		{MountOptions{DefaultPermissions: true}, ",default_permissions", "ro,default_permissions"},
+		{
+			MountOptions{AllowRoot: true, AutoUnmount: true, DefaultPermissions: true, MaxRead: 65536},
+			",max_read=65536,allow_other,default_permissions",
+			"ro,max_read=65536,allow_other,auto_unmount,default_permissions",
+		},
+		{
+			MountOptions{AllowOther: true, FSName: "src", Subtype: "kind"},
+			",allow_other",
+			"ro,allow_other,fsname=src,subtype=kind",
+		},
+	} {
+		const prefix = "fd=7,rootmode=40755,user_id=1000,group_id=100"
+		if got := directMountOptions(7, 1000, 100, &tc.opts); got != prefix+tc.direct {
+			t.Errorf("%+v: direct %q, want %q", tc.opts, got, prefix+tc.direct)
+		}
+		if got := fusermountOptions(&tc.opts); got != tc.fusermount {
+			t.Errorf("%+v: fusermount %q, want %q", tc.opts, got, tc.fusermount)
+		}
+	}
+}
+
+// AllowOther and AllowRoot together are refused before anything else is
+// tried, so the mount point is never looked at.
+func TestMountAllowOtherAndRoot(t *testing.T) {
+	_, _, err := mount("/nonexistent/mount/point", &MountOptions{AllowOther: true, AllowRoot: true})
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("mount = %v, want AllowOther and AllowRoot refused", err)
+	}
+}
+
+// fusermount's messages map to the typed errors, and only a busy mount
+// point or a temporary shortage is retried.
+func TestClassifyFusermount(t *testing.T) {
+	for _, tc := range []struct {
+		msg       string
+		kind      error
+		transient bool
+	}{
+		{"fusermount3: fuse device not found, try 'modprobe fuse' first", ErrFuseDeviceMissing, false},
+		{"fusermount: failed to open /dev/fuse: No such file or directory", ErrFuseDeviceMissing, false},
+		{"fusermount3: mount failed: Operation not permitted", ErrMountPermission, false},
+		{"fusermount3: failed to access mountpoint /mnt: Permission denied", ErrMountPermission, false},
+		{"fusermount: user has no write access to mountpoint /mnt", ErrMountPermission, false},
+		{"fusermount3: option allow_other only allowed if 'user_allow_other' is set in /etc/fuse.conf", ErrMountPermission, false},
+		{"fusermount3: mount failed: Device or resource busy", ErrMountpointBusy, true},
+		// Busy until emptied, which waiting does not do
+		{"fusermount: mountpoint is not empty", ErrMountpointBusy, false},
+		{"fusermount3: mount failed: Resource temporarily unavailable", nil, true},
+		{"fusermount3: unknown option 'foo'", nil, false},
+		{"", nil, false},
+	} {
+		kind := classifyFusermount(tc.msg)
+		if kind != tc.kind {
+			t.Errorf("classifyFusermount(%q) = %v, want %v", tc.msg, kind, tc.kind)
+		}
+		err := mountErr("fusermount", kind, fmt.Errorf("exit status 1: %s", tc.msg))
+		if got := transientMountErr(err); got != tc.transient {
+			t.Errorf("transientMountErr(%v) = %v, want %v", err, got, tc.transient)
+		}
+	}
+}
+
+// Errors from mount(2) and exec are retried by their errno; the permanent
+// kinds win over it.
+func TestTransientMountErr(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{mountErr("mount", classifyErrno(syscall.EBUSY), syscall.EBUSY), true},
+		{mountErr("mount", nil, syscall.EAGAIN), true},
+		{fmt.Errorf("retry: %w", syscall.EBUSY), true},
+		{mountErr("mount", classifyErrno(syscall.EPERM), syscall.EPERM), false},
+		{mountErr("open /dev/fuse", classifyErrno(syscall.ENODEV), syscall.ENODEV), false},
+		{mountErr("fusermount", ErrFusermountNotFound, errors.New("exec: not found")), false},
+		// A permanent kind is not retried whatever its cause says
+		{mountErr("mount", ErrMountPermission, syscall.EBUSY), false},
+		{mountErr("mount", nil, syscall.EINVAL), false},
+	} {
+		if got := transientMountErr(tc.err); got != tc.want {
+			t.Errorf("transientMountErr(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package rofuse
+
+import (
+	"os"
+	"sync"
+)
+
+// nodeCache remembers what the server has told the kernel about each inode
+// the kernel holds a reference to: the parent it was looked up in and its
+// last known size and mode. Entries are created by LOOKUP and READDIRPLUS
+// replies and dropped once the kernel forgets the inode.
+type nodeCache struct {
+	mu    sync.Mutex
+	nodes map[Inode]*cachedNode
+}
+
+// cachedNode is a nodeCache entry.
+type cachedNode struct {
+	parent  Inode
+	name    string
+	size    uint64
+	mode    os.FileMode
+	nlookup uint64
+}
+
+func newNodeCache() *nodeCache {
+	return &nodeCache{nodes: make(map[Inode]*cachedNode)}
+}
+
+// add records an entry sent to the kernel, which takes one lookup
+// reference on it. Negative entries (inode 0) take no reference.
+func (c *nodeCache) add(parent Inode, name string, e *Entry) {
+	if e.Ino == 0 || e.Ino == RootInode {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[e.Ino]
+	if !ok {
+		n = &cachedNode{}
+		c.nodes[e.Ino] = n
+	}
+	n.parent = parent
+	n.name = name
+	n.size = e.Attr.Size
+	n.mode = e.Attr.Mode
+	n.nlookup++
+}
+
+// addPlus records the entries of a READDIRPLUS reply. The kernel takes
+// no reference on "." and "..".
+func (c *nodeCache) addPlus(parent Inode, entries []DirEntryPlus) {
+	for i := range entries {
+		if isDotName(entries[i].Name) {
+			continue
+		}
+		c.add(parent, entries[i].Name, &entries[i].Entry)
+	}
+}
+
+// setAttr refreshes the cached attributes of a known inode.
+func (c *nodeCache) setAttr(ino Inode, a *Attr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[ino]; ok {
+		n.size = a.Size
+		n.mode = a.Mode
+	}
+}
+
+// forget drops nlookup references and removes the inode once none remain.
+func (c *nodeCache) forget(ino Inode, nlookup uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[ino]
+	if !ok {
+		return
+	}
+	if nlookup >= n.nlookup {
+		delete(c.nodes, ino)
+		return
+	}
+	n.nlookup -= nlookup
+}
+
+// size returns the last size reported for ino, if it is known.
+func (c *nodeCache) size(ino Inode) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[ino]; ok {
+		return n.size, true
+	}
+	return 0, false
+}
+
+// isDir reports whether ino was last reported as a directory, and whether
+// its type is known at all.
+func (c *nodeCache) isDir(ino Inode) (dir, ok bool) {
+	if ino == RootInode {
+		return true, true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[ino]; ok {
+		return n.mode.IsDir(), true
+	}
+	return false, false
+}
+
+// parent returns the directory ino was last looked up in. The root is its
+// own parent; unknown inodes also report themselves.
+func (c *nodeCache) parent(ino Inode) Inode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[ino]; ok {
+		return n.parent
+	}
+	return ino
+}
+
+// name returns the directory and name ino was last looked up by.
+func (c *nodeCache) name(ino Inode) (parent Inode, name string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[ino]; ok {
+		return n.parent, n.name, true
+	}
+	return 0, "", false
+}
+
+// cachedEntry is a name the kernel may have cached.
+type cachedEntry struct {
+	ino    Inode
+	parent Inode
+	name   string
+}
+
+// entries returns every cached inode with the name it was looked up by.
+func (c *nodeCache) entries() []cachedEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]cachedEntry, 0, len(c.nodes))
+	for ino, n := range c.nodes {
+		list = append(list, cachedEntry{ino: ino, parent: n.parent, name: n.name})
+	}
+	return list
+}
@@ -0,0 +1,202 @@
+package rofuse
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// notify sends an unsolicited notification to the kernel, or queues it if
+// MountOptions.NotifyQueueSize is set. A full queue blocks the caller
+// until there is room. Once the server is shutting down notifications
+// fail with ErrServerClosed, since nothing would write them.
+func (s *Server) notify(code int32, payload []byte) error {
+	if s.ctx.Err() != nil {
+		s.count("notify.dropped", 1)
+		return ErrServerClosed
+	}
+
+	data := make([]byte, proto.OutHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(code))
+	// Unique is 0 for notifications
+	copy(data[proto.OutHeaderSize:], payload)
+
+	if s.notifyCh == nil {
+		return s.sendNotify(data)
+	}
+
+	select {
+	case s.notifyCh <- data:
+		return nil
+	default:
+	}
+
+	s.count("notify.full", 1)
+	select {
+	case s.notifyCh <- data:
+		return nil
+	case <-s.ctx.Done():
+		s.count("notify.dropped", 1)
+		return ErrServerClosed
+	}
+}
+
+// sendNotify writes a notification to the kernel.
+func (s *Server) sendNotify(data []byte) error {
+	err := s.conn.writeResponse(data)
+	if err == syscall.ENOENT {
+		// The kernel has nothing cached for it
+		err = nil
+	}
+	if err != nil {
+		s.count("notify.error."+errnoName(toErrno(err)), 1)
+		return err
+	}
+	s.count("notify.sent", 1)
+	return nil
+}
+
+// runNotify writes queued notifications until the server shuts down;
+// whatever is still queued then is dropped.
+func (s *Server) runNotify() {
+	for {
+		select {
+		case data := <-s.notifyCh:
+			if err := s.sendNotify(data); err != nil {
+				s.opts.logf("notification failed: %v", err)
+			}
+		case <-s.ctx.Done():
+			if n := len(s.notifyCh); n > 0 {
+				s.count("notify.dropped", int64(n))
+			}
+			return
+		}
+	}
+}
+
+// NotifyBacklog returns how many notifications are queued waiting to be
+// written. It is always 0 without MountOptions.NotifyQueueSize.
+func (s *Server) NotifyBacklog() int {
+	return len(s.notifyCh)
+}
+
+// Notifier sends cache invalidations to the kernel for a Server. It can
+// be handed to a filesystem that watches its backend for changes, without
+// giving it the rest of the Server. The zero Notifier is not usable.
+type Notifier struct {
+	s *Server
+}
+
+// Notifier returns a Notifier for s.
+func (s *Server) Notifier() Notifier {
+	return Notifier{s: s}
+}
+
+// InvalInode is Server.NotifyInvalInode.
+func (n Notifier) InvalInode(ino Inode, off, length int64) error {
+	return n.s.NotifyInvalInode(ino, off, length)
+}
+
+// InvalEntry is Server.NotifyInvalEntry.
+func (n Notifier) InvalEntry(parent Inode, name string) error {
+	return n.s.NotifyInvalEntry(parent, name)
+}
+
+// DeleteEntry is Server.NotifyDelete.
+func (n Notifier) DeleteEntry(parent, child Inode, name string) error {
+	return n.s.NotifyDelete(parent, child, name)
+}
+
+// NotifyInvalInode tells the kernel that ino changed in the backend. Its
+// cached attributes are always dropped, so the next stat reaches GetAttr.
+// Cached file data is dropped depending on off and length:
+//
+//   - off < 0: none, only the attributes
+//   - off >= 0, length <= 0: from off to the end of the file, so (0, 0)
+//     drops everything
+//   - off >= 0, length > 0: the pages overlapping [off, off+length); pages
+//     outside the range stay cached
+//
+// The kernel caches whole pages, so a range that is not page-aligned drops
+// the pages it touches in full. Invalidating an inode the kernel does not
+// know is not an error. With MountOptions.NotifyQueueSize the notification
+// is queued and write errors are only counted and logged.
+func (s *Server) NotifyInvalInode(ino Inode, off, length int64) error {
+	data := make([]byte, proto.NotifyInvalInodeOutSize)
+	binary.LittleEndian.PutUint64(data[0:], uint64(ino))
+	binary.LittleEndian.PutUint64(data[8:], uint64(off))
+	binary.LittleEndian.PutUint64(data[16:], uint64(length))
+	return s.notify(proto.NotifyInvalInode, data)
+}
+
+// NotifyInvalEntry tells the kernel that name in parent may have changed
+// in the backend: it drops its cached entry, and the next access to the
+// name looks it up again. A name that appeared is found, one that went
+// away is no longer served from the cache. Invalidating a name the kernel
+// has not cached is not an error.
+func (s *Server) NotifyInvalEntry(parent Inode, name string) error {
+	if err := checkNotifyName(name); err != nil {
+		return err
+	}
+	data := make([]byte, proto.NotifyInvalEntryOutSize+len(name)+1)
+	binary.LittleEndian.PutUint64(data[0:], uint64(parent))
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(name)))
+	copy(data[proto.NotifyInvalEntryOutSize:], name)
+	return s.notify(proto.NotifyInvalEntry, data)
+}
+
+// NotifyDelete tells the kernel that name, which pointed to child, was
+// removed from parent in the backend. Unlike NotifyInvalEntry it also
+// detaches the dentry from the kernel's cache right away, so inotify
+// watchers see the deletion. If the cached entry points to another inode
+// it is only invalidated.
+func (s *Server) NotifyDelete(parent, child Inode, name string) error {
+	if err := checkNotifyName(name); err != nil {
+		return err
+	}
+	data := make([]byte, proto.NotifyDeleteOutSize+len(name)+1)
+	binary.LittleEndian.PutUint64(data[0:], uint64(parent))
+	binary.LittleEndian.PutUint64(data[8:], uint64(child))
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(name)))
+	copy(data[proto.NotifyDeleteOutSize:], name)
+	return s.notify(proto.NotifyDelete, data)
+}
+
+// checkNotifyName rejects names no directory entry can have.
+func checkNotifyName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\x00") {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// EvictInodes asks the kernel to let go of inos, so that it sends the
+// FORGETs that allow a filesystem to reclaim them. Each inode's entry is
+// invalidated under the name it was last looked up by, along with its
+// cached attributes and data. The kernel drops an inode once nothing else
+// holds it: open files and working directories keep theirs. It returns
+// the inodes it could not ask about: those the server has no name for,
+// and those whose invalidation failed. It is meant as the callback of
+// InodeTable.SetLimit, and must not be called while answering a LOOKUP.
+func (s *Server) EvictInodes(inos []Inode) (kept []Inode) {
+	for _, ino := range inos {
+		parent, name, ok := s.nodes.name(ino)
+		if !ok {
+			kept = append(kept, ino)
+			continue
+		}
+		err := s.NotifyInvalEntry(parent, name)
+		if err == nil {
+			err = s.NotifyInvalInode(ino, 0, 0)
+		}
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			s.opts.logf("evicting inode %d: %v", ino, err)
+			kept = append(kept, ino)
+		}
+	}
+	return kept
+}
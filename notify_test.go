@@ -0,0 +1,139 @@
+package rofuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func TestNotifyQueued(t *testing.T) {
+	k := newTestServer(t, newTestFS(), &MountOptions{NotifyQueueSize: 4})
+	if err := k.s.NotifyInvalInode(5, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if errno, data := k.recv(0); errno != proto.NotifyInvalInode || len(data) != proto.NotifyInvalInodeOutSize {
+		t.Errorf("got code %d with %d bytes, want an inode invalidation", errno, len(data))
+	}
+}
+
+// The range passed to NotifyInvalInode reaches the kernel as given.
+func TestNotifyInvalInodeRange(t *testing.T) {
+	k := newTestServer(t, newTestFS(), nil)
+	for _, want := range []proto.NotifyInvalInodeOut{
+		{Ino: 5, Off: 4096, Len: 4096}, // One page
+		{Ino: 5, Off: 0, Len: 0},       // All of the data
+		{Ino: 7, Off: -1, Len: 0},      // Attributes only
+	} {
+		if err := k.s.NotifyInvalInode(Inode(want.Ino), want.Off, want.Len); err != nil {
+			t.Fatal(err)
+		}
+		errno, data := k.recv(0)
+		if errno != proto.NotifyInvalInode {
+			t.Fatalf("got code %d, want an inode invalidation", errno)
+		}
+		if got := *wireStruct[proto.NotifyInvalInodeOut](t, data); got != want {
+			t.Errorf("sent %+v, want %+v", got, want)
+		}
+	}
+}
+
+// Notifications sent after Unmount fail instead of being queued for a
+// writer that is gone.
+func TestNotifyAfterUnmount(t *testing.T) {
+	for _, size := range []int{0, 4} {
+		k := newTestServer(t, newTestFS(), &MountOptions{NotifyQueueSize: size})
+		k.s.Unmount()
+		if err := k.s.NotifyInvalInode(5, 0, 0); !errors.Is(err, ErrServerClosed) {
+			t.Errorf("queue size %d: got %v, want ErrServerClosed", size, err)
+		}
+		if err := k.s.NotifyInvalEntry(RootInode, "name"); !errors.Is(err, ErrServerClosed) {
+			t.Errorf("queue size %d: got %v, want ErrServerClosed", size, err)
+		}
+	}
+}
+
+// Inodes the server has no name for are kept by EvictInodes.
+func TestEvictInodes(t *testing.T) {
+	fs := newTestFS()
+	ino := fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, nil)
+	k.lookup(RootInode, "file")
+
+	kept := k.s.EvictInodes([]Inode{ino, 99})
+	if len(kept) != 1 || kept[0] != 99 {
+		t.Errorf("kept %v, want [99]", kept)
+	}
+	if errno, data := k.recv(0); errno != proto.NotifyInvalEntry || !bytes.Contains(data, []byte("file\x00")) {
+		t.Errorf("got code %d with %q, want an entry invalidation of file", errno, data)
+	}
+}
+
+// Once the notification queue is full, notifiers wait for it instead of
+// growing it, and replies still go out while the writer is stuck.
+func TestNotifyQueueFull(t *testing.T) {
+	// Notification writes hang until released
+	hold, stuck := make(chan struct{}), make(chan struct{}, 1)
+	write := sysWrite
+	sysWrite = func(fd int, p []byte) (int, error) {
+		if len(p) >= proto.OutHeaderSize && binary.LittleEndian.Uint64(p[8:16]) == 0 {
+			select {
+			case stuck <- struct{}{}:
+			default:
+			}
+			<-hold
+		}
+		return write(fd, p)
+	}
+	t.Cleanup(func() { sysWrite = write })
+
+	fs := newTestFS()
+	fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, &MountOptions{NotifyQueueSize: 2})
+	// Before Unmount, which waits for the writer
+	var release sync.Once
+	t.Cleanup(func() { release.Do(func() { close(hold) }) })
+	sent := make(chan Inode, 5)
+	go func() {
+		for ino := Inode(10); ino < 15; ino++ {
+			if err := k.s.NotifyInvalInode(ino, 0, 0); err != nil {
+				t.Errorf("NotifyInvalInode %d: %v", ino, err)
+			}
+			sent <- ino
+		}
+	}()
+
+	// One notification is being written and two are queued
+	<-stuck
+	for range 3 {
+		<-sent
+	}
+	select {
+	case ino := <-sent:
+		t.Fatalf("notification of %d returned with the queue full", ino)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := k.s.NotifyBacklog(); n != 2 {
+		t.Errorf("backlog %d, want the queue size 2", n)
+	}
+	k.getattr(RootInode)
+	k.lookup(RootInode, "file")
+
+	release.Do(func() { close(hold) })
+	for range 2 {
+		<-sent
+	}
+	for want := Inode(10); want < 15; want++ {
+		errno, data := k.recv(0)
+		if errno != proto.NotifyInvalInode {
+			t.Fatalf("got code %d, want an inode invalidation", errno)
+		}
+		if ino := Inode(wireStruct[proto.NotifyInvalInodeOut](t, data).Ino); ino != want {
+			t.Errorf("invalidation of %d, want %d", ino, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package rofuse
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+	"github.com/KarpelesLab/rofuse/sharing"
+	"golang.org/x/sys/unix"
+)
+
+// serveParallel runs ServeParallel(n) on a test connection, with dups of
+// the socket standing in for clones of /dev/fuse, and returns the clones
+// it made and the channel ServeParallel's error is sent on.
+func serveParallel(t testing.TB, fs Filesystem, opts *MountOptions, n int) (*testKernel, []int, chan error) {
+	t.Helper()
+	made := make(chan []int, 1)
+	cloneFds = func(fd, count int) ([]int, error) {
+		var fds []int
+		for range count {
+			c, err := unix.Dup(fd)
+			if err != nil {
+				sharing.CloseAll(fds)
+				return nil, err
+			}
+			fds = append(fds, c)
+		}
+		made <- fds
+		return fds, nil
+	}
+	t.Cleanup(func() { cloneFds = sharing.CloneMultiple })
+
+	k := newTestConn(t, fs, opts)
+	served := make(chan error, 1)
+	go func() { served <- k.s.ServeParallel(n) }()
+	t.Cleanup(func() { k.s.Unmount() })
+	k.handshake(0)
+
+	var clones []int
+	if n > 1 {
+		clones = <-made
+	}
+	return k, clones, served
+}
+
+// Unmount closes every clone, and ServeParallel returns once all of its
+// loops have, with the requests they read answered.
+func TestServeParallelShutdown(t *testing.T) {
+	fs := holdFS{newTestFS()}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k, clones, served := serveParallel(t, fs, nil, 4)
+	if len(clones) != 3 {
+		t.Fatalf("%d clones, want 3", len(clones))
+	}
+
+	// Served by whichever loops read them
+	k.lookup(RootInode, "file")
+	in := wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096})
+	var held []uint64
+	for range 8 {
+		held = append(held, k.send(proto.OpRead, uint64(ino), in))
+	}
+	k.recv(k.sendInterrupt(k.unique.Add(2)))
+
+	if err := k.s.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	select {
+	case err := <-served:
+		// A loop that sees the server cancelled before its read fails
+		// ends with the context's error
+		if err != nil && err != context.Canceled {
+			t.Errorf("ServeParallel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeParallel still running after Unmount")
+	}
+	k.s.Wait()
+
+	for _, unique := range held {
+		if errno, _ := k.recv(unique); errno == 0 {
+			t.Errorf("held READ %d succeeded after Unmount", unique)
+		}
+	}
+	for _, c := range k.s.clones {
+		if c.Fd() >= 0 {
+			t.Errorf("clone connection still has fd %d", c.Fd())
+		}
+	}
+	for _, fd := range clones {
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != syscall.EBADF {
+			t.Errorf("clone fd %d: %v, want EBADF", fd, err)
+		}
+	}
+}
+
+// BenchmarkServeParallel answers b.N 4 KiB READs, all sent at once, with
+// Serve and with ServeParallel.
+func BenchmarkServeParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		loops int
+	}{
+		{"Serve", 1},
+		{"loops=2", 2},
+		{"loops=4", 4},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fs := newTestFS()
+			ino := fs.create(RootInode, "file", make([]byte, 4096))
+			k, _, _ := serveParallel(b, fs, nil, bc.loops)
+			in := wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096})
+			b.SetBytes(4096)
+			b.ResetTimer()
+
+			// The replies are read here rather than with k.recv, whose
+			// buffers would cost more than the READs. At most window
+			// READs are outstanding: the server's end of the socket does
+			// not block, and drops replies that do not fit its buffer.
+			const window = 16
+			sent := make(chan struct{}, window)
+			go func() {
+				for range b.N {
+					sent <- struct{}{}
+					h := k.header(proto.OpRead, uint64(ino))
+					h.Len = uint32(proto.InHeaderSize + len(in))
+					unix.Write(k.fd, append(wireBytes(&h), in...))
+				}
+			}()
+			buf := make([]byte, proto.OutHeaderSize+4096)
+			for range b.N {
+				if n, err := unix.Read(k.fd, buf); err != nil || n != len(buf) {
+					b.Fatalf("read %d bytes, %v, want %d", n, err, len(buf))
+				}
+				<-sent
+			}
+		})
+	}
+}
@@ -0,0 +1,547 @@
+package rofuse
+
+import (
+	"sync"
+	"syscall"
+)
+
+// PerUserFS serves a separate filesystem to each uid from one mount.
+//
+// The kernel caches dentries, attributes and pages by inode, for all users
+// at once, so the inodes of different users must never collide. PerUserFS
+// namespaces them: inode ino of the filesystem created for uid is exposed
+// as (uid+1)<<32 | ino, which limits inner inode numbers to 32 bits. The
+// root inode is the one thing all users share; requests on it are routed
+// by the caller's uid, and everything that could leak through it (its
+// attributes, entries under the root, its directory listing) is served
+// uncached. Requests on any other inode go to the filesystem encoded in
+// the inode, whoever sends them, and fail with ESTALE if it doesn't exist.
+//
+// File handles are mapped the same way, so handles of the inner
+// filesystems may use the full 64 bits.
+type PerUserFS struct {
+	factory func(uid uint32) (Filesystem, error)
+
+	mu      sync.Mutex
+	config  *Config
+	users   map[uint32]Filesystem
+	handles map[FileHandle]userHandle
+	nextFh  FileHandle
+}
+
+// userHandle is the inner filesystem's handle behind an outer one.
+type userHandle struct {
+	uid uint32
+	fh  FileHandle
+}
+
+// NewPerUserFS returns a PerUserFS that calls factory the first time a uid
+// accesses the mount to create the filesystem it will see. The filesystem
+// is initialized with the mount's Config and destroyed with the mount.
+// factory may be called concurrently, and more than once for a uid whose
+// first requests arrive together; only one of the filesystems is kept.
+func NewPerUserFS(factory func(uid uint32) (Filesystem, error)) *PerUserFS {
+	return &PerUserFS{
+		factory: factory,
+		users:   make(map[uint32]Filesystem),
+		handles: make(map[FileHandle]userHandle),
+	}
+}
+
+// userShift is where the uid is stored in outer inode numbers.
+const userShift = 32
+
+// encodeIno maps an inner inode of uid to the inode the kernel sees.
+func encodeIno(uid uint32, ino Inode) (Inode, error) {
+	if ino == RootInode || ino == 0 {
+		return ino, nil
+	}
+	if ino>>userShift != 0 || uid == 1<<32-1 {
+		return 0, syscall.EOVERFLOW
+	}
+	return Inode(uint64(uid)+1)<<userShift | ino, nil
+}
+
+// decodeIno splits an outer inode into its uid and inner inode. The root
+// belongs to the caller. Other inodes below 1<<32 were never handed out,
+// and are reported as not ok.
+func decodeIno(ctx Context, ino Inode) (uint32, Inode, bool) {
+	if ino == RootInode {
+		return ctx.Uid(), RootInode, true
+	}
+	if ino>>userShift == 0 {
+		return 0, 0, false
+	}
+	return uint32(ino>>userShift) - 1, ino & (1<<userShift - 1), true
+}
+
+// user returns the filesystem of uid, creating it if needed. It is created
+// and initialized without holding the lock, so that a slow factory only
+// holds up its own uid; if two requests of a new uid race, the filesystem
+// installed first wins and the other is destroyed.
+func (p *PerUserFS) user(ctx Context, uid uint32) (Filesystem, error) {
+	p.mu.Lock()
+	fs, ok := p.users[uid]
+	var config *Config
+	if p.config != nil {
+		c := *p.config
+		config = &c
+	}
+	p.mu.Unlock()
+	if ok {
+		return fs, nil
+	}
+
+	fs, err := p.factory(uid)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		if err := fs.Init(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	winner, ok := p.users[uid]
+	if !ok {
+		p.users[uid] = fs
+	}
+	p.mu.Unlock()
+	if ok {
+		if config != nil {
+			fs.Destroy(ctx)
+		}
+		return winner, nil
+	}
+	return fs, nil
+}
+
+// existing returns the filesystem of uid if it was created.
+func (p *PerUserFS) existing(uid uint32) (Filesystem, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fs, ok := p.users[uid]
+	return fs, ok
+}
+
+// route returns the filesystem and inner inode for an outer inode. Only
+// the root creates the caller's filesystem: any other inode was handed
+// out by a filesystem that exists, and is stale otherwise.
+func (p *PerUserFS) route(ctx Context, ino Inode) (Filesystem, uint32, Inode, error) {
+	uid, inner, ok := decodeIno(ctx, ino)
+	if !ok {
+		return nil, 0, 0, syscall.ESTALE
+	}
+	if ino == RootInode {
+		fs, err := p.user(ctx, uid)
+		return fs, uid, inner, err
+	}
+	fs, ok := p.existing(uid)
+	if !ok {
+		return nil, 0, 0, syscall.ESTALE
+	}
+	return fs, uid, inner, nil
+}
+
+// addHandle registers an inner handle and returns the outer one.
+func (p *PerUserFS) addHandle(uid uint32, fh FileHandle) FileHandle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextFh++
+	p.handles[p.nextFh] = userHandle{uid: uid, fh: fh}
+	return p.nextFh
+}
+
+// handle resolves an outer handle.
+func (p *PerUserFS) handle(fh FileHandle) (userHandle, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.handles[fh]
+	return h, ok
+}
+
+// dropHandle forgets an outer handle and returns what it pointed to.
+func (p *PerUserFS) dropHandle(fh FileHandle) (userHandle, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.handles[fh]
+	delete(p.handles, fh)
+	return h, ok
+}
+
+// handleFS resolves an outer handle to the filesystem and handle behind it.
+func (p *PerUserFS) handleFS(ctx Context, fh FileHandle, drop bool) (Filesystem, FileHandle, error) {
+	var h userHandle
+	var ok bool
+	if drop {
+		h, ok = p.dropHandle(fh)
+	} else {
+		h, ok = p.handle(fh)
+	}
+	if !ok {
+		return nil, 0, syscall.EBADF
+	}
+	fs, err := p.user(ctx, h.uid)
+	return fs, h.fh, err
+}
+
+// exportEntry rewrites an inner entry for the kernel. Entries directly
+// under the shared root must not be cached, as the next caller may be
+// someone else.
+func exportEntry(uid uint32, parent Inode, e *Entry) error {
+	ino, err := encodeIno(uid, e.Ino)
+	if err != nil {
+		return err
+	}
+	e.Ino = ino
+	if e.Attr.Ino != 0 {
+		e.Attr.Ino = ino
+	}
+	if parent == RootInode {
+		e.EntryTimeout = 0
+		if ino == RootInode {
+			e.AttrTimeout = 0
+		}
+	}
+	return nil
+}
+
+// Init records the configuration for the per-user filesystems.
+func (p *PerUserFS) Init(ctx Context, config *Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := *config
+	p.config = &c
+	return nil
+}
+
+// Destroy destroys every per-user filesystem created so far.
+func (p *PerUserFS) Destroy(ctx Context) {
+	p.mu.Lock()
+	users := p.users
+	p.users = make(map[uint32]Filesystem)
+	p.mu.Unlock()
+
+	for _, fs := range users {
+		fs.Destroy(ctx)
+	}
+}
+
+// Lookup looks name up in the filesystem owning parent.
+func (p *PerUserFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	fs, uid, inner, err := p.route(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	e, err := fs.Lookup(ctx, inner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *e
+	if err := exportEntry(uid, parent, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetAttr returns the attributes of ino from the filesystem owning it.
+func (p *PerUserFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+
+	var innerFh *FileHandle
+	if fh != nil {
+		if h, ok := p.handle(*fh); ok {
+			innerFh = &h.fh
+		}
+	}
+
+	resp, err := fs.GetAttr(ctx, inner, innerFh)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *resp
+	out.Attr.Ino = ino
+	if ino == RootInode {
+		// The next stat may come from another user
+		out.Timeout = -1
+	}
+	return &out, nil
+}
+
+// ReadLink reads a symlink of the filesystem owning ino.
+func (p *PerUserFS) ReadLink(ctx Context, ino Inode) (string, error) {
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return "", err
+	}
+	return fs.ReadLink(ctx, inner)
+}
+
+// Open opens ino in the filesystem owning it.
+func (p *PerUserFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	fs, uid, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fs.Open(ctx, inner, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *resp
+	out.Handle = p.addHandle(uid, resp.Handle)
+	return &out, nil
+}
+
+// Read reads through the inner handle behind fh.
+func (p *PerUserFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	fs, innerFh, err := p.handleFS(ctx, fh, false)
+	if err != nil {
+		return nil, err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return fs.Read(ctx, inner, innerFh, offset, size)
+}
+
+// Lseek seeks through the inner handle behind fh.
+func (p *PerUserFS) Lseek(ctx Context, ino Inode, fh FileHandle, offset int64, whence uint32) (int64, error) {
+	fs, innerFh, err := p.handleFS(ctx, fh, false)
+	if err != nil {
+		return 0, err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return fs.Lseek(ctx, inner, innerFh, offset, whence)
+}
+
+// Poll polls through the inner handle behind fh.
+func (p *PerUserFS) Poll(ctx Context, ino Inode, fh FileHandle, events uint32, kh uint64) (uint32, error) {
+	fs, innerFh, err := p.handleFS(ctx, fh, false)
+	if err != nil {
+		return 0, err
+	}
+	pfs, ok := fs.(PollFilesystem)
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return pfs.Poll(ctx, inner, innerFh, events, kh)
+}
+
+// Ioctl issues an ioctl through the inner handle behind fh.
+func (p *PerUserFS) Ioctl(ctx Context, ino Inode, fh FileHandle, cmd uint32, arg uint64, in []byte, outSize uint32) ([]byte, error) {
+	fs, innerFh, err := p.handleFS(ctx, fh, false)
+	if err != nil {
+		return nil, err
+	}
+	ifs, ok := fs.(IoctlFilesystem)
+	if !ok {
+		return nil, syscall.ENOTTY
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return ifs.Ioctl(ctx, inner, innerFh, cmd, arg, in, outSize)
+}
+
+// Release releases the inner handle behind fh.
+func (p *PerUserFS) Release(ctx Context, ino Inode, fh FileHandle) error {
+	fs, innerFh, err := p.handleFS(ctx, fh, true)
+	if err != nil {
+		return err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return fs.Release(ctx, inner, innerFh)
+}
+
+// ReleaseWithFlags releases the inner handle behind fh, passing info on
+// to the filesystem owning it.
+func (p *PerUserFS) ReleaseWithFlags(ctx Context, ino Inode, fh FileHandle, info ReleaseInfo) error {
+	fs, innerFh, err := p.handleFS(ctx, fh, true)
+	if err != nil {
+		return err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return releaseFile(fs, ctx, inner, innerFh, info)
+}
+
+// OpenDir opens ino in the filesystem owning it. The root's listing
+// differs per user, so it is never cached.
+func (p *PerUserFS) OpenDir(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	fs, uid, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fs.OpenDir(ctx, inner, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *resp
+	out.Handle = p.addHandle(uid, resp.Handle)
+	if ino == RootInode {
+		out.Flags &^= OpenCacheDir | OpenKeepCache
+	}
+	return &out, nil
+}
+
+// ReadDir lists a directory through the inner handle behind fh.
+func (p *PerUserFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	h, ok := p.handle(fh)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	fs, err := p.user(ctx, h.uid)
+	if err != nil {
+		return nil, err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+
+	entries, err := fs.ReadDir(ctx, inner, h.fh, offset, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DirEntry, len(entries))
+	for i, e := range entries {
+		if e.Ino, err = encodeIno(h.uid, e.Ino); err != nil {
+			return nil, err
+		}
+		out[i] = e
+	}
+	return out, nil
+}
+
+// ReadDirPlus lists a directory with attributes through the inner handle
+// behind fh.
+func (p *PerUserFS) ReadDirPlus(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntryPlus, error) {
+	h, ok := p.handle(fh)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	fs, err := p.user(ctx, h.uid)
+	if err != nil {
+		return nil, err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+
+	entries, err := fs.ReadDirPlus(ctx, inner, h.fh, offset, size)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DirEntryPlus, len(entries))
+	for i, e := range entries {
+		if err := exportEntry(h.uid, ino, &e.Entry); err != nil {
+			return nil, err
+		}
+		out[i] = e
+	}
+	return out, nil
+}
+
+// ReleaseDir releases the inner directory handle behind fh.
+func (p *PerUserFS) ReleaseDir(ctx Context, ino Inode, fh FileHandle) error {
+	fs, innerFh, err := p.handleFS(ctx, fh, true)
+	if err != nil {
+		return err
+	}
+	_, inner, _ := decodeIno(ctx, ino)
+	return fs.ReleaseDir(ctx, inner, innerFh)
+}
+
+// StatFS returns the statistics of the filesystem owning ino.
+func (p *PerUserFS) StatFS(ctx Context, ino Inode) (*StatFS, error) {
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+	return fs.StatFS(ctx, inner)
+}
+
+// Access checks permissions in the filesystem owning ino.
+func (p *PerUserFS) Access(ctx Context, ino Inode, mask uint32) error {
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return err
+	}
+	return fs.Access(ctx, inner, mask)
+}
+
+// Forget forwards to the filesystem owning ino. The shared root is never
+// forgotten.
+func (p *PerUserFS) Forget(ctx Context, ino Inode, nlookup uint64) {
+	if ino == RootInode {
+		return
+	}
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return
+	}
+	fs.Forget(ctx, inner, nlookup)
+}
+
+// BatchForget splits entries by owner and forwards each batch.
+func (p *PerUserFS) BatchForget(ctx Context, entries []ForgetEntry) {
+	byUser := make(map[uint32][]ForgetEntry)
+	for _, e := range entries {
+		if e.Ino == RootInode {
+			continue
+		}
+		uid, inner, ok := decodeIno(ctx, e.Ino)
+		if !ok {
+			continue
+		}
+		byUser[uid] = append(byUser[uid], ForgetEntry{Ino: inner, Nlookup: e.Nlookup})
+	}
+
+	for uid, batch := range byUser {
+		fs, ok := p.existing(uid)
+		if !ok {
+			continue
+		}
+		fs.BatchForget(ctx, batch)
+	}
+}
+
+// Statx forwards to the filesystem owning ino, answering from its
+// GetAttr if it doesn't support statx.
+func (p *PerUserFS) Statx(ctx Context, ino Inode, fh *FileHandle, mask, flags uint32) (*Statx, error) {
+	fs, _, inner, err := p.route(ctx, ino)
+	if err != nil {
+		return nil, err
+	}
+	sfs, ok := fs.(StatxFilesystem)
+	if !ok {
+		resp, err := p.GetAttr(ctx, ino, fh)
+		if err != nil {
+			return nil, err
+		}
+		st := StatxFromAttr(resp.Attr)
+		return &st, nil
+	}
+
+	var innerFh *FileHandle
+	if fh != nil {
+		if h, ok := p.handle(*fh); ok {
+			innerFh = &h.fh
+		}
+	}
+
+	st, err := sfs.Statx(ctx, inner, innerFh, mask, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *st
+	out.Attr.Ino = ino
+	return &out, nil
+}
@@ -0,0 +1,204 @@
+package rofuse
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func userContext(uid uint32) Context {
+	return newContext(context.Background(), uid, uid, 1, 0, 0)
+}
+
+// A slow factory for one uid doesn't hold up the others.
+func TestPerUserFSSlowFactory(t *testing.T) {
+	release := make(chan struct{})
+	p := NewPerUserFS(func(uid uint32) (Filesystem, error) {
+		if uid == 1 {
+			<-release
+		}
+		fs := newTestFS()
+		fs.create(RootInode, "file", nil)
+		return fs, nil
+	})
+	if err := p.Init(userContext(0), &Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := p.Lookup(userContext(1), RootInode, "file"); err != nil {
+			t.Errorf("uid 1: %v", err)
+		}
+	}()
+
+	finished := make(chan error, 1)
+	go func() {
+		_, err := p.Lookup(userContext(2), RootInode, "file")
+		finished <- err
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Errorf("uid 2: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("uid 2 waited for the factory of uid 1")
+	}
+	close(release)
+	<-done
+}
+
+type destroyCountFS struct {
+	*testFS
+	destroyed *atomic.Int32
+}
+
+func (f destroyCountFS) Destroy(ctx Context) { f.destroyed.Add(1) }
+
+// Concurrent first requests of a uid all end up on one filesystem, and the
+// ones that lost the race are destroyed.
+func TestPerUserFSRace(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		created   int
+		destroyed atomic.Int32
+	)
+	start := make(chan struct{})
+	p := NewPerUserFS(func(uid uint32) (Filesystem, error) {
+		<-start
+		mu.Lock()
+		defer mu.Unlock()
+		created++
+		return destroyCountFS{newTestFS(), &destroyed}, nil
+	})
+	if err := p.Init(userContext(0), &Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	got := make([]Filesystem, n)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs, err := p.user(userContext(1), 1)
+			if err != nil {
+				t.Error(err)
+			}
+			got[i] = fs
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	for i, fs := range got {
+		if fs != got[0] {
+			t.Fatalf("request %d got another filesystem", i)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := int(destroyed.Load()); n != created-1 {
+		t.Errorf("created %d filesystems and destroyed %d, want all but one destroyed", created, n)
+	}
+}
+
+// Two users looking up the same path through one mount get inodes and
+// contents of their own, and nothing under the shared root is cached for
+// the next caller.
+func TestPerUserFSServe(t *testing.T) {
+	var mu sync.Mutex
+	var created []uint32
+	p := NewPerUserFS(func(uid uint32) (Filesystem, error) {
+		mu.Lock()
+		created = append(created, uid)
+		mu.Unlock()
+		fs := newTestFS()
+		fs.create(RootInode, "file", []byte(fmt.Sprintf("uid %d", uid)))
+		fs.create(RootInode, fmt.Sprintf("only%d", uid), nil)
+		return fs, nil
+	})
+	k := newTestServer(t, p, nil)
+	callAs := func(uid uint32, op uint32, nodeid uint64, body []byte) (int32, []byte) {
+		return k.recv(k.sendAs(uid, op, nodeid, body))
+	}
+	mustCallAs := func(uid uint32, op uint32, nodeid uint64, body []byte) []byte {
+		t.Helper()
+		errno, data := callAs(uid, op, nodeid, body)
+		if errno != 0 {
+			t.Fatalf("uid %d: %s on %d: %v", uid, proto.OpcodeName(op), nodeid, syscall.Errno(-errno))
+		}
+		return data
+	}
+
+	inodes := make(map[uint32]uint64)
+	for _, uid := range []uint32{1, 2} {
+		e := wireStruct[proto.EntryOut](t, mustCallAs(uid, proto.OpLookup, uint64(RootInode), []byte("file\x00")))
+		if e.EntryValid != 0 || e.EntryValidNsec != 0 {
+			t.Errorf("uid %d: entry under the root cached for %d.%09ds", uid, e.EntryValid, e.EntryValidNsec)
+		}
+		inodes[uid] = e.NodeID
+
+		fh := wireStruct[proto.OpenOut](t, mustCallAs(uid, proto.OpOpen, e.NodeID, wireBytes(&proto.OpenIn{}))).Fh
+		data := mustCallAs(uid, proto.OpRead, e.NodeID, wireBytes(&proto.ReadIn{Fh: fh, Size: 4096}))
+		if want := fmt.Sprintf("uid %d", uid); string(data) != want {
+			t.Errorf("uid %d read %q, want %q", uid, data, want)
+		}
+
+		attr := wireStruct[proto.AttrOut](t, mustCallAs(uid, proto.OpGetattr, uint64(RootInode), wireBytes(&proto.GetAttrIn{})))
+		if attr.AttrValid != 0 || attr.AttrValidNsec != 0 {
+			t.Errorf("uid %d: root attributes cached for %d.%09ds", uid, attr.AttrValid, attr.AttrValidNsec)
+		}
+
+		open := wireStruct[proto.OpenOut](t, mustCallAs(uid, proto.OpOpendir, uint64(RootInode), wireBytes(&proto.OpenIn{})))
+		if OpenFlags(open.OpenFlags)&(OpenCacheDir|OpenKeepCache) != 0 {
+			t.Errorf("uid %d: root listing cached, flags %#x", uid, open.OpenFlags)
+		}
+		in := wireBytes(&proto.ReadIn{Fh: open.Fh, Size: 4096})
+		var names []string
+		for _, d := range parseDirentsPlus(t, mustCallAs(uid, proto.OpReaddirplus, uint64(RootInode), in)) {
+			names = append(names, d.Name)
+			if d.Name != "." && d.Name != ".." && (d.Entry.EntryValid != 0 || d.Entry.EntryValidNsec != 0) {
+				t.Errorf("uid %d: listed entry %q cached", uid, d.Name)
+			}
+		}
+		other := fmt.Sprintf("only%d", 3-uid)
+		if !slices.Contains(names, fmt.Sprintf("only%d", uid)) || slices.Contains(names, other) {
+			t.Errorf("uid %d lists %q", uid, names)
+		}
+	}
+	if inodes[1] == inodes[2] {
+		t.Errorf("both users got inode %d", inodes[1])
+	}
+
+	// Another user's inode still reaches its owner's filesystem
+	if _, err := p.GetAttr(userContext(2), Inode(inodes[1]), nil); err != nil {
+		t.Errorf("GETATTR of uid 1's inode by uid 2: %v", err)
+	}
+
+	// Inodes that were never handed out are stale, and their FORGETs
+	// ignored, without creating a filesystem for a made-up uid
+	for _, ino := range []uint64{5, 1<<32 - 1, 8<<userShift | 2} {
+		if errno, _ := callAs(1, proto.OpGetattr, ino, wireBytes(&proto.GetAttrIn{})); syscall.Errno(-errno) != syscall.ESTALE {
+			t.Errorf("GETATTR of %#x: %v, want ESTALE", ino, syscall.Errno(-errno))
+		}
+		k.send(proto.OpForget, ino, wireBytes(&proto.ForgetIn{Nlookup: 1}))
+	}
+	p.BatchForget(userContext(1), []ForgetEntry{{Ino: 5, Nlookup: 1}, {Ino: 9<<userShift | 2, Nlookup: 1}})
+	mustCallAs(1, proto.OpGetattr, uint64(RootInode), wireBytes(&proto.GetAttrIn{}))
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(created, []uint32{1, 2}) {
+		t.Errorf("filesystems created for %v, want [1 2]", created)
+	}
+}
@@ -0,0 +1,34 @@
+package rofuse
+
+import (
+	"encoding/binary"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// PollFilesystem is implemented by filesystems whose files are not always
+// ready, such as FIFOs or event files, so that poll(2), select(2) and
+// epoll work on them. Others are reported as always readable.
+//
+// Poll returns the events among events (POLLIN, POLLOUT, ... from
+// golang.org/x/sys/unix) that are ready on the open file fh. kh is 0
+// unless the caller is about to wait: then, if nothing is ready yet, the
+// filesystem keeps kh and calls Notifier.PollWakeup(kh) once something is,
+// after which the kernel polls again. A kh is only worth one wakeup.
+type PollFilesystem interface {
+	Poll(ctx Context, ino Inode, fh FileHandle, events uint32, kh uint64) (revents uint32, err error)
+}
+
+// NotifyPollWakeup wakes up the waiters of a poll that returned nothing
+// ready, given the kh that PollFilesystem.Poll was called with. Waking a
+// poll nobody waits on anymore is not an error.
+func (s *Server) NotifyPollWakeup(kh uint64) error {
+	data := make([]byte, proto.NotifyPollWakeupOutSize)
+	binary.LittleEndian.PutUint64(data, kh)
+	return s.notify(proto.NotifyPoll, data)
+}
+
+// PollWakeup is Server.NotifyPollWakeup.
+func (n Notifier) PollWakeup(kh uint64) error {
+	return n.s.NotifyPollWakeup(kh)
+}
@@ -0,0 +1,90 @@
+package rofuse
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
+)
+
+// pollFS has files that are readable once ready is set, and reports the kh
+// of every poll.
+type pollFS struct {
+	*testFS
+	ready atomic.Bool
+	khs   chan uint64
+}
+
+func (f *pollFS) Poll(ctx Context, ino Inode, fh FileHandle, events uint32, kh uint64) (uint32, error) {
+	f.khs <- kh
+	if f.ready.Load() {
+		return events & unix.POLLIN, nil
+	}
+	return 0, nil
+}
+
+// poll sends a POLL for POLLIN on fh and returns the events ready.
+func (k *testKernel) poll(ino Inode, fh, kh uint64, flags uint32) uint32 {
+	k.t.Helper()
+	in := proto.PollIn{Fh: fh, Kh: kh, Flags: flags, Events: unix.POLLIN}
+	data := k.mustCall(proto.OpPoll, uint64(ino), wireBytes(&in))
+	if len(data) != proto.PollOutSize {
+		k.t.Fatalf("%d-byte POLL reply", len(data))
+	}
+	return binary.LittleEndian.Uint32(data)
+}
+
+func TestPoll(t *testing.T) {
+	fs := &pollFS{testFS: newTestFS(), khs: make(chan uint64, 1)}
+	ino := fs.create(RootInode, "events", nil)
+	k := newTestServer(t, fs, nil)
+	fh := k.open(ino)
+
+	// Nothing ready: the filesystem keeps kh and wakes the poll up later
+	if revents := k.poll(ino, fh, 9, proto.PollScheduleNotify); revents != 0 {
+		t.Errorf("revents %#x before ready, want 0", revents)
+	}
+	kh := <-fs.khs
+	if kh != 9 {
+		t.Fatalf("Poll got kh %d, want 9", kh)
+	}
+	fs.ready.Store(true)
+	if err := k.s.Notifier().PollWakeup(kh); err != nil {
+		t.Fatalf("PollWakeup: %v", err)
+	}
+	errno, data := k.recv(0)
+	if errno != proto.NotifyPoll || len(data) != proto.NotifyPollWakeupOutSize {
+		t.Fatalf("got code %d with %d bytes, want a poll wakeup", errno, len(data))
+	}
+	if got := wireStruct[proto.NotifyPollWakeupOut](t, data).Kh; got != 9 {
+		t.Errorf("wakeup of kh %d, want 9", got)
+	}
+
+	// Ready right away
+	if revents := k.poll(ino, fh, 11, proto.PollScheduleNotify); revents != unix.POLLIN {
+		t.Errorf("revents %#x once ready, want POLLIN", revents)
+	}
+	<-fs.khs
+
+	// Without PollScheduleNotify, the kernel does not wait and kh is
+	// not the filesystem's to keep
+	k.poll(ino, fh, 13, 0)
+	if kh := <-fs.khs; kh != 0 {
+		t.Errorf("Poll got kh %d without PollScheduleNotify, want 0", kh)
+	}
+}
+
+// Filesystems that cannot poll are answered ENOSYS, so that the kernel
+// treats their files as always ready.
+func TestPollUnsupported(t *testing.T) {
+	fs := newTestFS()
+	ino := fs.create(RootInode, "file", nil)
+	k := newTestServer(t, fs, nil)
+	in := proto.PollIn{Fh: k.open(ino), Events: unix.POLLIN}
+	if errno, _ := k.call(proto.OpPoll, uint64(ino), wireBytes(&in)); syscall.Errno(-errno) != syscall.ENOSYS {
+		t.Errorf("POLL: errno %v, want ENOSYS", syscall.Errno(-errno))
+	}
+}
@@ -0,0 +1,65 @@
+package proto
+
+import (
+	"math/bits"
+	"strconv"
+)
+
+// capNames maps each capability flag to its kernel name (FUSE_*).
+var capNames = map[uint64]string{
+	CapAsyncRead:         "ASYNC_READ",
+	CapPosixLocks:        "POSIX_LOCKS",
+	CapFileOps:           "FILE_OPS",
+	CapAtomicOTrunc:      "ATOMIC_O_TRUNC",
+	CapExportSupport:     "EXPORT_SUPPORT",
+	CapBigWrites:         "BIG_WRITES",
+	CapDontMask:          "DONT_MASK",
+	CapSpliceWrite:       "SPLICE_WRITE",
+	CapSpliceMove:        "SPLICE_MOVE",
+	CapSpliceRead:        "SPLICE_READ",
+	CapFlockLocks:        "FLOCK_LOCKS",
+	CapIoctlDir:          "HAS_IOCTL_DIR",
+	CapAutoInvalData:     "AUTO_INVAL_DATA",
+	CapReaddirplus:       "DO_READDIRPLUS",
+	CapReaddirplusAuto:   "READDIRPLUS_AUTO",
+	CapAsyncDIO:          "ASYNC_DIO",
+	CapWritebackCache:    "WRITEBACK_CACHE",
+	CapNoOpenSupport:     "NO_OPEN_SUPPORT",
+	CapParallelDirops:    "PARALLEL_DIROPS",
+	CapHandleKillpriv:    "HANDLE_KILLPRIV",
+	CapPosixACL:          "POSIX_ACL",
+	CapAbortError:        "ABORT_ERROR",
+	CapMaxPages:          "MAX_PAGES",
+	CapCacheSymlinks:     "CACHE_SYMLINKS",
+	CapNoOpendirSupport:  "NO_OPENDIR_SUPPORT",
+	CapExplicitInvalData: "EXPLICIT_INVAL_DATA",
+	CapMapAlignment:      "MAP_ALIGNMENT",
+	CapSubmounts:         "SUBMOUNTS",
+	CapHandleKillprivV2:  "HANDLE_KILLPRIV_V2",
+	CapSetxattrExt:       "SETXATTR_EXT",
+	CapInitExt:           "INIT_EXT",
+	CapInitReserved:      "INIT_RESERVED",
+	CapSecurityCtx:       "SECURITY_CTX",
+	CapHasInode:          "HAS_INODE_DAX",
+	CapCreateSuppGroup:   "CREATE_SUPP_GROUP",
+	CapExpireOnly:        "HAS_EXPIRE_ONLY",
+	CapPassthrough:       "PASSTHROUGH",
+	CapNoExportSupport:   "NO_EXPORT_SUPPORT",
+	CapSameFiNode:        "SAME_FI_NODE",
+}
+
+// CapabilityNames returns the names of the capability flags set in flags,
+// lowest bit first. Bits without a known name are given as hex values.
+func CapabilityNames(flags uint64) []string {
+	names := make([]string, 0, bits.OnesCount64(flags))
+	for flags != 0 {
+		bit := flags & -flags
+		flags &^= bit
+		if name, ok := capNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "0x"+strconv.FormatUint(bit, 16))
+		}
+	}
+	return names
+}
@@ -66,6 +66,13 @@ const (
 	ReadLockowner uint32 = 1 << 1 // Lock owner is valid
 )
 
+// Lseek whence values the kernel forwards (SEEK_SET, SEEK_CUR and
+// SEEK_END are handled by the kernel itself)
+const (
+	SeekData uint32 = 3 // SEEK_DATA: next data at or after the offset
+	SeekHole uint32 = 4 // SEEK_HOLE: next hole at or after the offset
+)
+
 // Release flags
 const (
 	ReleaseFlush     uint32 = 1 << 0 // FLUSH operation at release
@@ -111,3 +118,47 @@ const (
 	AccessWrite uint32 = 2 // W_OK
 	AccessRead  uint32 = 4 // R_OK
 )
+
+// Poll flags for PollIn.Flags
+const (
+	PollScheduleNotify uint32 = 1 << 0 // Send FUSE_NOTIFY_POLL for Kh when ready
+)
+
+// Ioctl flags (FUSE_IOCTL_* from linux/fuse.h)
+const (
+	IoctlCompat       uint32 = 1 << 0 // 32-bit compat ioctl on a 64-bit machine
+	IoctlUnrestricted uint32 = 1 << 1 // Buffers not encoded in cmd (CUSE only)
+	IoctlRetry        uint32 = 1 << 2 // Reply: retry with the given buffers
+	Ioctl32Bit        uint32 = 1 << 3 // 32-bit ioctl
+	IoctlDir          uint32 = 1 << 4 // Ioctl on a directory (CapIoctlDir)
+	IoctlCompatX32    uint32 = 1 << 5 // x32 compat ioctl on a 64-bit machine
+)
+
+// Attr flags (FUSE_ATTR_* from linux/fuse.h)
+const (
+	AttrSubmount uint32 = 1 << 0 // Directory is a submount (CapSubmounts)
+	AttrDax      uint32 = 1 << 1 // Use DAX for this file (CapHasInode)
+)
+
+// Statx attribute bits (STATX_ATTR_* from linux/stat.h)
+const (
+	SxAttrImmutable uint64 = 0x10 // File cannot be modified
+	SxAttrAppend    uint64 = 0x20 // File can only be appended to
+)
+
+// Statx mask bits (STATX_* from linux/stat.h)
+const (
+	SxType       uint32 = 1 << 0
+	SxMode       uint32 = 1 << 1
+	SxNlink      uint32 = 1 << 2
+	SxUid        uint32 = 1 << 3
+	SxGid        uint32 = 1 << 4
+	SxAtime      uint32 = 1 << 5
+	SxMtime      uint32 = 1 << 6
+	SxCtime      uint32 = 1 << 7
+	SxIno        uint32 = 1 << 8
+	SxSize       uint32 = 1 << 9
+	SxBlocks     uint32 = 1 << 10
+	SxBasicStats uint32 = 0x7ff // Everything stat(2) reports
+	SxBtime      uint32 = 1 << 11
+)
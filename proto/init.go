@@ -51,6 +51,9 @@ const (
 	DefaultCongestionThreshold = 9
 	DefaultTimeGran            = 1  // Nanosecond precision
 	DefaultMaxPages            = 32 // 32 * 4096 = 128 KB
+	DefaultMaxRead             = DefaultMaxPages * PageSize
+	MaxPagesLimit              = 256 // Kernel's default cap on max_pages (fuse.max_pages_limit)
+	PageSize                   = 4096
 )
 
 // MinBufferSize is the minimum buffer size for reading FUSE requests.
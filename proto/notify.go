@@ -0,0 +1,57 @@
+package proto
+
+// Notification codes, sent in OutHeader.Error with Unique set to 0.
+const (
+	NotifyPoll       int32 = 1
+	NotifyInvalInode int32 = 2
+	NotifyInvalEntry int32 = 3
+	NotifyStore      int32 = 4
+	NotifyRetrieve   int32 = 5
+	NotifyDelete     int32 = 6
+)
+
+// NotifyPollWakeupOut is the body of FUSE_NOTIFY_POLL.
+// Size: 8 bytes
+type NotifyPollWakeupOut struct {
+	Kh uint64 // PollIn.Kh of the poll to wake up
+}
+
+// NotifyPollWakeupOutSize is the size of NotifyPollWakeupOut in bytes.
+const NotifyPollWakeupOutSize = 8
+
+// NotifyInvalInodeOut is the body of FUSE_NOTIFY_INVAL_INODE.
+// Size: 24 bytes
+type NotifyInvalInodeOut struct {
+	Ino uint64
+	Off int64 // Start of the data to drop; negative for attributes only
+	Len int64 // Length of the data to drop; 0 or less for up to EOF
+
+	// Attributes are dropped in every case; data is dropped by whole
+	// pages, from page Off/PAGE_SIZE to page (Off+Len-1)/PAGE_SIZE.
+}
+
+// NotifyInvalInodeOutSize is the size of NotifyInvalInodeOut in bytes.
+const NotifyInvalInodeOutSize = 24
+
+// NotifyInvalEntryOut is the body of FUSE_NOTIFY_INVAL_ENTRY.
+// Size: 16 bytes (followed by the NUL-terminated name)
+type NotifyInvalEntryOut struct {
+	Parent  uint64
+	Namelen uint32
+	Flags   uint32
+}
+
+// NotifyInvalEntryOutSize is the size of NotifyInvalEntryOut in bytes.
+const NotifyInvalEntryOutSize = 16
+
+// NotifyDeleteOut is the body of FUSE_NOTIFY_DELETE.
+// Size: 24 bytes (followed by the NUL-terminated name)
+type NotifyDeleteOut struct {
+	Parent  uint64
+	Child   uint64
+	Namelen uint32
+	Padding uint32
+}
+
+// NotifyDeleteOutSize is the size of NotifyDeleteOut in bytes.
+const NotifyDeleteOutSize = 24
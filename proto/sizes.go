@@ -0,0 +1,83 @@
+package proto
+
+import "unsafe"
+
+// Each wire struct must have exactly its declared size: the reply helpers
+// allocate the constant and pack the fields by offset, and the kernel
+// rejects a reply of the wrong length. A mismatch, easy to introduce when
+// a field is added, makes one of these array lengths negative and fails
+// the build.
+var (
+	_ [InHeaderSize - unsafe.Sizeof(InHeader{})]struct{}
+	_ [unsafe.Sizeof(InHeader{}) - InHeaderSize]struct{}
+	_ [OutHeaderSize - unsafe.Sizeof(OutHeader{})]struct{}
+	_ [unsafe.Sizeof(OutHeader{}) - OutHeaderSize]struct{}
+	_ [InitInSize - unsafe.Sizeof(InitIn{})]struct{}
+	_ [unsafe.Sizeof(InitIn{}) - InitInSize]struct{}
+	_ [InitOutSize - unsafe.Sizeof(InitOut{})]struct{}
+	_ [unsafe.Sizeof(InitOut{}) - InitOutSize]struct{}
+	_ [NotifyInvalInodeOutSize - unsafe.Sizeof(NotifyInvalInodeOut{})]struct{}
+	_ [unsafe.Sizeof(NotifyInvalInodeOut{}) - NotifyInvalInodeOutSize]struct{}
+	_ [NotifyInvalEntryOutSize - unsafe.Sizeof(NotifyInvalEntryOut{})]struct{}
+	_ [unsafe.Sizeof(NotifyInvalEntryOut{}) - NotifyInvalEntryOutSize]struct{}
+	_ [NotifyDeleteOutSize - unsafe.Sizeof(NotifyDeleteOut{})]struct{}
+	_ [unsafe.Sizeof(NotifyDeleteOut{}) - NotifyDeleteOutSize]struct{}
+	_ [AttrSize - unsafe.Sizeof(Attr{})]struct{}
+	_ [unsafe.Sizeof(Attr{}) - AttrSize]struct{}
+	_ [EntryOutSize - unsafe.Sizeof(EntryOut{})]struct{}
+	_ [unsafe.Sizeof(EntryOut{}) - EntryOutSize]struct{}
+	_ [AttrOutSize - unsafe.Sizeof(AttrOut{})]struct{}
+	_ [unsafe.Sizeof(AttrOut{}) - AttrOutSize]struct{}
+	_ [GetAttrInSize - unsafe.Sizeof(GetAttrIn{})]struct{}
+	_ [unsafe.Sizeof(GetAttrIn{}) - GetAttrInSize]struct{}
+	_ [OpenInSize - unsafe.Sizeof(OpenIn{})]struct{}
+	_ [unsafe.Sizeof(OpenIn{}) - OpenInSize]struct{}
+	_ [OpenOutSize - unsafe.Sizeof(OpenOut{})]struct{}
+	_ [unsafe.Sizeof(OpenOut{}) - OpenOutSize]struct{}
+	_ [ReadInSize - unsafe.Sizeof(ReadIn{})]struct{}
+	_ [unsafe.Sizeof(ReadIn{}) - ReadInSize]struct{}
+	_ [WriteInSize - unsafe.Sizeof(WriteIn{})]struct{}
+	_ [unsafe.Sizeof(WriteIn{}) - WriteInSize]struct{}
+	_ [LseekInSize - unsafe.Sizeof(LseekIn{})]struct{}
+	_ [unsafe.Sizeof(LseekIn{}) - LseekInSize]struct{}
+	_ [LseekOutSize - unsafe.Sizeof(LseekOut{})]struct{}
+	_ [unsafe.Sizeof(LseekOut{}) - LseekOutSize]struct{}
+	_ [PollInSize - unsafe.Sizeof(PollIn{})]struct{}
+	_ [unsafe.Sizeof(PollIn{}) - PollInSize]struct{}
+	_ [PollOutSize - unsafe.Sizeof(PollOut{})]struct{}
+	_ [unsafe.Sizeof(PollOut{}) - PollOutSize]struct{}
+	_ [IoctlInSize - unsafe.Sizeof(IoctlIn{})]struct{}
+	_ [unsafe.Sizeof(IoctlIn{}) - IoctlInSize]struct{}
+	_ [IoctlOutSize - unsafe.Sizeof(IoctlOut{})]struct{}
+	_ [unsafe.Sizeof(IoctlOut{}) - IoctlOutSize]struct{}
+	_ [ReleaseInSize - unsafe.Sizeof(ReleaseIn{})]struct{}
+	_ [unsafe.Sizeof(ReleaseIn{}) - ReleaseInSize]struct{}
+	_ [ForgetInSize - unsafe.Sizeof(ForgetIn{})]struct{}
+	_ [unsafe.Sizeof(ForgetIn{}) - ForgetInSize]struct{}
+	_ [BatchForgetInSize - unsafe.Sizeof(BatchForgetIn{})]struct{}
+	_ [unsafe.Sizeof(BatchForgetIn{}) - BatchForgetInSize]struct{}
+	_ [ForgetOneSize - unsafe.Sizeof(ForgetOne{})]struct{}
+	_ [unsafe.Sizeof(ForgetOne{}) - ForgetOneSize]struct{}
+	_ [AccessInSize - unsafe.Sizeof(AccessIn{})]struct{}
+	_ [unsafe.Sizeof(AccessIn{}) - AccessInSize]struct{}
+	_ [DirentSize - unsafe.Sizeof(Dirent{})]struct{}
+	_ [unsafe.Sizeof(Dirent{}) - DirentSize]struct{}
+	_ [DirentPlusSize - unsafe.Sizeof(DirentPlus{})]struct{}
+	_ [unsafe.Sizeof(DirentPlus{}) - DirentPlusSize]struct{}
+	_ [StatfsOutSize - unsafe.Sizeof(StatfsOut{})]struct{}
+	_ [unsafe.Sizeof(StatfsOut{}) - StatfsOutSize]struct{}
+	_ [KstatfsSize - unsafe.Sizeof(Kstatfs{})]struct{}
+	_ [unsafe.Sizeof(Kstatfs{}) - KstatfsSize]struct{}
+	_ [FlushInSize - unsafe.Sizeof(FlushIn{})]struct{}
+	_ [unsafe.Sizeof(FlushIn{}) - FlushInSize]struct{}
+	_ [InterruptInSize - unsafe.Sizeof(InterruptIn{})]struct{}
+	_ [unsafe.Sizeof(InterruptIn{}) - InterruptInSize]struct{}
+	_ [BackingMapSize - unsafe.Sizeof(BackingMap{})]struct{}
+	_ [unsafe.Sizeof(BackingMap{}) - BackingMapSize]struct{}
+	_ [StatxInSize - unsafe.Sizeof(StatxIn{})]struct{}
+	_ [unsafe.Sizeof(StatxIn{}) - StatxInSize]struct{}
+	_ [StatxSize - unsafe.Sizeof(Statx{})]struct{}
+	_ [unsafe.Sizeof(Statx{}) - StatxSize]struct{}
+	_ [StatxOutSize - unsafe.Sizeof(StatxOut{})]struct{}
+	_ [unsafe.Sizeof(StatxOut{}) - StatxOutSize]struct{}
+)
@@ -106,7 +106,7 @@ const OpenInSize = 8
 type OpenOut struct {
 	Fh        uint64 // File handle
 	OpenFlags uint32 // FOPEN_* flags
-	Padding   uint32
+	BackingID int32  // Passthrough backing id (v7.40+, with FOPEN_PASSTHROUGH)
 }
 
 // OpenOutSize is the size of OpenOut in bytes.
@@ -127,6 +127,22 @@ type ReadIn struct {
 // ReadInSize is the size of ReadIn in bytes.
 const ReadInSize = 40
 
+// WriteIn is the request body for FUSE_WRITE.
+// Writes are rejected, but the kernel still sizes read buffers for them.
+// Size: 40 bytes
+type WriteIn struct {
+	Fh         uint64
+	Offset     uint64
+	Size       uint32
+	WriteFlags uint32
+	LockOwner  uint64
+	Flags      uint32
+	Padding    uint32
+}
+
+// WriteInSize is the size of WriteIn in bytes.
+const WriteInSize = 40
+
 // ReleaseIn is the request body for FUSE_RELEASE and FUSE_RELEASEDIR.
 // Size: 24 bytes
 type ReleaseIn struct {
@@ -139,6 +155,75 @@ type ReleaseIn struct {
 // ReleaseInSize is the size of ReleaseIn in bytes.
 const ReleaseInSize = 24
 
+// LseekIn is the request body for FUSE_LSEEK.
+// Size: 24 bytes
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+// LseekInSize is the size of LseekIn in bytes.
+const LseekInSize = 24
+
+// LseekOut is the response for FUSE_LSEEK.
+// Size: 8 bytes
+type LseekOut struct {
+	Offset uint64
+}
+
+// LseekOutSize is the size of LseekOut in bytes.
+const LseekOutSize = 8
+
+// PollIn is the request body for FUSE_POLL.
+// Size: 24 bytes
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64 // Handle for FUSE_NOTIFY_POLL, if PollScheduleNotify is set
+	Flags  uint32 // PollScheduleNotify
+	Events uint32 // Requested poll events (POLLIN, ...)
+}
+
+// PollInSize is the size of PollIn in bytes.
+const PollInSize = 24
+
+// PollOut is the response for FUSE_POLL.
+// Size: 8 bytes
+type PollOut struct {
+	Revents uint32
+	Padding uint32
+}
+
+// PollOutSize is the size of PollOut in bytes.
+const PollOutSize = 8
+
+// IoctlIn is the request body for FUSE_IOCTL.
+// Size: 32 bytes (followed by InSize bytes of input data)
+type IoctlIn struct {
+	Fh      uint64
+	Flags   uint32 // FUSE_IOCTL_* flags (IoctlUnrestricted, ...)
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32 // Largest output the caller takes
+}
+
+// IoctlInSize is the size of IoctlIn in bytes.
+const IoctlInSize = 32
+
+// IoctlOut is the response for FUSE_IOCTL.
+// Size: 16 bytes (followed by the output data)
+type IoctlOut struct {
+	Result  int32  // Return value of ioctl(2)
+	Flags   uint32 // IoctlRetry to ask for other buffers
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// IoctlOutSize is the size of IoctlOut in bytes.
+const IoctlOutSize = 16
+
 // ForgetIn is the request body for FUSE_FORGET.
 // Size: 8 bytes
 type ForgetIn struct {
@@ -202,16 +287,16 @@ type DirentPlus struct {
 const DirentPlusSize = EntryOutSize + DirentSize
 
 // StatfsOut is the response for FUSE_STATFS.
-// Size: 64 bytes
+// Size: 80 bytes
 type StatfsOut struct {
 	St Kstatfs
 }
 
 // StatfsOutSize is the size of StatfsOut in bytes.
-const StatfsOutSize = 64
+const StatfsOutSize = 80
 
 // Kstatfs is the filesystem statistics structure.
-// Size: 64 bytes
+// Size: 80 bytes
 type Kstatfs struct {
 	Blocks  uint64
 	Bfree   uint64
@@ -226,7 +311,7 @@ type Kstatfs struct {
 }
 
 // KstatfsSize is the size of Kstatfs in bytes.
-const KstatfsSize = 64
+const KstatfsSize = 80
 
 // FlushIn is the request body for FUSE_FLUSH.
 // Size: 24 bytes
@@ -248,3 +333,83 @@ type InterruptIn struct {
 
 // InterruptInSize is the size of InterruptIn in bytes.
 const InterruptInSize = 8
+
+// BackingMap is the argument of FUSE_DEV_IOC_BACKING_OPEN.
+// Size: 16 bytes
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	Padding uint64
+}
+
+// BackingMapSize is the size of BackingMap in bytes.
+const BackingMapSize = 16
+
+// /dev/fuse ioctls for passthrough backing files (v7.40+).
+const (
+	DevIocBackingOpen  = 0x4010e501 // _IOW(229, 1, struct fuse_backing_map)
+	DevIocBackingClose = 0x4004e502 // _IOW(229, 2, uint32_t)
+)
+
+// StatxIn is the request body for FUSE_STATX (v7.39+).
+// Size: 24 bytes
+type StatxIn struct {
+	GetattrFlags uint32 // FUSE_GETATTR_* flags
+	Reserved     uint32
+	Fh           uint64 // File handle, valid with GetattrFh
+	SxFlags      uint32 // AT_STATX_* sync flags
+	SxMask       uint32 // STATX_* fields requested
+}
+
+// StatxInSize is the size of StatxIn in bytes.
+const StatxInSize = 24
+
+// SxTime is a timestamp in Statx.
+// Size: 16 bytes
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx is the attribute structure for FUSE_STATX.
+// Size: 256 bytes
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+// StatxSize is the size of Statx in bytes.
+const StatxSize = 256
+
+// StatxOut is the response for FUSE_STATX.
+// Size: 288 bytes
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Stat          Statx
+}
+
+// StatxOutSize is the size of StatxOut in bytes.
+const StatxOutSize = 288
@@ -0,0 +1,62 @@
+package rofuse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ReaderAtFile serves a read-only file from an io.ReaderAt of known size,
+// such as an *os.File, a byte slice's bytes.Reader or a section of a
+// larger object: the most common way of backing a file. Attr reports Size,
+// Mode and Mtime, and Read calls ReadAt, never past Size.
+//
+// A filesystem serving one routes to it the way it would a StatsFile:
+// Lookup of its name returns Entry(), and GetAttr, Open and Read on Ino
+// are answered by Attr, Open and Read. R must be safe for concurrent
+// ReadAt calls, as io.ReaderAt implementations are.
+type ReaderAtFile struct {
+	Ino   Inode
+	R     io.ReaderAt
+	Size  int64
+	Mode  os.FileMode // Permission bits; 0444 if zero
+	Mtime time.Time
+}
+
+// Attr returns the attributes of the file.
+func (f *ReaderAtFile) Attr() Attr {
+	return synthAttr(f.Ino, f.Size, f.Mode, f.Mtime)
+}
+
+// Entry returns the lookup result for the file, cached for an hour.
+func (f *ReaderAtFile) Entry() *Entry {
+	return synthEntry(f.Attr(), time.Hour)
+}
+
+// Open returns the open response for the file, keeping the page cache
+// across opens. Reads need no per-handle state, so the handle is 0.
+func (f *ReaderAtFile) Open() *OpenResponse {
+	return &OpenResponse{Flags: OpenKeepCache}
+}
+
+// Read returns up to size bytes from offset. Reads at or past Size return
+// no data, which the kernel takes as EOF, and reads crossing it are cut
+// short there.
+//
+// When ctx is the context of a server request, the data is read into a
+// pooled buffer that goes back to the pool once the request is answered,
+// so the returned slice must not be kept past the Filesystem's Read.
+func (f *ReaderAtFile) Read(ctx Context, offset int64, size uint32) ([]byte, error) {
+	n := synthRange(offset, size, f.Size)
+	if n == 0 {
+		return nil, nil
+	}
+	buf := readBuffer(ctx, n)
+	n, err := f.R.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// A short read with io.EOF means the reader is smaller than Size
+	return buf[:n], nil
+}
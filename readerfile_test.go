@@ -0,0 +1,71 @@
+package rofuse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReaderAtFile(t *testing.T) {
+	content := bytes.Repeat([]byte("rofuse"), 2000)
+	f := &ReaderAtFile{Ino: 2, R: bytes.NewReader(content), Size: int64(len(content))}
+	k := newTestServer(t, synthFS{f: f}, nil)
+
+	if got := k.lookup(RootInode, "file").Attr.Size; got != uint64(len(content)) {
+		t.Fatalf("size %d, want %d", got, len(content))
+	}
+	fh := k.open(2)
+	size := uint64(len(content))
+	for _, tt := range []struct {
+		name      string
+		off, want uint64 // want: end of the expected data
+	}{
+		{"start", 0, 4096},
+		{"middle", 5000, 9096},
+		{"across EOF", size - 10, size},
+		{"at EOF", size, size},
+		{"past EOF", size + 100, size + 100},
+	} {
+		got := k.readFile(2, fh, tt.off, 4096)
+		var exp []byte
+		if tt.off < size {
+			exp = content[tt.off:tt.want]
+		}
+		if !bytes.Equal(got, exp) {
+			t.Errorf("%s: read %d bytes not matching the %d expected", tt.name, len(got), len(exp))
+		}
+	}
+}
+
+// A reader smaller than Size ends the file early rather than failing.
+func TestReaderAtFileShort(t *testing.T) {
+	f := &ReaderAtFile{Ino: 2, R: bytes.NewReader([]byte("short")), Size: 100}
+	got, err := f.Read(nil, 0, 4096)
+	if err != nil || string(got) != "short" {
+		t.Errorf("got %q, %v; want %q", got, err, "short")
+	}
+}
+
+// Reads under a request come from the pool and go back to it on release.
+func TestReadBufferPooled(t *testing.T) {
+	req := &request{}
+	ctx := &fuseContext{req: req}
+	buf := readBuffer(ctx, 5000)
+	if len(buf) != 5000 || cap(buf) != 8192 {
+		t.Fatalf("len %d cap %d, want 5000 and 8192", len(buf), cap(buf))
+	}
+	if len(req.buffers) != 1 {
+		t.Fatalf("%d buffers recorded, want 1", len(req.buffers))
+	}
+	req.release()
+	if len(req.buffers) != 0 {
+		t.Errorf("%d buffers left after release", len(req.buffers))
+	}
+
+	// Too large for the pool, or outside a request: allocated
+	if buf := readBuffer(ctx, 2<<20); len(buf) != 2<<20 || len(req.buffers) != 0 {
+		t.Errorf("2MiB buffer: len %d, %d pooled", len(buf), len(req.buffers))
+	}
+	if buf := readBuffer(nil, 100); len(buf) != 100 {
+		t.Errorf("len %d, want 100", len(buf))
+	}
+}
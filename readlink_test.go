@@ -0,0 +1,45 @@
+package rofuse
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func TestReadlink(t *testing.T) {
+	fs := newTestFS()
+	good := fs.symlink(RootInode, "good", "target")
+	empty := fs.symlink(RootInode, "empty", "")
+	nul := fs.symlink(RootInode, "nul", "a\x00b")
+	k := newTestServer(t, fs, nil)
+
+	if got := string(k.mustCall(proto.OpReadlink, uint64(good), nil)); got != "target" {
+		t.Errorf("good: got %q, want %q", got, "target")
+	}
+	for name, ino := range map[string]Inode{"empty": empty, "nul": nul} {
+		if errno, _ := k.call(proto.OpReadlink, uint64(ino), nil); errno != -int32(syscall.EINVAL) {
+			t.Errorf("%s: got errno %d, want EINVAL", name, -errno)
+		}
+	}
+}
+
+// noReadlinkFS has the default ReadLink of FilesystemBase.
+type noReadlinkFS struct {
+	*testFS
+}
+
+func (noReadlinkFS) ReadLink(ctx Context, ino Inode) (string, error) {
+	return FilesystemBase{}.ReadLink(ctx, ino)
+}
+
+// A filesystem reporting a symlink without implementing ReadLink fails the
+// read with EIO rather than ENOSYS, which the kernel would remember.
+func TestReadlinkNotImplemented(t *testing.T) {
+	fs := newTestFS()
+	link := fs.symlink(RootInode, "link", "target")
+	k := newTestServer(t, noReadlinkFS{fs}, nil)
+	if errno, _ := k.call(proto.OpReadlink, uint64(link), nil); errno != -int32(syscall.EIO) {
+		t.Errorf("got errno %d, want EIO", -errno)
+	}
+}
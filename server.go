@@ -1,11 +1,24 @@
 package rofuse
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/KarpelesLab/rofuse/proto"
+	"github.com/KarpelesLab/rofuse/sharing"
+	"golang.org/x/sys/unix"
 )
 
 // Server manages the FUSE connection and dispatches requests.
@@ -13,23 +26,76 @@ type Server struct {
 	fs         Filesystem
 	mountPoint string
 	conn       *connection
+	clones     []*connection // Extra descriptors of ServeParallel
 	config     *Config
 
+	// Eventfd ending the reads of a server from NewServerFromFd, which
+	// has no mount of its own to take away; -1 otherwise
+	wake int
+
+	// Socket whose closing has fusermount unmount (MountOptions.AutoUnmount),
+	// -1 if none
+	autoUnmount int
+
+	// Only this user and root may make requests (MountOptions.AllowRoot)
+	owner uint32
+
 	// Buffer pool
 	bufPool *bufferPool
 
+	// Passthrough backing files
+	backing *backingTable
+
+	// What the kernel knows about each inode
+	nodes *nodeCache
+
+	// Open directories the server keeps state for
+	dirs openDirs
+
+	// Current snapshot token
+	snapshot atomic.Uint64
+
 	// Configuration
 	opts *MountOptions
 
+	// Opcodes handled on the serial goroutine (MountOptions.SerialOpcodes)
+	serial   map[uint32]bool
+	serialCh chan *request
+
+	// Per-uid concurrency limit (MountOptions.PerUidConcurrency)
+	uids *uidLimiter
+
+	// Global concurrency limit (MountOptions.MaxConcurrentRequests)
+	limiter *requestLimiter
+
+	// Queued notifications (MountOptions.NotifyQueueSize)
+	notifyCh chan []byte
+
+	// GETATTR coalescing (MountOptions.AttrBatchWindow)
+	attrs *attrBatcher
+
+	// Dispatched requests that FUSE_INTERRUPT can cancel, by unique id
+	inflight sync.Map // uint64 -> *request
+
 	// Lifecycle management
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
+	// Background serving
+	ready     chan struct{} // Closed once INIT has been answered
+	readyOnce sync.Once
+	done      chan struct{} // Closed when ServeBackground's loop returns
+	serveErr  error
+
 	// State
-	initialized bool
-	destroyed   bool
-	mu          sync.RWMutex
+	initialized   bool
+	destroyed     bool
+	closing       bool
+	serving       bool   // A serve loop was started
+	flags         uint64 // Capabilities negotiated at INIT
+	destroyAction DestroyAction
+	mu            sync.RWMutex
 }
 
 // Mount mounts a filesystem at the given path and returns a Server.
@@ -37,46 +103,264 @@ func Mount(mountPoint string, fs Filesystem, opts *MountOptions) (*Server, error
 	if opts == nil {
 		opts = &MountOptions{}
 	}
+	setDefaults(opts)
 
-	// Set defaults
+	// Mount the filesystem
+	fd, autoUnmount, err := mount(mountPoint, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newServer(mountPoint, newConnection(fd), fs, opts)
+	s.autoUnmount = autoUnmount
+	return s, nil
+}
+
+// NewServerFromFd returns a Server for a FUSE descriptor that is already
+// mounted and initialized, such as one received from a
+// sharing.Coordinator, so that a worker process can Serve it. Nothing is
+// mounted and the filesystem's Init is not called, since the process that
+// mounted handled INIT; Config returns nil, and NegotiatedFlags reports
+// what opts request rather than what the kernel granted. opts should
+// match the mounting process's.
+//
+// The descriptor is made non-blocking. Unmount stops serving and closes
+// it, leaving the mount itself to its owner.
+func NewServerFromFd(fd int, fs Filesystem, opts *MountOptions) (*Server, error) {
+	if opts == nil {
+		opts = &MountOptions{}
+	}
+	setDefaults(opts)
+
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("eventfd: %w", err)
+	}
+	conn, err := newStoppableConnection(fd, wake)
+	if err != nil {
+		unix.Close(wake)
+		return nil, err
+	}
+
+	s := newServer("", conn, fs, opts)
+	s.wake = wake
+	s.initialized = true
+	s.flags = initFlags(opts)
+	s.readyOnce.Do(func() { close(s.ready) })
+	return s, nil
+}
+
+// maxIO is the most the kernel reads or writes in one request:
+// FUSE_MAX_MAX_PAGES pages.
+const maxIO = proto.MaxPagesLimit * proto.PageSize
+
+// setDefaults fills in the options left zero.
+func setDefaults(opts *MountOptions) {
+	if opts.Logger == nil && opts.Debug {
+		opts.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
 	if opts.MaxReadahead == 0 {
 		opts.MaxReadahead = proto.DefaultMaxReadahead
 	}
 	if opts.MaxWrite == 0 {
 		opts.MaxWrite = proto.DefaultMaxWrite
 	}
+	if opts.MaxRead == 0 {
+		opts.MaxRead = proto.DefaultMaxRead
+	}
+
+	// Larger sizes would only oversize the buffers
+	if opts.MaxWrite > maxIO {
+		opts.warnf("MaxWrite %d exceeds the kernel's limit, using %d", opts.MaxWrite, maxIO)
+		opts.MaxWrite = maxIO
+	}
+	if opts.MaxRead > maxIO {
+		opts.warnf("MaxRead %d exceeds the kernel's limit, using %d", opts.MaxRead, maxIO)
+		opts.MaxRead = maxIO
+	}
+	if extra := opts.Capabilities &^ optionalCaps; extra != 0 {
+		opts.warnf("Capabilities %s not supported, ignoring them", strings.Join(proto.CapabilityNames(extra), " "))
+		opts.Capabilities &= optionalCaps
+	}
 	if opts.MaxBackground == 0 {
 		opts.MaxBackground = proto.DefaultMaxBackground
 	}
-
-	// Mount the filesystem
-	fd, err := mount(mountPoint, opts)
-	if err != nil {
-		return nil, err
+	if opts.MaxConcurrentRequests == 0 {
+		opts.MaxConcurrentRequests = 16 * int(opts.MaxBackground)
+	}
+	if opts.DefaultBlksize == 0 {
+		opts.DefaultBlksize = opts.MaxWrite
+	}
+	if opts.DefaultAttrTimeout == 0 {
+		opts.DefaultAttrTimeout = time.Second
+	}
+	if opts.UnmountTimeout == 0 {
+		opts.UnmountTimeout = DefaultUnmountTimeout
 	}
+}
 
+// newServer returns a Server for conn with its defaults already set.
+func newServer(mountPoint string, conn *connection, fs Filesystem, opts *MountOptions) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Server{
-		fs:         fs,
-		mountPoint: mountPoint,
-		conn:       newConnection(fd),
-		bufPool:    newBufferPool(int(opts.MaxWrite) + proto.InHeaderSize + 4096),
-		opts:       opts,
-		ctx:        ctx,
-		cancel:     cancel,
+		fs:          fs,
+		mountPoint:  mountPoint,
+		conn:        conn,
+		wake:        -1,
+		autoUnmount: -1,
+		owner:       uint32(os.Getuid()),
+		bufPool:     newBufferPool(int(opts.MaxWrite) + proto.InHeaderSize + 4096),
+		backing:     newBackingTable(),
+		nodes:       newNodeCache(),
+		opts:        opts,
+		ctx:         ctx,
+		cancel:      cancel,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 
-	return s, nil
+	if len(opts.SerialOpcodes) > 0 {
+		s.serial = make(map[uint32]bool, len(opts.SerialOpcodes))
+		for _, op := range opts.SerialOpcodes {
+			s.serial[op] = true
+		}
+	}
+
+	if opts.PerUidConcurrency > 0 {
+		s.uids = newUidLimiter(opts.PerUidConcurrency)
+	}
+
+	if opts.MaxConcurrentRequests > 0 {
+		s.limiter = newRequestLimiter(opts.MaxConcurrentRequests)
+	}
+
+	if bfs, ok := fs.(BatchAttrFilesystem); ok && opts.AttrBatchWindow > 0 {
+		s.attrs = newAttrBatcher(s, bfs, opts.AttrBatchWindow)
+	}
+
+	if opts.NotifyQueueSize > 0 {
+		s.notifyCh = make(chan []byte, opts.NotifyQueueSize)
+		go s.runNotify()
+	}
+
+	return s
 }
 
-// MountPoint returns the mount point path.
+// MountPoint returns the mount point path, or "" for a server from
+// NewServerFromFd.
 func (s *Server) MountPoint() string {
 	return s.mountPoint
 }
 
-// Serve runs the server loop. Blocks until unmounted or error.
+// Serve runs the server loop. Blocks until unmounted or error. A server
+// is served once: Serve, ServeParallel and ServeBackground return
+// ErrAlreadyServing if one of them was already called.
+//
+// On unmount the kernel may send FUSE_DESTROY (not every mount type gets
+// one) and then fails further reads with ENODEV, at which point Serve
+// returns nil. DESTROY is handled inline rather than in its own goroutine,
+// so MountOptions.OnDestroy is consulted before the next read and can make
+// Serve return right away instead of waiting for ENODEV.
 func (s *Server) Serve() error {
+	if err := s.startServing(); err != nil {
+		return err
+	}
+	return s.serve()
+}
+
+// serve is Serve once startServing succeeded.
+func (s *Server) serve() error {
+	if s.serial != nil {
+		s.serialCh = make(chan *request, serialQueueLen)
+		go s.runSerial(s.serialCh)
+		defer close(s.serialCh)
+	}
+
+	return s.serveConn(s.conn, s.bufPool)
+}
+
+// ServeParallel is Serve with n read loops instead of one. Each loop reads
+// from its own clone of the FUSE file descriptor (see sharing.CloneFuseFD)
+// into its own buffers, and replies go out on the descriptor the request
+// came from, so requests are read and answered on several CPUs at once.
+// The loops share the Filesystem and everything else. n below 2 is Serve.
+//
+// It returns once every loop has, with the first error one of them ended
+// with. Unmount closes the clones along with the main descriptor.
+func (s *Server) ServeParallel(n int) error {
+	if n < 2 {
+		return s.Serve()
+	}
+	if err := s.startServing(); err != nil {
+		return err
+	}
+
+	fds, err := cloneFds(s.conn.Fd(), n-1)
+	if err != nil {
+		return err
+	}
+	conns := []*connection{s.conn}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		sharing.CloseAll(fds)
+		return ErrServerClosed
+	}
+	var clones []*connection
+	for _, fd := range fds {
+		c, err := s.newConnection(fd)
+		if err != nil {
+			s.mu.Unlock()
+			sharing.CloseAll(fds)
+			return err
+		}
+		clones = append(clones, c)
+	}
+	s.clones = append(s.clones, clones...)
+	conns = append(conns, clones...)
+	s.mu.Unlock()
+
+	if s.serial != nil {
+		s.serialCh = make(chan *request, serialQueueLen)
+		go s.runSerial(s.serialCh)
+		defer close(s.serialCh)
+	}
+
+	errs := make(chan error, len(conns))
+	for i, c := range conns {
+		pool := s.bufPool
+		if i > 0 {
+			pool = newBufferPool(pool.size)
+		}
+		go func() { errs <- s.serveConn(c, pool) }()
+	}
+
+	var first error
+	for range conns {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// cloneFds clones the FUSE descriptor for ServeParallel, replaced by tests
+// whose descriptor is a socket
+var cloneFds = sharing.CloneMultiple
+
+// newConnection wraps a clone of the server's descriptor. Clones of a
+// server from NewServerFromFd stop along with it. Called with s.mu held.
+func (s *Server) newConnection(fd int) (*connection, error) {
+	if s.wake < 0 {
+		return newConnection(fd), nil
+	}
+	return newStoppableConnection(fd, s.wake)
+}
+
+// serveConn reads requests from conn into buffers from pool and
+// dispatches them, until the filesystem is unmounted.
+func (s *Server) serveConn(conn *connection, pool *bufferPool) error {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -84,7 +368,7 @@ func (s *Server) Serve() error {
 		default:
 		}
 
-		req, err := s.conn.readRequest(s.bufPool)
+		req, err := conn.readRequest(pool)
 		if err != nil {
 			if err == syscall.EINTR {
 				continue
@@ -92,23 +376,288 @@ func (s *Server) Serve() error {
 			if err == ErrNotMounted {
 				return nil
 			}
+			if errors.Is(err, ErrBufferTooSmall) {
+				if p, ok := s.growBuffers(pool); ok {
+					pool = p
+					continue
+				}
+				return fmt.Errorf("%w, kernel requires at least %d", err, requestBufferSize(s.opts.MaxWrite))
+			}
 			return err
 		}
+		// Taken now: the request may wait in a queue before it runs
+		req.snap = s.snapshot.Load()
+
+		if req.header.Opcode == proto.OpDestroy {
+			s.handleRequest(req)
+			req.release()
+
+			s.mu.RLock()
+			action := s.destroyAction
+			s.mu.RUnlock()
+			if action == DestroyExit {
+				return nil
+			}
+			continue
+		}
+
+		s.dispatch(req)
+	}
+}
+
+// serialQueueLen is how many requests may wait for the serial goroutine
+// before the read loop blocks.
+const serialQueueLen = 256
+
+// dispatch handles a request on its own goroutine, or queues it for the
+// serial goroutine if its opcode is listed in MountOptions.SerialOpcodes.
+// It never blocks on the limits: requests over them are queued, so that
+// the read loop keeps reading.
+func (s *Server) dispatch(req *request) {
+	// Adding to wg must not race with Unmount waiting on it
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		req.release()
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	req.refs.Store(1)
+	s.track(req)
+	if s.serial[req.header.Opcode] {
+		s.serialCh <- req
+		return
+	}
+
+	if s.uids != nil && !unlimited(req.header.Opcode) && !s.uids.acquire(req) {
+		// Started by uidLimiter.release when the uid has a slot
+		return
+	}
+	s.start(req)
+}
+
+// start handles req on a goroutine of its own, or queues it if
+// MaxConcurrentRequests are being handled already.
+func (s *Server) start(req *request) {
+	if s.limiter != nil && !unlimited(req.header.Opcode) && !s.limiter.acquire(req) {
+		// Handled by a goroutine finishing another request
+		return
+	}
+	go s.run(req)
+}
+
+// run handles req, then the requests that queued up for the slots it
+// held: the next one of the same uid (PerUidConcurrency) is started, and
+// the next one of all (MaxConcurrentRequests) handled on this goroutine.
+func (s *Server) run(req *request) {
+	for req != nil {
+		uid := req.header.Uid
+		limited := !unlimited(req.header.Opcode)
+		s.handleRequest(req)
+		s.finish(req)
+		if !limited {
+			return
+		}
+		if s.uids != nil {
+			if next := s.uids.release(uid); next != nil {
+				s.start(next)
+			}
+		}
+		if s.limiter == nil {
+			return
+		}
+		req = s.limiter.release()
+	}
+}
 
-		// Handle request
-		s.wg.Add(1)
-		go func(r *request) {
-			defer s.wg.Done()
-			defer r.release()
-			s.handleRequest(r)
-		}(req)
+// finish drops one hold on a dispatched request. The last one (the handler,
+// or a Replier answering after it) releases the buffer.
+func (s *Server) finish(req *request) {
+	if req.refs.Add(-1) == 0 {
+		if req.cancel != nil {
+			s.inflight.Delete(req.header.Unique)
+			req.cancel()
+		}
+		req.release()
+		s.wg.Done()
 	}
 }
 
+// track gives req a context of its own that a FUSE_INTERRUPT naming it
+// cancels, so that the filesystem sees ctx.Done() when the caller is
+// interrupted (e.g. by Ctrl-C), and that expires after
+// MountOptions.OperationTimeout. It runs on the read loop, so the request
+// is registered before any interrupt for it can be read.
+func (s *Server) track(req *request) {
+	switch req.header.Opcode {
+	case proto.OpForget, proto.OpBatchForget, proto.OpInterrupt:
+		// No reply the caller could be waiting for
+		return
+	}
+	if s.opts.OperationTimeout > 0 {
+		req.parent, req.cancel = context.WithTimeout(s.ctx, s.opts.OperationTimeout)
+	} else {
+		req.parent, req.cancel = context.WithCancel(s.ctx)
+	}
+	s.inflight.Store(req.header.Unique, req)
+}
+
+// interrupt cancels the context of the in-flight request unique, and
+// reports whether there was one.
+func (s *Server) interrupt(unique uint64) bool {
+	v, ok := s.inflight.Load(unique)
+	if !ok {
+		return false
+	}
+	v.(*request).cancel()
+	return true
+}
+
+// runSerial handles queued requests one at a time until ch is closed.
+func (s *Server) runSerial(ch <-chan *request) {
+	for req := range ch {
+		s.handleRequest(req)
+		s.finish(req)
+	}
+}
+
+// ServeBackground runs Serve in a new goroutine and returns once the kernel
+// has completed the INIT handshake, so the mount is usable when it returns.
+// If the loop ends before that, its error is returned (ErrServerClosed if
+// it ended without one).
+//
+// Afterwards Done is closed when the loop returns and Err reports why.
+// Unmount stops the loop; call Wait after Done to let in-flight requests
+// finish. Like Serve, it can only be called once per server, and returns
+// ErrAlreadyServing after that.
+func (s *Server) ServeBackground() error {
+	if err := s.startServing(); err != nil {
+		return err
+	}
+	go func() {
+		err := s.serve()
+		s.mu.Lock()
+		s.serveErr = err
+		s.mu.Unlock()
+		close(s.done)
+	}()
+
+	select {
+	case <-s.ready:
+		return nil
+	case <-s.done:
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return ErrServerClosed
+	}
+}
+
+// startServing marks the server as served. A server has one serve loop
+// (or one set of them, see ServeParallel) for its whole life: it fails
+// with ErrAlreadyServing once one was started, and with ErrServerClosed
+// after Unmount.
+func (s *Server) startServing() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	if s.serving {
+		return ErrAlreadyServing
+	}
+	s.serving = true
+	return nil
+}
+
+// WaitReady blocks until the kernel has completed the INIT handshake, or
+// ctx is done. Serve must be running for that to happen.
+func (s *Server) WaitReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Config returns the parameters negotiated with the kernel at INIT, or nil
+// before the handshake (see WaitReady). Each call returns a new copy.
+func (s *Server) Config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.config == nil {
+		return nil
+	}
+	c := *s.config
+	return &c
+}
+
+// Done returns a channel closed when the loop started by ServeBackground
+// returns. It is never closed for loops run by calling Serve directly.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the ServeBackground loop ended with, or nil while
+// it is running or if it ended cleanly.
+func (s *Server) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serveErr
+}
+
+// growBuffers returns a buffer pool large enough for the negotiated
+// MaxWrite to replace pool. It returns false if pool was already that big,
+// in which case retrying the read would not help.
+func (s *Server) growBuffers(pool *bufferPool) (*bufferPool, bool) {
+	need := requestBufferSize(s.opts.MaxWrite)
+	if pool.size >= need {
+		return nil, false
+	}
+
+	s.opts.logf("request buffer of %d bytes too small, growing to %d", pool.size, need)
+	return newBufferPool(need), true
+}
+
 // handleRequest dispatches a request to the appropriate handler.
 func (s *Server) handleRequest(req *request) {
 	opcode := req.header.Opcode
 
+	if s.opts.debugging() {
+		req.start = time.Now()
+		s.opts.Logger.Debug("request",
+			"op", proto.OpcodeName(opcode),
+			"unique", req.header.Unique,
+			"nodeid", req.header.NodeID,
+			"uid", req.header.Uid,
+			"gid", req.header.Gid,
+			"pid", req.header.Pid)
+	}
+
+	// Nothing but INIT may run before the handshake, there is no
+	// negotiated configuration yet
+	if opcode != proto.OpInit {
+		s.mu.RLock()
+		initialized := s.initialized
+		s.mu.RUnlock()
+		if !initialized {
+			s.opts.logf("%s received before INIT", proto.OpcodeName(opcode))
+			s.sendError(req, syscall.EIO)
+			return
+		}
+	}
+
+	// With AllowRoot the mount admits everyone; turn away all but the
+	// owner and root, except where there is no caller to check or the
+	// open that made the handle was checked already
+	if s.opts.AllowRoot && !s.admits(req) {
+		s.sendError(req, syscall.EACCES)
+		return
+	}
+
 	// Check if it's a write operation (read-only filesystem)
 	if isWriteOp(opcode) {
 		s.sendError(req, syscall.EROFS)
@@ -119,20 +668,72 @@ func (s *Server) handleRequest(req *request) {
 	h, ok := handlers[opcode]
 	if !ok {
 		// Unknown opcode - return ENOSYS
-		if s.opts.Debug {
-			// Log unknown opcode
-		}
+		s.opts.logf("unknown opcode %d", opcode)
 		s.sendError(req, syscall.ENOSYS)
 		return
 	}
 
+	// Don't let handlers read past the message the kernel sent
+	if err := checkRequest(req, h.minBody); err != nil {
+		s.protocolError(req, err)
+		s.sendError(req, syscall.EINVAL)
+		return
+	}
+
+	// Inode 0 never names a file; don't let it reach the filesystem
+	if needsNode(opcode) && !Inode(req.header.NodeID).Valid() {
+		s.opts.logf("%s on inode 0", proto.OpcodeName(opcode))
+		s.sendError(req, syscall.EINVAL)
+		return
+	}
+
+	// Start the trace span before the handler builds its context
+	if s.opts.TraceStart != nil {
+		s.newContext(req)
+	}
+
 	// Execute handler
-	if err := h(s, req); err != nil {
+	err := s.callHandler(h.handle, req)
+	if errors.Is(err, ErrReplyAsync) {
+		if req.replier == nil {
+			s.opts.logf("%s handler returned ErrReplyAsync without an AsyncReplier", proto.OpcodeName(opcode))
+			s.sendError(req, syscall.EIO)
+			req.endTrace(syscall.EIO)
+			return
+		}
+		// The Replier ends the trace
+		req.replier.arm(req.ctx)
+		return
+	}
+	if req.replier != nil {
+		req.replier.discard()
+	}
+	err = s.checkCancel(req, err)
+	req.endTrace(err)
+	if err != nil {
+		if opcode == proto.OpLookup {
+			s.lookupFailed(req, err)
+		}
 		s.sendError(req, err)
 		return
 	}
 }
 
+// checkCancel turns a context.Canceled returned for a request that was not
+// cancelled into EIO. It would otherwise reach the application as EINTR,
+// which it is not prepared for when nothing interrupted it; the usual
+// cause is a filesystem passing on the error of a context of its own.
+func (s *Server) checkCancel(req *request, err error) error {
+	if !errors.Is(err, context.Canceled) {
+		return err
+	}
+	if req.ctx != nil && req.ctx.Err() != nil {
+		return err
+	}
+	s.opts.logf("%s returned %v but the request was not cancelled, replying EIO", proto.OpcodeName(req.header.Opcode), err)
+	return syscall.EIO
+}
+
 // sendError sends an error response.
 func (s *Server) sendError(req *request, err error) {
 	// Don't send response for FORGET operations
@@ -142,7 +743,7 @@ func (s *Server) sendError(req *request, err error) {
 
 	errno := toErrno(err)
 	resp := newErrorResponse(req, errno)
-	s.conn.writeResponse(resp.bytes())
+	s.replied(req, errno, req.conn.writeResponse(resp.bytes()))
 }
 
 // sendResponse sends a successful response.
@@ -151,23 +752,152 @@ func (s *Server) sendResponse(req *request, payload []byte) {
 	if len(payload) > 0 {
 		copy(resp.payload(), payload)
 	}
-	s.conn.writeResponse(resp.bytes())
+	s.replied(req, 0, req.conn.writeResponse(resp.bytes()))
+}
+
+// replied checks the outcome of writing the reply to req, which carried
+// errno (0 for success). ENOENT means the request was interrupted and the
+// kernel no longer waits for it, and ErrNotMounted that it went away;
+// neither is worth reporting.
+func (s *Server) replied(req *request, errno int32, err error) {
+	if !req.start.IsZero() {
+		s.opts.Logger.Debug("reply",
+			"op", proto.OpcodeName(req.header.Opcode),
+			"unique", req.header.Unique,
+			"errno", replyErrnoName(errno),
+			"latency", time.Since(req.start))
+	}
+	if err == nil || err == ErrNotMounted || err == syscall.ENOENT {
+		return
+	}
+	s.opts.logf("%s reply: %v", proto.OpcodeName(req.header.Opcode), err)
+	s.count("reply.error."+errnoName(toErrno(err)), 1)
+}
+
+// minVecPayload is the smallest payload sendData writes in place; copying
+// smaller ones costs less than the extra iovec.
+const minVecPayload = 4096
+
+// sendData sends a successful response carrying file data. Large payloads
+// are written straight from p with writev instead of being copied behind
+// the header, which matters for READ, the hottest path of a read-only
+// filesystem.
+func (s *Server) sendData(req *request, p []byte) {
+	if len(p) < minVecPayload {
+		s.sendResponse(req, p)
+		return
+	}
+
+	var header [proto.OutHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(proto.OutHeaderSize+len(p)))
+	binary.LittleEndian.PutUint64(header[8:16], req.header.Unique)
+	s.replied(req, 0, req.conn.writeResponseVec(header[:], p))
 }
 
-// newContext creates a FUSE context from a request.
+// newContext returns the FUSE context of a request, creating it on first
+// use.
 func (s *Server) newContext(req *request) Context {
-	return newContext(s.ctx, req.header.Uid, req.header.Gid, req.header.Pid, req.header.Unique)
+	if req.ctx == nil {
+		parent := s.ctx
+		if req.parent != nil {
+			parent = req.parent
+		}
+		// The filesystem sees callers in its own id space
+		uid := reverseID(s.opts.UidMap, req.header.Uid, s.opts.UnmappedID)
+		gid := reverseID(s.opts.GidMap, req.header.Gid, s.opts.UnmappedID)
+		c := newContext(parent, uid, gid, req.header.Pid, req.header.Unique, req.snap).(*fuseContext)
+		c.srv = s
+		c.req = req
+		req.ctx = c
+
+		if s.opts.TraceStart != nil {
+			traced, end := s.opts.TraceStart(c, req.header.Opcode)
+			// Same request, running under the span's context
+			t := *c
+			t.Context = traced
+			req.ctx = &t
+			req.traceEnd = end
+		}
+	}
+	return req.ctx
 }
 
 // Unmount unmounts the filesystem and shuts down the server.
+//
+// Requests read after this point are dropped, and the contexts of the ones
+// in flight are cancelled. Unmount then waits up to
+// MountOptions.UnmountTimeout for their handlers to return before closing
+// the connection; replies from handlers still running after that are
+// discarded.
 func (s *Server) Unmount() error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
 	s.cancel()
-	err := unmount(s.mountPoint)
+	var err error
+	if s.mountPoint != "" {
+		err = unmount(s.mountPoint)
+	} else {
+		// The mount belongs to whoever passed the descriptor; only stop
+		// reading from it
+		s.stopReads()
+	}
+
+	if !s.drain(s.opts.UnmountTimeout) {
+		s.opts.logf("requests still running %v after unmount, closing anyway", s.opts.UnmountTimeout)
+	}
 	s.conn.close()
+	s.mu.Lock()
+	for _, c := range s.clones {
+		c.close()
+	}
+	if s.wake >= 0 {
+		unix.Close(s.wake)
+		s.wake = -1
+	}
+	if s.autoUnmount >= 0 {
+		// Already unmounted; fusermount finds nothing left to do
+		unix.Close(s.autoUnmount)
+		s.autoUnmount = -1
+	}
+	s.mu.Unlock()
 	return err
 }
 
+// stopReads signals the eventfd of a server from NewServerFromFd, ending
+// the read loops with ErrNotMounted. It stays signalled, so loops that
+// only get to read later stop as well.
+func (s *Server) stopReads() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.wake >= 0 {
+		var one [8]byte
+		binary.NativeEndian.PutUint64(one[:], 1)
+		unix.Write(s.wake, one[:])
+	}
+}
+
+// drain waits for in-flight requests to finish, giving up after timeout.
+// It reports whether all of them finished.
+func (s *Server) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // Wait waits for all pending requests to complete.
+// After Unmount it returns once every request goroutine has exited, which
+// may be later than Unmount itself if a handler ignores its context.
 func (s *Server) Wait() {
 	s.wg.Wait()
 }
@@ -202,3 +932,125 @@ func isWriteOp(opcode uint32) bool {
 		return false
 	}
 }
+
+// checkRequest reports a request whose header length is not what was
+// read, a body shorter than minBody, or a LOOKUP name that is empty or
+// not NUL-terminated. The errors wrap EINVAL.
+func checkRequest(req *request, minBody int) error {
+	if n := int(req.header.Len); n != len(req.data) {
+		return fmt.Errorf("header says %d bytes, read %d: %w", n, len(req.data), syscall.EINVAL)
+	}
+	body := req.bodyBytes()
+	if len(body) < minBody {
+		return fmt.Errorf("%d-byte body, need %d: %w", len(body), minBody, syscall.EINVAL)
+	}
+	if req.header.Opcode == proto.OpLookup {
+		if i := bytes.IndexByte(body, 0); i <= 0 {
+			return fmt.Errorf("name empty or not NUL-terminated: %w", syscall.EINVAL)
+		}
+	}
+	return nil
+}
+
+// checkReadIn reports, as a protocol error, a READ or READDIR asking for
+// more than the kernel ever does, which would only have the server
+// allocate that much, or a READ at an offset Read cannot take.
+func (s *Server) checkReadIn(req *request, in *proto.ReadIn) error {
+	var err error
+	switch {
+	case in.Size > maxIO:
+		err = fmt.Errorf("size %d over %d: %w", in.Size, maxIO, syscall.EINVAL)
+	case req.header.Opcode == proto.OpRead && in.Offset > math.MaxInt64:
+		// File offsets are signed in the kernel
+		err = fmt.Errorf("offset %d out of range: %w", in.Offset, syscall.EINVAL)
+	default:
+		return nil
+	}
+	s.protocolError(req, err)
+	return err
+}
+
+// protocolError reports a request the kernel sent in a form the server
+// cannot parse, as opposed to one the filesystem failed.
+func (s *Server) protocolError(req *request, err error) {
+	op := req.header.Opcode
+	s.opts.logf("malformed %s (unique %d): %v", proto.OpcodeName(op), req.header.Unique, err)
+	if s.opts.OnProtocolError != nil {
+		s.opts.OnProtocolError(op, req.header.Unique, err)
+	}
+}
+
+// callHandler runs h, turning a panic into EIO so that a bug in the
+// filesystem fails the one request instead of taking down the process
+// and leaving the mount wedged.
+func (s *Server) callHandler(h handler, req *request) (err error) {
+	defer s.recoverPanic(req.header.Opcode, req.header.Unique, &err)
+	return h(s, req)
+}
+
+// recoverPanic, deferred, turns a panic in the filesystem while serving op
+// into EIO in *err and reports it to MountOptions.PanicHandler.
+func (s *Server) recoverPanic(op uint32, unique uint64, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	s.count("panic", 1)
+	if s.opts.PanicHandler != nil {
+		s.opts.PanicHandler(op, unique, v, stack)
+	} else {
+		s.opts.logf("panic in %s (unique %d): %v\n%s", proto.OpcodeName(op), unique, v, stack)
+	}
+	*err = syscall.EIO
+}
+
+// admits reports whether req may be served under MountOptions.AllowRoot.
+func (s *Server) admits(req *request) bool {
+	if uid := req.header.Uid; uid == s.owner || uid == 0 {
+		return true
+	}
+	switch req.header.Opcode {
+	case proto.OpInit,
+		proto.OpDestroy,
+		proto.OpForget,
+		proto.OpBatchForget,
+		proto.OpInterrupt,
+		proto.OpRead,
+		proto.OpRelease,
+		proto.OpReaddir,
+		proto.OpReaddirplus,
+		proto.OpReleasedir:
+		return true
+	default:
+		return false
+	}
+}
+
+// needsNode reports whether opcode operates on the inode in the request
+// header. INIT, DESTROY, INTERRUPT and BATCH_FORGET legitimately carry
+// NodeID 0.
+func needsNode(opcode uint32) bool {
+	switch opcode {
+	case proto.OpLookup,
+		proto.OpForget,
+		proto.OpGetattr,
+		proto.OpReadlink,
+		proto.OpOpen,
+		proto.OpRead,
+		proto.OpRelease,
+		proto.OpFlush,
+		proto.OpOpendir,
+		proto.OpReaddir,
+		proto.OpReaddirplus,
+		proto.OpReleasedir,
+		proto.OpAccess,
+		proto.OpStatx,
+		proto.OpLseek,
+		proto.OpPoll,
+		proto.OpIoctl:
+		return true
+	default:
+		return false
+	}
+}
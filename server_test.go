@@ -0,0 +1,514 @@
+package rofuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
+)
+
+func TestServeBackground(t *testing.T) {
+	k := newTestConn(t, newTestFS(), nil)
+
+	started := make(chan error, 1)
+	go func() { started <- k.s.ServeBackground() }()
+	select {
+	case err := <-started:
+		t.Fatalf("ServeBackground returned %v before INIT", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	k.handshake(0)
+	if err := <-started; err != nil {
+		t.Fatalf("ServeBackground: %v", err)
+	}
+	if k.s.Config() == nil {
+		t.Error("no Config after ServeBackground returned")
+	}
+
+	// The loop runs once
+	if err := k.s.ServeBackground(); !errors.Is(err, ErrAlreadyServing) {
+		t.Errorf("second ServeBackground = %v, want ErrAlreadyServing", err)
+	}
+	if err := k.s.Serve(); !errors.Is(err, ErrAlreadyServing) {
+		t.Errorf("Serve after ServeBackground = %v, want ErrAlreadyServing", err)
+	}
+
+	k.s.Unmount()
+	select {
+	case <-k.s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop still running after Unmount")
+	}
+	if err := k.s.Err(); err != nil {
+		t.Errorf("Err after Unmount = %v, want nil", err)
+	}
+	if err := k.s.ServeBackground(); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ServeBackground after Unmount = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServeBackgroundError(t *testing.T) {
+	k := newTestConn(t, newTestFS(), nil)
+	go k.s.ServeBackground()
+	k.handshake(0)
+
+	// The connection breaking ends the loop with an error
+	k.close()
+	select {
+	case <-k.s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop still running after the connection closed")
+	}
+	if err := k.s.Err(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// After DESTROY is answered, DestroyExit makes Serve return at once, and
+// DestroyContinue, the default, keeps it serving until the connection goes
+// away.
+func TestOnDestroy(t *testing.T) {
+	for _, action := range []DestroyAction{DestroyExit, DestroyContinue} {
+		calls := make(chan struct{}, 2)
+		fs := newTestFS()
+		ino := fs.create(RootInode, "file", nil)
+		k := newTestConn(t, fs, &MountOptions{OnDestroy: func() DestroyAction {
+			calls <- struct{}{}
+			return action
+		}})
+		served := make(chan error, 1)
+		go func() { served <- k.s.Serve() }()
+		k.handshake(0)
+
+		if errno, _ := k.call(proto.OpDestroy, 0, nil); errno != 0 {
+			t.Fatalf("action %d: DESTROY: errno %v", action, syscall.Errno(-errno))
+		}
+		// Consulted once DESTROY is answered
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("action %d: OnDestroy not called", action)
+		}
+
+		if action == DestroyContinue {
+			select {
+			case err := <-served:
+				t.Fatalf("Serve returned %v after DESTROY", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			k.getattr(ino)
+			// What the kernel failing reads with ENODEV amounts to
+			k.s.stopReads()
+		}
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Errorf("action %d: Serve = %v, want nil", action, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("action %d: Serve still running", action)
+		}
+		if len(calls) != 0 {
+			t.Errorf("action %d: OnDestroy called more than once", action)
+		}
+	}
+}
+
+// Sizes past the kernel's limit are lowered to it, with a warning, and the
+// buffers are sized for what the kernel will actually send.
+func TestMaxPagesClamp(t *testing.T) {
+	var logged bytes.Buffer
+	const pages = 1024
+	k := newTestConn(t, newTestFS(), &MountOptions{
+		MaxRead:  pages * proto.PageSize,
+		MaxWrite: pages * proto.PageSize,
+		Logger:   slog.New(slog.NewTextHandler(&logged, nil)),
+	})
+
+	const limit = proto.MaxPagesLimit * proto.PageSize
+	if k.s.opts.MaxRead != limit || k.s.opts.MaxWrite != limit {
+		t.Errorf("MaxRead %d, MaxWrite %d, want both %d", k.s.opts.MaxRead, k.s.opts.MaxWrite, limit)
+	}
+	for _, opt := range []string{"MaxRead", "MaxWrite"} {
+		if !strings.Contains(logged.String(), "level=WARN msg=\""+opt+" ") {
+			t.Errorf("no warning about %s in %q", opt, logged.String())
+		}
+	}
+	if n := maxPages(k.s.opts); n != proto.MaxPagesLimit {
+		t.Errorf("max_pages %d, want %d", n, proto.MaxPagesLimit)
+	}
+	if size := k.s.bufPool.size; size > limit+2*proto.PageSize {
+		t.Errorf("request buffers of %d bytes for %d-byte writes", size, limit)
+	}
+}
+
+// A GETATTR cut short is answered EINVAL and reported as a protocol
+// error; a filesystem error is not.
+func TestOnProtocolError(t *testing.T) {
+	type report struct {
+		op     uint32
+		unique uint64
+		err    error
+	}
+	reports := make(chan report, 4)
+	fs := newTestFS()
+	k := newTestServer(t, fs, &MountOptions{
+		OnProtocolError: func(op uint32, unique uint64, err error) {
+			reports <- report{op, unique, err}
+		},
+	})
+
+	in := wireBytes(&proto.GetAttrIn{})
+	unique := k.send(proto.OpGetattr, uint64(RootInode), in[:proto.GetAttrInSize/2])
+	if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EINVAL {
+		t.Fatalf("truncated GETATTR: errno %v, want EINVAL", syscall.Errno(-errno))
+	}
+	select {
+	case r := <-reports:
+		if r.op != proto.OpGetattr || r.unique != unique || !errors.Is(r.err, syscall.EINVAL) {
+			t.Errorf("reported op %d unique %d err %v, want GETATTR %d EINVAL", r.op, r.unique, r.err, unique)
+		}
+	default:
+		t.Fatal("truncated GETATTR not reported")
+	}
+
+	if errno, _ := k.call(proto.OpGetattr, 999, in); syscall.Errno(-errno) != syscall.ENOENT {
+		t.Fatalf("GETATTR of unknown inode: errno %v, want ENOENT", syscall.Errno(-errno))
+	}
+	k.getattr(RootInode)
+	select {
+	case r := <-reports:
+		t.Errorf("well-formed request reported: %+v", r)
+	default:
+	}
+}
+
+// blockingFS reads block until the request's context is done, and fail
+// with its error.
+type blockingFS struct {
+	*testFS
+	started chan struct{}
+	ended   chan error
+}
+
+func (f blockingFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	f.started <- struct{}{}
+	<-ctx.Done()
+	f.ended <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// sendInterrupt sends a FUSE_INTERRUPT for the request unique, with the
+// id the kernel gives interrupts, and returns that id.
+func (k *testKernel) sendInterrupt(unique uint64) uint64 {
+	k.t.Helper()
+	h := k.header(proto.OpInterrupt, 0)
+	h.Unique = unique | 1
+	k.sendHeader(&h, wireBytes(&proto.InterruptIn{Unique: unique}))
+	return h.Unique
+}
+
+// A FUSE_INTERRUPT cancels the context of the request it names, and gets
+// no reply.
+func TestInterrupt(t *testing.T) {
+	fs := blockingFS{newTestFS(), make(chan struct{}, 1), make(chan error, 1)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, nil)
+	fh := k.open(ino)
+
+	unique := k.send(proto.OpRead, uint64(ino), wireBytes(&proto.ReadIn{Fh: fh, Size: 4096}))
+	<-fs.started
+	intr := k.sendInterrupt(unique)
+	select {
+	case err := <-fs.ended:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Read saw %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read not interrupted")
+	}
+	if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EINTR {
+		t.Errorf("READ: errno %v, want EINTR", syscall.Errno(-errno))
+	}
+	k.noReply(intr, 50*time.Millisecond)
+}
+
+// A request still running after OperationTimeout sees its context expire,
+// is answered ETIMEDOUT, and is then forgotten like any finished request.
+func TestOperationTimeout(t *testing.T) {
+	fs := blockingFS{newTestFS(), make(chan struct{}, 1), make(chan error, 1)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	const timeout = 50 * time.Millisecond
+	k := newTestServer(t, fs, &MountOptions{OperationTimeout: timeout})
+	fh := k.open(ino)
+
+	start := time.Now()
+	unique := k.send(proto.OpRead, uint64(ino), wireBytes(&proto.ReadIn{Fh: fh, Size: 4096}))
+	<-fs.started
+	if err := <-fs.ended; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Read saw %v, want context.DeadlineExceeded", err)
+	}
+	if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.ETIMEDOUT {
+		t.Errorf("READ: errno %v, want ETIMEDOUT", syscall.Errno(-errno))
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("answered after %v, before the %v timeout", d, timeout)
+	}
+
+	// Its cancel func ran, and it is no longer tracked
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := k.s.inflight.Load(unique); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request still tracked after its reply")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Requests that finish in time are unaffected
+	k.getattr(ino)
+}
+
+// stuckFS holds reads until released, whatever their context says.
+type stuckFS struct {
+	*testFS
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f stuckFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	f.started <- struct{}{}
+	<-f.release
+	return f.testFS.Read(ctx, ino, fh, offset, size)
+}
+
+// Unmount gives up on a handler that ignores its context after
+// UnmountTimeout, and once the handler does return, nothing the server
+// started is left running.
+func TestUnmountSlowBackend(t *testing.T) {
+	fs := stuckFS{newTestFS(), make(chan struct{}, 1), make(chan struct{})}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	goroutines := runtime.NumGoroutine()
+
+	const timeout = 50 * time.Millisecond
+	k := newTestConn(t, fs, &MountOptions{UnmountTimeout: timeout})
+	served := make(chan error, 1)
+	go func() { served <- k.s.Serve() }()
+	k.handshake(0)
+	k.send(proto.OpRead, uint64(ino), wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096}))
+	<-fs.started
+
+	start := time.Now()
+	k.s.Unmount()
+	if d := time.Since(start); d < timeout || d > 5*time.Second {
+		t.Errorf("Unmount returned after %v, want about %v", d, timeout)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve still running after Unmount")
+	}
+
+	// The late reply is dropped, and the goroutines end
+	close(fs.release)
+	k.s.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, %d before the server", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// An interrupt for a request the server does not know (yet) is answered
+// EAGAIN, so that the kernel sends it again while the request is pending.
+func TestInterruptUnknown(t *testing.T) {
+	k := newTestServer(t, newTestFS(), nil)
+	intr := k.sendInterrupt(k.unique.Add(2))
+	if errno, _ := k.recv(intr); syscall.Errno(-errno) != syscall.EAGAIN {
+		t.Errorf("INTERRUPT: errno %v, want EAGAIN", syscall.Errno(-errno))
+	}
+}
+
+// sendAs sends a request from uid and returns its unique id.
+func (k *testKernel) sendAs(uid uint32, op uint32, nodeid uint64, body []byte) uint64 {
+	k.t.Helper()
+	h := k.header(op, nodeid)
+	h.Uid = uid
+	k.sendHeader(&h, body)
+	return h.Unique
+}
+
+// With AllowRoot, the server turns away everyone but root and the user
+// who mounted, except for requests that have no caller to check or go
+// through a handle whose open was checked.
+func TestAllowRoot(t *testing.T) {
+	fs := newTestFS()
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{AllowRoot: true})
+	owner := k.s.owner
+	const other = 54321
+
+	lookup := append([]byte("file"), 0)
+	for _, uid := range []uint32{0, owner} {
+		if errno, _ := k.recv(k.sendAs(uid, proto.OpLookup, uint64(RootInode), lookup)); errno != 0 {
+			t.Errorf("LOOKUP by uid %d: errno %v", uid, syscall.Errno(-errno))
+		}
+	}
+	for _, op := range []uint32{proto.OpLookup, proto.OpGetattr, proto.OpOpen, proto.OpOpendir, proto.OpStatfs, proto.OpAccess} {
+		body := wireBytes(&proto.OpenIn{})
+		switch op {
+		case proto.OpLookup:
+			body = lookup
+		case proto.OpGetattr:
+			body = wireBytes(&proto.GetAttrIn{})
+		case proto.OpAccess:
+			body = wireBytes(&proto.AccessIn{})
+		}
+		if errno, _ := k.recv(k.sendAs(other, op, uint64(RootInode), body)); syscall.Errno(-errno) != syscall.EACCES {
+			t.Errorf("%s by uid %d: errno %v, want EACCES", proto.OpcodeName(op), other, syscall.Errno(-errno))
+		}
+	}
+
+	// Handles opened by the owner serve anyone the kernel lets use them
+	fh := k.open(ino)
+	read := wireBytes(&proto.ReadIn{Fh: fh, Size: 4096})
+	if errno, data := k.recv(k.sendAs(other, proto.OpRead, uint64(ino), read)); errno != 0 || string(data) != "data" {
+		t.Errorf("READ by uid %d: errno %v, %q", other, syscall.Errno(-errno), data)
+	}
+	if errno, _ := k.recv(k.sendAs(other, proto.OpRelease, uint64(ino), wireBytes(&proto.ReleaseIn{Fh: fh}))); errno != 0 {
+		t.Errorf("RELEASE by uid %d: errno %v", other, syscall.Errno(-errno))
+	}
+	dh := k.opendir(RootInode)
+	readdir := wireBytes(&proto.ReadIn{Fh: dh, Size: 4096})
+	for _, op := range []uint32{proto.OpReaddir, proto.OpReaddirplus} {
+		if errno, _ := k.recv(k.sendAs(other, op, uint64(RootInode), readdir)); errno != 0 {
+			t.Errorf("%s by uid %d: errno %v", proto.OpcodeName(op), other, syscall.Errno(-errno))
+		}
+	}
+	if errno, _ := k.recv(k.sendAs(other, proto.OpReleasedir, uint64(RootInode), wireBytes(&proto.ReleaseIn{Fh: dh}))); errno != 0 {
+		t.Errorf("RELEASEDIR by uid %d: errno %v", other, syscall.Errno(-errno))
+	}
+
+	// The kernel sends these on its own, with whatever uid
+	intr := k.header(proto.OpInterrupt, 0)
+	intr.Uid, intr.Unique = other, intr.Unique|1
+	k.sendHeader(&intr, wireBytes(&proto.InterruptIn{Unique: k.unique.Add(2)}))
+	if errno, _ := k.recv(intr.Unique); syscall.Errno(-errno) != syscall.EAGAIN {
+		t.Errorf("INTERRUPT by uid %d: errno %v, want EAGAIN", other, syscall.Errno(-errno))
+	}
+	if _, _, ok := k.s.nodes.name(ino); !ok {
+		t.Fatal("looked up file not in the node cache")
+	}
+	k.sendAs(other, proto.OpForget, uint64(ino), wireBytes(&proto.ForgetIn{Nlookup: 2}))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, _, ok := k.s.nodes.name(ino); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("FORGET by uid %d not handled", other)
+		}
+	}
+	if errno, _ := k.recv(k.sendAs(other, proto.OpDestroy, 0, nil)); errno != 0 {
+		t.Errorf("DESTROY by uid %d: errno %v", other, syscall.Errno(-errno))
+	}
+}
+
+// BenchmarkRead128K sends 128 KiB READ replies the way sendResponse does,
+// copying the data behind the header, and the way sendData does, writing
+// the header and the data with one writev.
+func BenchmarkRead128K(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		send func(s *Server, req *request, p []byte)
+	}{
+		{"copy", (*Server).sendResponse},
+		{"writev", (*Server).sendData},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			k := newTestConn(b, newTestFS(), nil)
+			data := make([]byte, 128<<10)
+			buf := make([]byte, proto.OutHeaderSize+len(data))
+			req := &request{header: &proto.InHeader{}, conn: k.s.conn}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+
+			for i := range b.N {
+				req.header.Unique = uint64(i + 1)
+				bc.send(k.s, req, data)
+				if n, err := unix.Read(k.fd, buf); err != nil || n != len(buf) {
+					b.Fatalf("read %d bytes, %v, want %d", n, err, len(buf))
+				}
+			}
+		})
+	}
+}
+
+// panicFS panics reading the file bad.
+type panicFS struct {
+	*testFS
+	bad Inode
+}
+
+func (f panicFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	if ino == f.bad {
+		panic("read of a bad file")
+	}
+	return f.testFS.Read(ctx, ino, fh, offset, size)
+}
+
+// A Read that panics fails its own request with EIO; the server keeps
+// answering the ones after it.
+func TestReadPanic(t *testing.T) {
+	fs := panicFS{testFS: newTestFS()}
+	fs.bad = fs.create(RootInode, "bad", []byte("bad"))
+	good := fs.create(RootInode, "good", []byte("good"))
+	type caught struct {
+		op     uint32
+		unique uint64
+		v      any
+		stack  []byte
+	}
+	panics := make(chan caught, 1)
+	counters := &Counters{}
+	k := newTestServer(t, fs, &MountOptions{
+		Metrics: counters,
+		PanicHandler: func(op uint32, unique uint64, v any, stack []byte) {
+			panics <- caught{op, unique, v, stack}
+		},
+	})
+
+	in := wireBytes(&proto.ReadIn{Fh: k.open(fs.bad), Size: 4096})
+	unique := k.send(proto.OpRead, uint64(fs.bad), in)
+	if errno, _ := k.recv(unique); syscall.Errno(-errno) != syscall.EIO {
+		t.Errorf("READ of bad: errno %v, want EIO", syscall.Errno(-errno))
+	}
+	c := <-panics
+	if c.op != proto.OpRead || c.unique != unique || c.v != "read of a bad file" {
+		t.Errorf("PanicHandler got %s, unique %d, %v; want READ, %d", proto.OpcodeName(c.op), c.unique, c.v, unique)
+	}
+	if !bytes.Contains(c.stack, []byte("panicFS.Read")) {
+		t.Errorf("stack does not show the panicking Read:\n%s", c.stack)
+	}
+	if n := counters.Snapshot()["panic"]; n != 1 {
+		t.Errorf("panic counter %d, want 1", n)
+	}
+
+	if data := k.readFile(good, k.open(good), 0, 4096); string(data) != "good" {
+		t.Errorf("READ after the panic: %q, want %q", data, "good")
+	}
+	k.getattr(good)
+}
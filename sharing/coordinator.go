@@ -3,19 +3,42 @@ package sharing
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // Coordinator manages multi-process FUSE serving.
 // It holds the master FUSE FD and distributes cloned FDs to worker processes.
 type Coordinator struct {
+	// AuthFunc, if set, is called with the credentials of each worker
+	// before it is given an FD; a non-nil error rejects the worker. Anyone
+	// who can connect to the socket may otherwise register, and a cloned
+	// FD gives full access to the mount, so callers not relying on the
+	// socket's file permissions should restrict the uids here.
+	AuthFunc func(cred *unix.Ucred) error
+
+	// OnWorkerExit, if set, is called with the PID of a worker whose
+	// connection closed (the process exited or closed its WorkerClient),
+	// after the coordinator removed it and closed its FD. It is not called
+	// for workers removed with RemoveWorker or Close.
+	OnWorkerExit func(pid int)
+
+	// Clone, if set, replaces CloneFuseFD to make the descriptor each
+	// worker is given from the master one. The coordinator closes it when
+	// the worker goes away.
+	Clone func(masterFd int) (int, error)
+
 	sockPath string
 	masterFd int
 	listener *net.UnixListener
 
-	workers   map[int]*Worker
+	// A process may register more than once, so workers are keyed by
+	// connection rather than pid
+	workers   map[*Worker]bool
 	workersMu sync.RWMutex
 
 	closed  bool
@@ -24,13 +47,17 @@ type Coordinator struct {
 
 // Worker represents a connected worker process.
 type Worker struct {
-	PID    int
+	PID    int    // Process ID, from the socket credentials
+	UID    uint32 // User ID, from the socket credentials
+	GID    uint32 // Group ID, from the socket credentials
 	conn   *net.UnixConn
 	fd     int // The cloned FD for this worker
 	closed bool
 }
 
 // RegisterMessage is sent by workers to register with the coordinator.
+// The PID is informational: the coordinator identifies workers by the
+// credentials of their socket.
 type RegisterMessage struct {
 	PID int
 }
@@ -54,13 +81,21 @@ func NewCoordinator(sockPath string, masterFd int) (*Coordinator, error) {
 		sockPath: sockPath,
 		masterFd: masterFd,
 		listener: passer.listener,
-		workers:  make(map[int]*Worker),
+		workers:  make(map[*Worker]bool),
 	}, nil
 }
 
 // AcceptWorker waits for a new worker process to connect and sends it a cloned FD.
 // Returns the Worker on success. The worker's FD is automatically closed when
 // the worker disconnects or when RemoveWorker is called.
+//
+// The worker's pid, uid and gid are taken from the socket (SO_PEERCRED),
+// never from what it reports, and passed to AuthFunc if set. Workers must
+// also live in the coordinator's mount namespace, otherwise the cloned FD
+// refers to a mount they cannot see; mismatches are rejected with
+// ErrMountNamespaceMismatch. When the namespace cannot be read (e.g. the
+// worker belongs to another user and we lack ptrace access), that check
+// is skipped.
 func (c *Coordinator) AcceptWorker() (*Worker, error) {
 	c.closeMu.Lock()
 	if c.closed {
@@ -82,18 +117,42 @@ func (c *Coordinator) AcceptWorker() (*Worker, error) {
 		return nil, fmt.Errorf("decode registration: %w", err)
 	}
 
+	enc := gob.NewEncoder(conn)
+
+	cred, err := peerCred(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("peer credentials: %w", err)
+	}
+	if c.AuthFunc != nil {
+		if err := c.AuthFunc(cred); err != nil {
+			enc.Encode(ResponseMessage{Success: false, Error: "not authorized"})
+			conn.Close()
+			return nil, fmt.Errorf("worker %d (uid %d): %w", cred.Pid, cred.Uid, err)
+		}
+	}
+
+	// Check that the worker can actually use a cloned FD
+	if same, err := SameMountNamespace(int(cred.Pid)); err == nil && !same {
+		enc.Encode(ResponseMessage{Success: false, Error: ErrMountNamespaceMismatch.Error()})
+		conn.Close()
+		return nil, fmt.Errorf("worker %d: %w", cred.Pid, ErrMountNamespaceMismatch)
+	}
+
 	// Clone the FUSE FD for this worker
-	clonedFd, err := CloneFuseFD(c.masterFd)
+	clone := c.Clone
+	if clone == nil {
+		clone = CloneFuseFD
+	}
+	clonedFd, err := clone(c.masterFd)
 	if err != nil {
 		// Send error response
-		enc := gob.NewEncoder(conn)
 		enc.Encode(ResponseMessage{Success: false, Error: err.Error()})
 		conn.Close()
 		return nil, fmt.Errorf("clone fd: %w", err)
 	}
 
 	// Send success response
-	enc := gob.NewEncoder(conn)
 	if err := enc.Encode(ResponseMessage{Success: true}); err != nil {
 		syscall.Close(clonedFd)
 		conn.Close()
@@ -108,29 +167,60 @@ func (c *Coordinator) AcceptWorker() (*Worker, error) {
 	}
 
 	worker := &Worker{
-		PID:  reg.PID,
+		PID:  int(cred.Pid),
+		UID:  cred.Uid,
+		GID:  cred.Gid,
 		conn: conn,
 		fd:   clonedFd,
 	}
 
 	c.workersMu.Lock()
-	c.workers[reg.PID] = worker
+	c.workers[worker] = true
 	c.workersMu.Unlock()
 
+	go c.watch(worker)
 	return worker, nil
 }
 
-// RemoveWorker removes a worker and closes its resources.
+// watch removes w once its connection closes. Workers send nothing after
+// registering, so any read returning means the worker is gone, or that
+// RemoveWorker or Close closed the connection.
+func (c *Coordinator) watch(w *Worker) {
+	var buf [1]byte
+	for {
+		if _, err := w.conn.Read(buf[:]); err != nil {
+			break
+		}
+	}
+
+	c.workersMu.Lock()
+	current := c.workers[w]
+	delete(c.workers, w)
+	c.workersMu.Unlock()
+
+	if current {
+		w.Close()
+		if c.OnWorkerExit != nil {
+			c.OnWorkerExit(w.PID)
+		}
+	}
+}
+
+// RemoveWorker removes the workers of process pid and closes their
+// resources.
 func (c *Coordinator) RemoveWorker(pid int) {
+	var removed []*Worker
 	c.workersMu.Lock()
-	worker, ok := c.workers[pid]
-	if ok {
-		delete(c.workers, pid)
+	for w := range c.workers {
+		if w.PID == pid {
+			delete(c.workers, w)
+			removed = append(removed, w)
+		}
 	}
 	c.workersMu.Unlock()
 
-	if ok && worker != nil {
-		worker.Close()
+	for _, w := range removed {
+		w.Close()
 	}
 }
 
@@ -140,7 +230,7 @@ func (c *Coordinator) Workers() []*Worker {
 	defer c.workersMu.RUnlock()
 
 	workers := make([]*Worker, 0, len(c.workers))
-	for _, w := range c.workers {
+	for w := range c.workers {
 		workers = append(workers, w)
 	}
 	return workers
@@ -161,10 +251,10 @@ func (c *Coordinator) Close() error {
 
 	// Close all workers
 	c.workersMu.Lock()
-	for _, worker := range c.workers {
+	for worker := range c.workers {
 		worker.Close()
 	}
-	c.workers = make(map[int]*Worker)
+	c.workers = make(map[*Worker]bool)
 	c.workersMu.Unlock()
 
 	// Close listener
@@ -214,8 +304,9 @@ func ConnectToCoordinator(sockPath string, pid int) (*WorkerClient, error) {
 		return nil, fmt.Errorf("encode registration: %w", err)
 	}
 
-	// Read response
-	dec := gob.NewDecoder(conn)
+	// Read response. gob buffers readers that can't read single bytes,
+	// which could swallow the byte carrying the FD that follows
+	dec := gob.NewDecoder(byteReader{conn})
 	var resp ResponseMessage
 	if err := dec.Decode(&resp); err != nil {
 		conn.Close()
@@ -264,3 +355,14 @@ func (w *WorkerClient) CloseFd() error {
 	}
 	return nil
 }
+
+// byteReader reads from a connection without reading ahead.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
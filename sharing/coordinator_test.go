@@ -0,0 +1,158 @@
+package sharing
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestCoordinator returns a coordinator handing out dups of /dev/null,
+// so that no FUSE mount is needed. It is closed when the test ends.
+func newTestCoordinator(t *testing.T) *Coordinator {
+	t.Helper()
+	master, err := unix.Open(os.DevNull, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(master) })
+
+	c, err := NewCoordinator(filepath.Join(t.TempDir(), "coord.sock"), master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Clone = unix.Dup
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// connect registers a worker from this process and returns both ends.
+func connect(t *testing.T, c *Coordinator) (*Worker, *WorkerClient) {
+	t.Helper()
+	type accepted struct {
+		w   *Worker
+		err error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		w, err := c.AcceptWorker()
+		ch <- accepted{w, err}
+	}()
+
+	client, err := ConnectToCoordinator(c.SockPath(), 12345)
+	if err != nil {
+		t.Fatalf("ConnectToCoordinator: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		client.CloseFd()
+	})
+	a := <-ch
+	if a.err != nil {
+		t.Fatalf("AcceptWorker: %v", a.err)
+	}
+	return a.w, client
+}
+
+// fdOpen reports whether fd is an open descriptor.
+func fdOpen(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err != syscall.EBADF
+}
+
+// Workers are identified by the socket's credentials, not by the pid they
+// claim, and a process may register more than once.
+func TestAcceptWorkerCredentials(t *testing.T) {
+	c := newTestCoordinator(t)
+	w1, client := connect(t, c)
+	w2, _ := connect(t, c)
+
+	for _, w := range []*Worker{w1, w2} {
+		if w.PID != os.Getpid() || w.UID != uint32(os.Getuid()) || w.GID != uint32(os.Getgid()) {
+			t.Errorf("worker pid %d uid %d gid %d, want %d %d %d", w.PID, w.UID, w.GID, os.Getpid(), os.Getuid(), os.Getgid())
+		}
+	}
+	if n := c.WorkerCount(); n != 2 {
+		t.Fatalf("%d workers, want 2 from the same process", n)
+	}
+	if client.Fd() < 0 || !fdOpen(client.Fd()) {
+		t.Errorf("worker received fd %d", client.Fd())
+	}
+
+	fds := []int{w1.fd, w2.fd}
+	c.RemoveWorker(os.Getpid())
+	if n := c.WorkerCount(); n != 0 {
+		t.Errorf("%d workers after RemoveWorker, want 0", n)
+	}
+	for _, fd := range fds {
+		if fdOpen(fd) {
+			t.Errorf("cloned fd %d still open after RemoveWorker", fd)
+		}
+	}
+}
+
+// AuthFunc sees the socket credentials and can turn the worker away.
+func TestAcceptWorkerAuth(t *testing.T) {
+	c := newTestCoordinator(t)
+	var seen *unix.Ucred
+	c.AuthFunc = func(cred *unix.Ucred) error {
+		seen = cred
+		return syscall.EPERM
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.AcceptWorker()
+		errs <- err
+	}()
+	if _, err := ConnectToCoordinator(c.SockPath(), 1); err == nil {
+		t.Error("rejected worker got an fd")
+	}
+	if err := <-errs; err == nil {
+		t.Error("AcceptWorker accepted a rejected worker")
+	}
+	if seen == nil || seen.Pid != int32(os.Getpid()) {
+		t.Errorf("AuthFunc saw %+v, want pid %d", seen, os.Getpid())
+	}
+	if n := c.WorkerCount(); n != 0 {
+		t.Errorf("%d workers, want 0", n)
+	}
+}
+
+// A worker whose connection closes is dropped and reported once; workers
+// the coordinator removes itself are not reported.
+func TestWorkerExit(t *testing.T) {
+	c := newTestCoordinator(t)
+	exits := make(chan int, 4)
+	c.OnWorkerExit = func(pid int) { exits <- pid }
+
+	w, client := connect(t, c)
+	client.Close()
+	select {
+	case pid := <-exits:
+		if pid != os.Getpid() {
+			t.Errorf("OnWorkerExit(%d), want %d", pid, os.Getpid())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnWorkerExit not called after the worker went away")
+	}
+	if n := c.WorkerCount(); n != 0 {
+		t.Errorf("%d workers after the connection closed, want 0", n)
+	}
+	if fdOpen(w.fd) {
+		t.Errorf("cloned fd %d still open", w.fd)
+	}
+
+	connect(t, c)
+	c.RemoveWorker(os.Getpid())
+	connect(t, c)
+	c.Close()
+	select {
+	case pid := <-exits:
+		t.Errorf("OnWorkerExit(%d) after RemoveWorker or Close", pid)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
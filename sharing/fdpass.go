@@ -49,22 +49,18 @@ func (p *FDPasser) SockPath() string {
 
 // SendFD sends a file descriptor to another process via a Unix socket connection.
 // The connection must be a Unix socket (SOCK_STREAM or SOCK_SEQPACKET).
+//
+// The message goes through conn itself rather than a dup from conn.File,
+// which would switch the socket to blocking mode and keep a concurrent
+// Read or Close on conn from ever returning.
 func SendFD(conn *net.UnixConn, fd int) error {
-	// Get the underlying file
-	f, err := conn.File()
-	if err != nil {
-		return fmt.Errorf("get file: %w", err)
-	}
-	defer f.Close()
-
 	// Build SCM_RIGHTS message
 	rights := syscall.UnixRights(fd)
 
 	// Must send at least one byte of data with SCM_RIGHTS
 	data := []byte{0}
 
-	err = syscall.Sendmsg(int(f.Fd()), data, rights, nil, 0)
-	if err != nil {
+	if _, _, err := conn.WriteMsgUnix(data, rights, nil); err != nil {
 		return fmt.Errorf("sendmsg: %w", err)
 	}
 
@@ -73,17 +69,10 @@ func SendFD(conn *net.UnixConn, fd int) error {
 
 // ReceiveFD receives a file descriptor from another process via a Unix socket.
 func ReceiveFD(conn *net.UnixConn) (int, error) {
-	// Get the underlying file
-	f, err := conn.File()
-	if err != nil {
-		return -1, fmt.Errorf("get file: %w", err)
-	}
-	defer f.Close()
-
 	data := make([]byte, 1)
 	oob := make([]byte, unix.CmsgSpace(4)) // Space for one FD
 
-	_, oobn, _, _, err := syscall.Recvmsg(int(f.Fd()), data, oob, 0)
+	_, oobn, _, _, err := conn.ReadMsgUnix(data, oob)
 	if err != nil {
 		return -1, fmt.Errorf("recvmsg: %w", err)
 	}
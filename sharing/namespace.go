@@ -0,0 +1,52 @@
+package sharing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrMountNamespaceMismatch is returned by AcceptWorker when the worker
+// runs in a different mount namespace than the coordinator.
+var ErrMountNamespaceMismatch = errors.New("worker is in a different mount namespace")
+
+// procDir is where SameMountNamespace finds the namespace links
+var procDir = "/proc"
+
+// SameMountNamespace reports whether the process pid shares the mount
+// namespace of the calling process, by comparing /proc/self/ns/mnt with
+// /proc/<pid>/ns/mnt. Reading another user's namespace link requires
+// ptrace access to it, so this may fail with a permission error.
+func SameMountNamespace(pid int) (bool, error) {
+	self, err := os.Readlink(procDir + "/self/ns/mnt")
+	if err != nil {
+		return false, err
+	}
+	other, err := os.Readlink(fmt.Sprintf("%s/%d/ns/mnt", procDir, pid))
+	if err != nil {
+		return false, err
+	}
+	return self == other, nil
+}
+
+// peerCred returns the credentials of the process at the other end of a
+// Unix socket connection, as recorded by the kernel at connect time.
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
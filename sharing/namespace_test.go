@@ -0,0 +1,82 @@
+package sharing
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSameMountNamespace(t *testing.T) {
+	if same, err := SameMountNamespace(os.Getpid()); err != nil || !same {
+		t.Errorf("own pid: %v, %v, want true", same, err)
+	}
+	// Above the largest pid_max the kernel allows
+	if _, err := SameMountNamespace(1 << 30); err == nil {
+		t.Error("no error for a pid that does not exist")
+	}
+
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("no new mount namespace: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if same, err := SameMountNamespace(cmd.Process.Pid); err != nil || same {
+		t.Errorf("process in a new namespace: %v, %v, want false", same, err)
+	}
+}
+
+// fakeProc points procDir at a directory where this process's namespace
+// link is self, and the link of the given pid is other if not empty.
+func fakeProc(t *testing.T, self, other string) {
+	t.Helper()
+	dir := t.TempDir()
+	links := map[string]string{"self": self}
+	if other != "" {
+		links[strconv.Itoa(os.Getpid())] = other
+	}
+	for name, target := range links {
+		if err := os.MkdirAll(filepath.Join(dir, name, "ns"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(dir, name, "ns", "mnt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := procDir
+	procDir = dir
+	t.Cleanup(func() { procDir = old })
+}
+
+// Workers are turned away when their namespace differs, but accepted
+// when it cannot be read.
+func TestAcceptWorkerNamespace(t *testing.T) {
+	t.Run("mismatch", func(t *testing.T) {
+		fakeProc(t, "mnt:[1]", "mnt:[2]")
+		c := newTestCoordinator(t)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.AcceptWorker()
+			errs <- err
+		}()
+		if _, err := ConnectToCoordinator(c.SockPath(), 1); err == nil {
+			t.Error("worker in another namespace got an fd")
+		}
+		if err := <-errs; !errors.Is(err, ErrMountNamespaceMismatch) {
+			t.Errorf("AcceptWorker: %v, want ErrMountNamespaceMismatch", err)
+		}
+	})
+	t.Run("unreadable", func(t *testing.T) {
+		fakeProc(t, "mnt:[1]", "")
+		c := newTestCoordinator(t)
+		connect(t, c)
+		if n := c.WorkerCount(); n != 1 {
+			t.Errorf("%d workers, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package rofuse
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/sharing"
+	"golang.org/x/sys/unix"
+)
+
+// A worker serves the descriptor a Coordinator hands it with
+// NewServerFromFd. The master is one end of a socket pair standing in for
+// /dev/fuse, and the coordinator dups it rather than cloning.
+func TestServeFromCoordinator(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	defer unix.Close(fds[0])
+	tv := unix.Timeval{Sec: 10}
+	if err := unix.SetsockoptTimeval(fds[1], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatalf("SO_RCVTIMEO: %v", err)
+	}
+
+	c, err := sharing.NewCoordinator(filepath.Join(t.TempDir(), "coord.sock"), fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Clone = unix.Dup
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := c.AcceptWorker()
+		accepted <- err
+	}()
+	client, err := sharing.ConnectToCoordinator(c.SockPath(), 0)
+	if err != nil {
+		t.Fatalf("ConnectToCoordinator: %v", err)
+	}
+	defer client.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("AcceptWorker: %v", err)
+	}
+
+	fs := newTestFS()
+	ino := fs.create(RootInode, "file", []byte("shared"))
+	s, err := NewServerFromFd(client.Fd(), fs, nil)
+	if err != nil {
+		t.Fatalf("NewServerFromFd: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	k := &testKernel{t: t, s: s, fd: fds[1], replies: make(map[uint64]testReply)}
+	defer k.close()
+	// No INIT: the process that mounted already answered it
+	if e := k.lookup(RootInode, "file"); e.NodeID != uint64(ino) {
+		t.Errorf("LOOKUP gave %d, want %d", e.NodeID, ino)
+	}
+	if got := string(k.readFile(ino, k.open(ino), 0, 4096)); got != "shared" {
+		t.Errorf("READ = %q, want %q", got, "shared")
+	}
+
+	if err := s.Unmount(); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+	// Unmount closes the worker's descriptor and nothing else
+	if _, err := unix.FcntlInt(uintptr(client.Fd()), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Errorf("worker fd still open after Unmount: %v", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(fds[0]), unix.F_GETFD, 0); err != nil {
+		t.Errorf("master fd: %v", err)
+	}
+	if c.WorkerCount() != 1 {
+		t.Errorf("%d workers after Unmount, want 1", c.WorkerCount())
+	}
+}
@@ -0,0 +1,48 @@
+package rofuse
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// HandleSignals unmounts the filesystem when one of sigs arrives, SIGINT
+// and SIGTERM if none are given, so that a daemon being stopped does not
+// leave a stale mount behind. It is optional sugar over signal.Notify and
+// Unmount: the unmount is lazy and waits at most
+// MountOptions.UnmountTimeout for running requests, as Unmount does.
+//
+// Only the first signal is handled. Handling then stops, so a second
+// Ctrl-C terminates the process the usual way if the unmount is stuck.
+// Handling also stops once the server shuts down by other means, or when
+// the returned function is called; either way, the signals go back to
+// whatever handling they had before.
+func (s *Server) HandleSignals(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case sig := <-ch:
+			signal.Stop(ch)
+			s.opts.logf("received %v, unmounting %s", sig, s.mountPoint)
+			if err := s.Unmount(); err != nil {
+				s.opts.logf("unmount on %v: %v", sig, err)
+			}
+		case <-s.ctx.Done():
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
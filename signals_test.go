@@ -0,0 +1,29 @@
+package rofuse
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	k := newTestConn(t, newTestFS(), nil)
+	go k.handshake(0)
+	if err := k.s.ServeBackground(); err != nil {
+		t.Fatal(err)
+	}
+	stop := k.s.HandleSignals(syscall.SIGTERM)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-k.s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still serving after SIGTERM")
+	}
+	if err := k.s.Err(); err != nil {
+		t.Errorf("Err = %v, want nil after an unmount", err)
+	}
+}
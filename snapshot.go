@@ -0,0 +1,54 @@
+package rofuse
+
+// Snapshots
+//
+// A filesystem serving versioned data can present the whole mount as one
+// point-in-time view. The server holds a snapshot token, an opaque number
+// chosen by the caller; every request captures the current token when it
+// is read from the kernel, before it waits in any queue, and exposes it
+// as Context.Snapshot(), so all the work done for a request resolves
+// against the same version. The filesystem is expected to look inodes,
+// attributes and data up in the version the token names.
+//
+// Moving to a new version is done with SetSnapshot, which also tells the
+// kernel to drop everything it cached from the previous one.
+
+// Snapshot returns the current snapshot token. It is 0 until SetSnapshot is
+// called.
+func (s *Server) Snapshot() uint64 {
+	return s.snapshot.Load()
+}
+
+// SetSnapshot makes id the snapshot token for requests arriving from now
+// on; requests already running keep theirs. If the token changed, the
+// kernel's cached entries, attributes and file data are invalidated for
+// every inode the server has handed out, so later lookups and reads reach
+// the filesystem again under the new token. It returns the first error
+// from sending those invalidations.
+func (s *Server) SetSnapshot(id uint64) error {
+	if s.snapshot.Swap(id) == id {
+		return nil
+	}
+
+	s.mu.RLock()
+	ready := s.initialized
+	s.mu.RUnlock()
+	if !ready {
+		// Nothing can be cached before INIT
+		return nil
+	}
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, e := range s.nodes.entries() {
+		keep(s.NotifyInvalEntry(e.parent, e.name))
+		keep(s.NotifyInvalInode(e.ino, 0, 0))
+	}
+	keep(s.NotifyInvalInode(RootInode, 0, 0))
+	return firstErr
+}
@@ -0,0 +1,113 @@
+package rofuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// snapFS holds reads until told to go on, and reports the snapshot token
+// each one ran under.
+type snapFS struct {
+	*testFS
+	started chan uint64
+	proceed chan struct{}
+}
+
+func (f snapFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	f.started <- ctx.Snapshot()
+	<-f.proceed
+	return f.testFS.Read(ctx, ino, fh, offset, size)
+}
+
+// A request keeps the token current when it was read, even if it waits
+// in the MaxConcurrentRequests queue while the token changes.
+func TestSnapshotQueued(t *testing.T) {
+	fs := snapFS{newTestFS(), make(chan uint64, 3), make(chan struct{}, 3)}
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, &MountOptions{MaxConcurrentRequests: 1})
+	in := wireBytes(&proto.ReadIn{Fh: k.open(ino), Size: 4096})
+
+	first := k.send(proto.OpRead, uint64(ino), in)
+	if snap := <-fs.started; snap != 0 {
+		t.Errorf("first READ under snapshot %d, want 0", snap)
+	}
+	queued := k.send(proto.OpRead, uint64(ino), in)
+	// Once the interrupt is answered, the queued READ has been read
+	k.recv(k.sendInterrupt(k.unique.Add(2)))
+
+	if err := k.s.SetSnapshot(7); err != nil {
+		t.Fatalf("SetSnapshot: %v", err)
+	}
+	fs.proceed <- struct{}{}
+	k.recv(first)
+	select {
+	case snap := <-fs.started:
+		if snap != 0 {
+			t.Errorf("queued READ under snapshot %d, want 0 as when it arrived", snap)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued READ not started")
+	}
+	fs.proceed <- struct{}{}
+	k.recv(queued)
+
+	later := k.send(proto.OpRead, uint64(ino), in)
+	if snap := <-fs.started; snap != 7 {
+		t.Errorf("READ after SetSnapshot under snapshot %d, want 7", snap)
+	}
+	fs.proceed <- struct{}{}
+	k.recv(later)
+}
+
+// Changing the token invalidates the entries and inodes the kernel was
+// given; setting the same token again does nothing.
+func TestSetSnapshotInvalidates(t *testing.T) {
+	fs := newTestFS()
+	ino := fs.create(RootInode, "file", []byte("data"))
+	k := newTestServer(t, fs, nil)
+	k.lookup(RootInode, "file")
+
+	if err := k.s.SetSnapshot(3); err != nil {
+		t.Fatalf("SetSnapshot: %v", err)
+	}
+	if got := k.s.Snapshot(); got != 3 {
+		t.Errorf("Snapshot = %d, want 3", got)
+	}
+
+	if errno, data := k.recv(0); errno != proto.NotifyInvalEntry || !bytes.Contains(data, []byte("file\x00")) {
+		t.Errorf("got code %d with %q, want an entry invalidation of file", errno, data)
+	}
+	var inodes []Inode
+	for range 2 {
+		errno, data := k.recv(0)
+		if errno != proto.NotifyInvalInode || len(data) != proto.NotifyInvalInodeOutSize {
+			t.Fatalf("got code %d with %d bytes, want an inode invalidation", errno, len(data))
+		}
+		inodes = append(inodes, Inode(binary.LittleEndian.Uint64(data)))
+	}
+	if inodes[0] != ino || inodes[1] != RootInode {
+		t.Errorf("invalidated inodes %v, want [%d %d]", inodes, ino, RootInode)
+	}
+
+	if err := k.s.SetSnapshot(3); err != nil {
+		t.Fatalf("SetSnapshot again: %v", err)
+	}
+	k.noReply(0, 50*time.Millisecond)
+}
+
+// Before INIT the kernel has nothing cached, and is sent nothing.
+func TestSetSnapshotBeforeInit(t *testing.T) {
+	k := newTestKernel(t, newTestFS(), nil)
+	if err := k.s.SetSnapshot(5); err != nil {
+		t.Fatalf("SetSnapshot: %v", err)
+	}
+	k.noReply(0, 50*time.Millisecond)
+	k.handshake(0)
+	if got := k.s.Snapshot(); got != 5 {
+		t.Errorf("Snapshot = %d, want 5", got)
+	}
+}
@@ -0,0 +1,66 @@
+package rofuse
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// StatsFile is a synthesized read-only file whose content is the current
+// value of a set of Counters, as a JSON object, so a mount can expose its
+// own metrics (e.g. as /.stats). Install the same Counters as
+// MountOptions.Metrics to publish the server's counters.
+//
+// A filesystem serving one embeds or holds a StatsFile and routes to it:
+// Lookup of its name returns Entry(), and GetAttr, Open and Read on Ino
+// are answered by Attr, Open and Read. Ino must not collide with the
+// filesystem's other inodes; take one outside their range, or allocate it
+// from the filesystem's InodeTable.
+//
+// The content changes as the counters do, so the file reports size 0 and
+// is opened with direct I/O: every read reaches Read and sees fresh
+// numbers, and readers go until EOF rather than trusting st_size. Each
+// Read renders the counters anew, so a reader needing a consistent view
+// should read the file in one go. MountOptions.ClampReads would cut it
+// to nothing and must not be combined with it.
+type StatsFile struct {
+	Ino      Inode
+	Counters *Counters
+	Mode     os.FileMode // Permission bits; 0444 if zero
+}
+
+// Attr returns the attributes of the stats file.
+func (f *StatsFile) Attr() Attr {
+	return synthAttr(f.Ino, 0, f.Mode, time.Now())
+}
+
+// Entry returns the lookup result for the stats file. Nothing about it is
+// cached, since its attributes keep changing.
+func (f *StatsFile) Entry() *Entry {
+	return synthEntry(f.Attr(), 0)
+}
+
+// Open returns the open response for the stats file, with direct I/O so
+// that the kernel does not cache the content or cut it at st_size.
+func (f *StatsFile) Open() *OpenResponse {
+	return &OpenResponse{Flags: OpenDirectIO}
+}
+
+// Read returns up to size bytes of the rendered counters from offset.
+func (f *StatsFile) Read(ctx Context, offset int64, size uint32) ([]byte, error) {
+	counts := map[string]int64{}
+	if f.Counters != nil {
+		counts = f.Counters.Snapshot()
+	}
+	data, err := json.MarshalIndent(counts, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	n := synthRange(offset, size, int64(len(data)))
+	if n == 0 {
+		return nil, nil
+	}
+	return data[offset : offset+int64(n)], nil
+}
@@ -0,0 +1,46 @@
+package rofuse
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+func TestStatsFile(t *testing.T) {
+	counters := &Counters{}
+	stats := &StatsFile{Ino: 2, Counters: counters}
+	k := newTestServer(t, synthFS{f: stats}, &MountOptions{Metrics: counters})
+
+	entry := k.lookup(RootInode, "file")
+	if entry.EntryValid != 0 || entry.AttrValid != 0 || entry.Attr.Size != 0 {
+		t.Errorf("entry cached %ds/%ds with size %d, want nothing cached and size 0",
+			entry.EntryValid, entry.AttrValid, entry.Attr.Size)
+	}
+	data := k.mustCall(proto.OpOpen, 2, wireBytes(&proto.OpenIn{}))
+	if out := wireStruct[proto.OpenOut](t, data); out.OpenFlags&proto.FopenDirectIO == 0 {
+		t.Errorf("open flags %#x, want direct I/O", out.OpenFlags)
+	}
+
+	k.call(proto.OpLookup, uint64(RootInode), []byte("missing\x00"))
+	counters.Count("test.counter", 42)
+	var got map[string]int64
+	if err := json.Unmarshal(k.readFile(2, 0, 0, 1<<16), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["test.counter"] != 42 {
+		t.Errorf("test.counter = %d, want 42", got["test.counter"])
+	}
+	// The server's own counters are there too
+	if got["lookup.error.ENOENT"] != 1 {
+		t.Errorf("lookup.error.ENOENT = %d, want 1", got["lookup.error.ENOENT"])
+	}
+
+	// Reading in pieces resumes where the previous read stopped
+	counters.Count("test.counter", 1)
+	full := k.readFile(2, 0, 0, 1<<16)
+	part := append(k.readFile(2, 0, 0, 5), k.readFile(2, 0, 5, 1<<16)...)
+	if string(part) != string(full) {
+		t.Errorf("read in pieces %q, in one go %q", part, full)
+	}
+}
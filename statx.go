@@ -0,0 +1,73 @@
+package rofuse
+
+import (
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// Statx is the result of a statx(2) call: the usual attributes plus the
+// fields only statx can report, such as the birth time.
+type Statx struct {
+	Mask           uint32 // proto.Sx* bits of the fields that are valid
+	Attr           Attr   // Attributes, Attr.Btime with proto.SxBtime
+	Attributes     uint64 // proto.SxAttr* flags
+	AttributesMask uint64 // proto.SxAttr* flags the filesystem supports
+}
+
+// StatxFromAttr builds a Statx from attr, with the basic fields marked
+// valid. If attr.Btime is not zero it is reported as the birth time.
+func StatxFromAttr(attr Attr) Statx {
+	st := Statx{
+		Mask: proto.SxBasicStats,
+		Attr: attr,
+	}
+	if !attr.Btime.IsZero() {
+		st.Mask |= proto.SxBtime
+	}
+	return st
+}
+
+// StatxFilesystem is implemented by filesystems that answer FUSE_STATX
+// (v7.39+) themselves. mask holds the proto.Sx* fields the caller asked
+// for and flags its AT_STATX_* sync flags; the server only passes the
+// birth time on when it was requested. Other filesystems are answered
+// from GetAttr, see StatxFromAttr.
+type StatxFilesystem interface {
+	Statx(ctx Context, ino Inode, fh *FileHandle, mask, flags uint32) (*Statx, error)
+}
+
+// statxToProto converts st for the wire, keeping btime only if it is in
+// the requested mask.
+func statxToProto(st *Statx, mask uint32, opts *MountOptions) proto.Statx {
+	a := attrToProto(&st.Attr, opts)
+	out := proto.Statx{
+		Mask:           st.Mask,
+		Blksize:        a.Blksize,
+		Attributes:     st.Attributes,
+		Nlink:          a.Nlink,
+		Uid:            a.Uid,
+		Gid:            a.Gid,
+		Mode:           uint16(a.Mode),
+		Ino:            a.Ino,
+		Size:           a.Size,
+		Blocks:         a.Blocks,
+		AttributesMask: st.AttributesMask,
+		Atime:          proto.SxTime{Sec: int64(a.Atime), Nsec: a.AtimeNsec},
+		Ctime:          proto.SxTime{Sec: int64(a.Ctime), Nsec: a.CtimeNsec},
+		Mtime:          proto.SxTime{Sec: int64(a.Mtime), Nsec: a.MtimeNsec},
+		RdevMajor:      Major(a.Rdev),
+		RdevMinor:      Minor(a.Rdev),
+	}
+
+	if mask&proto.SxBtime != 0 && st.Mask&proto.SxBtime != 0 {
+		out.Btime = sxTime(st.Attr.Btime)
+	} else {
+		out.Mask &^= proto.SxBtime
+	}
+	return out
+}
+
+func sxTime(t time.Time) proto.SxTime {
+	return proto.SxTime{Sec: t.Unix(), Nsec: uint32(t.Nanosecond())}
+}
@@ -0,0 +1,89 @@
+package rofuse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// sxFS answers STATX itself, always with a birth time, and reports the
+// mask it was asked for.
+type sxFS struct {
+	*testFS
+	masks chan uint32
+}
+
+func (f *sxFS) Statx(ctx Context, ino Inode, fh *FileHandle, mask, flags uint32) (*Statx, error) {
+	f.masks <- mask
+	resp, err := f.GetAttr(ctx, ino, fh)
+	if err != nil {
+		return nil, err
+	}
+	st := StatxFromAttr(resp.Attr)
+	return &st, nil
+}
+
+// statx sends a STATX for the fields in mask.
+func (k *testKernel) statx(ino Inode, mask uint32) *proto.Statx {
+	k.t.Helper()
+	data := k.mustCall(proto.OpStatx, uint64(ino), wireBytes(&proto.StatxIn{SxMask: mask}))
+	if len(data) != proto.StatxOutSize {
+		k.t.Fatalf("%d-byte STATX reply", len(data))
+	}
+	return &wireStruct[proto.StatxOut](k.t, data).Stat
+}
+
+// The birth time is only sent when STATX_BTIME is asked for, whether the
+// filesystem answers STATX or GetAttr does; GETATTR has no room for it.
+func TestStatxBtime(t *testing.T) {
+	btime := time.Unix(1700000000, 123)
+	mtime := time.Unix(1800000000, 0)
+	base := newTestFS()
+	ino := base.create(RootInode, "file", []byte("data"))
+	base.nodes[ino].attr.Btime = btime
+	base.nodes[ino].attr.Mtime = mtime
+
+	for _, tc := range []struct {
+		name string
+		fs   Filesystem
+	}{
+		{"GetAttr", base},
+		{"Statx", &sxFS{testFS: base, masks: make(chan uint32, 1)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := newTestServer(t, tc.fs, nil)
+			check := func(mask uint32) {
+				t.Helper()
+				st := k.statx(ino, mask)
+				if sfs, ok := tc.fs.(*sxFS); ok {
+					if got := <-sfs.masks; got != mask {
+						t.Errorf("Statx asked for %#x, want %#x", got, mask)
+					}
+				}
+				if st.Mtime.Sec != mtime.Unix() || st.Size != 4 {
+					t.Errorf("mask %#x: mtime %d, size %d", mask, st.Mtime.Sec, st.Size)
+				}
+				if mask&proto.SxBtime == 0 {
+					if st.Mask&proto.SxBtime != 0 || st.Btime != (proto.SxTime{}) {
+						t.Errorf("mask %#x: btime sent unasked: mask %#x, %+v", mask, st.Mask, st.Btime)
+					}
+					return
+				}
+				if st.Mask&proto.SxBtime == 0 {
+					t.Errorf("mask %#x: reply mask %#x lacks STATX_BTIME", mask, st.Mask)
+				}
+				if st.Btime.Sec != btime.Unix() || st.Btime.Nsec != uint32(btime.Nanosecond()) {
+					t.Errorf("mask %#x: btime %+v, want %v", mask, st.Btime, btime)
+				}
+			}
+			check(proto.SxBasicStats)
+			check(proto.SxBasicStats | proto.SxBtime)
+
+			a := k.getattr(ino).Attr
+			if a.Mtime != uint64(mtime.Unix()) || a.Size != 4 {
+				t.Errorf("GETATTR: mtime %d, size %d", a.Mtime, a.Size)
+			}
+		})
+	}
+}
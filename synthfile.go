@@ -0,0 +1,51 @@
+package rofuse
+
+import (
+	"os"
+	"time"
+)
+
+// The synthesized files (StatsFile, GeneratorFile, ReaderAtFile) are
+// regular read-only files a filesystem routes to by inode. What they have
+// in common is below.
+
+// synthAttr returns the attributes of a synthesized file of size bytes.
+// The permission bits default to 0444.
+func synthAttr(ino Inode, size int64, perm os.FileMode, mtime time.Time) Attr {
+	perm = perm.Perm()
+	if perm == 0 {
+		perm = 0444
+	}
+	return Attr{
+		Ino:    ino,
+		Size:   uint64(size),
+		Blocks: (uint64(size) + 511) / 512,
+		Mode:   perm,
+		Nlink:  1,
+		Atime:  mtime,
+		Mtime:  mtime,
+		Ctime:  mtime,
+	}
+}
+
+// synthEntry returns the lookup result for a synthesized file, with the
+// entry and attributes cached for timeout.
+func synthEntry(attr Attr, timeout time.Duration) *Entry {
+	return &Entry{
+		Ino:          attr.Ino,
+		Attr:         attr,
+		AttrTimeout:  timeout,
+		EntryTimeout: timeout,
+	}
+}
+
+// synthRange returns how many of the size bytes read from offset are in a
+// file of fileSize bytes: 0 at or past its end, which the kernel takes as
+// EOF.
+func synthRange(offset int64, size uint32, fileSize int64) int {
+	if offset < 0 || offset >= fileSize {
+		return 0
+	}
+	// Compare as a remainder, as offset+size could overflow near MaxInt64
+	return int(min(int64(size), fileSize-offset))
+}
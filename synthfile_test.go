@@ -0,0 +1,76 @@
+package rofuse
+
+import (
+	"math"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// synthFile is what StatsFile, GeneratorFile and ReaderAtFile have in
+// common.
+type synthFile interface {
+	Attr() Attr
+	Entry() *Entry
+	Open() *OpenResponse
+	Read(ctx Context, offset int64, size uint32) ([]byte, error)
+}
+
+// synthFS serves one synthesized file as "file" in the root.
+type synthFS struct {
+	FilesystemBase
+	f synthFile
+}
+
+func (fs synthFS) Lookup(ctx Context, parent Inode, name string) (*Entry, error) {
+	if parent != RootInode || name != "file" {
+		return nil, syscall.ENOENT
+	}
+	return fs.f.Entry(), nil
+}
+
+func (fs synthFS) GetAttr(ctx Context, ino Inode, fh *FileHandle) (*AttrResponse, error) {
+	if ino == RootInode {
+		return &AttrResponse{Attr: Attr{Ino: RootInode, Mode: os.ModeDir | 0755, Nlink: 2}}, nil
+	}
+	return &AttrResponse{Attr: fs.f.Attr()}, nil
+}
+
+func (fs synthFS) Open(ctx Context, ino Inode, flags uint32) (*OpenResponse, error) {
+	return fs.f.Open(), nil
+}
+
+func (fs synthFS) Read(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]byte, error) {
+	return fs.f.Read(ctx, offset, size)
+}
+
+func (fs synthFS) ReadDir(ctx Context, ino Inode, fh FileHandle, offset int64, size uint32) ([]DirEntry, error) {
+	if offset > 0 {
+		return nil, nil
+	}
+	attr := fs.f.Attr()
+	return []DirEntry{{Ino: attr.Ino, Offset: 1, Type: proto.DtReg, Name: "file"}}, nil
+}
+
+func TestSynthRange(t *testing.T) {
+	for _, tt := range []struct {
+		offset   int64
+		size     uint32
+		fileSize int64
+		want     int
+	}{
+		{0, 10, 100, 10},
+		{95, 10, 100, 5},
+		{100, 10, 100, 0},
+		{200, 10, 100, 0},
+		{-1, 10, 100, 0},
+		{0, 10, 0, 0},
+		{math.MaxInt64 - 4, 10, math.MaxInt64, 4},
+	} {
+		if got := synthRange(tt.offset, tt.size, tt.fileSize); got != tt.want {
+			t.Errorf("synthRange(%d, %d, %d) = %d, want %d", tt.offset, tt.size, tt.fileSize, got, tt.want)
+		}
+	}
+}
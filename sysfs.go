@@ -0,0 +1,138 @@
+package rofuse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fusectlDir is where the fusectl filesystem exposes per-connection knobs.
+const fusectlDir = "/sys/fs/fuse/connections"
+
+// ConnectionID returns the id of the kernel's FUSE connection for this
+// mount, which names its directory under /sys/fs/fuse/connections. It is
+// the device number of the mount, looked up in /proc/self/mountinfo. A
+// server from NewServerFromFd has no mount point to look up, and gets
+// ErrNoMountPoint.
+func (s *Server) ConnectionID() (uint32, error) {
+	if s.mountPoint == "" {
+		return 0, ErrNoMountPoint
+	}
+	mp, err := filepath.Abs(s.mountPoint)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return mountConnID(f, mp)
+}
+
+// mountConnID returns the device number of the topmost FUSE mount at mp
+// in the mountinfo table read from r.
+func mountConnID(r io.Reader, mp string) (uint32, error) {
+	var id uint32
+	found := false
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		// 36 35 0:42 / /mnt/x rw,nosuid - fuse.myfs myfs rw,...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != mp {
+			continue
+		}
+
+		sep := -1
+		for i := 5; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		if fstype := fields[sep+1]; fstype != "fuse" && !strings.HasPrefix(fstype, "fuse.") {
+			continue
+		}
+
+		major, minor, ok := strings.Cut(fields[2], ":")
+		if !ok {
+			continue
+		}
+		ma, err1 := strconv.ParseUint(major, 10, 32)
+		mi, err2 := strconv.ParseUint(minor, 10, 32)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		// The kernel's internal dev_t layout; the last match is the
+		// topmost mount
+		id = uint32(ma<<20 | mi)
+		found = true
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("%s: %w", mp, ErrNotMounted)
+	}
+	return id, nil
+}
+
+// SetMaxBackground changes the number of background (async) requests the
+// kernel may have outstanding on this connection, without remounting.
+// Writing to fusectl normally requires root.
+func (s *Server) SetMaxBackground(n int) error {
+	return s.writeConnAttr("max_background", n)
+}
+
+// SetCongestionThreshold changes the number of background requests at
+// which the kernel reports the connection as congested.
+// Writing to fusectl normally requires root.
+func (s *Server) SetCongestionThreshold(n int) error {
+	return s.writeConnAttr("congestion_threshold", n)
+}
+
+// writeConnAttr writes value to the named fusectl file of this connection.
+func (s *Server) writeConnAttr(name string, value int) error {
+	if value < 0 {
+		return fmt.Errorf("%s: invalid value %d", name, value)
+	}
+
+	id, err := s.ConnectionID()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	p := filepath.Join(fusectlDir, strconv.FormatUint(uint64(id), 10), name)
+	// Permission errors are passed through for errors.Is(err, fs.ErrPermission)
+	return os.WriteFile(p, []byte(strconv.Itoa(value)), 0)
+}
+
+// unescapeMountinfo decodes the octal escapes (\040 and the like) the
+// kernel uses for whitespace and backslashes in mountinfo paths.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
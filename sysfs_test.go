@@ -0,0 +1,73 @@
+package rofuse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUnescapeMountinfo(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"/mnt/plain", "/mnt/plain"},
+		{`/mnt/with\040space`, "/mnt/with space"},
+		{`/mnt/tab\011and\012newline`, "/mnt/tab\tand\nnewline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`/mnt/trailing\04`, `/mnt/trailing\04`}, // Too short to be an escape
+		{`/mnt/not\999octal`, `/mnt/not\999octal`},
+		{`\040`, " "},
+	} {
+		if got := unescapeMountinfo(tc.in); got != tc.want {
+			t.Errorf("unescapeMountinfo(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// mountinfoFixture has a FUSE mount at /mnt/a shadowed by another, one at
+// a path with a space, and other filesystems at the paths looked up.
+const mountinfoFixture = `22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+36 22 0:42 / /mnt/a rw,nosuid,nodev - fuse.first first rw,user_id=0,group_id=0
+37 36 0:43 / /mnt/a rw,nosuid,nodev shared:7 - fuse.second second rw,user_id=0,group_id=0
+38 22 0:44 / /mnt/with\040space ro - fuse dev ro,user_id=0,group_id=0
+39 22 0:45 / /mnt/tmp rw - tmpfs tmpfs rw
+40 22 bad / /mnt/bad rw - fuse x rw
+41 22 0:46 / /mnt/nosep rw fuse x rw
+`
+
+func TestMountConnID(t *testing.T) {
+	for _, tc := range []struct {
+		mp   string
+		want uint32
+	}{
+		{"/mnt/a", 43}, // The topmost mount
+		{"/mnt/with space", 44},
+	} {
+		id, err := mountConnID(strings.NewReader(mountinfoFixture), tc.mp)
+		if err != nil || id != tc.want {
+			t.Errorf("%s: id %d, %v, want %d", tc.mp, id, err, tc.want)
+		}
+	}
+
+	// Majors take the bits above the 20 of the minor
+	id, err := mountConnID(strings.NewReader("50 22 3:5 / /mnt/m rw - fuse.x x rw\n"), "/mnt/m")
+	if err != nil || id != 3<<20|5 {
+		t.Errorf("id %#x, %v, want %#x", id, err, 3<<20|5)
+	}
+
+	for _, mp := range []string{"/", "/mnt/tmp", "/mnt/bad", "/mnt/nosep", "/mnt/none"} {
+		if _, err := mountConnID(strings.NewReader(mountinfoFixture), mp); !errors.Is(err, ErrNotMounted) {
+			t.Errorf("%s: %v, want ErrNotMounted", mp, err)
+		}
+	}
+}
+
+// A server from NewServerFromFd does not know its mount point, and must
+// not pick up whatever is mounted at the working directory.
+func TestConnectionIDNoMountPoint(t *testing.T) {
+	k := newTestConn(t, newTestFS(), nil)
+	if _, err := k.s.ConnectionID(); !errors.Is(err, ErrNoMountPoint) {
+		t.Errorf("ConnectionID = %v, want ErrNoMountPoint", err)
+	}
+	if err := k.s.SetMaxBackground(12); !errors.Is(err, ErrNoMountPoint) {
+		t.Errorf("SetMaxBackground = %v, want ErrNoMountPoint", err)
+	}
+}
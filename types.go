@@ -2,12 +2,19 @@ package rofuse
 
 import (
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/KarpelesLab/rofuse/proto"
+	"golang.org/x/sys/unix"
 )
 
 // Attr represents file/directory attributes.
+//
+// Flags holds FUSE attribute flags, which tell the kernel how to treat
+// the inode: proto.AttrSubmount marks a directory as the root of another
+// filesystem. They are not chattr(1) flags; files are reported immutable
+// or append-only through Statx.Attributes (proto.SxAttrImmutable).
 type Attr struct {
 	Ino     Inode       // Inode number
 	Size    uint64      // File size in bytes
@@ -15,35 +22,114 @@ type Attr struct {
 	Atime   time.Time   // Access time
 	Mtime   time.Time   // Modification time
 	Ctime   time.Time   // Status change time
+	Btime   time.Time   // Creation (birth) time, zero if unknown
 	Mode    os.FileMode // File mode and permissions
 	Nlink   uint32      // Number of hard links
 	Uid     uint32      // Owner user ID
 	Gid     uint32      // Owner group ID
-	Rdev    uint32      // Device ID (for special files)
+	Rdev    uint32      // Device ID for special files, see Makedev
 	Blksize uint32      // Block size for filesystem I/O
+	Flags   uint32      // proto.Attr* flags, such as proto.AttrSubmount
+}
+
+// SymlinkAttr returns the attributes of a symlink to target: mode
+// os.ModeSymlink|0777 and Size set to the target's length, which callers
+// of readlink(2) use to size their buffer. Ino, times and ownership are
+// left for the caller to fill in.
+func SymlinkAttr(target string) Attr {
+	return Attr{
+		Size:   uint64(len(target)),
+		Blocks: (uint64(len(target)) + 511) / 512,
+		Mode:   os.ModeSymlink | 0777,
+		Nlink:  1,
+	}
+}
+
+// AttrFromFileInfo returns the attributes of fi. When fi comes from the
+// operating system (fi.Sys() is a *syscall.Stat_t), everything stat(2)
+// reported is kept, including Ino, which a filesystem serving the files
+// under its own inode numbers must overwrite. Otherwise only the size,
+// mode and modification time are known: the other times are set to the
+// latter, Blocks is derived from the size and Nlink is 1.
+func AttrFromFileInfo(fi os.FileInfo) Attr {
+	size := uint64(max(fi.Size(), 0))
+	attr := Attr{
+		Size:   size,
+		Blocks: (size + 511) / 512,
+		Atime:  fi.ModTime(),
+		Mtime:  fi.ModTime(),
+		Ctime:  fi.ModTime(),
+		Mode:   fi.Mode(),
+		Nlink:  1,
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return attr
+	}
+	attr.Ino = Inode(st.Ino)
+	attr.Blocks = uint64(st.Blocks)
+	attr.Atime = time.Unix(st.Atim.Unix())
+	attr.Ctime = time.Unix(st.Ctim.Unix())
+	attr.Nlink = uint32(st.Nlink)
+	attr.Uid, attr.Gid = st.Uid, st.Gid
+	attr.Blksize = uint32(st.Blksize)
+	rdev := uint64(st.Rdev)
+	attr.Rdev = Makedev(unix.Major(rdev), unix.Minor(rdev))
+	return attr
 }
 
 // Entry represents a directory entry lookup result.
 type Entry struct {
-	Ino          Inode         // Inode number of the entry
+	Ino          Inode         // Inode number of the entry, 0 if negative
 	Generation   uint64        // Inode generation (for NFS exports)
 	Attr         Attr          // Attributes of the entry
 	AttrTimeout  time.Duration // How long to cache attributes
 	EntryTimeout time.Duration // How long to cache the entry
 }
 
+// NegativeEntry returns the Lookup result for a name that does not exist,
+// telling the kernel to remember that for timeout: until then, accessing
+// the name fails with ENOENT without a LOOKUP. NotifyInvalEntry ends it
+// early when the name is created. Returning ENOENT caches nothing.
+func NegativeEntry(timeout time.Duration) *Entry {
+	return &Entry{EntryTimeout: timeout}
+}
+
+// AttrResponse is the result of GetAttr.
+//
+// Timeout is how long the kernel may cache the attributes before asking
+// again: long for immutable data, short for data that changes behind the
+// kernel's back. Zero uses MountOptions.DefaultAttrTimeout, and a
+// negative value disables caching, so every stat reaches GetAttr.
+type AttrResponse struct {
+	Attr    Attr          // Attributes of the inode
+	Timeout time.Duration // How long to cache the attributes
+}
+
 // DirEntry represents a directory entry for ReadDir.
+//
+// Type may be proto.DtUnknown when the child's type is not known without a
+// stat. The kernel passes it on as DT_UNKNOWN and tools that need the type
+// (ls -F, find -type) look the entry up, so the cost is only paid for the
+// entries that are actually inspected.
 type DirEntry struct {
 	Ino    Inode  // Inode number
 	Offset uint64 // Offset for next entry (cookie)
-	Type   uint32 // File type (DT_REG, DT_DIR, etc.)
+	Type   uint32 // File type (DT_REG, DT_DIR, etc.; DT_UNKNOWN if not known)
 	Name   string // Entry name
 }
 
 // DirEntryPlus is a DirEntry with full attributes for ReadDirPlus.
+//
+// Offset is the cookie of the next entry, as in DirEntry. The type sent
+// to the kernel comes from Entry.Attr.Mode; Type is only used when the
+// mode does not tell (os.ModeIrregular).
 type DirEntryPlus struct {
-	Entry Entry  // Full entry with attributes
-	Name  string // Entry name
+	Entry  Entry  // Full entry with attributes
+	Offset uint64 // Offset for next entry (cookie)
+	Type   uint32 // File type if the mode has none (DT_*)
+	Name   string // Entry name
 }
 
 // FileHandle represents an open file or directory handle.
@@ -53,6 +139,20 @@ type FileHandle uint64
 type OpenResponse struct {
 	Handle FileHandle // Handle to use for subsequent operations
 	Flags  OpenFlags  // Response flags (FOPEN_*)
+
+	// BackingID is a passthrough backing id from Server.OpenBackingFD.
+	// When non-zero the kernel serves reads on this handle directly from
+	// the backing file, and the server holds a reference on the id until
+	// the handle is released. Only valid from Open, not OpenDir.
+	BackingID int32
+
+	// BackingFd is a file to serve reads on this handle from, registered
+	// by the server for the lifetime of the handle when the kernel agreed
+	// to MountOptions.Passthrough. Otherwise, or if registering it fails,
+	// reads go to Read as usual, so the filesystem must keep fd open until
+	// Release. Zero means none; BackingID takes precedence. Only valid
+	// from Open, not OpenDir.
+	BackingFd int
 }
 
 // OpenFlags are flags returned from Open/OpenDir.
@@ -90,6 +190,14 @@ type StatFS struct {
 	Frsize  uint32 // Fragment size
 }
 
+// SetInodeCount fills Files and Ffree for a read-only filesystem holding n
+// files, directories and links: df -i shows n inodes, all in use, as no
+// more can be created.
+func (st *StatFS) SetInodeCount(n uint64) {
+	st.Files = n
+	st.Ffree = 0
+}
+
 // ForgetEntry represents an entry in BatchForget.
 type ForgetEntry struct {
 	Ino     Inode
@@ -103,12 +211,44 @@ type Config struct {
 	ProtoMinor   uint32 // Negotiated protocol minor version
 	MaxReadahead uint32 // Maximum readahead size
 	MaxWrite     uint32 // Maximum write size
+	MaxRead      uint32 // Maximum read size
 	MaxPages     uint16 // Maximum pages per request
+	Flags        uint64 // Capabilities negotiated with the kernel (proto.Cap*)
 }
 
 // Helper functions for converting between user types and proto types
 
-func attrToProto(a *Attr) proto.Attr {
+// attrToProto converts attributes for the wire, filling in the mount's
+// defaults for fields the filesystem left zero and applying its remapping
+// options, then AttrFilter.
+func attrToProto(a *Attr, opts *MountOptions) proto.Attr {
+	blksize := a.Blksize
+	if blksize == 0 {
+		blksize = opts.DefaultBlksize
+	}
+
+	mode := a.Mode
+	if opts.ModeMask != 0 {
+		mode &^= os.ModePerm &^ opts.ModeMask
+	}
+
+	uid := mapID(opts.UidMap, a.Uid, opts.UnmappedID)
+	gid := mapID(opts.GidMap, a.Gid, opts.UnmappedID)
+	if opts.ForceUid != nil {
+		uid = *opts.ForceUid
+	}
+	if opts.ForceGid != nil {
+		gid = *opts.ForceGid
+	}
+
+	if opts.AttrFilter != nil {
+		filtered := *a
+		filtered.Mode, filtered.Uid, filtered.Gid, filtered.Blksize = mode, uid, gid, blksize
+		opts.AttrFilter(a.Ino, &filtered)
+		a = &filtered
+		mode, uid, gid, blksize = a.Mode, a.Uid, a.Gid, a.Blksize
+	}
+
 	return proto.Attr{
 		Ino:       uint64(a.Ino),
 		Size:      a.Size,
@@ -119,12 +259,13 @@ func attrToProto(a *Attr) proto.Attr {
 		AtimeNsec: uint32(a.Atime.Nanosecond()),
 		MtimeNsec: uint32(a.Mtime.Nanosecond()),
 		CtimeNsec: uint32(a.Ctime.Nanosecond()),
-		Mode:      fileModeToUnix(a.Mode),
+		Mode:      fileModeToUnix(mode),
 		Nlink:     a.Nlink,
-		Uid:       a.Uid,
-		Gid:       a.Gid,
+		Uid:       uid,
+		Gid:       gid,
 		Rdev:      a.Rdev,
-		Blksize:   a.Blksize,
+		Blksize:   blksize,
+		Flags:     a.Flags,
 	}
 }
 
@@ -140,12 +281,10 @@ func fileModeToUnix(mode os.FileMode) uint32 {
 		m |= proto.ModeFifo
 	case os.ModeSocket:
 		m |= proto.ModeSocket
+	case os.ModeDevice | os.ModeCharDevice:
+		m |= proto.ModeChar
 	case os.ModeDevice:
-		if mode&os.ModeCharDevice != 0 {
-			m |= proto.ModeChar
-		} else {
-			m |= proto.ModeBlock
-		}
+		m |= proto.ModeBlock
 	default:
 		m |= proto.ModeRegular
 	}
@@ -170,8 +309,9 @@ func durationToTimespec(d time.Duration) (sec uint64, nsec uint32) {
 	return
 }
 
-// fileModeToType converts os.FileMode to a DT_* type constant.
-func fileModeToType(mode os.FileMode) uint32 {
+// FileModeType converts the type bits of an os.FileMode to a DT_* type
+// constant, for DirEntry.Type. os.ModeIrregular is DT_UNKNOWN.
+func FileModeType(mode os.FileMode) uint32 {
 	switch mode.Type() {
 	case os.ModeDir:
 		return proto.DtDir
@@ -181,12 +321,36 @@ func fileModeToType(mode os.FileMode) uint32 {
 		return proto.DtFifo
 	case os.ModeSocket:
 		return proto.DtSock
+	case os.ModeDevice | os.ModeCharDevice:
+		return proto.DtChr
 	case os.ModeDevice:
-		if mode&os.ModeCharDevice != 0 {
-			return proto.DtChr
-		}
 		return proto.DtBlk
+	case os.ModeIrregular:
+		return proto.DtUnknown
 	default:
 		return proto.DtReg
 	}
 }
+
+// typeToFileMode is the inverse of FileModeType. DT_UNKNOWN maps to
+// os.ModeIrregular.
+func typeToFileMode(typ uint32) os.FileMode {
+	switch typ {
+	case proto.DtDir:
+		return os.ModeDir
+	case proto.DtLnk:
+		return os.ModeSymlink
+	case proto.DtFifo:
+		return os.ModeNamedPipe
+	case proto.DtSock:
+		return os.ModeSocket
+	case proto.DtChr:
+		return os.ModeDevice | os.ModeCharDevice
+	case proto.DtBlk:
+		return os.ModeDevice
+	case proto.DtReg:
+		return 0
+	default:
+		return os.ModeIrregular
+	}
+}
@@ -0,0 +1,216 @@
+package rofuse
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/KarpelesLab/rofuse/proto"
+)
+
+// READDIRPLUS and GETATTR report the same timestamps, to the nanosecond,
+// so that the kernel sees no change whichever of them it cached last.
+func TestReaddirplusTimestamps(t *testing.T) {
+	fs := newTestFS()
+	times := map[string]time.Time{
+		"recent": time.Unix(1700000000, 123456789),
+		"odd":    time.Unix(1234567890, 1),
+		"max":    time.Unix(1600000000, 999999999),
+		"old":    time.Unix(-1000, 500),
+	}
+	for name, mtime := range times {
+		ino := fs.create(RootInode, name, nil)
+		n, _ := fs.node(ino)
+		n.attr.Mtime = mtime
+		n.attr.Atime = mtime.Add(time.Nanosecond)
+		n.attr.Ctime = mtime.Add(2 * time.Nanosecond)
+	}
+	k := newTestServer(t, plusFS{fs}, nil)
+
+	entries := k.readdirplus(RootInode, k.opendir(RootInode), 0)
+	if len(entries) != len(times) {
+		t.Fatalf("%d entries, want %d", len(entries), len(times))
+	}
+	for _, e := range entries {
+		want := times[e.Name]
+		a := e.Entry.Attr
+		for _, ts := range []struct {
+			field string
+			sec   uint64
+			nsec  uint32
+			want  time.Time
+		}{
+			{"mtime", a.Mtime, a.MtimeNsec, want},
+			{"atime", a.Atime, a.AtimeNsec, want.Add(time.Nanosecond)},
+			{"ctime", a.Ctime, a.CtimeNsec, want.Add(2 * time.Nanosecond)},
+		} {
+			if got := time.Unix(int64(ts.sec), int64(ts.nsec)); !got.Equal(ts.want) {
+				t.Errorf("%s: READDIRPLUS %s %v, want %v", e.Name, ts.field, got, ts.want)
+			}
+		}
+
+		got := k.getattr(e.Ino).Attr
+		if !sameTimes(got, a) {
+			t.Errorf("%s: GETATTR times %d.%09d/%d.%09d/%d.%09d, READDIRPLUS %d.%09d/%d.%09d/%d.%09d", e.Name,
+				got.Atime, got.AtimeNsec, got.Mtime, got.MtimeNsec, got.Ctime, got.CtimeNsec,
+				a.Atime, a.AtimeNsec, a.Mtime, a.MtimeNsec, a.Ctime, a.CtimeNsec)
+		}
+	}
+}
+
+func sameTimes(a, b proto.Attr) bool {
+	return a.Atime == b.Atime && a.AtimeNsec == b.AtimeNsec &&
+		a.Mtime == b.Mtime && a.MtimeNsec == b.MtimeNsec &&
+		a.Ctime == b.Ctime && a.CtimeNsec == b.CtimeNsec
+}
+
+func TestAttrFromFileInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, make([]byte, 1000), 0640); err != nil {
+		t.Fatal(err)
+	}
+	osInfo, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := osInfo.Sys().(*syscall.Stat_t)
+
+	mtime := time.Unix(1700000000, 5)
+	mapInfo, err := fs.Stat(fstest.MapFS{"f": {Data: make([]byte, 513), Mode: 0444, ModTime: mtime}}, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		fi   fs.FileInfo
+		want Attr
+	}{
+		// All of stat(2) is kept
+		{"os", osInfo, Attr{
+			Ino:     Inode(st.Ino),
+			Size:    1000,
+			Blocks:  uint64(st.Blocks),
+			Atime:   time.Unix(st.Atim.Unix()),
+			Mtime:   osInfo.ModTime(),
+			Ctime:   time.Unix(st.Ctim.Unix()),
+			Mode:    0640,
+			Nlink:   1,
+			Uid:     uint32(os.Getuid()),
+			Gid:     st.Gid,
+			Blksize: uint32(st.Blksize),
+		}},
+		// Only size, mode and mtime are known
+		{"sys nil", mapInfo, Attr{
+			Size:   513,
+			Blocks: 2,
+			Atime:  mtime,
+			Mtime:  mtime,
+			Ctime:  mtime,
+			Mode:   0444,
+			Nlink:  1,
+		}},
+	} {
+		got := AttrFromFileInfo(tc.fi)
+		times := []struct{ got, want time.Time }{
+			{got.Atime, tc.want.Atime}, {got.Mtime, tc.want.Mtime}, {got.Ctime, tc.want.Ctime},
+		}
+		for i, ts := range times {
+			if !ts.got.Equal(ts.want) {
+				t.Errorf("%s: time %d is %v, want %v", tc.name, i, ts.got, ts.want)
+			}
+		}
+		got.Atime, got.Mtime, got.Ctime = tc.want.Atime, tc.want.Mtime, tc.want.Ctime
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The attribute options apply alike to GETATTR, LOOKUP and READDIRPLUS,
+// AttrFilter last.
+func TestAttrOptions(t *testing.T) {
+	type attrs struct {
+		mode     uint32
+		uid, gid uint32
+		blksize  uint32
+		size     uint64
+	}
+	fs := newTestFS()
+	file := fs.create(RootInode, "file", []byte("data"))
+	setuid := fs.create(RootInode, "setuid", nil)
+	for _, ino := range []Inode{file, setuid} {
+		n, _ := fs.node(ino)
+		n.attr.Uid, n.attr.Gid = 1000, 1000
+	}
+	n, _ := fs.node(setuid)
+	n.attr.Mode = os.ModeSetuid | 0755
+	n.attr.Blksize = 8192
+
+	uid, gid := uint32(0), uint32(50)
+	for _, tc := range []struct {
+		name string
+		opts MountOptions
+		want map[string]attrs
+	}{
+		{"none", MountOptions{}, map[string]attrs{
+			"file":   {proto.ModeRegular | 0644, 1000, 1000, proto.DefaultMaxWrite, 4},
+			"setuid": {proto.ModeRegular | proto.ModeSetuid | 0755, 1000, 1000, 8192, 0},
+		}},
+		{"ModeMask", MountOptions{ModeMask: 0555}, map[string]attrs{
+			"file":   {proto.ModeRegular | 0444, 1000, 1000, proto.DefaultMaxWrite, 4},
+			"setuid": {proto.ModeRegular | proto.ModeSetuid | 0555, 1000, 1000, 8192, 0},
+		}},
+		{"ForceUid", MountOptions{ForceUid: &uid, ForceGid: &gid}, map[string]attrs{
+			"file":   {proto.ModeRegular | 0644, 0, 50, proto.DefaultMaxWrite, 4},
+			"setuid": {proto.ModeRegular | proto.ModeSetuid | 0755, 0, 50, 8192, 0},
+		}},
+		{"DefaultBlksize", MountOptions{DefaultBlksize: 65536}, map[string]attrs{
+			"file":   {proto.ModeRegular | 0644, 1000, 1000, 65536, 4},
+			"setuid": {proto.ModeRegular | proto.ModeSetuid | 0755, 1000, 1000, 8192, 0},
+		}},
+		// The filter sees what the other options made of the attributes
+		{"AttrFilter", MountOptions{
+			ModeMask:       0555,
+			ForceUid:       &uid,
+			DefaultBlksize: 65536,
+			AttrFilter: func(ino Inode, a *Attr) {
+				if a.Mode.Perm()&0222 == 0 && a.Uid == 0 && a.Blksize != 0 {
+					a.Gid = a.Blksize
+				}
+				a.Size = 0
+			},
+		}, map[string]attrs{
+			"file":   {proto.ModeRegular | 0444, 0, 65536, 65536, 0},
+			"setuid": {proto.ModeRegular | proto.ModeSetuid | 0555, 0, 8192, 8192, 0},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			k := newTestServer(t, plusFS{fs}, &opts)
+			check := func(op, name string, a proto.Attr) {
+				t.Helper()
+				got := attrs{a.Mode, a.Uid, a.Gid, a.Blksize, a.Size}
+				if want := tc.want[name]; got != want {
+					t.Errorf("%s %s: %+v, want %+v", op, name, got, want)
+				}
+			}
+
+			for name, ino := range map[string]Inode{"file": file, "setuid": setuid} {
+				check("GETATTR", name, k.getattr(ino).Attr)
+				check("LOOKUP", name, k.lookup(RootInode, name).Attr)
+			}
+			entries := k.readdirplus(RootInode, k.opendir(RootInode), 0)
+			if len(entries) != len(tc.want) {
+				t.Fatalf("%d READDIRPLUS entries, want %d", len(entries), len(tc.want))
+			}
+			for _, e := range entries {
+				check("READDIRPLUS", e.Name, e.Entry.Attr)
+			}
+		})
+	}
+}